@@ -4,12 +4,11 @@ package cli
 import (
 	"context"
 	"fmt"
-	"net/http"
 	"os"
 	"time"
 
+	"github.com/kopia/kopia/internal/apiclient"
 	"github.com/kopia/kopia/internal/kopialogging"
-	"github.com/kopia/kopia/internal/serverapi"
 	"github.com/kopia/kopia/repo"
 	"github.com/kopia/kopia/repo/block"
 	"github.com/kopia/kopia/repo/storage"
@@ -48,9 +47,20 @@ func noRepositoryAction(act func(ctx context.Context) error) func(ctx *kingpin.P
 	}
 }
 
-func serverAction(act func(ctx context.Context, cli *serverapi.Client) error) func(ctx *kingpin.ParseContext) error {
+func serverAction(act func(ctx context.Context, cli *apiclient.Client) error) func(ctx *kingpin.ParseContext) error {
 	return func(_ *kingpin.ParseContext) error {
-		return act(context.Background(), serverapi.NewClient(*serverAddress, http.DefaultClient))
+		apiClient, err := apiclient.NewClient(apiclient.Options{
+			BaseURL:                             *serverAddress,
+			Username:                            *serverUsername,
+			Password:                            *serverPassword,
+			Token:                               *serverToken,
+			TrustedServerCertificateFingerprint: *serverCertFingerprint,
+		})
+		if err != nil {
+			return fmt.Errorf("unable to create API client: %v", err)
+		}
+
+		return act(context.Background(), apiClient)
 	}
 }
 
@@ -67,15 +77,19 @@ func repositoryAction(act func(ctx context.Context, rep *repo.Repository) error)
 		rep := mustOpenRepository(ctx, nil)
 		repositoryOpenTime := time.Since(t0)
 
-		storageType := rep.Storage.ConnectionInfo().Type
+		storageType, formatVersion := "server", 0
+		if !rep.IsRemote() {
+			storageType = rep.Storage.ConnectionInfo().Type
+			formatVersion = rep.Blocks.Format.Version
+		}
 
-		reportStartupTime(storageType, rep.Blocks.Format.Version, repositoryOpenTime)
+		reportStartupTime(storageType, formatVersion, repositoryOpenTime)
 
 		t1 := time.Now()
 		err := act(ctx, rep)
 		commandDuration := time.Since(t1)
 
-		reportSubcommandFinished(kpc.SelectedCommand.FullCommand(), err == nil, storageType, rep.Blocks.Format.Version, commandDuration)
+		reportSubcommandFinished(kpc.SelectedCommand.FullCommand(), err == nil, storageType, formatVersion, commandDuration)
 		if cerr := rep.Close(ctx); cerr != nil {
 			return fmt.Errorf("unable to close repository: %v", cerr)
 		}
@@ -83,6 +97,18 @@ func repositoryAction(act func(ctx context.Context, rep *repo.Repository) error)
 	}
 }
 
+// directRepositoryAction is like repositoryAction but fails when the repository is accessed through
+// API server, for actions that require direct access to the storage.
+func directRepositoryAction(act func(ctx context.Context, rep *repo.Repository) error) func(ctx *kingpin.ParseContext) error {
+	return repositoryAction(func(ctx context.Context, rep *repo.Repository) error {
+		if rep.IsRemote() {
+			return repo.ErrRemoteRepository
+		}
+
+		return act(ctx, rep)
+	})
+}
+
 // App returns an instance of command-line application object.
 func App() *kingpin.Application {
 	return app
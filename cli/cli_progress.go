@@ -112,6 +112,9 @@ func (mp *multiProgress) Progress(path string, numFiles int, dirCompleted, dirTo
 func (mp *multiProgress) UploadFinished() {
 }
 
+func (mp *multiProgress) IgnoredError(path string, err error) {
+}
+
 func shortenPath(s string) string {
 	if len(s) < 60 {
 		return s
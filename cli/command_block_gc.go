@@ -45,5 +45,5 @@ func runBlockGarbageCollectAction(ctx context.Context, rep *repo.Repository) err
 }
 
 func init() {
-	blockGarbageCollectCommand.Action(repositoryAction(runBlockGarbageCollectAction))
+	blockGarbageCollectCommand.Action(directRepositoryAction(runBlockGarbageCollectAction))
 }
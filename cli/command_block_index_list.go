@@ -31,5 +31,5 @@ func runListBlockIndexesAction(ctx context.Context, rep *repo.Repository) error
 }
 
 func init() {
-	blockIndexListCommand.Action(repositoryAction(runListBlockIndexesAction))
+	blockIndexListCommand.Action(directRepositoryAction(runListBlockIndexesAction))
 }
@@ -17,5 +17,5 @@ func runOptimizeCommand(ctx context.Context, rep *repo.Repository) error {
 }
 
 func init() {
-	optimizeCommand.Action(repositoryAction(runOptimizeCommand))
+	optimizeCommand.Action(directRepositoryAction(runOptimizeCommand))
 }
@@ -31,10 +31,16 @@ func runRecoverBlockIndexesAction(ctx context.Context, rep *repo.Repository) err
 	}()
 
 	if len(*blockIndexRecoverPackFile) == 0 {
-		return rep.Storage.ListBlocks(ctx, block.PackBlockPrefix, func(bm storage.BlockMetadata) error {
-			recoverIndexFromSinglePackFile(ctx, rep, bm.BlockID, bm.Length, &totalCount)
-			return nil
-		})
+		for _, prefix := range block.PackBlockPrefixes {
+			if err := rep.Storage.ListBlocks(ctx, prefix, func(bm storage.BlockMetadata) error {
+				recoverIndexFromSinglePackFile(ctx, rep, bm.BlockID, bm.Length, &totalCount)
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+
+		return nil
 	}
 
 	for _, packFile := range *blockIndexRecoverPackFile {
@@ -56,5 +62,5 @@ func recoverIndexFromSinglePackFile(ctx context.Context, rep *repo.Repository, p
 }
 
 func init() {
-	blockIndexRecoverCommand.Action(repositoryAction(runRecoverBlockIndexesAction))
+	blockIndexRecoverCommand.Action(directRepositoryAction(runRecoverBlockIndexesAction))
 }
@@ -80,5 +80,5 @@ func runShowBlockIndexesAction(ctx context.Context, rep *repo.Repository) error
 }
 
 func init() {
-	blockIndexShowCommand.Action(repositoryAction(runShowBlockIndexesAction))
+	blockIndexShowCommand.Action(directRepositoryAction(runShowBlockIndexesAction))
 }
@@ -20,17 +20,10 @@ var (
 )
 
 func runListBlocksAction(ctx context.Context, rep *repo.Repository) error {
-	blocks, err := rep.Blocks.ListBlockInfos(*blockListPrefix, *blockListIncludeDeleted)
-	if err != nil {
-		return err
-	}
-
-	sortBlocks(blocks)
-
 	var count int
 	var totalSize int64
 	uniquePacks := map[string]bool{}
-	for _, b := range blocks {
+	printBlock := func(b block.Info) error {
 		totalSize += int64(b.Length)
 		count++
 		if b.PackFile != "" {
@@ -45,6 +38,25 @@ func runListBlocksAction(ctx context.Context, rep *repo.Repository) error {
 		} else {
 			fmt.Printf("%v\n", b.BlockID)
 		}
+		return nil
+	}
+
+	if *blockListSort == "none" || (*blockListSort == "name" && !*blockListReverse) {
+		// blocks are iterated in the order of their IDs, so they don't need to be loaded into memory.
+		if err := rep.Blocks.IterateBlockInfos(*blockListPrefix, *blockListIncludeDeleted, printBlock); err != nil {
+			return err
+		}
+	} else {
+		blocks, err := rep.Blocks.ListBlockInfos(*blockListPrefix, *blockListIncludeDeleted)
+		if err != nil {
+			return err
+		}
+
+		sortBlocks(blocks)
+
+		for _, b := range blocks {
+			printBlock(b) //nolint:errcheck
+		}
 	}
 
 	if *blockListSummary {
@@ -82,5 +94,5 @@ func comparePacks(a, b block.Info) bool {
 }
 
 func init() {
-	blockListCommand.Action(repositoryAction(runListBlocksAction))
+	blockListCommand.Action(directRepositoryAction(runListBlocksAction))
 }
@@ -94,8 +94,7 @@ func getBlocksToRewrite(ctx context.Context, rep *repo.Repository) <-chan blockI
 
 		// add all blocks from short packs
 		if *blockRewriteShortPacks {
-			threshold := uint32(rep.Blocks.Format.MaxPackSize * 6 / 10)
-			findBlocksInShortPacks(ctx, rep, ch, threshold)
+			findBlocksInShortPacks(ctx, rep, ch)
 		}
 
 		// add all blocks with given format version
@@ -132,7 +131,7 @@ func findBlocksWithFormatVersion(ctx context.Context, rep *repo.Repository, ch c
 	}
 }
 
-func findBlocksInShortPacks(ctx context.Context, rep *repo.Repository, ch chan blockInfoOrError, threshold uint32) {
+func findBlocksInShortPacks(ctx context.Context, rep *repo.Repository, ch chan blockInfoOrError) {
 	log.Debugf("listing blocks...")
 	infos, err := rep.Blocks.ListBlockInfos("", true)
 	if err != nil {
@@ -141,7 +140,9 @@ func findBlocksInShortPacks(ctx context.Context, rep *repo.Repository, ch chan b
 	}
 
 	log.Debugf("finding blocks in short packs...")
-	shortPackBlocks, err := findShortPackBlocks(infos, threshold)
+	shortPackBlocks, err := findShortPackBlocks(infos, func(packFile string) int64 {
+		return int64(rep.Blocks.PackSizeLimit(packFile) * 6 / 10)
+	})
 	if err != nil {
 		ch <- blockInfoOrError{err: fmt.Errorf("unable to find short pack blocks: %v", err)}
 		return
@@ -159,8 +160,8 @@ func findBlocksInShortPacks(ctx context.Context, rep *repo.Repository, ch chan b
 	}
 }
 
-func findShortPackBlocks(infos []block.Info, threshold uint32) (map[string]bool, error) {
-	packUsage := map[string]uint32{}
+func findShortPackBlocks(infos []block.Info, threshold func(packFile string) int64) (map[string]bool, error) {
+	packUsage := map[string]int64{}
 
 	for _, bi := range infos {
 		packUsage[bi.PackFile] += bi.Length
@@ -169,7 +170,7 @@ func findShortPackBlocks(infos []block.Info, threshold uint32) (map[string]bool,
 	shortPackBlocks := map[string]bool{}
 
 	for packFile, usage := range packUsage {
-		if usage < threshold {
+		if usage < threshold(packFile) {
 			shortPackBlocks[packFile] = true
 		}
 	}
@@ -178,5 +179,5 @@ func findShortPackBlocks(infos []block.Info, threshold uint32) (map[string]bool,
 }
 
 func init() {
-	blockRewriteCommand.Action(repositoryAction(runRewriteBlocksAction))
+	blockRewriteCommand.Action(directRepositoryAction(runRewriteBlocksAction))
 }
@@ -28,5 +28,5 @@ func removeBlock(r *repo.Repository, blockID string) error {
 
 func init() {
 	setupShowCommand(removeBlockCommand)
-	removeBlockCommand.Action(repositoryAction(runRemoveBlockCommand))
+	removeBlockCommand.Action(directRepositoryAction(runRemoveBlockCommand))
 }
@@ -34,5 +34,5 @@ func showBlock(ctx context.Context, r *repo.Repository, blockID string) error {
 
 func init() {
 	setupShowCommand(showBlockCommand)
-	showBlockCommand.Action(repositoryAction(runShowBlockCommand))
+	showBlockCommand.Action(directRepositoryAction(runShowBlockCommand))
 }
@@ -23,10 +23,10 @@ func runBlockStatsAction(ctx context.Context, rep *repo.Repository) error {
 	}
 	sort.Slice(blocks, func(i, j int) bool { return blocks[i].Length < blocks[j].Length })
 
-	var sizeThreshold uint32 = 10
-	countMap := map[uint32]int{}
-	totalSizeOfBlocksUnder := map[uint32]int64{}
-	var sizeThresholds []uint32
+	var sizeThreshold int64 = 10
+	countMap := map[int64]int{}
+	totalSizeOfBlocksUnder := map[int64]int64{}
+	var sizeThresholds []int64
 	for i := 0; i < 8; i++ {
 		sizeThresholds = append(sizeThresholds, sizeThreshold)
 		countMap[sizeThreshold] = 0
@@ -80,5 +80,5 @@ func percentileSize(p int, blocks []block.Info) int64 {
 }
 
 func init() {
-	blockStatsCommand.Action(repositoryAction(runBlockStatsAction))
+	blockStatsCommand.Action(directRepositoryAction(runBlockStatsAction))
 }
@@ -27,16 +27,14 @@ func runVerifyBlockCommand(ctx context.Context, rep *repo.Repository) error {
 }
 
 func verifyAllBlocks(ctx context.Context, rep *repo.Repository) error {
-	blockIDs, err := rep.Blocks.ListBlocks("")
-	if err != nil {
-		return fmt.Errorf("unable to list blocks: %v", err)
-	}
-
 	var errorCount int
-	for _, blockID := range blockIDs {
+	if err := rep.Blocks.IterateBlocks("", func(blockID string) error {
 		if err := verifyBlock(ctx, rep, blockID); err != nil {
 			errorCount++
 		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("unable to list blocks: %v", err)
 	}
 	if errorCount == 0 {
 		return nil
@@ -57,5 +55,5 @@ func verifyBlock(ctx context.Context, r *repo.Repository, blockID string) error
 }
 
 func init() {
-	verifyBlockCommand.Action(repositoryAction(runVerifyBlockCommand))
+	verifyBlockCommand.Action(directRepositoryAction(runVerifyBlockCommand))
 }
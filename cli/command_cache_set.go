@@ -26,5 +26,5 @@ func runCacheSetCommand(ctx context.Context, rep *repo.Repository) error {
 }
 
 func init() {
-	cacheSetParamsCommand.Action(repositoryAction(runCacheSetCommand))
+	cacheSetParamsCommand.Action(directRepositoryAction(runCacheSetCommand))
 }
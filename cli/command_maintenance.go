@@ -0,0 +1,136 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/kopia/kopia/internal/units"
+	"github.com/kopia/kopia/repo"
+	"github.com/kopia/kopia/snapshot/maintenance"
+)
+
+var (
+	maintenanceCommands = app.Command("maintenance", "Commands to control repository maintenance.")
+
+	maintenanceInfoCommand = maintenanceCommands.Command("info", "Display maintenance parameters, schedule and history.").Default()
+
+	maintenanceSetCommand                  = maintenanceCommands.Command("set", "Set repository maintenance parameters.")
+	maintenanceSetQuickEnabled             = maintenanceSetCommand.Flag("enable-quick", "Enable or disable quick maintenance").Enum("true", "false")
+	maintenanceSetQuickInterval            = maintenanceSetCommand.Flag("quick-interval", "Interval between quick maintenance runs").Duration()
+	maintenanceSetFullEnabled              = maintenanceSetCommand.Flag("enable-full", "Enable or disable full maintenance, which deletes expired snapshots and unreferenced data").Enum("true", "false")
+	maintenanceSetFullInterval             = maintenanceSetCommand.Flag("full-interval", "Interval between full maintenance runs").Duration()
+	maintenanceSetIndexCompactionThreshold = maintenanceSetCommand.Flag("index-compaction-threshold", "Number of small index blocks that triggers index compaction").Int()
+	maintenanceSetMinContentAge            = maintenanceSetCommand.Flag("min-age", "Do not delete or repack blocks younger than this").Duration()
+	maintenanceSetRepackThreshold          = maintenanceSetCommand.Flag("repack-threshold", "Repack pack files whose ratio of live data is below the threshold (0 disables)").Default("-1").Float64()
+	maintenanceSetLeaseDuration            = maintenanceSetCommand.Flag("lease-duration", "Time after which unfinished maintenance of another host is considered abandoned").Duration()
+	maintenanceSetLeaseSettleTime          = maintenanceSetCommand.Flag("lease-settle-time", "Time to wait for maintenance leases of other hosts to become visible").Duration()
+
+	maintenanceRunCommand = maintenanceCommands.Command("run", "Perform repository maintenance now.")
+	maintenanceRunFull    = maintenanceRunCommand.Flag("full", "Perform full maintenance").Bool()
+)
+
+func init() {
+	maintenanceInfoCommand.Action(directRepositoryAction(runMaintenanceInfo))
+	maintenanceSetCommand.Action(directRepositoryAction(runMaintenanceSet))
+	maintenanceRunCommand.Action(directRepositoryAction(runMaintenanceRun))
+}
+
+func runMaintenanceInfo(ctx context.Context, rep *repo.Repository) error {
+	p, err := maintenance.GetParams(ctx, rep)
+	if err != nil {
+		return err
+	}
+
+	history, err := maintenance.History(ctx, rep)
+	if err != nil {
+		return err
+	}
+
+	sched := maintenance.NextSchedule(p, history)
+
+	printStdout("Quick maintenance: %v\n", describeMaintenanceCycle(p.QuickCycle, sched.NextQuickRun))
+	printStdout("Full maintenance:  %v\n", describeMaintenanceCycle(p.FullCycle, sched.NextFullRun))
+	printStdout("Index compaction threshold: %v\n", p.IndexCompactionThreshold)
+	printStdout("GC minimum content age: %v, repack threshold: %v\n", p.MinContentAge, p.RepackThreshold)
+	printStdout("Lease duration: %v, settle time: %v\n", p.LeaseDuration, p.LeaseSettleTime)
+
+	if len(history) > 0 {
+		printStdout("\nRecent runs:\n")
+	}
+
+	for _, ri := range history {
+		status := "SUCCESS"
+		if !ri.Success {
+			status = "FAILED: " + ri.Error
+		}
+
+		printStdout("  %v %-5v %8v %v %v\n", ri.Start.Local().Format(timeFormat), ri.Mode, ri.End.Sub(ri.Start).Truncate(time.Millisecond), ri.Owner, status)
+	}
+
+	return nil
+}
+
+func describeMaintenanceCycle(c maintenance.CycleParams, next time.Time) string {
+	if !c.Enabled {
+		return "disabled"
+	}
+
+	return fmt.Sprintf("every %v, next run %v", c.Interval, next.Local().Format(timeFormat))
+}
+
+func runMaintenanceSet(ctx context.Context, rep *repo.Repository) error {
+	p, err := maintenance.GetParams(ctx, rep)
+	if err != nil {
+		return err
+	}
+
+	if *maintenanceSetQuickEnabled != "" {
+		p.QuickCycle.Enabled = *maintenanceSetQuickEnabled == "true"
+	}
+	if *maintenanceSetQuickInterval != 0 {
+		p.QuickCycle.Interval = *maintenanceSetQuickInterval
+	}
+	if *maintenanceSetFullEnabled != "" {
+		p.FullCycle.Enabled = *maintenanceSetFullEnabled == "true"
+	}
+	if *maintenanceSetFullInterval != 0 {
+		p.FullCycle.Interval = *maintenanceSetFullInterval
+	}
+	if *maintenanceSetIndexCompactionThreshold != 0 {
+		p.IndexCompactionThreshold = *maintenanceSetIndexCompactionThreshold
+	}
+	if *maintenanceSetMinContentAge != 0 {
+		p.MinContentAge = *maintenanceSetMinContentAge
+	}
+	if *maintenanceSetRepackThreshold >= 0 {
+		p.RepackThreshold = *maintenanceSetRepackThreshold
+	}
+	if *maintenanceSetLeaseDuration != 0 {
+		p.LeaseDuration = *maintenanceSetLeaseDuration
+	}
+	if *maintenanceSetLeaseSettleTime != 0 {
+		p.LeaseSettleTime = *maintenanceSetLeaseSettleTime
+	}
+
+	return maintenance.SetParams(ctx, rep, p)
+}
+
+func runMaintenanceRun(ctx context.Context, rep *repo.Repository) error {
+	mode := maintenance.ModeQuick
+	if *maintenanceRunFull {
+		mode = maintenance.ModeFull
+	}
+
+	ri, err := maintenance.Run(ctx, rep, mode, getUserName()+"@"+getHostName())
+	if err != nil {
+		return err
+	}
+
+	printStderr("Finished %v maintenance in %v.\n", ri.Mode, ri.End.Sub(ri.Start).Truncate(time.Millisecond))
+	if ri.GC != nil {
+		printStderr("Expired %v snapshots, deleted %v unreferenced packs (%v).\n", ri.ExpiredSnapshots, ri.GC.DeletedPackCount, units.BytesStringBase10(ri.GC.DeletedPackBytes))
+	}
+
+	return nil
+}
@@ -26,5 +26,5 @@ func runListObjectsAction(ctx context.Context, rep *repo.Repository) error {
 }
 
 func init() {
-	objectListCommand.Action(repositoryAction(runListObjectsAction))
+	objectListCommand.Action(directRepositoryAction(runListObjectsAction))
 }
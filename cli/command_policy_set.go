@@ -6,8 +6,11 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/kopia/kopia/fs/ignorefs"
+	"github.com/kopia/kopia/internal/actions"
+	"github.com/kopia/kopia/internal/notification"
 	"github.com/kopia/kopia/policy"
 	"github.com/kopia/kopia/repo"
 	"github.com/kopia/kopia/snapshot"
@@ -21,6 +24,12 @@ var (
 	// Frequency
 	policySetInterval   = policySetCommand.Flag("snapshot-interval", "Interval between snapshots").DurationList()
 	policySetTimesOfDay = policySetCommand.Flag("snapshot-time", "Times of day when to take snapshot (HH:mm)").Strings()
+	policySetCron       = policySetCommand.Flag("snapshot-cron", "Cron expressions (minute hour day-of-month month day-of-week) determining when to take snapshot (or 'inherit')").Strings()
+	policySetDays       = policySetCommand.Flag("snapshot-days", "Comma-separated days of week when snapshots can be taken, e.g. 'mon,tue' (or 'inherit')").String()
+	policySetWindow     = policySetCommand.Flag("snapshot-window", "Time of day when snapshots can start (HH:mm-HH:mm) (or 'inherit')").String()
+	policySetJitter     = policySetCommand.Flag("snapshot-jitter", "Maximum random delay added to planned snapshot times").DurationList()
+	policySetManual     = policySetCommand.Flag("manual", "Only take snapshots on demand (true, false or inherit)").Enum("true", "false", inheritPolicyString)
+	policySetRunMissed  = policySetCommand.Flag("run-missed", "Take missed scheduled snapshots as soon as possible (true, false or inherit)").Enum("true", "false", inheritPolicyString)
 
 	// Expiration policies.
 	policySetKeepLatest  = policySetCommand.Flag("keep-latest", "Number of most recent backups to keep per source (or 'inherit')").PlaceHolder("N").String()
@@ -29,6 +38,11 @@ var (
 	policySetKeepWeekly  = policySetCommand.Flag("keep-weekly", "Number of most-recent weekly backups to keep per source (or 'inherit')").PlaceHolder("N").String()
 	policySetKeepMonthly = policySetCommand.Flag("keep-monthly", "Number of most-recent monthly backups to keep per source (or 'inherit')").PlaceHolder("N").String()
 	policySetKeepAnnual  = policySetCommand.Flag("keep-annual", "Number of most-recent annual backups to keep per source (or 'inherit')").PlaceHolder("N").String()
+	policySetKeepWithin  = policySetCommand.Flag("keep-within", "Keep all backups younger than the specified duration, such as 720h (or 'inherit')").PlaceHolder("DURATION").String()
+
+	policySetAddKeepTag    = policySetCommand.Flag("add-keep-tag", "Keep all backups with tags matching the selector (key=value or key)").PlaceHolder("SELECTOR").Strings()
+	policySetRemoveKeepTag = policySetCommand.Flag("remove-keep-tag", "Remove selector of tagged backups to keep").PlaceHolder("SELECTOR").Strings()
+	policySetClearKeepTag  = policySetCommand.Flag("clear-keep-tag", "Clear list of selectors of tagged backups to keep").Bool()
 
 	// Files to ignore.
 	policySetAddIgnore    = policySetCommand.Flag("add-ignore", "List of paths to add to the ignore list").PlaceHolder("PATTERN").Strings()
@@ -41,6 +55,26 @@ var (
 	policySetClearDotIgnore  = policySetCommand.Flag("clear-dot-ignore", "Clear list of paths in the dot-ignore list").Bool()
 	policySetMaxFileSize     = policySetCommand.Flag("max-file-size", "Exclude files above given size").PlaceHolder("N").String()
 
+	// Notifications.
+	policySetNotifyWebhooks     = policySetCommand.Flag("notify-webhook", "Add URL receiving JSON notifications").PlaceHolder("URL").Strings()
+	policySetNotifyEmails       = policySetCommand.Flag("notify-email", "Add email notification recipient").PlaceHolder("ADDRESS").Strings()
+	policySetNotifySMTPServer   = policySetCommand.Flag("notify-smtp-server", "SMTP server (host:port) used for email notifications").String()
+	policySetNotifySMTPUsername = policySetCommand.Flag("notify-smtp-username", "SMTP username used for email notifications").String()
+	policySetNotifySMTPPassword = policySetCommand.Flag("notify-smtp-password", "SMTP password used for email notifications").Envar("KOPIA_NOTIFY_SMTP_PASSWORD").String()
+	policySetNotifyEmailFrom    = policySetCommand.Flag("notify-email-from", "Sender of email notifications").String()
+	policySetNotifyCommands     = policySetCommand.Flag("notify-command", "Add command receiving notifications (server only runs commands from the global policy)").PlaceHolder("COMMAND").Strings()
+	policySetNotifyEvents       = policySetCommand.Flag("notify-event", "Events to notify added targets about (snapshot-failed, snapshot-overdue, maintenance-failed), all by default").Enums(string(notification.EventSnapshotFailed), string(notification.EventSnapshotOverdue), string(notification.EventMaintenanceFailed))
+	policySetNotifyMinInterval  = policySetCommand.Flag("notify-min-interval", "Minimum interval between repeated notifications sent to added targets").Duration()
+	policySetClearNotify        = policySetCommand.Flag("clear-notify", "Remove all notification targets").Bool()
+
+	// Actions.
+	policySetBeforeSnapshotRootAction = policySetCommand.Flag("before-snapshot-root-action", "Command to run before snapshotting the source ('none' to remove)").PlaceHolder("COMMAND").String()
+	policySetAfterSnapshotRootAction  = policySetCommand.Flag("after-snapshot-root-action", "Command to run after snapshotting the source ('none' to remove)").PlaceHolder("COMMAND").String()
+	policySetBeforeFolderAction       = policySetCommand.Flag("before-folder-action", "Command to run before snapshotting the directory ('none' to remove)").PlaceHolder("COMMAND").String()
+	policySetAfterFolderAction        = policySetCommand.Flag("after-folder-action", "Command to run after snapshotting the directory ('none' to remove)").PlaceHolder("COMMAND").String()
+	policySetActionTimeout            = policySetCommand.Flag("action-timeout", "Maximum time the actions being set are allowed to run").Duration()
+	policySetActionMode               = policySetCommand.Flag("action-mode", "Whether failure of the actions being set aborts the snapshot (essential) or is ignored (optional)").Enum(string(actions.ModeEssential), string(actions.ModeOptional))
+
 	// General policy.
 	policySetInherit = policySetCommand.Flag(inheritPolicyString, "Enable or disable inheriting policies from the parent").BoolList()
 )
@@ -97,6 +131,14 @@ func setPolicyFromFlags(target snapshot.SourceInfo, p *policy.Policy, changeCoun
 		return fmt.Errorf("scheduling policy: %v", err)
 	}
 
+	if err := setNotificationPolicyFromFlags(&p.NotificationPolicy, changeCount); err != nil {
+		return fmt.Errorf("notification policy: %v", err)
+	}
+
+	if err := setActionsPolicyFromFlags(&p.ActionsPolicy, changeCount); err != nil {
+		return fmt.Errorf("actions policy: %v", err)
+	}
+
 	if err := applyPolicyNumber64("maximum file size", &p.FilesPolicy.MaxFileSize, *policySetMaxFileSize, changeCount); err != nil {
 		return fmt.Errorf("maximum file size: %v", err)
 	}
@@ -147,6 +189,19 @@ func setRetentionPolicyFromFlags(rp *policy.RetentionPolicy, changeCount *int) e
 			return err
 		}
 	}
+
+	if err := applyPolicyDuration("age of backups to keep", &rp.KeepWithinSeconds, *policySetKeepWithin, changeCount); err != nil {
+		return err
+	}
+
+	if *policySetClearKeepTag {
+		*changeCount++
+		rp.KeepTags = nil
+		printStderr(" - removing all tag selectors of backups to keep\n")
+	} else {
+		rp.KeepTags = addRemoveDedupeAndSort("tag selectors of backups to keep", rp.KeepTags, *policySetAddKeepTag, *policySetRemoveKeepTag, changeCount)
+	}
+
 	return nil
 }
 
@@ -187,9 +242,248 @@ func setSchedulingPolicyFromFlags(sp *policy.SchedulingPolicy, changeCount *int)
 		}
 	}
 
+	if len(*policySetCron) > 0 {
+		*changeCount++
+		sp.Cron = nil
+
+		for _, c := range *policySetCron {
+			if c == inheritPolicyString {
+				sp.Cron = nil
+				break
+			}
+			sp.Cron = append(sp.Cron, c)
+		}
+
+		if sp.Cron == nil {
+			printStderr(" - resetting snapshot cron expressions to default\n")
+		} else {
+			printStderr(" - setting snapshot cron expressions to %q\n", sp.Cron)
+		}
+	}
+
+	if err := setSchedulingRestrictionsFromFlags(sp, changeCount); err != nil {
+		return err
+	}
+
+	// It's not really a list, just optional value.
+	for _, jitter := range *policySetJitter {
+		*changeCount++
+		sp.JitterSeconds = int64(jitter.Seconds())
+		printStderr(" - setting maximum random delay of snapshots to %v\n", sp.Jitter())
+		break
+	}
+
+	applyOptionalBool("manual snapshots only", &sp.Manual, *policySetManual, changeCount)
+	applyOptionalBool("running missed snapshots", &sp.RunMissed, *policySetRunMissed, changeCount)
+
+	return sp.Validate()
+}
+
+func setSchedulingRestrictionsFromFlags(sp *policy.SchedulingPolicy, changeCount *int) error {
+	switch *policySetDays {
+	case "":
+	case inheritPolicyString:
+		*changeCount++
+		sp.DaysOfWeek = nil
+		printStderr(" - resetting snapshot days to default\n")
+	default:
+		*changeCount++
+		sp.DaysOfWeek = nil
+		for _, d := range strings.Split(*policySetDays, ",") {
+			wd, ok := weekdayNames[strings.ToLower(strings.TrimSpace(d))]
+			if !ok {
+				return fmt.Errorf("invalid day of week: %q", d)
+			}
+			sp.DaysOfWeek = append(sp.DaysOfWeek, wd)
+		}
+		printStderr(" - setting snapshot days to %v\n", sp.DaysOfWeek)
+	}
+
+	switch *policySetWindow {
+	case "":
+	case inheritPolicyString:
+		*changeCount++
+		sp.Window = nil
+		printStderr(" - resetting snapshot time window to default\n")
+	default:
+		w := &policy.TimeWindow{}
+		if err := w.Parse(*policySetWindow); err != nil {
+			return err
+		}
+		*changeCount++
+		sp.Window = w
+		printStderr(" - setting snapshot time window to %v\n", w)
+	}
+
 	return nil
 }
 
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func applyOptionalBool(desc string, val **bool, str string, changeCount *int) {
+	switch str {
+	case "":
+		// not changed
+	case inheritPolicyString:
+		*changeCount++
+		printStderr(" - resetting %v to a default value inherited from parent.\n", desc)
+		*val = nil
+	default:
+		*changeCount++
+		v := str == "true"
+		printStderr(" - setting %v to %v.\n", desc, v)
+		*val = &v
+	}
+}
+
+func setNotificationPolicyFromFlags(np *notification.Policy, changeCount *int) error {
+	if *policySetClearNotify {
+		*changeCount++
+		printStderr(" - removing all notification targets\n")
+		np.Targets = nil
+	}
+
+	var targets []notification.Target
+
+	for _, u := range *policySetNotifyWebhooks {
+		targets = append(targets, notification.Target{Type: notification.TargetWebhook, URL: u})
+	}
+
+	if len(*policySetNotifyEmails) > 0 {
+		targets = append(targets, notification.Target{
+			Type:         notification.TargetEmail,
+			SMTPServer:   *policySetNotifySMTPServer,
+			SMTPUsername: *policySetNotifySMTPUsername,
+			SMTPPassword: *policySetNotifySMTPPassword,
+			From:         *policySetNotifyEmailFrom,
+			To:           *policySetNotifyEmails,
+		})
+	}
+
+	for _, c := range *policySetNotifyCommands {
+		args, err := splitCommandLine(c)
+		if err != nil {
+			return err
+		}
+		targets = append(targets, notification.Target{Type: notification.TargetCommand, Command: args})
+	}
+
+	for _, t := range targets {
+		for _, e := range *policySetNotifyEvents {
+			t.Events = append(t.Events, notification.Event(e))
+		}
+		t.MinIntervalSeconds = int64(policySetNotifyMinInterval.Seconds())
+
+		if err := t.Validate(); err != nil {
+			return err
+		}
+
+		*changeCount++
+		printStderr(" - adding notification target: %v\n", t.String())
+		np.Targets = append(np.Targets, t)
+	}
+
+	return nil
+}
+
+func setActionsPolicyFromFlags(ap *actions.Policy, changeCount *int) error {
+	if err := applyAction("before-snapshot-root action", &ap.BeforeSnapshotRoot, *policySetBeforeSnapshotRootAction, changeCount); err != nil {
+		return err
+	}
+
+	if err := applyAction("after-snapshot-root action", &ap.AfterSnapshotRoot, *policySetAfterSnapshotRootAction, changeCount); err != nil {
+		return err
+	}
+
+	if err := applyAction("before-folder action", &ap.BeforeFolder, *policySetBeforeFolderAction, changeCount); err != nil {
+		return err
+	}
+
+	return applyAction("after-folder action", &ap.AfterFolder, *policySetAfterFolderAction, changeCount)
+}
+
+func applyAction(desc string, val **actions.Action, str string, changeCount *int) error {
+	switch str {
+	case "":
+		// not changed
+		return nil
+
+	case "none":
+		*changeCount++
+		printStderr(" - removing %v\n", desc)
+		*val = nil
+		return nil
+	}
+
+	args, err := splitCommandLine(str)
+	if err != nil {
+		return err
+	}
+
+	a := &actions.Action{
+		Command:        args,
+		TimeoutSeconds: int(policySetActionTimeout.Seconds()),
+		Mode:           actions.Mode(*policySetActionMode),
+	}
+
+	if err := a.Validate(); err != nil {
+		return err
+	}
+
+	*changeCount++
+	printStderr(" - setting %v to %v\n", desc, a)
+	*val = a
+
+	return nil
+}
+
+// splitCommandLine splits the command line into arguments separated by spaces, which can be quoted using single or double quotes.
+func splitCommandLine(s string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	var quote rune
+	inArg := false
+
+	for _, c := range s {
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			current.WriteRune(c)
+		case c == '\'' || c == '"':
+			quote = c
+			inArg = true
+		case c == ' ' || c == '\t':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(c)
+			inArg = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in %q", s)
+	}
+
+	if inArg {
+		args = append(args, current.String())
+	}
+
+	return args, nil
+}
+
 func addRemoveDedupeAndSort(desc string, base, add, remove []string, changeCount *int) []string {
 	entries := map[string]bool{}
 	for _, b := range base {
@@ -239,6 +533,31 @@ func applyPolicyNumber(desc string, val **int, str string, changeCount *int) err
 	return nil
 }
 
+func applyPolicyDuration(desc string, val **int64, str string, changeCount *int) error {
+	if str == "" {
+		// not changed
+		return nil
+	}
+
+	if str == inheritPolicyString {
+		*changeCount++
+		printStderr(" - resetting %v to a default value inherited from parent.\n", desc)
+		*val = nil
+		return nil
+	}
+
+	d, err := time.ParseDuration(str)
+	if err != nil {
+		return fmt.Errorf("can't parse the %v %q: %v", desc, str, err)
+	}
+
+	*changeCount++
+	printStderr(" - setting %v to %v.\n", desc, d)
+	v := int64(d.Seconds())
+	*val = &v
+	return nil
+}
+
 func applyPolicyNumber64(desc string, val *int64, str string, changeCount *int) error {
 	if str == "" {
 		// not changed
@@ -3,10 +3,13 @@ package cli
 import (
 	"context"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/kopia/kopia/internal/units"
 	"github.com/kopia/kopia/policy"
 	"github.com/kopia/kopia/repo"
+	"github.com/kopia/kopia/snapshot"
 )
 
 var (
@@ -36,6 +39,9 @@ func showPolicy(ctx context.Context, rep *repo.Repository) error {
 			fmt.Println(effective)
 		} else {
 			printPolicy(effective, policies)
+			if err := printPlannedSnapshots(ctx, rep, target, effective); err != nil {
+				return err
+			}
 		}
 	}
 
@@ -77,6 +83,10 @@ func printPolicy(p *policy.Policy, parents []*policy.Policy) {
 	printFilesPolicy(p, parents)
 	printStdout("\n")
 	printSchedulingPolicy(p, parents)
+	printStdout("\n")
+	printNotificationPolicy(p, parents)
+	printStdout("\n")
+	printActionsPolicy(p, parents)
 }
 
 func printRetentionPolicy(p *policy.Policy, parents []*policy.Policy) {
@@ -111,6 +121,22 @@ func printRetentionPolicy(p *policy.Policy, parents []*policy.Policy) {
 		getDefinitionPoint(parents, func(pol *policy.Policy) bool {
 			return pol.RetentionPolicy.KeepLatest != nil
 		}))
+
+	if d := p.RetentionPolicy.KeepWithin(); d > 0 {
+		printStdout("  Snapshots within:  %-14v%v\n", d,
+			getDefinitionPoint(parents, func(pol *policy.Policy) bool {
+				return pol.RetentionPolicy.KeepWithinSeconds != nil
+			}))
+	}
+
+	if len(p.RetentionPolicy.KeepTags) > 0 {
+		printStdout("  Snapshots tagged:                %v\n", getDefinitionPoint(parents, func(pol *policy.Policy) bool {
+			return len(pol.RetentionPolicy.KeepTags) > 0
+		}))
+		for _, sel := range p.RetentionPolicy.KeepTags {
+			printStdout("    %v\n", sel)
+		}
+	}
 }
 
 func printFilesPolicy(p *policy.Policy, parents []*policy.Policy) {
@@ -144,15 +170,24 @@ func printFilesPolicy(p *policy.Policy, parents []*policy.Policy) {
 }
 
 func printSchedulingPolicy(p *policy.Policy, parents []*policy.Policy) {
-	if p.SchedulingPolicy.Interval() != 0 {
-		printStdout("Snapshot interval:     %10v  %v\n", p.SchedulingPolicy.Interval(), getDefinitionPoint(parents, func(pol *policy.Policy) bool {
+	sp := &p.SchedulingPolicy
+
+	if sp.IsManual() {
+		printStdout("Snapshot schedule:     %10v  %v\n", "manual", getDefinitionPoint(parents, func(pol *policy.Policy) bool {
+			return pol.SchedulingPolicy.Manual != nil
+		}))
+		return
+	}
+
+	if sp.Interval() != 0 {
+		printStdout("Snapshot interval:     %10v  %v\n", sp.Interval(), getDefinitionPoint(parents, func(pol *policy.Policy) bool {
 			return pol.SchedulingPolicy.Interval() != 0
 		}))
 	}
 
-	if len(p.SchedulingPolicy.TimesOfDay) > 0 {
+	if len(sp.TimesOfDay) > 0 {
 		printStdout("Snapshot times:\n")
-		for _, tod := range p.SchedulingPolicy.TimesOfDay {
+		for _, tod := range sp.TimesOfDay {
 			printStdout("  %9v                        %v\n", tod, getDefinitionPoint(parents, func(pol *policy.Policy) bool {
 				for _, t := range pol.SchedulingPolicy.TimesOfDay {
 					if t == tod {
@@ -164,8 +199,129 @@ func printSchedulingPolicy(p *policy.Policy, parents []*policy.Policy) {
 			}))
 		}
 	}
+
+	if len(sp.Cron) > 0 {
+		printStdout("Snapshot cron expressions:\n")
+		for _, c := range sp.Cron {
+			printStdout("  %-30v %v\n", c, getDefinitionPoint(parents, func(pol *policy.Policy) bool {
+				return containsString(pol.SchedulingPolicy.Cron, c)
+			}))
+		}
+	}
+
+	if len(sp.DaysOfWeek) > 0 {
+		printStdout("Only on days:          %10v  %v\n", formatDaysOfWeek(sp.DaysOfWeek), getDefinitionPoint(parents, func(pol *policy.Policy) bool {
+			return len(pol.SchedulingPolicy.DaysOfWeek) > 0
+		}))
+	}
+
+	if sp.Window != nil {
+		printStdout("Only between:          %10v  %v\n", sp.Window, getDefinitionPoint(parents, func(pol *policy.Policy) bool {
+			return pol.SchedulingPolicy.Window != nil
+		}))
+	}
+
+	if sp.JitterSeconds != 0 {
+		printStdout("Random delay up to:    %10v  %v\n", sp.Jitter(), getDefinitionPoint(parents, func(pol *policy.Policy) bool {
+			return pol.SchedulingPolicy.JitterSeconds != 0
+		}))
+	}
+
+	if sp.ShouldRunMissed() {
+		printStdout("Run missed snapshots as soon as possible %v\n", getDefinitionPoint(parents, func(pol *policy.Policy) bool {
+			return pol.SchedulingPolicy.RunMissed != nil
+		}))
+	}
+}
+
+func formatDaysOfWeek(days []time.Weekday) string {
+	var names []string
+	for _, d := range days {
+		names = append(names, d.String()[0:3])
+	}
+
+	return strings.Join(names, ",")
 }
 
+func printNotificationPolicy(p *policy.Policy, parents []*policy.Policy) {
+	if len(p.NotificationPolicy.Targets) == 0 {
+		printStdout("No notification targets.\n")
+		return
+	}
+
+	printStdout("Notify:                            %v\n", getDefinitionPoint(parents, func(pol *policy.Policy) bool {
+		return len(pol.NotificationPolicy.Targets) > 0
+	}))
+	for _, t := range p.NotificationPolicy.Targets {
+		events := "all events"
+		if len(t.Events) > 0 {
+			events = fmt.Sprintf("%v", t.Events)
+		}
+
+		printStdout("  %v (%v, at most every %v)\n", t.String(), events, t.MinInterval())
+	}
+}
+
+func printActionsPolicy(p *policy.Policy, parents []*policy.Policy) {
+	ap := &p.ActionsPolicy
+
+	if ap.BeforeSnapshotRoot == nil && ap.AfterSnapshotRoot == nil && ap.BeforeFolder == nil && ap.AfterFolder == nil {
+		printStdout("No actions.\n")
+		return
+	}
+
+	if ap.BeforeSnapshotRoot != nil {
+		printStdout("Before snapshot:                   %v\n  %v\n", getDefinitionPoint(parents, func(pol *policy.Policy) bool {
+			return pol.ActionsPolicy.BeforeSnapshotRoot != nil
+		}), ap.BeforeSnapshotRoot)
+	}
+
+	if ap.AfterSnapshotRoot != nil {
+		printStdout("After snapshot:                    %v\n  %v\n", getDefinitionPoint(parents, func(pol *policy.Policy) bool {
+			return pol.ActionsPolicy.AfterSnapshotRoot != nil
+		}), ap.AfterSnapshotRoot)
+	}
+
+	if ap.BeforeFolder != nil {
+		printStdout("Before this directory:\n  %v\n", ap.BeforeFolder)
+	}
+
+	if ap.AfterFolder != nil {
+		printStdout("After this directory:\n  %v\n", ap.AfterFolder)
+	}
+}
+
+// printPlannedSnapshots prints next few times when the snapshot of the target is planned.
+func printPlannedSnapshots(ctx context.Context, rep *repo.Repository, target snapshot.SourceInfo, p *policy.Policy) error {
+	if target.Path == "" {
+		return nil
+	}
+
+	snapshots, err := snapshot.ListSnapshots(ctx, rep, target)
+	if err != nil {
+		return fmt.Errorf("unable to list snapshots of %v: %v", target, err)
+	}
+
+	var previous time.Time
+	if snaps := snapshot.SortByTime(snapshots, true); len(snaps) > 0 {
+		previous = snaps[0].StartTime
+	}
+
+	planned := p.SchedulingPolicy.PlannedSnapshotTimes(previous, time.Now(), target.String(), plannedSnapshotCount)
+	if len(planned) == 0 {
+		return nil
+	}
+
+	printStdout("\nNext planned snapshots:\n")
+	for _, t := range planned {
+		printStdout("  %v\n", t.Local().Format("Mon "+timeFormat))
+	}
+
+	return nil
+}
+
+const plannedSnapshotCount = 5
+
 func valueOrNotSet(p *int) string {
 	if p == nil {
 		return "-"
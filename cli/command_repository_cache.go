@@ -26,5 +26,5 @@ func runCacheCommand(ctx context.Context, rep *repo.Repository) error {
 }
 
 func init() {
-	cacheCommand.Action(repositoryAction(runCacheCommand))
+	cacheCommand.Action(directRepositoryAction(runCacheCommand))
 }
@@ -0,0 +1,37 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/kopia/kopia/repo"
+)
+
+var (
+	changePasswordCommand     = repositoryCommands.Command("change-password", "Change repository password.")
+	changePasswordNewPassword = changePasswordCommand.Flag("new-password", "New repository password.").Envar("KOPIA_NEW_PASSWORD").String()
+)
+
+func runChangePasswordCommand(ctx context.Context, rep *repo.Repository) error {
+	newPass := *changePasswordNewPassword
+	if newPass == "" {
+		newPass = mustAskForChangedRepositoryPassword()
+	}
+
+	if err := rep.ChangePassword(ctx, newPass); err != nil {
+		return fmt.Errorf("unable to change password: %v", err)
+	}
+
+	if _, ok := getPersistedPassword(repositoryConfigFileName(), getUserName()); ok {
+		if err := persistPassword(repositoryConfigFileName(), getUserName(), newPass); err != nil {
+			return fmt.Errorf("password changed, but unable to save the new password: %v", err)
+		}
+	}
+
+	printStderr("Password changed. Other clients must use the new password when connecting to this repository.\n")
+	return nil
+}
+
+func init() {
+	changePasswordCommand.Action(repositoryAction(runChangePasswordCommand))
+}
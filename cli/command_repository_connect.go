@@ -18,6 +18,7 @@ var (
 	connectCacheDirectory       string
 	connectMaxCacheSizeMB       int64
 	connectMaxListCacheDuration time.Duration
+	connectEnableActions        bool
 )
 
 func setupConnectOptions(cmd *kingpin.CmdClause) {
@@ -27,6 +28,7 @@ func setupConnectOptions(cmd *kingpin.CmdClause) {
 	cmd.Flag("cache-directory", "Cache directory").PlaceHolder("PATH").StringVar(&connectCacheDirectory)
 	cmd.Flag("cache-size-mb", "Size of local cache").PlaceHolder("MB").Default("500").Int64Var(&connectMaxCacheSizeMB)
 	cmd.Flag("max-list-cache-duration", "Duration of index cache").Default("600s").Hidden().DurationVar(&connectMaxListCacheDuration)
+	cmd.Flag("enable-actions", "Allow running actions defined in policies, which can be set by any user able to write policies to the repository").BoolVar(&connectEnableActions)
 }
 
 func connectOptions() repo.ConnectOptions {
@@ -36,6 +38,7 @@ func connectOptions() repo.ConnectOptions {
 			MaxCacheSizeBytes:       connectMaxCacheSizeMB << 20,
 			MaxListCacheDurationSec: int(connectMaxListCacheDuration.Seconds()),
 		},
+		EnableActions: connectEnableActions,
 	}
 }
 
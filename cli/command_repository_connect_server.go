@@ -0,0 +1,53 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/kopia/kopia/internal/config"
+	"github.com/kopia/kopia/repo"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var (
+	connectAPIServerCommand         = connectCommand.Command("server", "Connect to a repository exposed by Kopia API server")
+	connectAPIServerURL             = connectAPIServerCommand.Flag("url", "Server URL, such as https://host:51515").Required().String()
+	connectAPIServerUsername        = connectAPIServerCommand.Flag("server-username", "Server username").Default(getUserName()).String()
+	connectAPIServerCertFingerprint = connectAPIServerCommand.Flag("server-cert-fingerprint", "SHA256 fingerprint of the trusted server TLS certificate").String()
+)
+
+func runConnectAPIServerCommand(ctx context.Context) error {
+	// the password is the password of the server user, which is persisted just like the repository password.
+	password := mustGetPasswordFromFlags(false, false)
+
+	configFile := repositoryConfigFileName()
+	si := &config.APIServerInfo{
+		BaseURL:                             *connectAPIServerURL,
+		Username:                            *connectAPIServerUsername,
+		TrustedServerCertificateFingerprint: *connectAPIServerCertFingerprint,
+	}
+
+	if err := repo.ConnectAPIServer(ctx, configFile, si, password, connectOptions()); err != nil {
+		return err
+	}
+
+	if connectPersistCredentials {
+		if err := persistPassword(configFile, getUserName(), password); err != nil {
+			return fmt.Errorf("unable to persist password: %v", err)
+		}
+	} else {
+		deletePassword(configFile, getUserName())
+	}
+
+	printStderr("Connected to repository server.\n")
+	promptForAnalyticsConsent()
+
+	return nil
+}
+
+func init() {
+	connectAPIServerCommand.Action(func(_ *kingpin.ParseContext) error {
+		return runConnectAPIServerCommand(context.Background())
+	})
+}
@@ -4,7 +4,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strconv"
 
+	"github.com/kopia/kopia/internal/compression"
+	"github.com/kopia/kopia/internal/packindex"
 	"github.com/kopia/kopia/internal/units"
 	"github.com/kopia/kopia/repo"
 	"github.com/kopia/kopia/repo/block"
@@ -17,6 +20,8 @@ var (
 
 	createMetadataEncryptionFormat = createCommand.Flag("metadata-encryption", "Metadata item encryption.").PlaceHolder("FORMAT").Default(repo.DefaultEncryptionAlgorithm).Enum(repo.SupportedEncryptionAlgorithms...)
 	createObjectFormat             = createCommand.Flag("object-format", "Format of repository objects.").PlaceHolder("FORMAT").Default(block.DefaultFormat).Enum(block.SupportedFormats...)
+	createCompression              = createCommand.Flag("compression", "Compression algorithm applied to blocks before encryption.").PlaceHolder("ALGORITHM").Default("none").Enum(append([]string{"none"}, compression.SupportedCompressors...)...)
+	createIndexVersion             = createCommand.Flag("index-version", "Version of pack indexes, version 2 supports packs and blocks larger than 2 GiB and block checksums but can't be read by older clients.").Default(strconv.Itoa(packindex.DefaultVersion)).Enum(strconv.Itoa(packindex.Version1), strconv.Itoa(packindex.Version2))
 	createObjectSplitter           = createCommand.Flag("object-splitter", "The splitter to use for new objects in the repository").Default("DYNAMIC").Enum(object.SupportedSplitters...)
 
 	createMinBlockSize = createCommand.Flag("min-block-size", "Minimum size of a data block.").PlaceHolder("KB").Default("1024").Int()
@@ -35,6 +40,8 @@ func newRepositoryOptionsFromFlags() *repo.NewRepositoryOptions {
 	return &repo.NewRepositoryOptions{
 		MetadataEncryptionAlgorithm: *createMetadataEncryptionFormat,
 		BlockFormat:                 *createObjectFormat,
+		Compression:                 *createCompression,
+		IndexVersion:                mustParseIndexVersion(*createIndexVersion),
 
 		Splitter:     *createObjectSplitter,
 		MinBlockSize: *createMinBlockSize * 1024,
@@ -43,6 +50,15 @@ func newRepositoryOptionsFromFlags() *repo.NewRepositoryOptions {
 	}
 }
 
+func mustParseIndexVersion(s string) int {
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		panic("invalid index version: " + s)
+	}
+
+	return v
+}
+
 func ensureEmpty(ctx context.Context, s storage.Storage) error {
 	hasDataError := errors.New("has data")
 	err := s.ListBlocks(ctx, "", func(cb storage.BlockMetadata) error {
@@ -70,6 +86,8 @@ func runCreateCommandWithStorage(ctx context.Context, st storage.Storage) error
 	printStderr("Initializing repository with:\n")
 	printStderr("  metadata encryption: %v\n", options.MetadataEncryptionAlgorithm)
 	printStderr("  block format:        %v\n", options.BlockFormat)
+	printStderr("  compression:         %v\n", options.Compression)
+	printStderr("  index version:       %v\n", options.IndexVersion)
 	switch options.Splitter {
 	case "DYNAMIC":
 		printStderr("  object splitter:     DYNAMIC with block sizes (min:%v avg:%v max:%v)\n",
@@ -0,0 +1,96 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/kopia/kopia/repo"
+)
+
+var (
+	keyCommands = repositoryCommands.Command("key", "Manage credentials that can open the repository.")
+
+	keyAddCommand     = keyCommands.Command("add", "Add new password or key file that can open the repository.")
+	keyAddLabel       = keyAddCommand.Flag("label", "Label describing the credential (e.g. machine or person name).").Required().String()
+	keyAddKeyFile     = keyAddCommand.Flag("generate-key-file", "Generate a key file at the given path instead of using a password.").PlaceHolder("PATH").String()
+	keyAddNewPassword = keyAddCommand.Flag("new-password", "Password for the new credential.").Envar("KOPIA_NEW_PASSWORD").String()
+
+	keyListCommand = keyCommands.Command("list", "List credentials that can open the repository.").Alias("ls").Default()
+
+	keyRemoveCommand = keyCommands.Command("remove", "Remove a credential.").Alias("rm")
+	keyRemoveID      = keyRemoveCommand.Arg("id", "Key slot ID").Required().String()
+	keyRemoveForce   = keyRemoveCommand.Flag("force", "Allow removing the credential used to open the repository.").Bool()
+)
+
+func runKeyAddCommand(ctx context.Context, rep *repo.Repository) error {
+	if *keyAddKeyFile != "" {
+		secret, err := repo.NewKeyFileSecret()
+		if err != nil {
+			return err
+		}
+
+		if err := ioutil.WriteFile(*keyAddKeyFile, []byte(secret), 0600); err != nil {
+			return fmt.Errorf("unable to write key file: %v", err)
+		}
+
+		id, err := rep.AddKeySlot(ctx, repo.KeySlotKeyFile, *keyAddLabel, secret)
+		if err != nil {
+			return fmt.Errorf("unable to add key file: %v", err)
+		}
+
+		printStderr("Added key slot %v, use '--key-file=%v' to open the repository.\n", id, *keyAddKeyFile)
+		return nil
+	}
+
+	newPass := *keyAddNewPassword
+	if newPass == "" {
+		newPass = mustAskForChangedRepositoryPassword()
+	}
+
+	id, err := rep.AddKeySlot(ctx, repo.KeySlotPassword, *keyAddLabel, newPass)
+	if err != nil {
+		return fmt.Errorf("unable to add password: %v", err)
+	}
+
+	printStderr("Added key slot %v.\n", id)
+	return nil
+}
+
+func runKeyListCommand(ctx context.Context, rep *repo.Repository) error {
+	slots := rep.KeySlots()
+	if len(slots) == 0 {
+		printStderr("Repository does not use key slots, it will be upgraded when a credential is added or changed.\n")
+		return nil
+	}
+
+	for _, s := range slots {
+		var current string
+		if s.ID == rep.CurrentKeySlotID() {
+			current = " (current)"
+		}
+
+		printStdout("%v %-8v %v %v%v\n", s.ID, s.Type, s.Created.Local().Format(timeFormat), s.Label, current)
+	}
+
+	return nil
+}
+
+func runKeyRemoveCommand(ctx context.Context, rep *repo.Repository) error {
+	if *keyRemoveID == rep.CurrentKeySlotID() && !*keyRemoveForce {
+		return fmt.Errorf("refusing to remove the credential used to open the repository, pass --force to remove anyway")
+	}
+
+	if err := rep.RemoveKeySlot(ctx, *keyRemoveID); err != nil {
+		return fmt.Errorf("unable to remove key slot: %v", err)
+	}
+
+	printStderr("Removed key slot %v.\n", *keyRemoveID)
+	return nil
+}
+
+func init() {
+	keyAddCommand.Action(repositoryAction(runKeyAddCommand))
+	keyListCommand.Action(repositoryAction(runKeyListCommand))
+	keyRemoveCommand.Action(repositoryAction(runKeyRemoveCommand))
+}
@@ -128,5 +128,5 @@ func getSourcesToMigrate(ctx context.Context, rep *repo.Repository) ([]snapshot.
 }
 
 func init() {
-	migrateCommand.Action(repositoryAction(runMigrateCommand))
+	migrateCommand.Action(directRepositoryAction(runMigrateCommand))
 }
@@ -27,11 +27,15 @@ func runStatusCommand(ctx context.Context, rep *repo.Repository) error {
 	}
 	fmt.Println()
 
-	ci := rep.Storage.ConnectionInfo()
-	fmt.Printf("Storage type:        %v\n", ci.Type)
+	if rep.IsRemote() {
+		fmt.Printf("Storage type:        repository server\n")
+	} else {
+		ci := rep.Storage.ConnectionInfo()
+		fmt.Printf("Storage type:        %v\n", ci.Type)
 
-	if cjson, err := json.MarshalIndent(scrubber.ScrubSensitiveData(reflect.ValueOf(ci.Config)).Interface(), "                     ", "  "); err == nil {
-		fmt.Printf("Storage config:      %v\n", string(cjson))
+		if cjson, err := json.MarshalIndent(scrubber.ScrubSensitiveData(reflect.ValueOf(ci.Config)).Interface(), "                     ", "  "); err == nil {
+			fmt.Printf("Storage config:      %v\n", string(cjson))
+		}
 	}
 	fmt.Println()
 
@@ -53,8 +57,13 @@ func runStatusCommand(ctx context.Context, rep *repo.Repository) error {
 	fmt.Printf("Unique ID:           %x\n", rep.UniqueID)
 	fmt.Println()
 	fmt.Printf("Object manager:      v%v\n", rep.Objects.Format.Version)
-	fmt.Printf("Block format:        %v\n", rep.Blocks.Format.BlockFormat)
-	fmt.Printf("Max pack length:     %v\n", units.BytesStringBase2(int64(rep.Blocks.Format.MaxPackSize)))
+	if !rep.IsRemote() {
+		fmt.Printf("Block format:        %v\n", rep.Blocks.Format.BlockFormat)
+		fmt.Printf("Max pack length:     %v\n", units.BytesStringBase2(int64(rep.Blocks.Format.MaxPackSize)))
+		if rep.Blocks.Format.IndexVersion != 0 {
+			fmt.Printf("Index version:       %v\n", rep.Blocks.Format.IndexVersion)
+		}
+	}
 	fmt.Printf("Splitter:            %v%v\n", rep.Objects.Format.Splitter, splitterExtraInfo)
 
 	return nil
@@ -0,0 +1,64 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/kopia/kopia/internal/units"
+	"github.com/kopia/kopia/repo"
+	"github.com/kopia/kopia/repo/block"
+	"github.com/kopia/kopia/repo/object"
+	"github.com/kopia/kopia/snapshot/upgrade"
+)
+
+var (
+	upgradeCommand            = repositoryCommands.Command("upgrade", "Migrate all repository contents to a new object format or splitter. Other clients must not use the repository until it completes.")
+	upgradeObjectFormat       = upgradeCommand.Flag("object-format", "New format of repository objects.").PlaceHolder("FORMAT").Enum(block.SupportedFormats...)
+	upgradeObjectSplitter     = upgradeCommand.Flag("object-splitter", "New splitter to use for objects in the repository.").Enum(object.SupportedSplitters...)
+	upgradeCheckpointInterval = upgradeCommand.Flag("checkpoint-interval", "Maximum time between persisting progress of the upgrade, which allows it to be resumed.").Default(upgrade.DefaultCheckpointInterval.String()).Duration()
+	upgradeAbort              = upgradeCommand.Flag("abort", "Abort the interrupted upgrade and discard its progress.").Bool()
+)
+
+func runUpgradeCommand(ctx context.Context, rep *repo.Repository) error {
+	if *upgradeAbort {
+		if err := rep.AbortUpgrade(ctx); err != nil {
+			return fmt.Errorf("unable to abort upgrade: %v", err)
+		}
+
+		printStderr("Upgrade aborted.\n")
+		return nil
+	}
+
+	if *upgradeObjectFormat == "" && *upgradeObjectSplitter == "" {
+		return fmt.Errorf("must specify --object-format or --object-splitter")
+	}
+
+	st, err := upgrade.Run(ctx, rep, upgrade.Options{
+		UpgradeOptions: repo.UpgradeOptions{
+			BlockFormat: *upgradeObjectFormat,
+			Splitter:    *upgradeObjectSplitter,
+		},
+		Owner:              getUserName() + "@" + getHostName(),
+		CheckpointInterval: *upgradeCheckpointInterval,
+	})
+	if err != nil {
+		return err
+	}
+
+	if st.Resumed {
+		printStderr("Resumed interrupted upgrade.\n")
+	}
+
+	printStderr("Migrated %v manifests including %v snapshots, %v objects and %v blocks (%v).\n",
+		st.ManifestCount, st.SnapshotCount, st.ObjectCount, st.BlockCount, units.BytesStringBase10(st.Bytes))
+	if st.DeletedManifestCount > 0 {
+		printStderr("Skipped %v manifests deleted during the upgrade.\n", st.DeletedManifestCount)
+	}
+
+	printStderr("Repository upgraded. Other clients must open the repository again.\n")
+	return nil
+}
+
+func init() {
+	upgradeCommand.Action(directRepositoryAction(runUpgradeCommand))
+}
@@ -0,0 +1,66 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/kopia/kopia/internal/apiclient"
+	"github.com/kopia/kopia/internal/serverapi"
+	"github.com/kopia/kopia/internal/units"
+)
+
+var (
+	serverEventsCommand = serverCommands.Command("events", "Watch live events published by Kopia server")
+	serverEventsHost    = serverEventsCommand.Flag("host", "Only show events of sources on a given host").String()
+	serverEventsUser    = serverEventsCommand.Flag("user", "Only show events of sources of a given user").String()
+	serverEventsPath    = serverEventsCommand.Flag("path", "Only show events of sources whose path contains a given string").String()
+)
+
+func init() {
+	serverEventsCommand.Action(serverAction(runServerEvents))
+}
+
+func runServerEvents(ctx context.Context, cli *apiclient.Client) error {
+	filter := url.Values{}
+	if *serverEventsHost != "" {
+		filter.Set("host", *serverEventsHost)
+	}
+	if *serverEventsUser != "" {
+		filter.Set("userName", *serverEventsUser)
+	}
+	if *serverEventsPath != "" {
+		filter.Set("path", *serverEventsPath)
+	}
+
+	return serverapi.WatchEvents(ctx, cli, filter, func(ev *serverapi.Event) error {
+		fmt.Println(formatServerEvent(ev))
+		return nil
+	})
+}
+
+func formatServerEvent(ev *serverapi.Event) string {
+	s := fmt.Sprintf("%v %-20v", ev.Time.Local().Format(timeFormatPrecise), ev.Type)
+	if ev.Source != nil {
+		s += " " + ev.Source.String()
+	}
+
+	switch ev.Type {
+	case serverapi.EventUploadProgress:
+		s += fmt.Sprintf(" '%v' %v/%v", ev.Path, units.BytesStringBase10(ev.PathCompleted), units.BytesStringBase10(ev.PathTotal))
+	case serverapi.EventSnapshotFinished:
+		s += " " + ev.SnapshotID
+	case serverapi.EventUploadError:
+		s += fmt.Sprintf(" '%v'", ev.Path)
+	}
+
+	if ev.Message != "" {
+		s += " " + ev.Message
+	}
+
+	if ev.Error != "" {
+		s += " error: " + ev.Error
+	}
+
+	return s
+}
@@ -3,6 +3,7 @@ package cli
 import (
 	"context"
 
+	"github.com/kopia/kopia/internal/apiclient"
 	"github.com/kopia/kopia/internal/serverapi"
 )
 
@@ -14,6 +15,6 @@ func init() {
 	serverFlushCommand.Action(serverAction(runServerFlush))
 }
 
-func runServerFlush(ctx context.Context, cli *serverapi.Client) error {
+func runServerFlush(ctx context.Context, cli *apiclient.Client) error {
 	return cli.Post("flush", &serverapi.Empty{}, &serverapi.Empty{})
 }
@@ -3,7 +3,7 @@ package cli
 import (
 	"context"
 
-	"github.com/kopia/kopia/internal/serverapi"
+	"github.com/kopia/kopia/internal/apiclient"
 )
 
 var (
@@ -14,6 +14,6 @@ func init() {
 	serverResumeCommand.Action(serverAction(runServerResume))
 }
 
-func runServerResume(ctx context.Context, cli *serverapi.Client) error {
-	return cli.Post("sources/resume", &serverapi.Empty{}, &serverapi.Empty{})
+func runServerResume(ctx context.Context, cli *apiclient.Client) error {
+	return triggerActionOnMatchingSources(ctx, cli, "sources/resume")
 }
@@ -2,19 +2,37 @@ package cli
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"os"
+	"strings"
 	"time"
 
+	"github.com/kopia/kopia/internal/apiclient"
 	"github.com/kopia/kopia/internal/server"
 	"github.com/kopia/kopia/repo"
 )
 
 var (
-	serverAddress = serverCommands.Flag("--address", "Server address").Default("127.0.0.1:51515").String()
+	serverAddress = serverCommands.Flag("address", "Server address").Default("127.0.0.1:51515").String()
+
+	serverUsername        = serverCommands.Flag("server-username", "HTTP server username (basic auth)").Default("kopia").String()
+	serverPassword        = serverCommands.Flag("server-password", "HTTP server password (basic auth)").Envar("KOPIA_SERVER_PASSWORD").String()
+	serverToken           = serverCommands.Flag("server-token", "HTTP server bearer token").Envar("KOPIA_SERVER_TOKEN").String()
+	serverCertFingerprint = serverCommands.Flag("server-cert-fingerprint", "SHA256 fingerprint of the trusted server TLS certificate").String()
 
 	serverStartCommand  = serverCommands.Command("start", "Start Kopia server").Default()
 	serverStartHTMLPath = serverStartCommand.Flag("html", "Server the provided HTML at the root URL").ExistingDir()
+
+	serverStartAuthFile        = serverStartCommand.Flag("auth-file", "JSON file with users allowed to access the server").ExistingFile()
+	serverStartTLSCertFile     = serverStartCommand.Flag("tls-cert-file", "TLS certificate PEM").String()
+	serverStartTLSKeyFile      = serverStartCommand.Flag("tls-key-file", "TLS key PEM file").String()
+	serverStartTLSGenerateCert = serverStartCommand.Flag("tls-generate-cert", "Generate self-signed TLS certificate, saving it to --tls-cert-file and --tls-key-file if specified").Bool()
+	serverStartTLSCertValidity = serverStartCommand.Flag("tls-generate-cert-validity", "Validity of the generated TLS certificate").Default("8760h").Duration()
+	serverStartInsecure        = serverStartCommand.Flag("insecure", "Allow listening on non-loopback address without authentication, giving everyone full control of the server").Bool()
 )
 
 func init() {
@@ -22,19 +40,173 @@ func init() {
 }
 
 func runServer(ctx context.Context, rep *repo.Repository) error {
-	srv, err := server.New(ctx, rep, getHostName(), getUserName())
+	users, err := serverUsers()
+	if err != nil {
+		return err
+	}
+
+	listenAddress := serverListenAddress()
+	if len(users) == 0 && !isLoopbackAddress(listenAddress) {
+		if !*serverStartInsecure {
+			return fmt.Errorf("refusing to listen on %v without authentication, use --server-password or --auth-file (or --insecure)", listenAddress)
+		}
+
+		log.Warningf("server is listening on %v without authentication", listenAddress)
+	}
+
+	tlsConfig, err := serverTLSConfig(listenAddress)
+	if err != nil {
+		return err
+	}
+
+	srv, err := server.New(ctx, rep, getHostName(), getUserName(), server.Options{
+		Users: users,
+	})
 	if err != nil {
 		return fmt.Errorf("unable to initialize server: %v", err)
 	}
 
 	go rep.RefreshPeriodically(ctx, 10*time.Second)
 
-	url := "http://" + *serverAddress
-	log.Infof("starting server on %v", url)
-	http.Handle("/api/", srv.APIHandlers())
+	mux := http.NewServeMux()
+	mux.Handle("/api/", srv.APIHandlers())
+	mux.Handle("/metrics", srv.MetricsHandler())
 	if *serverStartHTMLPath != "" {
 		fileServer := http.FileServer(http.Dir(*serverStartHTMLPath))
-		http.Handle("/", fileServer)
+		mux.Handle("/", fileServer)
+	}
+
+	httpServer := &http.Server{
+		Addr:      listenAddress,
+		Handler:   mux,
+		TLSConfig: tlsConfig,
+	}
+
+	if tlsConfig != nil {
+		log.Infof("starting server on https://%v", listenAddress)
+		return httpServer.ListenAndServeTLS("", "")
+	}
+
+	log.Infof("starting server on http://%v", listenAddress)
+	return httpServer.ListenAndServe()
+}
+
+// serverListenAddress returns the host:port portion of --address.
+func serverListenAddress() string {
+	a := *serverAddress
+	if p := strings.Index(a, "://"); p >= 0 {
+		a = a[p+3:]
+	}
+
+	return strings.TrimSuffix(a, "/")
+}
+
+func isLoopbackAddress(hostPort string) bool {
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return false
+	}
+
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func serverUsers() ([]server.User, error) {
+	var users []server.User
+
+	if *serverStartAuthFile != "" {
+		ac, err := server.ReadAuthConfig(*serverStartAuthFile)
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, ac.Users...)
+	}
+
+	if *serverPassword != "" || *serverToken != "" {
+		users = append(users, server.User{
+			Username: *serverUsername,
+			Password: *serverPassword,
+			Token:    *serverToken,
+			Role:     server.RoleControl,
+		})
+	}
+
+	return users, nil
+}
+
+func serverTLSConfig(listenAddress string) (*tls.Config, error) {
+	if *serverStartTLSGenerateCert {
+		return generateServerCertificate(listenAddress)
 	}
-	return http.ListenAndServe(*serverAddress, nil)
+
+	if *serverStartTLSCertFile == "" && *serverStartTLSKeyFile == "" {
+		if strings.HasPrefix(*serverAddress, "https://") {
+			return nil, fmt.Errorf("https:// address requires --tls-cert-file and --tls-key-file or --tls-generate-cert")
+		}
+
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(*serverStartTLSCertFile, *serverStartTLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load TLS certificate: %v", err)
+	}
+
+	printServerCertificateFingerprint(cert)
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+func generateServerCertificate(listenAddress string) (*tls.Config, error) {
+	for _, fn := range []string{*serverStartTLSCertFile, *serverStartTLSKeyFile} {
+		if fn == "" {
+			continue
+		}
+
+		if _, err := os.Stat(fn); err == nil {
+			return nil, fmt.Errorf("%v already exists, not overwriting", fn)
+		}
+	}
+
+	hosts := []string{"localhost", "127.0.0.1"}
+	if host, _, err := net.SplitHostPort(listenAddress); err == nil && host != "" && host != "localhost" && host != "127.0.0.1" {
+		hosts = append(hosts, host)
+	}
+
+	certPEM, keyPEM, err := server.GenerateSelfSignedCertificate(hosts, *serverStartTLSCertValidity)
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate TLS certificate: %v", err)
+	}
+
+	if fn := *serverStartTLSCertFile; fn != "" {
+		if err := ioutil.WriteFile(fn, certPEM, 0600); err != nil {
+			return nil, fmt.Errorf("unable to write TLS certificate: %v", err)
+		}
+	}
+
+	if fn := *serverStartTLSKeyFile; fn != "" {
+		if err := ioutil.WriteFile(fn, keyPEM, 0600); err != nil {
+			return nil, fmt.Errorf("unable to write TLS key: %v", err)
+		}
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid generated TLS certificate: %v", err)
+	}
+
+	printServerCertificateFingerprint(cert)
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+func printServerCertificateFingerprint(cert tls.Certificate) {
+	if len(cert.Certificate) == 0 {
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "SERVER CERT SHA256: %v\n", apiclient.CertificateFingerprint(cert.Certificate[0]))
 }
@@ -3,7 +3,9 @@ package cli
 import (
 	"context"
 	"fmt"
+	"time"
 
+	"github.com/kopia/kopia/internal/apiclient"
 	"github.com/kopia/kopia/internal/serverapi"
 )
 
@@ -15,7 +17,7 @@ func init() {
 	serverStatusCommand.Action(serverAction(runServerStatus))
 }
 
-func runServerStatus(ctx context.Context, cli *serverapi.Client) error {
+func runServerStatus(ctx context.Context, cli *apiclient.Client) error {
 	var status serverapi.SourcesResponse
 	if err := cli.Get("sources", &status); err != nil {
 		return err
@@ -23,7 +25,34 @@ func runServerStatus(ctx context.Context, cli *serverapi.Client) error {
 
 	for _, src := range status.Sources {
 		fmt.Printf("%15v %v\n", src.Status, src.Source)
+		if src.LastError != "" {
+			fmt.Printf("%15v %v\n", "", src.LastError)
+		}
+	}
+
+	var mst serverapi.MaintenanceStatusResponse
+	if err := cli.Get("maintenance", &mst); err != nil {
+		return err
+	}
+
+	switch {
+	case mst.Running != "":
+		fmt.Printf("%15v %v maintenance in progress\n", "MAINTENANCE", mst.Running)
+	case !mst.Schedule.NextQuickRun.IsZero() || !mst.Schedule.NextFullRun.IsZero():
+		fmt.Printf("%15v next quick %v, next full %v\n", "MAINTENANCE", formatMaintenanceTime(mst.Schedule.NextQuickRun), formatMaintenanceTime(mst.Schedule.NextFullRun))
+	}
+
+	if mst.LastError != "" {
+		fmt.Printf("%15v %v\n", "", mst.LastError)
 	}
 
 	return nil
 }
+
+func formatMaintenanceTime(t time.Time) string {
+	if t.IsZero() {
+		return "disabled"
+	}
+
+	return t.Local().Format(timeFormat)
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/kopia/kopia/internal/apiclient"
 	"github.com/kopia/kopia/internal/serverapi"
 )
 
@@ -15,11 +16,11 @@ func init() {
 	serverStartUploadCommand.Action(serverAction(runServerStartUpload))
 }
 
-func runServerStartUpload(ctx context.Context, cli *serverapi.Client) error {
+func runServerStartUpload(ctx context.Context, cli *apiclient.Client) error {
 	return triggerActionOnMatchingSources(ctx, cli, "sources/upload")
 }
 
-func triggerActionOnMatchingSources(ctx context.Context, cli *serverapi.Client, path string) error {
+func triggerActionOnMatchingSources(ctx context.Context, cli *apiclient.Client, path string) error {
 	var resp serverapi.MultipleSourceActionResponse
 
 	if err := cli.Post(path, &serverapi.Empty{}, &resp); err != nil {
@@ -32,6 +32,8 @@ var (
 	snapshotCreateForceHash               = snapshotCreateCommand.Flag("force-hash", "Force hashing of source files for a given percentage of files [0..100]").Default("0").Int()
 	snapshotCreateHashCacheMinAge         = snapshotCreateCommand.Flag("hash-cache-min-age", "Do not hash-cache files below certain age").Default("10m").Duration()
 	snapshotCreateParallelUploads         = snapshotCreateCommand.Flag("parallel", "Upload N files in parallel").PlaceHolder("N").Default("0").Int()
+	snapshotCreateTags                    = snapshotCreateCommand.Flag("tag", "Tag the snapshot with a key=value pair").PlaceHolder("KEY=VALUE").Strings()
+	snapshotCreatePins                    = snapshotCreateCommand.Flag("pin", "Pin the snapshot to prevent it from being expired").PlaceHolder("NAME").Strings()
 )
 
 func runBackupCommand(ctx context.Context, rep *repo.Repository) error {
@@ -61,6 +63,10 @@ func runBackupCommand(ctx context.Context, rep *repo.Repository) error {
 		return fmt.Errorf("description too long")
 	}
 
+	if _, err := parseSnapshotTags(*snapshotCreateTags); err != nil {
+		return err
+	}
+
 	var finalErrors []string
 
 	for _, snapshotDir := range sources {
@@ -85,10 +91,9 @@ func runBackupCommand(ctx context.Context, rep *repo.Repository) error {
 }
 
 func snapshotSingleSource(ctx context.Context, rep *repo.Repository, u *upload.Uploader, sourceInfo snapshot.SourceInfo) error {
-	t0 := time.Now()
-	rep.Blocks.ResetStats()
-
-	localEntry := mustGetLocalFSEntry(sourceInfo.Path)
+	if !rep.IsRemote() {
+		rep.Blocks.ResetStats()
+	}
 
 	previousManifest, err := findPreviousSnapshotManifest(ctx, rep, sourceInfo)
 	if err != nil {
@@ -100,17 +105,45 @@ func snapshotSingleSource(ctx context.Context, rep *repo.Repository, u *upload.U
 		return err
 	}
 
+	u.Actions, err = policy.ActionsRunner(ctx, rep, sourceInfo)
+	if err != nil {
+		return err
+	}
+
+	if err = u.Actions.RunBeforeSnapshotRoot(ctx); err != nil {
+		upload.ReportSnapshotResult(sourceInfo, nil, err)
+		return err
+	}
+
+	snapID, err := uploadAndSaveSnapshot(ctx, rep, u, sourceInfo, previousManifest)
+	if actionErr := u.Actions.RunAfterSnapshotRoot(ctx, snapID, err); actionErr != nil && err == nil {
+		return actionErr
+	}
+
+	return err
+}
+
+func uploadAndSaveSnapshot(ctx context.Context, rep *repo.Repository, u *upload.Uploader, sourceInfo snapshot.SourceInfo, previousManifest *snapshot.Manifest) (string, error) {
+	t0 := time.Now()
+	localEntry := mustGetLocalFSEntry(u.Actions.SnapshotPath)
+
 	log.Debugf("uploading %v using previous manifest %v", sourceInfo, previousManifest)
 	manifest, err := u.Upload(ctx, localEntry, sourceInfo, previousManifest)
 	if err != nil {
-		return err
+		upload.ReportSnapshotResult(sourceInfo, nil, err)
+		return "", err
 	}
 
 	manifest.Description = *snapshotCreateDescription
+	manifest.Pins = append([]string(nil), *snapshotCreatePins...)
+	if manifest.Tags, err = parseSnapshotTags(*snapshotCreateTags); err != nil {
+		return "", err
+	}
 
 	snapID, err := snapshot.SaveSnapshot(ctx, rep, manifest)
+	upload.ReportSnapshotResult(sourceInfo, manifest, err)
 	if err != nil {
-		return fmt.Errorf("cannot save manifest: %v", err)
+		return "", fmt.Errorf("cannot save manifest: %v", err)
 	}
 
 	log.Infof("uploaded snapshot %v (root %v) in %v", snapID, manifest.RootObjectID(), time.Since(t0))
@@ -119,7 +152,7 @@ func snapshotSingleSource(ctx context.Context, rep *repo.Repository, u *upload.U
 	b, _ := json.MarshalIndent(&manifest, "", "  ")
 	log.Debugf("%s", string(b))
 
-	return nil
+	return snapID, nil
 }
 
 func findPreviousSnapshotManifest(ctx context.Context, rep *repo.Repository, sourceInfo snapshot.SourceInfo) (*snapshot.Manifest, error) {
@@ -0,0 +1,70 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+
+	"github.com/kopia/kopia/fs"
+	"github.com/kopia/kopia/fs/localfs"
+	"github.com/kopia/kopia/internal/diff"
+	"github.com/kopia/kopia/repo"
+)
+
+var (
+	snapshotDiffCommand = snapshotCommands.Command("diff", "Show differences between two snapshots or between a snapshot and a local directory.")
+
+	snapshotDiffOld             = snapshotDiffCommand.Arg("old", "Snapshot manifest ID or object ID, optionally followed by a path (ID/path/to/entry).").Required().String()
+	snapshotDiffNew             = snapshotDiffCommand.Arg("new", "Snapshot manifest ID, object ID or path to an existing local directory.").Required().String()
+	snapshotDiffJSON            = snapshotDiffCommand.Flag("json", "Output changes as JSON, one object per line").Short('j').Bool()
+	snapshotDiffContent         = snapshotDiffCommand.Flag("content", "Show unified diffs of modified text files").Bool()
+	snapshotDiffMaxContentSize  = snapshotDiffCommand.Flag("max-content-size", "Maximum size of a file to show content diff for").PlaceHolder("BYTES").Default("100000").Int64()
+	snapshotDiffIgnoreOwnership = snapshotDiffCommand.Flag("ignore-ownership", "Do not report ownership changes").Bool()
+)
+
+func runSnapshotDiffCommand(ctx context.Context, rep *repo.Repository) error {
+	oldEntry, err := getEntryFromSnapshotOrObjectID(ctx, rep, *snapshotDiffOld)
+	if err != nil {
+		return err
+	}
+
+	newEntry, err := getSnapshotDiffTarget(ctx, rep, *snapshotDiffNew)
+	if err != nil {
+		return err
+	}
+
+	c := diff.NewComparer()
+	c.IgnoreOwnership = *snapshotDiffIgnoreOwnership
+	if *snapshotDiffContent {
+		c.MaxContentDiffSize = *snapshotDiffMaxContentSize
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	c.OnChange = func(ch *diff.Change) error {
+		if *snapshotDiffJSON {
+			return enc.Encode(ch)
+		}
+
+		printStdout("%v\n", ch)
+		if ch.ContentDiff != "" {
+			printStdout("%v", ch.ContentDiff)
+		}
+		return nil
+	}
+
+	return c.Compare(ctx, oldEntry, newEntry)
+}
+
+// getSnapshotDiffTarget returns local filesystem entry if the given path exists locally,
+// otherwise interprets it as snapshot or object ID.
+func getSnapshotDiffTarget(ctx context.Context, rep *repo.Repository, target string) (fs.Entry, error) {
+	if _, err := os.Stat(target); err == nil {
+		return localfs.NewEntry(target)
+	}
+
+	return getEntryFromSnapshotOrObjectID(ctx, rep, target)
+}
+
+func init() {
+	snapshotDiffCommand.Action(repositoryAction(runSnapshotDiffCommand))
+}
@@ -0,0 +1,105 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/kopia/kopia/repo"
+	"github.com/kopia/kopia/snapshot"
+)
+
+var (
+	snapshotEditCommand = snapshotCommands.Command("edit", "Edit tags and pins of snapshots.")
+
+	snapshotEditIDs        = snapshotEditCommand.Arg("id", "Manifest IDs of snapshots to edit (as shown by 'snapshot list --manifest-id')").Required().Strings()
+	snapshotEditAddTags    = snapshotEditCommand.Flag("add-tag", "Add or replace a tag").PlaceHolder("KEY=VALUE").Strings()
+	snapshotEditRemoveTags = snapshotEditCommand.Flag("remove-tag", "Remove a tag").PlaceHolder("KEY").Strings()
+	snapshotEditAddPins    = snapshotEditCommand.Flag("add-pin", "Add a pin preventing the snapshot from being expired").PlaceHolder("NAME").Strings()
+	snapshotEditRemovePins = snapshotEditCommand.Flag("remove-pin", "Remove a pin").PlaceHolder("NAME").Strings()
+)
+
+func runSnapshotEditCommand(ctx context.Context, rep *repo.Repository) error {
+	addTags, err := parseSnapshotTags(*snapshotEditAddTags)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range *snapshotEditIDs {
+		m, err := snapshot.LoadSnapshot(ctx, rep, id)
+		if err != nil {
+			return fmt.Errorf("unable to load snapshot %v: %v", id, err)
+		}
+
+		changeCount := 0
+
+		for k, v := range addTags {
+			if m.Tags == nil {
+				m.Tags = map[string]string{}
+			}
+
+			changeCount++
+			printStderr(" - setting tag %v to %q\n", k, v)
+			m.Tags[k] = v
+		}
+
+		for _, k := range *snapshotEditRemoveTags {
+			if _, ok := m.Tags[k]; ok {
+				changeCount++
+				printStderr(" - removing tag %v\n", k)
+				delete(m.Tags, k)
+			}
+		}
+
+		m.Pins = addRemoveDedupeAndSort("pins", m.Pins, *snapshotEditAddPins, *snapshotEditRemovePins, &changeCount)
+
+		if changeCount == 0 {
+			printStderr("No changes to snapshot %v\n", id)
+			continue
+		}
+
+		if err := snapshot.UpdateSnapshot(ctx, rep, m); err != nil {
+			return fmt.Errorf("unable to update snapshot %v: %v", id, err)
+		}
+
+		printStderr("Updated snapshot %v, new ID %v\n", id, m.ID)
+	}
+
+	return nil
+}
+
+// parseSnapshotTags parses tags specified as KEY=VALUE.
+func parseSnapshotTags(tags []string) (map[string]string, error) {
+	if len(tags) == 0 {
+		return nil, nil
+	}
+
+	result := map[string]string{}
+
+	for _, t := range tags {
+		p := strings.Index(t, "=")
+		if p <= 0 {
+			return nil, fmt.Errorf("invalid tag %q, expected KEY=VALUE", t)
+		}
+
+		result[t[0:p]] = t[p+1:]
+	}
+
+	return result, nil
+}
+
+func formatSnapshotTags(tags map[string]string) string {
+	var result []string
+	for k, v := range tags {
+		result = append(result, k+"="+v)
+	}
+
+	sort.Strings(result)
+
+	return strings.Join(result, ",")
+}
+
+func init() {
+	snapshotEditCommand.Action(repositoryAction(runSnapshotEditCommand))
+}
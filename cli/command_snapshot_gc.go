@@ -0,0 +1,44 @@
+package cli
+
+import (
+	"context"
+
+	"github.com/kopia/kopia/internal/units"
+	"github.com/kopia/kopia/repo"
+	"github.com/kopia/kopia/snapshot/gc"
+)
+
+var (
+	snapshotGCCommand         = snapshotCommands.Command("gc", "Remove blocks not referenced by any snapshot and repack partially-used packs.")
+	snapshotGCDelete          = snapshotGCCommand.Flag("delete", "Whether to actually delete unreferenced blocks").String()
+	snapshotGCMinContentAge   = snapshotGCCommand.Flag("min-age", "Do not delete or repack blocks younger than this").Default("24h").Duration()
+	snapshotGCRepackThreshold = snapshotGCCommand.Flag("repack-threshold", "Repack pack files whose ratio of live data is below the threshold (0 disables)").Default("0.5").Float64()
+)
+
+func runSnapshotGCCommand(ctx context.Context, rep *repo.Repository) error {
+	st, err := gc.Run(ctx, rep, gc.Options{
+		Delete:          *snapshotGCDelete == "yes",
+		MinContentAge:   *snapshotGCMinContentAge,
+		RepackThreshold: *snapshotGCRepackThreshold,
+	})
+	if err != nil {
+		return err
+	}
+
+	printStderr("In use:       %v blocks (%v)\n", st.InUseBlockCount, units.BytesStringBase10(st.InUseBytes))
+	printStderr("Too recent:   %v blocks (%v)\n", st.TooRecentBlockCount, units.BytesStringBase10(st.TooRecentBytes))
+	printStderr("Unreferenced: %v blocks (%v)\n", st.UnreferencedBlockCount, units.BytesStringBase10(st.UnreferencedBytes))
+	printStderr("Repacked:     %v packs, rewritten %v blocks (%v)\n", st.RepackedPackCount, st.RewrittenBlockCount, units.BytesStringBase10(st.RewrittenBytes))
+
+	if *snapshotGCDelete != "yes" {
+		printStderr("Nothing was deleted, pass '--delete=yes' to actually delete.\n")
+		return nil
+	}
+
+	printStderr("Deleted:      %v packs (%v)\n", st.DeletedPackCount, units.BytesStringBase10(st.DeletedPackBytes))
+	return nil
+}
+
+func init() {
+	snapshotGCCommand.Action(directRepositoryAction(runSnapshotGCCommand))
+}
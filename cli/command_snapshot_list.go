@@ -27,6 +27,8 @@ var (
 	snapshotListShowModTime          = snapshotListCommand.Flag("mtime", "Include file mod time").Bool()
 	shapshotListShowOwner            = snapshotListCommand.Flag("owner", "Include owner").Bool()
 	maxResultsPerPath                = snapshotListCommand.Flag("max-results", "Maximum number of results.").Default("1000").Int()
+	snapshotListShowTags             = snapshotListCommand.Flag("tags", "Include tags and pins").Default("true").Bool()
+	snapshotListFilterTags           = snapshotListCommand.Flag("tagged", "Only include snapshots with tags matching the selector (key=value or key)").PlaceHolder("SELECTOR").Strings()
 )
 
 func findSnapshotsForSource(ctx context.Context, rep *repo.Repository, sourceInfo snapshot.SourceInfo) (manifestIDs []string, relPath string, err error) {
@@ -123,6 +125,10 @@ func outputManifestFromSingleSource(ctx context.Context, rep *repo.Repository, m
 	}
 
 	for _, m := range manifests {
+		if !matchesAllTags(m, *snapshotListFilterTags) {
+			continue
+		}
+
 		root, err := repofs.SnapshotRoot(rep, m)
 		if err != nil {
 			fmt.Printf("  %v <ERROR> %v\n", m.StartTime.Format("2006-01-02 15:04:05 MST"), err)
@@ -180,6 +186,15 @@ func outputManifestFromSingleSource(ctx context.Context, rep *repo.Repository, m
 			}
 		}
 
+		if *snapshotListShowTags {
+			if len(m.Tags) > 0 {
+				bits = append(bits, "tags:"+formatSnapshotTags(m.Tags))
+			}
+			if len(m.Pins) > 0 {
+				bits = append(bits, "pins:"+strings.Join(m.Pins, ","))
+			}
+		}
+
 		if *snapshotListShowRetentionReasons {
 			if len(m.RetentionReasons) > 0 {
 				bits = append(bits, "retention:"+strings.Join(m.RetentionReasons, ","))
@@ -202,6 +217,16 @@ func outputManifestFromSingleSource(ctx context.Context, rep *repo.Repository, m
 	return nil
 }
 
+func matchesAllTags(m *snapshot.Manifest, selectors []string) bool {
+	for _, sel := range selectors {
+		if !m.MatchesTag(sel) {
+			return false
+		}
+	}
+
+	return true
+}
+
 func deltaBytes(b int64) string {
 	if b > 0 {
 		return "(+" + units.BytesStringBase10(b) + ")"
@@ -0,0 +1,71 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/kopia/kopia/internal/restore"
+	"github.com/kopia/kopia/internal/units"
+	"github.com/kopia/kopia/repo"
+)
+
+var (
+	snapshotRestoreCommand = snapshotCommands.Command("restore", "Restore a directory or file from a snapshot to local filesystem.")
+
+	snapshotRestoreSource          = snapshotRestoreCommand.Arg("source", "Snapshot manifest ID or object ID, optionally followed by a path (ID/path/to/entry).").Required().String()
+	snapshotRestoreTarget          = snapshotRestoreCommand.Arg("target", "Local directory (or file name) to restore to.").Required().String()
+	snapshotRestoreParallel        = snapshotRestoreCommand.Flag("parallel", "Restore N files in parallel").PlaceHolder("N").Default("8").Int()
+	snapshotRestoreOverwrite       = snapshotRestoreCommand.Flag("overwrite", "Overwrite existing files").Bool()
+	snapshotRestoreSkipExisting    = snapshotRestoreCommand.Flag("skip-existing", "Skip files that already exist").Bool()
+	snapshotRestoreInclude         = snapshotRestoreCommand.Flag("include", "Restore only entries matching the pattern (gitignore syntax)").Strings()
+	snapshotRestoreExclude         = snapshotRestoreCommand.Flag("exclude", "Do not restore entries matching the pattern (gitignore syntax)").Strings()
+	snapshotRestoreIgnoreOwnership = snapshotRestoreCommand.Flag("ignore-ownership", "Do not restore file ownership").Bool()
+	snapshotRestoreStrictMetadata  = snapshotRestoreCommand.Flag("strict-metadata", "Fail when permissions, modification times or ownership can't be restored").Bool()
+)
+
+func runSnapshotRestoreCommand(ctx context.Context, rep *repo.Repository) error {
+	if *snapshotRestoreOverwrite && *snapshotRestoreSkipExisting {
+		return fmt.Errorf("--overwrite and --skip-existing are mutually exclusive")
+	}
+
+	source, err := getEntryFromSnapshotOrObjectID(ctx, rep, *snapshotRestoreSource)
+	if err != nil {
+		return err
+	}
+
+	r := restore.NewRestorer()
+	r.Parallel = *snapshotRestoreParallel
+	r.Overwrite = *snapshotRestoreOverwrite
+	r.SkipExisting = *snapshotRestoreSkipExisting
+	r.IncludeRules = *snapshotRestoreInclude
+	r.ExcludeRules = *snapshotRestoreExclude
+	r.IgnoreOwnership = *snapshotRestoreIgnoreOwnership
+	r.IgnoreMetadataErrors = !*snapshotRestoreStrictMetadata
+	r.ProgressCallback = func(enqueued, active, completed int64) {
+		log.Infof("restored %v of %v entries (%v in progress)", completed, enqueued, active)
+	}
+	onCtrlC(r.Cancel)
+
+	log.Infof("restoring %v to %v", *snapshotRestoreSource, *snapshotRestoreTarget)
+	st, err := r.Restore(ctx, source, *snapshotRestoreTarget)
+	if err != nil {
+		return err
+	}
+
+	printStderr("Restored %v files (%v), %v directories and %v symlinks, skipped %v existing entries.\n",
+		st.RestoredFileCount,
+		units.BytesStringBase10(st.RestoredTotalFileSize),
+		st.RestoredDirCount,
+		st.RestoredSymlinkCount,
+		st.SkippedCount)
+
+	if st.IgnoredErrorCount > 0 {
+		printStderr("Ignored %v errors when restoring metadata.\n", st.IgnoredErrorCount)
+	}
+
+	return nil
+}
+
+func init() {
+	snapshotRestoreCommand.Action(repositoryAction(runSnapshotRestoreCommand))
+}
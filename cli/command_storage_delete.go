@@ -24,5 +24,5 @@ func runDeleteStorageBlocks(ctx context.Context, rep *repo.Repository) error {
 }
 
 func init() {
-	storageDeleteCommand.Action(repositoryAction(runDeleteStorageBlocks))
+	storageDeleteCommand.Action(directRepositoryAction(runDeleteStorageBlocks))
 }
@@ -31,5 +31,5 @@ func runListStorageBlocks(ctx context.Context, rep *repo.Repository) error {
 }
 
 func init() {
-	storageListCommand.Action(repositoryAction(runListStorageBlocks))
+	storageListCommand.Action(directRepositoryAction(runListStorageBlocks))
 }
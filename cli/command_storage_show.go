@@ -30,5 +30,5 @@ func runShowStorageBlocks(ctx context.Context, rep *repo.Repository) error {
 }
 
 func init() {
-	storageShowCommand.Action(repositoryAction(runShowStorageBlocks))
+	storageShowCommand.Action(directRepositoryAction(runShowStorageBlocks))
 }
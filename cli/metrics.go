@@ -0,0 +1,32 @@
+package cli
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+var metricsListenAddr = app.Flag("metrics-listen-addr", "Expose Prometheus metrics on a given host:port while the command runs").Envar("KOPIA_METRICS_LISTEN_ADDR").String()
+
+func startMetricsServer(_ *kingpin.ParseContext) error {
+	if *metricsListenAddr == "" {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	log.Infof("serving metrics on http://%v/metrics", *metricsListenAddr)
+	go func() {
+		if err := http.ListenAndServe(*metricsListenAddr, mux); err != nil {
+			log.Warningf("unable to serve metrics: %v", err)
+		}
+	}()
+
+	return nil
+}
+
+func init() {
+	app.PreAction(startMetricsServer)
+}
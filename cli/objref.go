@@ -9,6 +9,7 @@ import (
 	"github.com/kopia/kopia/fs/repofs"
 	"github.com/kopia/kopia/repo"
 	"github.com/kopia/kopia/repo/object"
+	"github.com/kopia/kopia/snapshot"
 )
 
 // ParseObjectID interprets the given ID string and returns corresponding object.ID.
@@ -27,6 +28,37 @@ func parseObjectID(ctx context.Context, rep *repo.Repository, id string) (object
 	return parseNestedObjectID(ctx, dir, parts[1:])
 }
 
+// getEntryFromSnapshotOrObjectID returns fs.Entry for a given snapshot manifest ID or object ID, optionally followed by
+// a slash-separated path within it.
+func getEntryFromSnapshotOrObjectID(ctx context.Context, rep *repo.Repository, id string) (fs.Entry, error) {
+	parts := strings.Split(id, "/")
+
+	var root fs.Entry
+	if md, err := rep.Manifests.GetMetadata(ctx, parts[0]); err == nil && md.Labels["type"] == "snapshot" {
+		man, err := snapshot.LoadSnapshot(ctx, rep, parts[0])
+		if err != nil {
+			return nil, err
+		}
+
+		root, err = repofs.SnapshotRoot(rep, man)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		oid, err := object.ParseID(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("can't parse snapshot or object ID %v: %v", id, err)
+		}
+
+		root, err = repofs.ObjectEntry(ctx, rep, oid)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open object %v: %v", oid, err)
+		}
+	}
+
+	return getNestedEntry(ctx, root, parts[1:])
+}
+
 func getNestedEntry(ctx context.Context, startingDir fs.Entry, parts []string) (fs.Entry, error) {
 	current := startingDir
 	for _, part := range parts {
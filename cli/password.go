@@ -16,6 +16,7 @@ import (
 
 var (
 	password = app.Flag("password", "Repository password.").Envar("KOPIA_PASSWORD").Short('p').String()
+	keyFile  = app.Flag("key-file", "File containing repository key, used instead of password.").Envar("KOPIA_KEY_FILE").String()
 )
 
 func mustAskForNewRepositoryPassword() string {
@@ -32,6 +33,20 @@ func mustAskForNewRepositoryPassword() string {
 	}
 }
 
+func mustAskForChangedRepositoryPassword() string {
+	for {
+		p1, err := askPass("Enter new password: ")
+		failOnError(err)
+		p2, err := askPass("Re-enter new password for verification: ")
+		failOnError(err)
+		if p1 != p2 {
+			fmt.Println("Passwords don't match!")
+		} else {
+			return p1
+		}
+	}
+}
+
 func mustAskForExistingRepositoryPassword() string {
 	p1, err := askPass("Enter password to open repository: ")
 	failOnError(err)
@@ -48,6 +63,10 @@ func mustGetPasswordFromFlags(isNew bool, allowPersistent bool) string {
 	}
 
 	switch {
+	case *keyFile != "":
+		b, err := ioutil.ReadFile(*keyFile)
+		failOnError(err)
+		return strings.TrimSpace(string(b))
 	case *password != "":
 		return strings.TrimSpace(*password)
 	case isNew:
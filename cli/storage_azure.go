@@ -0,0 +1,31 @@
+package cli
+
+import (
+	"context"
+
+	"github.com/kopia/kopia/repo/storage"
+	"github.com/kopia/kopia/repo/storage/azure"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+func init() {
+	var options azure.Options
+
+	RegisterStorageConnectFlags(
+		"azure",
+		"an Azure Blob Storage container",
+		func(cmd *kingpin.CmdClause) {
+			cmd.Flag("container", "Name of the Azure blob container").Required().StringVar(&options.Container)
+			cmd.Flag("storage-account", "Azure storage account name (overrides AZURE_STORAGE_ACCOUNT environment variable)").Required().Envar("AZURE_STORAGE_ACCOUNT").StringVar(&options.StorageAccount)
+			cmd.Flag("storage-key", "Azure storage account key (overrides AZURE_STORAGE_KEY environment variable)").Envar("AZURE_STORAGE_KEY").StringVar(&options.StorageKey)
+			cmd.Flag("sas-token", "Azure shared access signature token, used instead of storage key (overrides AZURE_STORAGE_SAS_TOKEN environment variable)").Envar("AZURE_STORAGE_SAS_TOKEN").StringVar(&options.SASToken)
+			cmd.Flag("endpoint", "Blob service endpoint URL (defaults to https://<account>.blob.core.windows.net)").StringVar(&options.Endpoint)
+			cmd.Flag("prefix", "Prefix to use for objects in the container").StringVar(&options.Prefix)
+			cmd.Flag("max-download-speed", "Limit the download speed.").PlaceHolder("BYTES_PER_SEC").IntVar(&options.MaxDownloadSpeedBytesPerSecond)
+			cmd.Flag("max-upload-speed", "Limit the upload speed.").PlaceHolder("BYTES_PER_SEC").IntVar(&options.MaxUploadSpeedBytesPerSecond)
+		},
+		func(ctx context.Context) (storage.Storage, error) {
+			return azure.New(ctx, &options)
+		},
+	)
+}
@@ -0,0 +1,49 @@
+package cli
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/kopia/kopia/repo/storage"
+	"github.com/kopia/kopia/repo/storage/sftp"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+func init() {
+	var (
+		options     sftp.Options
+		connectFlat bool
+	)
+
+	RegisterStorageConnectFlags(
+		"sftp",
+		"an SFTP server",
+		func(cmd *kingpin.CmdClause) {
+			cmd.Flag("path", "Path to the repository on the SFTP server").Required().StringVar(&options.Path)
+			cmd.Flag("host", "SFTP host name").Required().StringVar(&options.Host)
+			cmd.Flag("port", "SFTP port").Default("22").IntVar(&options.Port)
+			cmd.Flag("username", "SFTP user name").Required().StringVar(&options.Username)
+			cmd.Flag("keyfile", "Path to private key file used for authentication").Default(defaultSSHFile("id_rsa")).StringVar(&options.Keyfile)
+			cmd.Flag("known-hosts", "Path to known_hosts file used to verify the identity of the host").Default(defaultSSHFile("known_hosts")).StringVar(&options.KnownHostsFile)
+			cmd.Flag("flat", "Use flat directory structure").BoolVar(&connectFlat)
+		},
+		func(ctx context.Context) (storage.Storage, error) {
+			sftpo := options
+			if connectFlat {
+				sftpo.DirectoryShards = []int{}
+			}
+
+			return sftp.New(ctx, &sftpo)
+		},
+	)
+}
+
+func defaultSSHFile(name string) string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(home, ".ssh", name)
+}
@@ -0,0 +1,53 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/kopia/kopia/repo/storage"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var (
+	createFromURLCommand  = createCommand.Command("from-url", "Create repository in storage specified by URL").Default()
+	createURL             = createFromURLCommand.Flag("url", "Storage URL, such as s3://bucket/prefix?endpoint=...").String()
+	connectFromURLCommand = connectCommand.Command("from-url", "Connect to repository in storage specified by URL").Default()
+	connectURL            = connectFromURLCommand.Flag("url", "Storage URL, such as s3://bucket/prefix?endpoint=...").String()
+)
+
+func storageFromURL(ctx context.Context, u string) (storage.Storage, error) {
+	if u == "" {
+		return nil, errors.New("either storage type or --url must be specified")
+	}
+
+	st, err := storage.NewStorageFromURL(ctx, u)
+	if err != nil {
+		return nil, fmt.Errorf("can't connect to storage: %v", err)
+	}
+
+	return st, nil
+}
+
+func init() {
+	// default subcommands allow 'create --url' and 'connect --url' to be used without specifying the storage type.
+	createFromURLCommand.Action(func(_ *kingpin.ParseContext) error {
+		ctx := context.Background()
+		st, err := storageFromURL(ctx, *createURL)
+		if err != nil {
+			return err
+		}
+
+		return runCreateCommandWithStorage(ctx, st)
+	})
+
+	connectFromURLCommand.Action(func(_ *kingpin.ParseContext) error {
+		ctx := context.Background()
+		st, err := storageFromURL(ctx, *connectURL)
+		if err != nil {
+			return err
+		}
+
+		return runConnectCommandWithStorage(ctx, st)
+	})
+}
@@ -144,6 +144,30 @@ func DirectoryEntry(rep *repo.Repository, objectID object.ID, dirSummary *fs.Dir
 	return d.(fs.Directory)
 }
 
+// ObjectEntry returns fs.Entry based on repository object with the specified ID, which is a directory
+// if the object contains directory entries and a file otherwise.
+func ObjectEntry(ctx context.Context, rep *repo.Repository, objectID object.ID) (fs.Entry, error) {
+	r, err := rep.Objects.Open(ctx, objectID)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close() //nolint:errcheck
+
+	if dir.IsDirectoryStream(r) {
+		return DirectoryEntry(rep, objectID, nil), nil
+	}
+
+	return newRepoEntry(rep, &dir.Entry{
+		EntryMetadata: fs.EntryMetadata{
+			Name:        objectID.String(),
+			Permissions: 0644,
+			Type:        fs.EntryTypeFile,
+			FileSize:    r.Length(),
+		},
+		ObjectID: objectID,
+	}), nil
+}
+
 // SnapshotRoot returns fs.Entry representing the root of a snapshot.
 func SnapshotRoot(rep *repo.Repository, man *snapshot.Manifest) (fs.Entry, error) {
 	oid := man.RootObjectID()
@@ -0,0 +1,333 @@
+// Package actions implements running user-defined commands before and after snapshotting sources and directories.
+package actions
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kopia/kopia/internal/kopialogging"
+	"github.com/kopia/kopia/snapshot"
+)
+
+var log = kopialogging.Logger("kopia/actions")
+
+// Mode determines what happens when an action fails.
+type Mode string
+
+// Supported action modes.
+const (
+	// ModeEssential aborts the snapshot when the action fails.
+	ModeEssential Mode = "essential"
+
+	// ModeOptional logs the failure and continues the snapshot.
+	ModeOptional Mode = "optional"
+)
+
+// DefaultTimeout is the default maximum time an action is allowed to run.
+const DefaultTimeout = 5 * time.Minute
+
+// Kinds of actions, passed to commands in KOPIA_ACTION environment variable.
+const (
+	BeforeSnapshotRoot = "before-snapshot-root"
+	AfterSnapshotRoot  = "after-snapshot-root"
+	BeforeFolder       = "before-folder"
+	AfterFolder        = "after-folder"
+)
+
+// snapshotPathVariable can be printed by before-snapshot-root action as KOPIA_SNAPSHOT_PATH=<path>
+// to snapshot a different directory instead of the source path.
+const snapshotPathVariable = "KOPIA_SNAPSHOT_PATH"
+
+// Action describes a command to run.
+type Action struct {
+	Command        []string `json:"command"`
+	TimeoutSeconds int      `json:"timeout,omitempty"`
+	Mode           Mode     `json:"mode,omitempty"`
+}
+
+// Timeout returns the maximum time the action is allowed to run.
+func (a *Action) Timeout() time.Duration {
+	if a.TimeoutSeconds == 0 {
+		return DefaultTimeout
+	}
+
+	return time.Duration(a.TimeoutSeconds) * time.Second
+}
+
+// IsOptional returns true when the failure of the action should not abort the snapshot.
+func (a *Action) IsOptional() bool {
+	return a.Mode == ModeOptional
+}
+
+// Validate checks that the action is well-formed.
+func (a *Action) Validate() error {
+	if len(a.Command) == 0 {
+		return fmt.Errorf("action requires command")
+	}
+
+	if a.TimeoutSeconds < 0 {
+		return fmt.Errorf("invalid timeout: %v", a.TimeoutSeconds)
+	}
+
+	switch a.Mode {
+	case "", ModeEssential, ModeOptional:
+		return nil
+	default:
+		return fmt.Errorf("unsupported action mode: %q", a.Mode)
+	}
+}
+
+func (a *Action) String() string {
+	mode := a.Mode
+	if mode == "" {
+		mode = ModeEssential
+	}
+
+	return fmt.Sprintf("%v (%v, timeout %v)", strings.Join(a.Command, " "), mode, a.Timeout())
+}
+
+// Policy describes actions to run when snapshotting a source.
+type Policy struct {
+	BeforeSnapshotRoot *Action `json:"beforeSnapshotRoot,omitempty"`
+	AfterSnapshotRoot  *Action `json:"afterSnapshotRoot,omitempty"`
+
+	// Folder actions only apply to the directory whose policy defines them and are never inherited.
+	BeforeFolder *Action `json:"beforeFolder,omitempty"`
+	AfterFolder  *Action `json:"afterFolder,omitempty"`
+}
+
+// Merge applies default values from the provided policy, only snapshot root actions are inherited.
+func (p *Policy) Merge(src Policy) {
+	if p.BeforeSnapshotRoot == nil {
+		p.BeforeSnapshotRoot = src.BeforeSnapshotRoot
+	}
+
+	if p.AfterSnapshotRoot == nil {
+		p.AfterSnapshotRoot = src.AfterSnapshotRoot
+	}
+}
+
+// Validate checks that all actions are well-formed.
+func (p *Policy) Validate() error {
+	for _, a := range []*Action{p.BeforeSnapshotRoot, p.AfterSnapshotRoot, p.BeforeFolder, p.AfterFolder} {
+		if a == nil {
+			continue
+		}
+
+		if err := a.Validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Runner runs actions for a single snapshot of a source.
+// All methods are safe to call on a nil Runner, in which case they do nothing.
+type Runner struct {
+	Source snapshot.SourceInfo
+
+	// Root actions of the source, from its effective policy.
+	Root Policy
+
+	// Folders maps relative paths of directories ("." for the root, "./sub/dir" for subdirectories)
+	// to actions defined in their policies.
+	Folders map[string]*Policy
+
+	// SnapshotPath is the local directory being snapshotted, which is the source path unless
+	// redirected by the before-snapshot-root action.
+	SnapshotPath string
+}
+
+// NewRunner returns a Runner for the specified source.
+func NewRunner(src snapshot.SourceInfo, root Policy, folders map[string]*Policy) *Runner {
+	return &Runner{
+		Source:       src,
+		Root:         root,
+		Folders:      folders,
+		SnapshotPath: src.Path,
+	}
+}
+
+// RunBeforeSnapshotRoot runs the before-snapshot-root action, which may redirect SnapshotPath.
+func (r *Runner) RunBeforeSnapshotRoot(ctx context.Context) error {
+	if r == nil || r.Root.BeforeSnapshotRoot == nil {
+		return nil
+	}
+
+	vars, err := r.run(ctx, BeforeSnapshotRoot, r.Root.BeforeSnapshotRoot, r.SnapshotPath, nil)
+	if err != nil {
+		return err
+	}
+
+	if p := vars[snapshotPathVariable]; p != "" {
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(r.Source.Path, p)
+		}
+
+		log.Infof("snapshot of %v redirected to %v", r.Source, p)
+		r.SnapshotPath = filepath.Clean(p)
+	}
+
+	return nil
+}
+
+// RunAfterSnapshotRoot runs the after-snapshot-root action, passing the ID of the created snapshot
+// or the error that prevented it from being created.
+func (r *Runner) RunAfterSnapshotRoot(ctx context.Context, snapshotID string, snapshotErr error) error {
+	if r == nil || r.Root.AfterSnapshotRoot == nil {
+		return nil
+	}
+
+	env := []string{"KOPIA_SNAPSHOT_ID=" + snapshotID}
+	if snapshotErr != nil {
+		env = append(env, "KOPIA_SNAPSHOT_ERROR="+snapshotErr.Error())
+	}
+
+	_, err := r.run(ctx, AfterSnapshotRoot, r.Root.AfterSnapshotRoot, r.SnapshotPath, env)
+	return err
+}
+
+// RunBeforeFolder runs the before-folder action defined for the directory with a given relative path.
+func (r *Runner) RunBeforeFolder(ctx context.Context, relativePath string) error {
+	if r == nil || r.Folders[relativePath] == nil || r.Folders[relativePath].BeforeFolder == nil {
+		return nil
+	}
+
+	_, err := r.run(ctx, BeforeFolder, r.Folders[relativePath].BeforeFolder, filepath.Join(r.SnapshotPath, relativePath), nil)
+	return err
+}
+
+// RunAfterFolder runs the after-folder action defined for the directory with a given relative path.
+func (r *Runner) RunAfterFolder(ctx context.Context, relativePath string) error {
+	if r == nil || r.Folders[relativePath] == nil || r.Folders[relativePath].AfterFolder == nil {
+		return nil
+	}
+
+	_, err := r.run(ctx, AfterFolder, r.Folders[relativePath].AfterFolder, filepath.Join(r.SnapshotPath, relativePath), nil)
+	return err
+}
+
+// run executes the action and returns variables it printed to standard output as KEY=VALUE lines.
+// Failures of optional actions are logged and not returned.
+func (r *Runner) run(ctx context.Context, kind string, a *Action, dir string, extraEnv []string) (map[string]string, error) {
+	vars, err := r.execute(ctx, kind, a, dir, extraEnv)
+	if err == nil {
+		return vars, nil
+	}
+
+	if a.IsOptional() {
+		log.Warningf("optional %v action for %v failed: %v", kind, r.Source, err)
+		return nil, nil
+	}
+
+	return nil, fmt.Errorf("%v action failed: %v", kind, err)
+}
+
+func (r *Runner) execute(ctx context.Context, kind string, a *Action, dir string, extraEnv []string) (map[string]string, error) {
+	if len(a.Command) == 0 {
+		return nil, fmt.Errorf("missing command")
+	}
+
+	// Capture output in temporary files rather than pipes, so that processes spawned by the
+	// command that outlive it can't delay its completion past the timeout.
+	stdout, err := tempOutputFile()
+	if err != nil {
+		return nil, err
+	}
+	defer removeTempOutputFile(stdout)
+
+	stderr, err := tempOutputFile()
+	if err != nil {
+		return nil, err
+	}
+	defer removeTempOutputFile(stderr)
+
+	ctx, cancel := context.WithTimeout(ctx, a.Timeout())
+	defer cancel()
+
+	log.Debugf("running %v action for %v: %v", kind, r.Source, a.Command)
+
+	cmd := exec.CommandContext(ctx, a.Command[0], a.Command[1:]...) //nolint:gosec
+	cmd.Dir = workingDirectory(kind, r.Source.Path, dir)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.Env = append(os.Environ(),
+		"KOPIA_ACTION="+kind,
+		"KOPIA_SOURCE="+r.Source.String(),
+		"KOPIA_SOURCE_PATH="+r.Source.Path,
+		snapshotPathVariable+"="+dir,
+	)
+	cmd.Env = append(cmd.Env, extraEnv...)
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("timed out after %v", a.Timeout())
+		}
+
+		if out := bytes.TrimSpace(readTempOutputFile(stderr)); len(out) > 0 {
+			return nil, fmt.Errorf("%v: %s", err, out)
+		}
+
+		return nil, err
+	}
+
+	return parseVariables(readTempOutputFile(stdout)), nil
+}
+
+// workingDirectory returns the directory in which the action runs, which is the directory
+// being snapshotted for folder actions and the source directory for snapshot root actions,
+// since the directory being snapshotted may be created or removed by them.
+func workingDirectory(kind, sourcePath, dir string) string {
+	switch kind {
+	case BeforeFolder, AfterFolder:
+		return dir
+	default:
+		return sourcePath
+	}
+}
+
+func tempOutputFile() (*os.File, error) {
+	f, err := ioutil.TempFile("", "kopia-action")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create temporary file: %v", err)
+	}
+
+	return f, nil
+}
+
+func readTempOutputFile(f *os.File) []byte {
+	b, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		log.Warningf("unable to read action output: %v", err)
+	}
+
+	return b
+}
+
+func removeTempOutputFile(f *os.File) {
+	f.Close()           //nolint:errcheck
+	os.Remove(f.Name()) //nolint:errcheck
+}
+
+func parseVariables(b []byte) map[string]string {
+	vars := map[string]string{}
+
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if p := strings.Index(line, "="); p > 0 {
+			vars[line[0:p]] = line[p+1:]
+		}
+	}
+
+	return vars
+}
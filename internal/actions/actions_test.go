@@ -0,0 +1,191 @@
+package actions
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/kopia/kopia/snapshot"
+)
+
+func shellAction(script string, args ...string) *Action {
+	return &Action{Command: append([]string{"sh", "-c", script}, args...)}
+}
+
+func setupTest(t *testing.T) (string, func()) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test requires POSIX shell")
+	}
+
+	dir, err := ioutil.TempDir("", "actions")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+
+	return dir, func() { os.RemoveAll(dir) } //nolint:errcheck
+}
+
+func readFile(t *testing.T, fname string) string {
+	b, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatalf("unable to read %v: %v", fname, err)
+	}
+
+	return string(b)
+}
+
+func TestRootActions(t *testing.T) {
+	dir, cleanup := setupTest(t)
+	defer cleanup()
+
+	out := filepath.Join(dir, "out")
+	src := snapshot.SourceInfo{Host: "host1", UserName: "user1", Path: dir}
+
+	r := NewRunner(src, Policy{
+		BeforeSnapshotRoot: shellAction(`echo "$KOPIA_ACTION $KOPIA_SOURCE_PATH" > "$0"; echo KOPIA_SNAPSHOT_PATH=sub`, out),
+		AfterSnapshotRoot:  shellAction(`echo "$KOPIA_ACTION $KOPIA_SNAPSHOT_PATH $KOPIA_SNAPSHOT_ID $KOPIA_SNAPSHOT_ERROR" >> "$0"`, out),
+	}, nil)
+
+	if err := r.RunBeforeSnapshotRoot(context.Background()); err != nil {
+		t.Fatalf("before action failed: %v", err)
+	}
+
+	if got, want := r.SnapshotPath, filepath.Join(dir, "sub"); got != want {
+		t.Errorf("snapshot path not redirected: %v, want %v", got, want)
+	}
+
+	if err := r.RunAfterSnapshotRoot(context.Background(), "snap1", nil); err != nil {
+		t.Fatalf("after action failed: %v", err)
+	}
+
+	if err := r.RunAfterSnapshotRoot(context.Background(), "", errors.New("boom")); err != nil {
+		t.Fatalf("after action failed: %v", err)
+	}
+
+	want := "before-snapshot-root " + dir + "\n" +
+		"after-snapshot-root " + dir + "/sub snap1 \n" +
+		"after-snapshot-root " + dir + "/sub  boom\n"
+	if got := readFile(t, out); got != want {
+		t.Errorf("unexpected action output: %q, want %q", got, want)
+	}
+}
+
+func TestActionFailures(t *testing.T) {
+	dir, cleanup := setupTest(t)
+	defer cleanup()
+
+	src := snapshot.SourceInfo{Path: dir}
+
+	essential := NewRunner(src, Policy{BeforeSnapshotRoot: shellAction("echo failing >&2; exit 1")}, nil)
+	err := essential.RunBeforeSnapshotRoot(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "failing") {
+		t.Errorf("unexpected error from essential action: %v", err)
+	}
+
+	optional := shellAction("echo KOPIA_SNAPSHOT_PATH=/elsewhere; exit 1")
+	optional.Mode = ModeOptional
+	r := NewRunner(src, Policy{BeforeSnapshotRoot: optional}, nil)
+	if err := r.RunBeforeSnapshotRoot(context.Background()); err != nil {
+		t.Errorf("unexpected error from optional action: %v", err)
+	}
+
+	if r.SnapshotPath != dir {
+		t.Errorf("failed action must not redirect snapshot path: %v", r.SnapshotPath)
+	}
+
+	slow := shellAction("sleep 10")
+	slow.TimeoutSeconds = 1
+	r = NewRunner(src, Policy{AfterSnapshotRoot: slow}, nil)
+	if err := r.RunAfterSnapshotRoot(context.Background(), "", nil); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("unexpected error from slow action: %v", err)
+	}
+}
+
+func TestFolderActions(t *testing.T) {
+	dir, cleanup := setupTest(t)
+	defer cleanup()
+
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0700); err != nil {
+		t.Fatalf("unable to create directory: %v", err)
+	}
+
+	out := filepath.Join(dir, "out")
+	r := NewRunner(snapshot.SourceInfo{Path: dir}, Policy{}, map[string]*Policy{
+		"./sub": {
+			BeforeFolder: shellAction(`echo "$KOPIA_ACTION $PWD" >> "$0"`, out),
+			AfterFolder:  shellAction(`echo "$KOPIA_ACTION $KOPIA_SNAPSHOT_PATH" >> "$0"`, out),
+		},
+	})
+
+	for _, rel := range []string{".", "./sub"} {
+		if err := r.RunBeforeFolder(context.Background(), rel); err != nil {
+			t.Fatalf("before action failed: %v", err)
+		}
+
+		if err := r.RunAfterFolder(context.Background(), rel); err != nil {
+			t.Fatalf("after action failed: %v", err)
+		}
+	}
+
+	sub, err := filepath.EvalSymlinks(filepath.Join(dir, "sub"))
+	if err != nil {
+		t.Fatalf("unable to resolve path: %v", err)
+	}
+
+	want := "before-folder " + sub + "\nafter-folder " + dir + "/sub\n"
+	if got := readFile(t, out); got != want {
+		t.Errorf("unexpected action output: %q, want %q", got, want)
+	}
+
+	var nilRunner *Runner
+	if err := nilRunner.RunBeforeFolder(context.Background(), "."); err != nil {
+		t.Errorf("unexpected error from nil runner: %v", err)
+	}
+}
+
+func TestPolicyMerge(t *testing.T) {
+	parent := Policy{
+		BeforeSnapshotRoot: &Action{Command: []string{"parent-before"}},
+		AfterSnapshotRoot:  &Action{Command: []string{"parent-after"}},
+		BeforeFolder:       &Action{Command: []string{"parent-folder"}},
+	}
+
+	p := Policy{AfterSnapshotRoot: &Action{Command: []string{"child-after"}}}
+	p.Merge(parent)
+
+	if p.BeforeSnapshotRoot == nil || p.BeforeSnapshotRoot.Command[0] != "parent-before" {
+		t.Errorf("before-snapshot-root action not inherited: %+v", p.BeforeSnapshotRoot)
+	}
+
+	if p.AfterSnapshotRoot.Command[0] != "child-after" {
+		t.Errorf("after-snapshot-root action overridden: %+v", p.AfterSnapshotRoot)
+	}
+
+	if p.BeforeFolder != nil {
+		t.Errorf("folder actions must not be inherited: %+v", p.BeforeFolder)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		action Action
+		valid  bool
+	}{
+		{Action{Command: []string{"true"}}, true},
+		{Action{Command: []string{"true"}, Mode: ModeOptional, TimeoutSeconds: 10}, true},
+		{Action{}, false},
+		{Action{Command: []string{"true"}, Mode: "sometimes"}, false},
+		{Action{Command: []string{"true"}, TimeoutSeconds: -1}, false},
+	}
+
+	for _, tc := range cases {
+		if err := tc.action.Validate(); (err == nil) != tc.valid {
+			t.Errorf("unexpected validation result for %+v: %v", tc.action, err)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+// Package apiclient implements a client for Kopia HTTP API server.
+package apiclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ErrNotFound is returned when the server responds with HTTP 404 status.
+var ErrNotFound = errors.New("not found")
+
+// Client provides helper methods for communicating with Kopia API server.
+type Client struct {
+	baseURL string
+	client  *http.Client
+	options Options
+}
+
+// Options encapsulates all connection options for the API client.
+type Options struct {
+	// BaseURL is the URL of the server such as https://host:port, plain host:port denotes http://host:port.
+	BaseURL string
+
+	// Username and Password are used for HTTP basic authentication.
+	Username string
+	Password string
+
+	// Token is used for bearer token authentication when Password is not specified.
+	Token string
+
+	// TrustedServerCertificateFingerprint is the SHA256 fingerprint of the server certificate in hex,
+	// when set the certificate is trusted based on its fingerprint alone, which allows self-signed certificates.
+	TrustedServerCertificateFingerprint string
+}
+
+// Get sends HTTP GET request and decodes the JSON response into the provided payload structure.
+func (c *Client) Get(path string, respPayload interface{}) error {
+	return c.do(http.MethodGet, path, nil, respPayload)
+}
+
+// Post sends HTTP post request with given JSON payload structure and decodes the JSON response into another payload structure.
+func (c *Client) Post(path string, reqPayload, respPayload interface{}) error {
+	var buf bytes.Buffer
+
+	if err := json.NewEncoder(&buf).Encode(reqPayload); err != nil {
+		return fmt.Errorf("unable to encode request: %v", err)
+	}
+
+	return c.do(http.MethodPost, path, &buf, respPayload)
+}
+
+// Delete sends HTTP DELETE request and decodes the JSON response into the provided payload structure.
+func (c *Client) Delete(path string, respPayload interface{}) error {
+	return c.do(http.MethodDelete, path, nil, respPayload)
+}
+
+// StreamEvents connects to an endpoint streaming Server-Sent Events and invokes the callback
+// for each received event until the stream is closed, the context is cancelled or the callback
+// returns an error.
+func (c *Client) StreamEvents(ctx context.Context, path string, callback func(eventType string, data []byte) error) error {
+	req, err := c.newRequest(http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Accept", "text/event-stream")
+
+	// the default client may have a timeout, which would terminate long-running streams.
+	cli := *c.client
+	cli.Timeout = 0
+
+	resp, err := cli.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("invalid server response: %v", resp.Status)
+	}
+
+	var eventType string
+	var data bytes.Buffer
+
+	s := bufio.NewScanner(resp.Body)
+	s.Buffer(nil, maxEventSize)
+
+	for s.Scan() {
+		line := s.Text()
+		switch {
+		case line == "":
+			// blank line terminates the event
+			if data.Len() > 0 {
+				if err := callback(eventType, bytes.TrimSuffix(data.Bytes(), []byte("\n"))); err != nil {
+					return err
+				}
+			}
+			eventType = ""
+			data.Reset()
+
+		case strings.HasPrefix(line, ":"):
+			// comment, used for keep-alive
+
+		case strings.HasPrefix(line, "event:"):
+			eventType = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+
+		case strings.HasPrefix(line, "data:"):
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+			data.WriteString("\n")
+		}
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if err := s.Err(); err != nil {
+		return fmt.Errorf("error reading event stream: %v", err)
+	}
+
+	return nil
+}
+
+// maxEventSize is the maximum size of a single line of the event stream.
+const maxEventSize = 1 << 20
+
+func (c *Client) newRequest(method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, c.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	switch {
+	case c.options.Password != "":
+		req.SetBasicAuth(c.options.Username, c.options.Password)
+	case c.options.Token != "":
+		req.Header.Set("Authorization", "Bearer "+c.options.Token)
+	}
+
+	return req, nil
+}
+
+func (c *Client) do(method, path string, body io.Reader, respPayload interface{}) error {
+	req, err := c.newRequest(method, path, body)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("invalid server response: %v", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(respPayload); err != nil {
+		return fmt.Errorf("malformed server response: %v", err)
+	}
+
+	return nil
+}
+
+// CertificateFingerprint returns the SHA256 fingerprint of a DER-encoded certificate in hex.
+func CertificateFingerprint(der []byte) string {
+	h := sha256.Sum256(der)
+	return hex.EncodeToString(h[:])
+}
+
+// NewClient creates a client for connecting to Kopia HTTP API.
+func NewClient(options Options) (*Client, error) {
+	baseURL := options.BaseURL
+	if !strings.Contains(baseURL, "://") {
+		baseURL = "http://" + baseURL
+	}
+
+	cli := http.DefaultClient
+
+	if fp := options.TrustedServerCertificateFingerprint; fp != "" {
+		if !strings.HasPrefix(baseURL, "https://") {
+			return nil, fmt.Errorf("server certificate fingerprint requires https:// URL")
+		}
+
+		cli = &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					// the certificate chain is verified by VerifyPeerCertificate instead
+					InsecureSkipVerify:    true, //nolint:gosec
+					VerifyPeerCertificate: verifyPeerFingerprint(fp),
+				},
+			},
+		}
+	}
+
+	return &Client{strings.TrimSuffix(baseURL, "/") + "/api/v1/", cli, options}, nil
+}
+
+func verifyPeerFingerprint(expected string) func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	expected = strings.ToLower(strings.Replace(expected, ":", "", -1))
+
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("server did not present a certificate")
+		}
+
+		if actual := CertificateFingerprint(rawCerts[0]); actual != expected {
+			return fmt.Errorf("server certificate fingerprint mismatch: %v, want %v", actual, expected)
+		}
+
+		return nil
+	}
+}
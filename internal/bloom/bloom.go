@@ -0,0 +1,117 @@
+// Package bloom implements a serializable Bloom filter for fast negative lookups of string keys.
+package bloom
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
+)
+
+const (
+	headerSize = 12
+	maxHashes  = 32
+)
+
+// Filter is a Bloom filter, which tells that a key has definitely not been added or that it might have been.
+type Filter struct {
+	hashCount uint32
+	bits      []uint64
+}
+
+// New creates a Filter sized for the expected number of keys and the desired rate of false positives.
+func New(expectedKeys int, falsePositiveRate float64) *Filter {
+	if expectedKeys < 1 {
+		expectedKeys = 1
+	}
+
+	bitCount := math.Ceil(-float64(expectedKeys) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	words := (int(bitCount) + 63) / 64
+
+	hashCount := uint32(math.Round(float64(words*64) / float64(expectedKeys) * math.Ln2))
+	if hashCount < 1 {
+		hashCount = 1
+	}
+	if hashCount > maxHashes {
+		hashCount = maxHashes
+	}
+
+	return &Filter{
+		hashCount: hashCount,
+		bits:      make([]uint64, words),
+	}
+}
+
+// hashes returns two independent hashes of the key which are combined to produce hashCount bit positions.
+func hashes(key string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(key)) //nolint:errcheck
+	h1 := h.Sum64()
+
+	// rotate to get a second hash, which must be odd to visit all positions.
+	h2 := (h1>>33 | h1<<31) | 1
+	return h1, h2
+}
+
+// Add adds the key to the filter.
+func (f *Filter) Add(key string) {
+	h1, h2 := hashes(key)
+	n := uint64(len(f.bits) * 64)
+
+	for i := uint64(0); i < uint64(f.hashCount); i++ {
+		pos := (h1 + i*h2) % n
+		f.bits[pos/64] |= 1 << (pos % 64)
+	}
+}
+
+// MayContain returns false if the key has definitely not been added to the filter.
+func (f *Filter) MayContain(key string) bool {
+	h1, h2 := hashes(key)
+	n := uint64(len(f.bits) * 64)
+
+	for i := uint64(0); i < uint64(f.hashCount); i++ {
+		pos := (h1 + i*h2) % n
+		if f.bits[pos/64]&(1<<(pos%64)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Bytes returns the serialized representation of the filter.
+func (f *Filter) Bytes() []byte {
+	b := make([]byte, headerSize+8*len(f.bits))
+	binary.BigEndian.PutUint32(b[0:4], f.hashCount)
+	binary.BigEndian.PutUint64(b[4:12], uint64(len(f.bits)))
+
+	for i, w := range f.bits {
+		binary.BigEndian.PutUint64(b[headerSize+8*i:], w)
+	}
+
+	return b
+}
+
+// FromBytes deserializes the filter returned by Bytes().
+func FromBytes(b []byte) (*Filter, error) {
+	if len(b) < headerSize {
+		return nil, fmt.Errorf("invalid bloom filter length: %v", len(b))
+	}
+
+	hashCount := binary.BigEndian.Uint32(b[0:4])
+	words := binary.BigEndian.Uint64(b[4:12])
+	if hashCount < 1 || hashCount > maxHashes || words < 1 || uint64(len(b)-headerSize) != 8*words {
+		return nil, fmt.Errorf("invalid bloom filter header")
+	}
+
+	f := &Filter{
+		hashCount: hashCount,
+		bits:      make([]uint64, words),
+	}
+
+	for i := range f.bits {
+		f.bits[i] = binary.BigEndian.Uint64(b[headerSize+8*i:])
+	}
+
+	return f, nil
+}
@@ -0,0 +1,57 @@
+package bloom
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	const count = 10000
+
+	f := New(count, 0.01)
+	for i := 0; i < count; i++ {
+		f.Add(fmt.Sprintf("key-%v", i))
+	}
+
+	f2, err := FromBytes(f.Bytes())
+	if err != nil {
+		t.Fatalf("unable to deserialize: %v", err)
+	}
+
+	if !reflect.DeepEqual(f, f2) {
+		t.Errorf("deserialized filter is different")
+	}
+
+	for i := 0; i < count; i++ {
+		if !f2.MayContain(fmt.Sprintf("key-%v", i)) {
+			t.Fatalf("filter does not contain key-%v", i)
+		}
+	}
+
+	falsePositives := 0
+	for i := 0; i < count; i++ {
+		if f2.MayContain(fmt.Sprintf("other-key-%v", i)) {
+			falsePositives++
+		}
+	}
+
+	if falsePositives > count*2/100 {
+		t.Errorf("too many false positives: %v out of %v", falsePositives, count)
+	}
+}
+
+func TestFromBytesInvalid(t *testing.T) {
+	valid := New(100, 0.01).Bytes()
+
+	for _, b := range [][]byte{
+		nil,
+		valid[0:10],
+		valid[0 : len(valid)-1],
+		append(append([]byte(nil), valid...), 0),
+	} {
+		if _, err := FromBytes(b); err == nil {
+			t.Errorf("expected error deserializing %v bytes", len(b))
+		}
+	}
+}
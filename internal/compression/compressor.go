@@ -0,0 +1,88 @@
+// Package compression manages compression algorithms applied to blocks before they are encrypted and stored.
+package compression
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// HeaderID is a unique identifier of the compressor stored at the beginning of each compressed payload.
+type HeaderID uint32
+
+const headerLength = 4
+
+// Compressor implements compression and decompression of a block of data.
+type Compressor interface {
+	// HeaderID returns the unique identifier of the compressor written in front of compressed data.
+	HeaderID() HeaderID
+
+	// Compress returns compressed bytes prefixed with compressor header. Must not clobber the input slice.
+	Compress(b []byte) ([]byte, error)
+
+	// Decompress returns uncompressed bytes. The input must include the header. Must not clobber the input slice.
+	Decompress(b []byte) ([]byte, error)
+}
+
+// Compressors maps known compression algorithm names to their implementations.
+var Compressors = map[string]Compressor{}
+
+// SupportedCompressors is a sorted list of names of all registered compressors.
+var SupportedCompressors []string
+
+var byHeaderID = map[HeaderID]Compressor{}
+
+// RegisterCompressor registers the provided compressor under the given name.
+func RegisterCompressor(name string, c Compressor) {
+	if byHeaderID[c.HeaderID()] != nil {
+		panic(fmt.Sprintf("compressor with header %x already registered", c.HeaderID()))
+	}
+
+	Compressors[name] = c
+	byHeaderID[c.HeaderID()] = c
+
+	SupportedCompressors = append(SupportedCompressors, name)
+	sort.Strings(SupportedCompressors)
+}
+
+// Decompress decompresses the provided data using the compressor identified by its header.
+func Decompress(b []byte) ([]byte, error) {
+	id, err := headerIDOf(b)
+	if err != nil {
+		return nil, err
+	}
+
+	c := byHeaderID[id]
+	if c == nil {
+		return nil, fmt.Errorf("unsupported compressor %x", id)
+	}
+
+	return c.Decompress(b)
+}
+
+func headerIDOf(b []byte) (HeaderID, error) {
+	if len(b) < headerLength {
+		return 0, fmt.Errorf("invalid compression header")
+	}
+
+	return HeaderID(binary.BigEndian.Uint32(b[0:headerLength])), nil
+}
+
+func verifyHeader(b []byte, want HeaderID) ([]byte, error) {
+	id, err := headerIDOf(b)
+	if err != nil {
+		return nil, err
+	}
+
+	if id != want {
+		return nil, fmt.Errorf("unexpected compression header %x, expected %x", id, want)
+	}
+
+	return b[headerLength:], nil
+}
+
+func newHeader(id HeaderID, capacity int) []byte {
+	b := make([]byte, headerLength, headerLength+capacity)
+	binary.BigEndian.PutUint32(b, uint32(id))
+	return b
+}
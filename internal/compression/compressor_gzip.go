@@ -0,0 +1,57 @@
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+)
+
+func init() {
+	RegisterCompressor("gzip", &gzipCompressor{0x1000, gzip.DefaultCompression})
+	RegisterCompressor("gzip-best-speed", &gzipCompressor{0x1001, gzip.BestSpeed})
+	RegisterCompressor("gzip-best-compression", &gzipCompressor{0x1002, gzip.BestCompression})
+}
+
+type gzipCompressor struct {
+	id    HeaderID
+	level int
+}
+
+func (c *gzipCompressor) HeaderID() HeaderID {
+	return c.id
+}
+
+func (c *gzipCompressor) Compress(b []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(newHeader(c.id, len(b)))
+
+	w, err := gzip.NewWriterLevel(buf, c.level)
+	if err != nil {
+		return nil, fmt.Errorf("unable to initialize gzip: %v", err)
+	}
+
+	if _, err := w.Write(b); err != nil {
+		return nil, fmt.Errorf("compression error: %v", err)
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("compression error: %v", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (c *gzipCompressor) Decompress(b []byte) ([]byte, error) {
+	b, err := verifyHeader(b, c.id)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("unable to open gzip stream: %v", err)
+	}
+	defer r.Close() //nolint:errcheck
+
+	return ioutil.ReadAll(r)
+}
@@ -0,0 +1,33 @@
+package compression
+
+import (
+	"github.com/klauspost/compress/s2"
+)
+
+func init() {
+	RegisterCompressor("s2-default", &s2Compressor{0x1200, s2.Encode})
+	RegisterCompressor("s2-better", &s2Compressor{0x1201, s2.EncodeBetter})
+}
+
+type s2Compressor struct {
+	id     HeaderID
+	encode func(dst, src []byte) []byte
+}
+
+func (c *s2Compressor) HeaderID() HeaderID {
+	return c.id
+}
+
+func (c *s2Compressor) Compress(b []byte) ([]byte, error) {
+	compressed := c.encode(make([]byte, s2.MaxEncodedLen(len(b))), b)
+	return append(newHeader(c.id, len(compressed)), compressed...), nil
+}
+
+func (c *s2Compressor) Decompress(b []byte) ([]byte, error) {
+	b, err := verifyHeader(b, c.id)
+	if err != nil {
+		return nil, err
+	}
+
+	return s2.Decode(nil, b)
+}
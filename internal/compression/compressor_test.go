@@ -0,0 +1,57 @@
+package compression
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestCompressor(t *testing.T) {
+	compressible := bytes.Repeat([]byte("hello world, this is compressible data "), 1000)
+
+	incompressible := make([]byte, 10000)
+	rand.Read(incompressible)
+
+	for _, name := range SupportedCompressors {
+		c := Compressors[name]
+
+		for _, data := range [][]byte{nil, {1, 2, 3}, compressible, incompressible} {
+			compressed, err := c.Compress(data)
+			if err != nil {
+				t.Fatalf("%v: compression error: %v", name, err)
+			}
+
+			if bytes.Equal(data, compressible) && len(compressed) >= len(data) {
+				t.Errorf("%v: compressible data did not compress: %v, want < %v", name, len(compressed), len(data))
+			}
+
+			decompressed, err := Decompress(compressed)
+			if err != nil {
+				t.Fatalf("%v: decompression error: %v", name, err)
+			}
+
+			if !bytes.Equal(decompressed, data) {
+				t.Errorf("%v: invalid decompressed data", name)
+			}
+		}
+	}
+}
+
+func TestDecompressInvalidHeader(t *testing.T) {
+	if _, err := Decompress([]byte{1, 2}); err == nil {
+		t.Errorf("expected error for short input")
+	}
+
+	if _, err := Decompress([]byte{0xff, 0xff, 0xff, 0xff, 1, 2, 3}); err == nil {
+		t.Errorf("expected error for unknown compressor")
+	}
+
+	compressed, err := Compressors["gzip"].Compress([]byte{1, 2, 3})
+	if err != nil {
+		t.Fatalf("compression error: %v", err)
+	}
+
+	if _, err := Compressors["zstd"].Decompress(compressed); err == nil {
+		t.Errorf("expected error when decompressing using wrong compressor")
+	}
+}
@@ -0,0 +1,71 @@
+package compression
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func init() {
+	RegisterCompressor("zstd", newZstdCompressor(0x1100, zstd.SpeedDefault))
+	RegisterCompressor("zstd-fastest", newZstdCompressor(0x1101, zstd.SpeedFastest))
+	RegisterCompressor("zstd-better-compression", newZstdCompressor(0x1102, zstd.SpeedBetterCompression))
+}
+
+type zstdCompressor struct {
+	id    HeaderID
+	level zstd.EncoderLevel
+
+	once    sync.Once
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+	initErr error
+}
+
+func newZstdCompressor(id HeaderID, level zstd.EncoderLevel) *zstdCompressor {
+	return &zstdCompressor{id: id, level: level}
+}
+
+// init lazily creates encoder and decoder, which are safe for concurrent use via EncodeAll() and DecodeAll().
+func (c *zstdCompressor) init() error {
+	c.once.Do(func() {
+		c.encoder, c.initErr = zstd.NewWriter(nil, zstd.WithEncoderLevel(c.level))
+		if c.initErr != nil {
+			return
+		}
+
+		c.decoder, c.initErr = zstd.NewReader(nil)
+	})
+
+	if c.initErr != nil {
+		return fmt.Errorf("unable to initialize zstd: %v", c.initErr)
+	}
+
+	return nil
+}
+
+func (c *zstdCompressor) HeaderID() HeaderID {
+	return c.id
+}
+
+func (c *zstdCompressor) Compress(b []byte) ([]byte, error) {
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+
+	return c.encoder.EncodeAll(b, newHeader(c.id, len(b))), nil
+}
+
+func (c *zstdCompressor) Decompress(b []byte) ([]byte, error) {
+	b, err := verifyHeader(b, c.id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+
+	return c.decoder.DecodeAll(b, nil)
+}
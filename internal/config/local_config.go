@@ -11,8 +11,22 @@ import (
 
 // LocalConfig is a configuration of Kopia.
 type LocalConfig struct {
-	Storage storage.ConnectionInfo `json:"storage"`
-	Caching block.CachingOptions   `json:"caching"`
+	// Storage is not set when the repository is accessed through API server.
+	Storage *storage.ConnectionInfo `json:"storage,omitempty"`
+	Caching block.CachingOptions    `json:"caching"`
+
+	// APIServer is set when the repository is accessed through Kopia API server instead of the storage.
+	APIServer *APIServerInfo `json:"apiServer,omitempty"`
+
+	// EnableActions allows running commands defined in policies stored in the repository.
+	EnableActions bool `json:"enableActions,omitempty"`
+}
+
+// APIServerInfo describes the connection to a repository exposed by Kopia API server.
+type APIServerInfo struct {
+	BaseURL                             string `json:"url"`
+	Username                            string `json:"username"`
+	TrustedServerCertificateFingerprint string `json:"serverCertFingerprint,omitempty"`
 }
 
 // RepositoryObjectFormat describes the format of objects in a repository.
@@ -0,0 +1,67 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseInvalid(t *testing.T) {
+	cases := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"x * * * *",
+		"@fortnightly",
+	}
+
+	for _, c := range cases {
+		if _, err := Parse(c); err == nil {
+			t.Errorf("expected error parsing %q", c)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	// Wednesday
+	base := time.Date(2019, 1, 16, 10, 30, 0, 0, time.UTC)
+
+	cases := []struct {
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		{"* * * * *", base, time.Date(2019, 1, 16, 10, 31, 0, 0, time.UTC)},
+		{"* * * * *", base.Add(15 * time.Second), time.Date(2019, 1, 16, 10, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", base, time.Date(2019, 1, 16, 10, 45, 0, 0, time.UTC)},
+		{"0 22 * * *", base, time.Date(2019, 1, 16, 22, 0, 0, 0, time.UTC)},
+		{"0 2 * * *", base, time.Date(2019, 1, 17, 2, 0, 0, 0, time.UTC)},
+		{"30 10 * * *", base, time.Date(2019, 1, 17, 10, 30, 0, 0, time.UTC)},
+		{"0 9-17/4 * * *", base, time.Date(2019, 1, 16, 13, 0, 0, 0, time.UTC)},
+		{"0 0 * * mon-fri", time.Date(2019, 1, 18, 12, 0, 0, 0, time.UTC), time.Date(2019, 1, 21, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", base, time.Date(2019, 1, 20, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", base, time.Date(2019, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 feb *", base, time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1,15 * fri", base, time.Date(2019, 1, 18, 0, 0, 0, 0, time.UTC)},
+		{"@weekly", base, time.Date(2019, 1, 20, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", base, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", base, time.Time{}},
+	}
+
+	for _, tc := range cases {
+		s, err := Parse(tc.expr)
+		if err != nil {
+			t.Fatalf("unable to parse %q: %v", tc.expr, err)
+		}
+
+		if got := s.Next(tc.from); !got.Equal(tc.want) {
+			t.Errorf("%q: Next(%v) = %v, want %v", tc.expr, tc.from, got, tc.want)
+		}
+	}
+}
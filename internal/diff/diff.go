@@ -0,0 +1,390 @@
+// Package diff implements comparison of two filesystem trees.
+package diff
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/kopia/kopia/fs"
+	"github.com/kopia/kopia/internal/kopialogging"
+	"github.com/kopia/kopia/repo/object"
+)
+
+var log = kopialogging.Logger("kopia/diff")
+
+const compareBufferSize = 65536
+
+// ChangeType describes the kind of difference between two entries.
+type ChangeType string
+
+// Supported change types.
+const (
+	ChangeAdded    ChangeType = "added"    // entry exists only in the new tree
+	ChangeRemoved  ChangeType = "removed"  // entry exists only in the old tree
+	ChangeModified ChangeType = "modified" // contents of the entry have changed (metadata may have changed too)
+	ChangeMetadata ChangeType = "metadata" // only metadata of the entry has changed
+)
+
+// Change describes a single difference between two trees.
+type Change struct {
+	Path            string            `json:"path"`
+	Type            ChangeType        `json:"type"`
+	Old             *fs.EntryMetadata `json:"old,omitempty"`
+	New             *fs.EntryMetadata `json:"new,omitempty"`
+	MetadataChanges []string          `json:"metadataChanges,omitempty"`
+	ContentDiff     string            `json:"contentDiff,omitempty"`
+}
+
+// String returns human-readable description of the change.
+func (c *Change) String() string {
+	switch c.Type {
+	case ChangeAdded:
+		return fmt.Sprintf("+ %v", c.Path)
+	case ChangeRemoved:
+		return fmt.Sprintf("- %v", c.Path)
+	case ChangeModified:
+		if len(c.MetadataChanges) > 0 {
+			return fmt.Sprintf("M %v (%v)", c.Path, strings.Join(c.MetadataChanges, ", "))
+		}
+		return fmt.Sprintf("M %v", c.Path)
+	default:
+		return fmt.Sprintf("m %v (%v)", c.Path, strings.Join(c.MetadataChanges, ", "))
+	}
+}
+
+// Comparer walks two filesystem trees and reports differences between them.
+type Comparer struct {
+	// Include unified content diffs for modified text files not larger than the given size (0 disables content diffs).
+	MaxContentDiffSize int64
+
+	// Do not report differences in ownership (uid/gid).
+	IgnoreOwnership bool
+
+	// Called for each difference found, in tree order. Returning an error stops the comparison.
+	OnChange func(c *Change) error
+}
+
+// NewComparer returns new Comparer.
+func NewComparer() *Comparer {
+	return &Comparer{}
+}
+
+// Compare compares two filesystem entries recursively.
+func (c *Comparer) Compare(ctx context.Context, oldEntry, newEntry fs.Entry) error {
+	return c.compareEntry(ctx, oldEntry, newEntry, ".")
+}
+
+func (c *Comparer) report(ch *Change) error {
+	if c.OnChange == nil {
+		return nil
+	}
+
+	return c.OnChange(ch)
+}
+
+func (c *Comparer) compareEntry(ctx context.Context, e1, e2 fs.Entry, path string) error {
+	if e1 == nil && e2 == nil {
+		return nil
+	}
+
+	if e1 == nil {
+		return c.reportAdded(ctx, e2, path)
+	}
+
+	if e2 == nil {
+		return c.reportRemoved(ctx, e1, path)
+	}
+
+	md1, md2 := e1.Metadata(), e2.Metadata()
+	if md1.Type != md2.Type {
+		// entry changed type, report as removal followed by addition
+		if err := c.reportRemoved(ctx, e1, path); err != nil {
+			return err
+		}
+		return c.reportAdded(ctx, e2, path)
+	}
+
+	metadataChanges := c.compareMetadata(md1, md2)
+
+	if d1, ok := e1.(fs.Directory); ok {
+		if len(metadataChanges) > 0 {
+			if err := c.report(&Change{Path: path, Type: ChangeMetadata, Old: md1, New: md2, MetadataChanges: metadataChanges}); err != nil {
+				return err
+			}
+		}
+
+		if sameObjectID(e1, e2) {
+			// identical directory contents, no need to descend
+			return nil
+		}
+
+		d2, ok := e2.(fs.Directory)
+		if !ok {
+			return fmt.Errorf("unexpected entry type of %v", path)
+		}
+
+		return c.compareDirectories(ctx, d1, d2, path)
+	}
+
+	modified, err := c.contentsDiffer(ctx, e1, e2)
+	if err != nil {
+		return fmt.Errorf("unable to compare %v: %v", path, err)
+	}
+
+	switch {
+	case modified:
+		ch := &Change{Path: path, Type: ChangeModified, Old: md1, New: md2, MetadataChanges: metadataChanges}
+		if ch.ContentDiff, err = c.contentDiff(ctx, e1, e2, path); err != nil {
+			return err
+		}
+		return c.report(ch)
+
+	case len(metadataChanges) > 0:
+		return c.report(&Change{Path: path, Type: ChangeMetadata, Old: md1, New: md2, MetadataChanges: metadataChanges})
+
+	default:
+		return nil
+	}
+}
+
+func (c *Comparer) compareDirectories(ctx context.Context, d1, d2 fs.Directory, path string) error {
+	log.Debugf("comparing directories %v", path)
+
+	entries1, err := d1.Readdir(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to read old directory %v: %v", path, err)
+	}
+
+	entries2, err := d2.Readdir(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to read new directory %v: %v", path, err)
+	}
+
+	// both lists are sorted by name, merge them
+	i1, i2 := 0, 0
+	for i1 < len(entries1) || i2 < len(entries2) {
+		var e1, e2 fs.Entry
+		var name string
+
+		switch {
+		case i2 >= len(entries2) || (i1 < len(entries1) && entries1[i1].Metadata().Name < entries2[i2].Metadata().Name):
+			e1 = entries1[i1]
+			name = e1.Metadata().Name
+			i1++
+
+		case i1 >= len(entries1) || entries2[i2].Metadata().Name < entries1[i1].Metadata().Name:
+			e2 = entries2[i2]
+			name = e2.Metadata().Name
+			i2++
+
+		default:
+			e1, e2 = entries1[i1], entries2[i2]
+			name = e1.Metadata().Name
+			i1++
+			i2++
+		}
+
+		if err := c.compareEntry(ctx, e1, e2, path+"/"+name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *Comparer) reportAdded(ctx context.Context, e fs.Entry, path string) error {
+	if err := c.report(&Change{Path: path, Type: ChangeAdded, New: e.Metadata()}); err != nil {
+		return err
+	}
+
+	return c.forEachChild(ctx, e, path, func(child fs.Entry, childPath string) error {
+		return c.reportAdded(ctx, child, childPath)
+	})
+}
+
+func (c *Comparer) reportRemoved(ctx context.Context, e fs.Entry, path string) error {
+	if err := c.report(&Change{Path: path, Type: ChangeRemoved, Old: e.Metadata()}); err != nil {
+		return err
+	}
+
+	return c.forEachChild(ctx, e, path, func(child fs.Entry, childPath string) error {
+		return c.reportRemoved(ctx, child, childPath)
+	})
+}
+
+func (c *Comparer) forEachChild(ctx context.Context, e fs.Entry, path string, cb func(child fs.Entry, childPath string) error) error {
+	d, ok := e.(fs.Directory)
+	if !ok {
+		return nil
+	}
+
+	entries, err := d.Readdir(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to read directory %v: %v", path, err)
+	}
+
+	for _, child := range entries {
+		if err := cb(child, path+"/"+child.Metadata().Name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *Comparer) compareMetadata(md1, md2 *fs.EntryMetadata) []string {
+	var changes []string
+
+	if md1.Permissions != md2.Permissions {
+		changes = append(changes, fmt.Sprintf("mode %04o -> %04o", int(md1.Permissions), int(md2.Permissions)))
+	}
+
+	if !md1.ModTime.Equal(md2.ModTime) {
+		changes = append(changes, fmt.Sprintf("mtime %v -> %v", md1.ModTime.Local(), md2.ModTime.Local()))
+	}
+
+	if !c.IgnoreOwnership {
+		if md1.UserID != md2.UserID {
+			changes = append(changes, fmt.Sprintf("uid %v -> %v", md1.UserID, md2.UserID))
+		}
+
+		if md1.GroupID != md2.GroupID {
+			changes = append(changes, fmt.Sprintf("gid %v -> %v", md1.GroupID, md2.GroupID))
+		}
+	}
+
+	if md1.Type == fs.EntryTypeFile && md1.FileSize != md2.FileSize {
+		changes = append(changes, fmt.Sprintf("size %v -> %v", md1.FileSize, md2.FileSize))
+	}
+
+	return changes
+}
+
+// sameObjectID returns true if both entries are backed by the same repository object.
+func sameObjectID(e1, e2 fs.Entry) bool {
+	o1, ok1 := e1.(object.HasObjectID)
+	o2, ok2 := e2.(object.HasObjectID)
+	return ok1 && ok2 && o1.ObjectID() == o2.ObjectID()
+}
+
+// contentsDiffer determines whether contents of two non-directory entries are different.
+// When both entries are backed by repository objects, object IDs are compared, otherwise the contents are read.
+func (c *Comparer) contentsDiffer(ctx context.Context, e1, e2 fs.Entry) (bool, error) {
+	o1, ok1 := e1.(object.HasObjectID)
+	o2, ok2 := e2.(object.HasObjectID)
+	if ok1 && ok2 {
+		return o1.ObjectID() != o2.ObjectID(), nil
+	}
+
+	switch v1 := e1.(type) {
+	case fs.Symlink:
+		l1, err := v1.Readlink(ctx)
+		if err != nil {
+			return false, err
+		}
+
+		l2, err := e2.(fs.Symlink).Readlink(ctx)
+		if err != nil {
+			return false, err
+		}
+
+		return l1 != l2, nil
+
+	case fs.File:
+		if e1.Metadata().FileSize != e2.Metadata().FileSize {
+			return true, nil
+		}
+
+		return filesDiffer(ctx, v1, e2.(fs.File))
+
+	default:
+		return false, fmt.Errorf("unsupported entry type: %T", e1)
+	}
+}
+
+func filesDiffer(ctx context.Context, f1, f2 fs.File) (bool, error) {
+	r1, err := f1.Open(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer r1.Close() //nolint:errcheck
+
+	r2, err := f2.Open(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer r2.Close() //nolint:errcheck
+
+	buf1 := make([]byte, compareBufferSize)
+	buf2 := make([]byte, compareBufferSize)
+
+	for {
+		n1, err1 := io.ReadFull(r1, buf1)
+		n2, err2 := io.ReadFull(r2, buf2)
+
+		if !bytes.Equal(buf1[0:n1], buf2[0:n2]) {
+			return true, nil
+		}
+
+		eof1 := err1 == io.EOF || err1 == io.ErrUnexpectedEOF
+		eof2 := err2 == io.EOF || err2 == io.ErrUnexpectedEOF
+
+		switch {
+		case err1 != nil && !eof1:
+			return false, err1
+		case err2 != nil && !eof2:
+			return false, err2
+		case eof1 || eof2:
+			return eof1 != eof2, nil
+		}
+	}
+}
+
+// contentDiff returns unified diff of two small text files or an empty string if the diff is not applicable.
+func (c *Comparer) contentDiff(ctx context.Context, e1, e2 fs.Entry, path string) (string, error) {
+	if c.MaxContentDiffSize <= 0 {
+		return "", nil
+	}
+
+	f1, ok1 := e1.(fs.File)
+	f2, ok2 := e2.(fs.File)
+	if !ok1 || !ok2 || e1.Metadata().FileSize > c.MaxContentDiffSize || e2.Metadata().FileSize > c.MaxContentDiffSize {
+		return "", nil
+	}
+
+	b1, err := readAll(ctx, f1)
+	if err != nil {
+		return "", fmt.Errorf("unable to read old contents of %v: %v", path, err)
+	}
+
+	b2, err := readAll(ctx, f2)
+	if err != nil {
+		return "", fmt.Errorf("unable to read new contents of %v: %v", path, err)
+	}
+
+	if !isText(b1) || !isText(b2) {
+		return "", nil
+	}
+
+	name := strings.TrimPrefix(path, "./")
+	return unifiedDiff("a/"+name, "b/"+name, string(b1), string(b2)), nil
+}
+
+func readAll(ctx context.Context, f fs.File) ([]byte, error) {
+	r, err := f.Open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close() //nolint:errcheck
+
+	return ioutil.ReadAll(r)
+}
+
+func isText(b []byte) bool {
+	return utf8.Valid(b) && bytes.IndexByte(b, 0) < 0
+}
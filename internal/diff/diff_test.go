@@ -0,0 +1,176 @@
+package diff
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kopia/kopia/internal/mockfs"
+)
+
+func newTestTree() *mockfs.Directory {
+	d := mockfs.NewDirectory()
+	d.AddFile("f1", []byte("line1\nline2\n"), 0644)
+	d.AddFile("f2", []byte{1, 2, 3}, 0644)
+	d.AddDir("d1", 0755)
+	d.AddFile("d1/f3", []byte{1, 2, 3, 4}, 0644)
+	d.AddDir("d2", 0755)
+	d.AddFile("d2/f4", []byte{1}, 0644)
+	d.AddSymlink("l1", "f1", 0777)
+	return d
+}
+
+func collectChanges(t *testing.T, c *Comparer, e1, e2 *mockfs.Directory) []string {
+	var result []string
+	c.OnChange = func(ch *Change) error {
+		result = append(result, ch.String())
+		return nil
+	}
+
+	if err := c.Compare(context.Background(), e1, e2); err != nil {
+		t.Fatalf("compare failed: %v", err)
+	}
+
+	return result
+}
+
+func TestCompareIdentical(t *testing.T) {
+	if got := collectChanges(t, NewComparer(), newTestTree(), newTestTree()); len(got) != 0 {
+		t.Errorf("unexpected changes between identical trees: %v", got)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	d1 := newTestTree()
+	d2 := newTestTree()
+
+	d2.Subdir("d1").Remove("f3")
+	d2.AddFile("d1/f5", []byte{5}, 0644)
+	d2.Remove("d2")
+	d2.AddDir("d3", 0700)
+	d2.AddFile("d3/f6", []byte{6}, 0600)
+	d2.Remove("f2")
+	d2.AddFile("f2", []byte{1, 2, 4}, 0600)
+	d2.Remove("l1")
+	d2.AddSymlink("l1", "f2", 0777)
+	d2.Remove("f1")
+	d2.AddFile("f1", []byte("line1\nline2\n"), 0644).Metadata().ModTime = time.Unix(1000, 0)
+
+	want := []string{
+		"- ./d1/f3",
+		"+ ./d1/f5",
+		"- ./d2",
+		"- ./d2/f4",
+		"+ ./d3",
+		"+ ./d3/f6",
+		"m ./f1 (mtime " + time.Time{}.Local().String() + " -> " + time.Unix(1000, 0).Local().String() + ")",
+		"M ./f2 (mode 0644 -> 0600)",
+		"M ./l1",
+	}
+
+	if got := collectChanges(t, NewComparer(), d1, d2); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected changes:\n%v\nwant:\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestCompareTypeChange(t *testing.T) {
+	d1 := newTestTree()
+	d2 := newTestTree()
+
+	d2.Remove("f2")
+	d2.AddDir("f2", 0755)
+	d2.AddFile("f2/x", []byte{1}, 0644)
+
+	want := []string{
+		"- ./f2",
+		"+ ./f2",
+		"+ ./f2/x",
+	}
+
+	if got := collectChanges(t, NewComparer(), d1, d2); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected changes:\n%v\nwant:\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestCompareContentDiff(t *testing.T) {
+	d1 := newTestTree()
+	d2 := newTestTree()
+
+	d2.Remove("f1")
+	d2.AddFile("f1", []byte("line1\nline3\n"), 0644)
+
+	var changes []*Change
+	c := NewComparer()
+	c.MaxContentDiffSize = 1000
+	c.OnChange = func(ch *Change) error {
+		changes = append(changes, ch)
+		return nil
+	}
+
+	if err := c.Compare(context.Background(), d1, d2); err != nil {
+		t.Fatalf("compare failed: %v", err)
+	}
+
+	if len(changes) != 1 {
+		t.Fatalf("unexpected changes: %v", changes)
+	}
+
+	want := "--- a/f1\n+++ b/f1\n@@ -1,2 +1,2 @@\n line1\n-line2\n+line3\n"
+	if got := changes[0].ContentDiff; got != want {
+		t.Errorf("unexpected content diff:\n%v\nwant:\n%v", got, want)
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	lines := func(from, to int) string {
+		var s string
+		for i := from; i <= to; i++ {
+			s += fmt.Sprintf("line%v\n", i)
+		}
+		return s
+	}
+
+	cases := []struct {
+		desc     string
+		old, new string
+		want     string
+	}{
+		{"same", "a\nb\n", "a\nb\n", ""},
+		{"empty to lines", "", "a\nb\n", "--- a\n+++ b\n@@ -0,0 +1,2 @@\n+a\n+b\n"},
+		{"lines to empty", "a\n", "", "--- a\n+++ b\n@@ -1 +0,0 @@\n-a\n"},
+		{
+			"change in the middle",
+			lines(1, 10),
+			lines(1, 4) + "changed\n" + lines(6, 10),
+			"--- a\n+++ b\n@@ -2,7 +2,7 @@\n line2\n line3\n line4\n-line5\n+changed\n line6\n line7\n line8\n",
+		},
+		{
+			"separate hunks",
+			lines(1, 20),
+			lines(2, 18) + "added\n" + lines(19, 20),
+			"--- a\n+++ b\n@@ -1,4 +1,3 @@\n-line1\n line2\n line3\n line4\n" +
+				"@@ -16,5 +15,6 @@\n line16\n line17\n line18\n+added\n line19\n line20\n",
+		},
+		{
+			"nearby changes merged",
+			lines(1, 10),
+			lines(1, 2) + lines(4, 7) + "added\n" + lines(8, 10),
+			"--- a\n+++ b\n@@ -1,10 +1,10 @@\n line1\n line2\n-line3\n line4\n line5\n line6\n line7\n+added\n line8\n line9\n line10\n",
+		},
+		{
+			"no newline at end",
+			"a\nb",
+			"a\nc",
+			"--- a\n+++ b\n@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+c\n\\ No newline at end of file\n",
+		},
+	}
+
+	for _, tc := range cases {
+		if got := unifiedDiff("a", "b", tc.old, tc.new); got != tc.want {
+			t.Errorf("%v: unexpected diff:\n%v\nwant:\n%v", tc.desc, got, tc.want)
+		}
+	}
+}
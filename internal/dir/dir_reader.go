@@ -10,6 +10,16 @@ import (
 
 var directoryStreamType = "kopia:directory"
 
+// maxStreamHeaderLength is the maximum number of bytes read to determine whether a stream contains directory entries.
+const maxStreamHeaderLength = 1024
+
+// IsDirectoryStream returns true if the stream read from the specified reader contains directory entries,
+// only its beginning is read.
+func IsDirectoryStream(r io.Reader) bool {
+	_, err := jsonstream.NewReader(bufio.NewReader(io.LimitReader(r, maxStreamHeaderLength)), directoryStreamType, nil)
+	return err == nil
+}
+
 // ReadEntries reads all the Entry from the specified reader.
 func ReadEntries(r io.Reader) ([]*Entry, *fs.DirectorySummary, error) {
 	var summ fs.DirectorySummary
@@ -83,6 +83,25 @@ func (imd *Directory) AddFile(name string, content []byte, permissions fs.Permis
 	return file
 }
 
+// AddSymlink adds a mock symbolic link with the specified name, target and permissions.
+func (imd *Directory) AddSymlink(name string, target string, permissions fs.Permissions) fs.Symlink {
+	imd, name = imd.resolveSubdir(name)
+	sl := &inmemorySymlink{
+		entry: entry{
+			metadata: &fs.EntryMetadata{
+				Name:        name,
+				Type:        fs.EntryTypeSymlink,
+				Permissions: permissions,
+			},
+		},
+		target: target,
+	}
+
+	imd.addChild(sl)
+
+	return sl
+}
+
 // AddDir adds a fake directory with a given name and permissions.
 func (imd *Directory) AddDir(name string, permissions fs.Permissions) *Directory {
 	imd, name = imd.resolveSubdir(name)
@@ -177,6 +196,13 @@ func (imf *File) SetContents(b []byte) {
 
 }
 
+// FailOpen causes the file to fail to open with a given error.
+func (imf *File) FailOpen(err error) {
+	imf.source = func() (ReaderSeekerCloser, error) {
+		return nil, err
+	}
+}
+
 type fileReader struct {
 	ReaderSeekerCloser
 	metadata *fs.EntryMetadata
@@ -201,10 +227,12 @@ func (imf *File) Open(ctx context.Context) (fs.Reader, error) {
 
 type inmemorySymlink struct {
 	entry
+
+	target string
 }
 
 func (imsl *inmemorySymlink) Readlink(ctx context.Context) (string, error) {
-	panic("not implemented yet")
+	return imsl.target, nil
 }
 
 // NewDirectory returns new mock directory.ds
@@ -213,6 +241,7 @@ func NewDirectory() *Directory {
 		entry: entry{
 			metadata: &fs.EntryMetadata{
 				Name: "<root>",
+				Type: fs.EntryTypeDirectory,
 			},
 		},
 	}
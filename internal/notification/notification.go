@@ -0,0 +1,285 @@
+// Package notification implements sending notifications about problems with snapshots and maintenance
+// to webhooks, email recipients and shell commands.
+package notification
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/kopia/kopia/internal/kopialogging"
+)
+
+var log = kopialogging.Logger("kopia/notification")
+
+// Event identifies the kind of notification.
+type Event string
+
+// Supported notification events.
+const (
+	EventSnapshotFailed    Event = "snapshot-failed"
+	EventSnapshotOverdue   Event = "snapshot-overdue"
+	EventMaintenanceFailed Event = "maintenance-failed"
+)
+
+// Supported target types.
+const (
+	TargetWebhook = "webhook"
+	TargetEmail   = "email"
+	TargetCommand = "command"
+)
+
+// DefaultMinInterval is the default minimum interval between notifications about the same event
+// and source sent to a single target.
+const DefaultMinInterval = time.Hour
+
+const (
+	defaultSubjectTemplate = `Kopia on {{.Hostname}}: {{.Event}}{{if .Source}} for {{.Source}}{{end}}`
+	defaultBodyTemplate    = `Event:  {{.Event}}
+Time:   {{.Time.Format "2006-01-02 15:04:05 MST"}}
+Host:   {{.Hostname}}
+{{- if .Source}}
+Source: {{.Source}}
+{{- end}}
+{{- if .Error}}
+Error:  {{.Error}}
+{{- end}}
+{{- if .Details}}
+
+{{.Details}}
+{{- end}}
+`
+)
+
+// Message describes a single notification.
+type Message struct {
+	Event    Event     `json:"event"`
+	Time     time.Time `json:"time"`
+	Hostname string    `json:"hostname"`
+	Source   string    `json:"source,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Details  string    `json:"details,omitempty"`
+
+	// Subject and Body are rendered from templates of the target.
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+// Target describes where and when notifications are sent.
+type Target struct {
+	Type string `json:"type"`
+
+	// Events to notify about, all events when empty.
+	Events []Event `json:"events,omitempty"`
+
+	// MinIntervalSeconds limits the rate of notifications about the same event and source, DefaultMinInterval when zero.
+	MinIntervalSeconds int64 `json:"minIntervalSeconds,omitempty"`
+
+	// SubjectTemplate and BodyTemplate are text/template templates executed with the Message.
+	SubjectTemplate string `json:"subjectTemplate,omitempty"`
+	BodyTemplate    string `json:"bodyTemplate,omitempty"`
+
+	// URL receives JSON-encoded Message using HTTP POST (webhook).
+	URL     string            `json:"url,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// SMTP settings and recipients (email).
+	SMTPServer   string   `json:"smtpServer,omitempty"`
+	SMTPUsername string   `json:"smtpUsername,omitempty"`
+	SMTPPassword string   `json:"smtpPassword,omitempty"`
+	From         string   `json:"from,omitempty"`
+	To           []string `json:"to,omitempty"`
+
+	// Command is executed with the message body on standard input and message fields in KOPIA_NOTIFICATION_* environment variables (command).
+	Command []string `json:"command,omitempty"`
+}
+
+// MinInterval returns the minimum interval between notifications about the same event and source.
+func (t *Target) MinInterval() time.Duration {
+	if t.MinIntervalSeconds == 0 {
+		return DefaultMinInterval
+	}
+
+	return time.Duration(t.MinIntervalSeconds) * time.Second
+}
+
+// Validate checks that the target has all required settings.
+func (t *Target) Validate() error {
+	switch t.Type {
+	case TargetWebhook:
+		if t.URL == "" {
+			return fmt.Errorf("webhook target requires URL")
+		}
+	case TargetEmail:
+		if t.SMTPServer == "" || t.From == "" || len(t.To) == 0 {
+			return fmt.Errorf("email target requires SMTP server, sender and recipients")
+		}
+	case TargetCommand:
+		if len(t.Command) == 0 {
+			return fmt.Errorf("command target requires command")
+		}
+	default:
+		return fmt.Errorf("unsupported notification target type: %q", t.Type)
+	}
+
+	for _, tmpl := range []string{t.SubjectTemplate, t.BodyTemplate} {
+		if _, err := template.New("").Parse(tmpl); err != nil {
+			return fmt.Errorf("invalid template: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// String returns a short description of the target, which also identifies it for the purpose of rate-limiting.
+func (t *Target) String() string {
+	switch t.Type {
+	case TargetWebhook:
+		return "webhook " + t.URL
+	case TargetEmail:
+		return "email " + strings.Join(t.To, ",")
+	case TargetCommand:
+		return "command " + strings.Join(t.Command, " ")
+	default:
+		return t.Type
+	}
+}
+
+func (t *Target) wants(ev Event) bool {
+	if len(t.Events) == 0 {
+		return true
+	}
+
+	for _, e := range t.Events {
+		if e == ev {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Policy describes notification targets.
+type Policy struct {
+	Targets []Target `json:"targets,omitempty"`
+}
+
+// Merge applies default values from the provided policy, targets are inherited only when none are defined.
+func (p *Policy) Merge(src Policy) {
+	if len(p.Targets) == 0 {
+		p.Targets = append([]Target(nil), src.Targets...)
+	}
+}
+
+// Notifier sends notifications to targets, limiting the rate of repeated notifications.
+type Notifier struct {
+	Hostname string
+
+	mu       sync.Mutex
+	lastSent map[string]time.Time
+	now      func() time.Time
+}
+
+// NewNotifier returns a Notifier sending notifications on behalf of a given host.
+func NewNotifier(hostname string) *Notifier {
+	return &Notifier{
+		Hostname: hostname,
+		lastSent: map[string]time.Time{},
+		now:      time.Now,
+	}
+}
+
+// Notify sends the message to all targets interested in its event, skipping targets which
+// have been recently notified about the same event and source.
+func (n *Notifier) Notify(ctx context.Context, targets []Target, msg Message) error {
+	if msg.Time.IsZero() {
+		msg.Time = n.now()
+	}
+
+	if msg.Hostname == "" {
+		msg.Hostname = n.Hostname
+	}
+
+	var errs []string
+
+	for i := range targets {
+		t := &targets[i]
+		if !t.wants(msg.Event) || !n.shouldSend(t, &msg) {
+			continue
+		}
+
+		if err := n.send(ctx, t, msg); err != nil {
+			log.Warningf("unable to send %v notification to %v: %v", msg.Event, t, err)
+			errs = append(errs, err.Error())
+			continue
+		}
+
+		log.Infof("sent %v notification to %v", msg.Event, t)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("unable to send notifications: %v", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// shouldSend determines whether a notification about a given message can be sent to the target and records it.
+func (n *Notifier) shouldSend(t *Target, msg *Message) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	key := fmt.Sprintf("%v|%v|%v", t, msg.Event, msg.Source)
+	if last, ok := n.lastSent[key]; ok && msg.Time.Sub(last) < t.MinInterval() {
+		log.Debugf("not sending %v notification to %v, last sent at %v", msg.Event, t, last)
+		return false
+	}
+
+	n.lastSent[key] = msg.Time
+	return true
+}
+
+func (n *Notifier) send(ctx context.Context, t *Target, msg Message) error {
+	var err error
+
+	if msg.Subject, err = render(t.SubjectTemplate, defaultSubjectTemplate, &msg); err != nil {
+		return err
+	}
+
+	if msg.Body, err = render(t.BodyTemplate, defaultBodyTemplate, &msg); err != nil {
+		return err
+	}
+
+	switch t.Type {
+	case TargetWebhook:
+		return sendWebhook(ctx, t, &msg)
+	case TargetEmail:
+		return sendEmail(t, &msg)
+	case TargetCommand:
+		return runCommand(ctx, t, &msg)
+	default:
+		return fmt.Errorf("unsupported notification target type: %q", t.Type)
+	}
+}
+
+func render(tmpl, defaultTemplate string, msg *Message) (string, error) {
+	if tmpl == "" {
+		tmpl = defaultTemplate
+	}
+
+	t, err := template.New("notification").Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("invalid template: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, msg); err != nil {
+		return "", fmt.Errorf("unable to render template: %v", err)
+	}
+
+	return buf.String(), nil
+}
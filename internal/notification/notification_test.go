@@ -0,0 +1,284 @@
+package notification
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhook(t *testing.T) {
+	var mu sync.Mutex
+	var received []Message
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var m Message
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			t.Errorf("invalid webhook payload: %v", err)
+		}
+		if got, want := r.Header.Get("X-Token"), "secret"; got != want {
+			t.Errorf("unexpected header: %q, want %q", got, want)
+		}
+
+		mu.Lock()
+		received = append(received, m)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	n := NewNotifier("host1")
+	targets := []Target{{
+		Type:            TargetWebhook,
+		URL:             srv.URL,
+		Headers:         map[string]string{"X-Token": "secret"},
+		SubjectTemplate: "{{.Event}} on {{.Hostname}}",
+	}}
+
+	if err := n.Notify(context.Background(), targets, Message{
+		Event:  EventSnapshotFailed,
+		Source: "user@host1:/path",
+		Error:  "disk on fire",
+	}); err != nil {
+		t.Fatalf("unable to notify: %v", err)
+	}
+
+	if len(received) != 1 {
+		t.Fatalf("unexpected number of webhook calls: %v", len(received))
+	}
+
+	m := received[0]
+	if got, want := m.Subject, "snapshot-failed on host1"; got != want {
+		t.Errorf("unexpected subject: %q, want %q", got, want)
+	}
+
+	if !strings.Contains(m.Body, "Error:  disk on fire") || !strings.Contains(m.Body, "Source: user@host1:/path") {
+		t.Errorf("unexpected body: %q", m.Body)
+	}
+}
+
+func TestWebhookError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	n := NewNotifier("host1")
+	if err := n.Notify(context.Background(), []Target{{Type: TargetWebhook, URL: srv.URL}}, Message{Event: EventMaintenanceFailed}); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestRateLimiting(t *testing.T) {
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+	defer srv.Close()
+
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	n := NewNotifier("host1")
+	n.now = func() time.Time { return now }
+
+	targets := []Target{{
+		Type:               TargetWebhook,
+		URL:                srv.URL,
+		Events:             []Event{EventSnapshotFailed, EventSnapshotOverdue},
+		MinIntervalSeconds: 600,
+	}}
+
+	cases := []struct {
+		advance   time.Duration
+		event     Event
+		source    string
+		wantCalls int
+	}{
+		{0, EventSnapshotFailed, "a", 1},
+		{time.Minute, EventSnapshotFailed, "a", 1},      // rate-limited
+		{0, EventSnapshotFailed, "b", 2},                // different source
+		{0, EventSnapshotOverdue, "a", 3},               // different event
+		{0, EventMaintenanceFailed, "", 3},              // not wanted by target
+		{10 * time.Minute, EventSnapshotFailed, "a", 4}, // interval elapsed
+	}
+
+	for i, tc := range cases {
+		now = now.Add(tc.advance)
+		if err := n.Notify(context.Background(), targets, Message{Event: tc.event, Source: tc.source}); err != nil {
+			t.Fatalf("case %v: unable to notify: %v", i, err)
+		}
+
+		if calls != tc.wantCalls {
+			t.Errorf("case %v: unexpected number of calls %v, want %v", i, calls, tc.wantCalls)
+		}
+	}
+}
+
+func TestEmail(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer l.Close() //nolint:errcheck
+
+	received := make(chan string, 1)
+	go serveFakeSMTP(l, received)
+
+	n := NewNotifier("host1")
+	targets := []Target{{
+		Type:       TargetEmail,
+		SMTPServer: l.Addr().String(),
+		From:       "kopia@example.com",
+		To:         []string{"admin@example.com"},
+	}}
+
+	if err := n.Notify(context.Background(), targets, Message{Event: EventSnapshotOverdue, Source: "user@host1:/path"}); err != nil {
+		t.Fatalf("unable to notify: %v", err)
+	}
+
+	select {
+	case data := <-received:
+		for _, want := range []string{
+			"To: admin@example.com",
+			"Subject: Kopia on host1: snapshot-overdue for user@host1:/path",
+			"Event:  snapshot-overdue",
+		} {
+			if !strings.Contains(data, want) {
+				t.Errorf("message does not contain %q: %v", want, data)
+			}
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatalf("message not received")
+	}
+}
+
+// serveFakeSMTP accepts a single SMTP session and sends the received message data to the channel.
+func serveFakeSMTP(l net.Listener, received chan<- string) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close() //nolint:errcheck
+
+	r := bufio.NewReader(conn)
+	reply := func(s string) { fmt.Fprintf(conn, "%v\r\n", s) }
+
+	reply("220 localhost ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(cmd, "DATA"):
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(l)
+			}
+			received <- data.String()
+			reply("250 ok")
+		case strings.HasPrefix(cmd, "QUIT"):
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func TestCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test requires POSIX shell")
+	}
+
+	dir, err := ioutil.TempDir("", "notification")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir) //nolint:errcheck
+
+	out := filepath.Join(dir, "out")
+	n := NewNotifier("host1")
+	targets := []Target{{
+		Type:         TargetCommand,
+		Command:      []string{"sh", "-c", `echo "$KOPIA_NOTIFICATION_EVENT $KOPIA_NOTIFICATION_ERROR" > "$0"; cat >> "$0"`, out},
+		BodyTemplate: "body of {{.Source}}",
+	}}
+
+	if err := n.Notify(context.Background(), targets, Message{Event: EventMaintenanceFailed, Source: "src", Error: "boom"}); err != nil {
+		t.Fatalf("unable to notify: %v", err)
+	}
+
+	b, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatalf("unable to read output: %v", err)
+	}
+
+	if got, want := string(b), "maintenance-failed boom\nbody of src"; got != want {
+		t.Errorf("unexpected command output: %q, want %q", got, want)
+	}
+
+	targets[0].Command = []string{"sh", "-c", "exit 1"}
+	if err := n.Notify(context.Background(), targets, Message{Event: EventMaintenanceFailed}); err == nil {
+		t.Errorf("expected error from failing command")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		target Target
+		valid  bool
+	}{
+		{Target{Type: TargetWebhook, URL: "http://localhost"}, true},
+		{Target{Type: TargetWebhook}, false},
+		{Target{Type: TargetEmail, SMTPServer: "localhost:25", From: "a@b", To: []string{"c@d"}}, true},
+		{Target{Type: TargetEmail, SMTPServer: "localhost:25", From: "a@b"}, false},
+		{Target{Type: TargetCommand, Command: []string{"true"}}, true},
+		{Target{Type: TargetCommand, Command: []string{"true"}, BodyTemplate: "{{.Foo"}, false},
+		{Target{Type: "pager"}, false},
+	}
+
+	for _, tc := range cases {
+		if err := tc.target.Validate(); (err == nil) != tc.valid {
+			t.Errorf("unexpected validation result for %+v: %v", tc.target, err)
+		}
+	}
+}
+
+func TestPolicyMerge(t *testing.T) {
+	parent := Policy{Targets: []Target{{Type: TargetWebhook, URL: "http://parent"}}}
+
+	var p Policy
+	p.Merge(parent)
+	if len(p.Targets) != 1 || p.Targets[0].URL != "http://parent" {
+		t.Errorf("targets not inherited: %+v", p)
+	}
+
+	child := Policy{Targets: []Target{{Type: TargetWebhook, URL: "http://child"}}}
+	child.Merge(parent)
+	if len(child.Targets) != 1 || child.Targets[0].URL != "http://child" {
+		t.Errorf("targets should not be inherited: %+v", child)
+	}
+}
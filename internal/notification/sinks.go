@@ -0,0 +1,100 @@
+package notification
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	webhookTimeout = 30 * time.Second
+	commandTimeout = time.Minute
+)
+
+func sendWebhook(ctx context.Context, t *Target, msg *Message) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, t.URL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.Headers {
+		req.Header.Set(k, v)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %v", resp.Status)
+	}
+
+	return nil
+}
+
+func sendEmail(t *Target, msg *Message) error {
+	var auth smtp.Auth
+	if t.SMTPUsername != "" {
+		host, _, err := net.SplitHostPort(t.SMTPServer)
+		if err != nil {
+			return fmt.Errorf("invalid SMTP server: %v", err)
+		}
+		auth = smtp.PlainAuth("", t.SMTPUsername, t.SMTPPassword, host)
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %v\r\n", t.From)
+	fmt.Fprintf(&buf, "To: %v\r\n", strings.Join(t.To, ", "))
+	fmt.Fprintf(&buf, "Subject: %v\r\n", singleLine(msg.Subject))
+	fmt.Fprintf(&buf, "Date: %v\r\n", msg.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&buf, "\r\n")
+	buf.WriteString(strings.Replace(msg.Body, "\n", "\r\n", -1))
+
+	return smtp.SendMail(t.SMTPServer, auth, t.From, t.To, buf.Bytes())
+}
+
+func singleLine(s string) string {
+	return strings.Replace(strings.Replace(s, "\r", " ", -1), "\n", " ", -1)
+}
+
+func runCommand(ctx context.Context, t *Target, msg *Message) error {
+	ctx, cancel := context.WithTimeout(ctx, commandTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, t.Command[0], t.Command[1:]...) //nolint:gosec
+	cmd.Stdin = strings.NewReader(msg.Body)
+	cmd.Env = append(os.Environ(),
+		"KOPIA_NOTIFICATION_EVENT="+string(msg.Event),
+		"KOPIA_NOTIFICATION_TIME="+msg.Time.Format(time.RFC3339),
+		"KOPIA_NOTIFICATION_HOSTNAME="+msg.Hostname,
+		"KOPIA_NOTIFICATION_SOURCE="+msg.Source,
+		"KOPIA_NOTIFICATION_ERROR="+msg.Error,
+		"KOPIA_NOTIFICATION_SUBJECT="+msg.Subject,
+	)
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("command failed: %v %s", err, bytes.TrimSpace(out))
+	}
+
+	return nil
+}
@@ -34,20 +34,32 @@ func (b Builder) sortedBlocks() []*Info {
 }
 
 type indexLayout struct {
-	packFileOffsets map[string]uint32
+	packFileOffsets map[string]int64
 	entryCount      int
 	keyLength       int
 	entryLength     int
-	extraDataOffset uint32
+	extraDataOffset int64
 }
 
-// Build writes the pack index to the provided output.
-func (b Builder) Build(output io.Writer) error {
+// Build writes the pack index in the specified format version to the provided output.
+func (b Builder) Build(output io.Writer, version int) error {
+	var formatEntry func(entry []byte, it *Info, layout *indexLayout) error
+	var entryLength int
+
+	switch version {
+	case Version1:
+		formatEntry, entryLength = formatEntryV1, entryV1Size
+	case Version2:
+		formatEntry, entryLength = formatEntryV2, entryV2Size
+	default:
+		return fmt.Errorf("unsupported index version: %v", version)
+	}
+
 	allBlocks := b.sortedBlocks()
 	layout := &indexLayout{
-		packFileOffsets: map[string]uint32{},
+		packFileOffsets: map[string]int64{},
 		keyLength:       -1,
-		entryLength:     20,
+		entryLength:     entryLength,
 		entryCount:      len(allBlocks),
 	}
 
@@ -57,8 +69,8 @@ func (b Builder) Build(output io.Writer) error {
 	extraData := prepareExtraData(allBlocks, layout)
 
 	// write header
-	header := make([]byte, 8)
-	header[0] = 1 // version
+	header := make([]byte, headerSize)
+	header[0] = byte(version)
 	header[1] = byte(layout.keyLength)
 	binary.BigEndian.PutUint16(header[2:4], uint16(layout.entryLength))
 	binary.BigEndian.PutUint32(header[4:8], uint32(layout.entryCount))
@@ -69,7 +81,7 @@ func (b Builder) Build(output io.Writer) error {
 	// write all sorted blocks.
 	entry := make([]byte, layout.entryLength)
 	for _, it := range allBlocks {
-		if err := writeEntry(w, it, layout, entry); err != nil {
+		if err := writeEntry(w, it, layout, entry, formatEntry); err != nil {
 			return fmt.Errorf("unable to write entry: %v", err)
 		}
 	}
@@ -90,7 +102,7 @@ func prepareExtraData(allBlocks []*Info, layout *indexLayout) []byte {
 		}
 		if it.PackFile != "" {
 			if _, ok := layout.packFileOffsets[it.PackFile]; !ok {
-				layout.packFileOffsets[it.PackFile] = uint32(len(extraData))
+				layout.packFileOffsets[it.PackFile] = int64(len(extraData))
 				extraData = append(extraData, []byte(it.PackFile)...)
 			}
 		}
@@ -98,16 +110,24 @@ func prepareExtraData(allBlocks []*Info, layout *indexLayout) []byte {
 			panic("storing payloads in indexes is not supported")
 		}
 	}
-	layout.extraDataOffset = uint32(8 + layout.entryCount*(layout.keyLength+layout.entryLength))
+	layout.extraDataOffset = int64(headerSize + layout.entryCount*(layout.keyLength+layout.entryLength))
 	return extraData
 }
 
-func writeEntry(w io.Writer, it *Info, layout *indexLayout, entry []byte) error {
+func writeEntry(w io.Writer, it *Info, layout *indexLayout, entry []byte, formatEntry func(entry []byte, it *Info, layout *indexLayout) error) error {
 	k := contentIDToBytes(it.BlockID)
 	if len(k) != layout.keyLength {
 		return fmt.Errorf("inconsistent key length: %v vs %v", len(k), layout.keyLength)
 	}
 
+	if len(it.PackFile) == 0 {
+		return fmt.Errorf("empty pack block ID for %v", it.BlockID)
+	}
+
+	if len(it.PackFile) > 255 {
+		return fmt.Errorf("pack block ID too long for %v: %v", it.BlockID, it.PackFile)
+	}
+
 	if err := formatEntry(entry, it, layout); err != nil {
 		return fmt.Errorf("unable to format entry: %v", err)
 	}
@@ -122,30 +142,67 @@ func writeEntry(w io.Writer, it *Info, layout *indexLayout, entry []byte) error
 	return nil
 }
 
-func formatEntry(entry []byte, it *Info, layout *indexLayout) error {
+func formatEntryV1(entry []byte, it *Info, layout *indexLayout) error {
 	entryTimestampAndFlags := entry[0:8]
 	entryPackFileOffset := entry[8:12]
 	entryPackedOffset := entry[12:16]
 	entryPackedLength := entry[16:20]
 	timestampAndFlags := uint64(it.TimestampSeconds) << 16
 
-	if len(it.PackFile) == 0 {
-		return fmt.Errorf("empty pack block ID for %v", it.BlockID)
+	packFileOffset := layout.extraDataOffset + layout.packFileOffsets[it.PackFile]
+	if packFileOffset > maxV1Uint32 {
+		return fmt.Errorf("index of %v entries is too large for version %v", layout.entryCount, Version1)
+	}
+
+	if it.PackOffset < 0 || it.PackOffset > maxV1PackedOffset || it.Length < 0 || it.Length > maxV1Uint32 {
+		return fmt.Errorf("offset %v and length %v of %v are not supported by index version %v", it.PackOffset, it.Length, it.BlockID, Version1)
 	}
 
-	binary.BigEndian.PutUint32(entryPackFileOffset, layout.extraDataOffset+layout.packFileOffsets[it.PackFile])
+	binary.BigEndian.PutUint32(entryPackFileOffset, uint32(packFileOffset))
 	if it.Deleted {
-		binary.BigEndian.PutUint32(entryPackedOffset, it.PackOffset|0x80000000)
+		binary.BigEndian.PutUint32(entryPackedOffset, uint32(it.PackOffset)|0x80000000)
 	} else {
-		binary.BigEndian.PutUint32(entryPackedOffset, it.PackOffset)
+		binary.BigEndian.PutUint32(entryPackedOffset, uint32(it.PackOffset))
 	}
-	binary.BigEndian.PutUint32(entryPackedLength, it.Length)
+	binary.BigEndian.PutUint32(entryPackedLength, uint32(it.Length))
 	timestampAndFlags |= uint64(it.FormatVersion) << 8
 	timestampAndFlags |= uint64(len(it.PackFile))
 	binary.BigEndian.PutUint64(entryTimestampAndFlags, timestampAndFlags)
 	return nil
 }
 
+func formatEntryV2(entry []byte, it *Info, layout *indexLayout) error {
+	if it.PackOffset < 0 || it.Length < 0 || it.PayloadLength < 0 {
+		return fmt.Errorf("invalid offset %v and length %v of %v", it.PackOffset, it.Length, it.BlockID)
+	}
+
+	var flags byte
+	if it.Deleted {
+		flags |= entryFlagDeleted
+	}
+	if it.Compressed {
+		flags |= entryFlagCompressed
+	}
+	if it.Encrypted {
+		flags |= entryFlagEncrypted
+	}
+	if it.Checksum != 0 {
+		flags |= entryFlagChecksum
+	}
+
+	binary.BigEndian.PutUint64(entry[0:8], uint64(it.TimestampSeconds))
+	binary.BigEndian.PutUint64(entry[8:16], uint64(layout.extraDataOffset+layout.packFileOffsets[it.PackFile]))
+	binary.BigEndian.PutUint64(entry[16:24], uint64(it.PackOffset))
+	binary.BigEndian.PutUint64(entry[24:32], uint64(it.Length))
+	entry[32] = it.FormatVersion
+	entry[33] = flags
+	entry[34] = byte(len(it.PackFile))
+	entry[35] = 0
+	binary.BigEndian.PutUint32(entry[36:40], it.Checksum)
+	binary.BigEndian.PutUint64(entry[40:48], uint64(it.PayloadLength))
+	return nil
+}
+
 // NewBuilder creates a new Builder.
 func NewBuilder() Builder {
 	return make(map[string]*Info)
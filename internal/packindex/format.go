@@ -5,18 +5,39 @@ import (
 	"fmt"
 )
 
+// Supported versions of the pack index format.
+const (
+	// Version1 stores pack offsets as 31-bit and lengths as 32-bit numbers.
+	Version1 = 1
+
+	// Version2 stores 64-bit offsets and lengths, block flags and checksums.
+	Version2 = 2
+
+	// DefaultVersion is the version of indexes written unless the repository opts into a newer one.
+	DefaultVersion = Version1
+)
+
+const (
+	headerSize  = 8
+	entryV1Size = 20
+	entryV2Size = 48
+
+	maxV1PackedOffset = 0x7fffffff // the most significant bit marks deleted entries
+	maxV1Uint32       = 0xffffffff
+)
+
 // Format describes a format of a single pack index. The actual structure is not used,
 // it's purely for documentation purposes.
 // The struct is byte-aligned.
 type Format struct {
-	Version    byte   // format version number must be 0x01
+	Version    byte   // format version number, 0x01 or 0x02
 	KeySize    byte   // size of each key in bytes
 	EntrySize  uint16 // size of each entry in bytes, big-endian
 	EntryCount uint32 // number of sorted (key,value) entries that follow
 
 	Entries []struct {
 		Key   []byte // key bytes (KeySize)
-		Entry entry
+		Entry entry  // entryV2 in version 2
 	}
 
 	ExtraData []byte // extra data
@@ -34,7 +55,7 @@ type entry struct {
 }
 
 func (e *entry) parse(b []byte) error {
-	if len(b) < 20 {
+	if len(b) < entryV1Size {
 		return fmt.Errorf("invalid entry length: %v", len(b))
 	}
 
@@ -72,3 +93,46 @@ func (e *entry) PackedOffset() uint32 {
 func (e *entry) PackedLength() uint32 {
 	return e.packedLength
 }
+
+// Flags of entryV2.
+const (
+	entryFlagDeleted    = 1 << 0
+	entryFlagCompressed = 1 << 1
+	entryFlagEncrypted  = 1 << 2
+	entryFlagChecksum   = 1 << 3
+)
+
+type entryV2 struct {
+	// big endian:
+	timestampSeconds int64  // 8 bytes, seconds since 1970/01/01 UTC
+	packFileOffset   uint64 // 8 bytes, offset within index file where pack block ID begins
+	packedOffset     uint64 // 8 bytes, offset within pack file where the contents begin
+	packedLength     uint64 // 8 bytes, content length
+	formatVersion    byte   // block format version
+	flags            byte   // combination of entryFlag* values
+	packFileLength   byte   // length of pack block ID
+	_                byte   // reserved, must be zero
+	checksum         uint32 // 4 bytes, checksum of block contents, valid if entryFlagChecksum is set
+	payloadLength    uint64 // 8 bytes, length of block contents before compression and encryption, 0 if unknown
+}
+
+func (e *entryV2) parse(b []byte) error {
+	if len(b) < entryV2Size {
+		return fmt.Errorf("invalid entry length: %v", len(b))
+	}
+
+	e.timestampSeconds = int64(binary.BigEndian.Uint64(b[0:8]))
+	e.packFileOffset = binary.BigEndian.Uint64(b[8:16])
+	e.packedOffset = binary.BigEndian.Uint64(b[16:24])
+	e.packedLength = binary.BigEndian.Uint64(b[24:32])
+	e.formatVersion = b[32]
+	e.flags = b[33]
+	e.packFileLength = b[34]
+	e.checksum = binary.BigEndian.Uint32(b[36:40])
+	e.payloadLength = binary.BigEndian.Uint64(b[40:48])
+	return nil
+}
+
+func (e *entryV2) hasFlag(f byte) bool {
+	return e.flags&f != 0
+}
@@ -5,9 +5,9 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
 	"sort"
 	"strings"
-	"sync"
 )
 
 // Index is a read-only index of packed blocks.
@@ -19,34 +19,49 @@ type Index interface {
 	Iterate(prefix string, cb func(Info) error) error
 }
 
+// index does not need locking because io.ReaderAt permits parallel reads, so it can be
+// looked up while it's being iterated.
 type index struct {
 	hdr      headerInfo
-	mu       sync.Mutex
 	readerAt io.ReaderAt
 }
 
 type headerInfo struct {
+	version    int
 	keySize    int
 	valueSize  int
 	entryCount int
 }
 
 func readHeader(readerAt io.ReaderAt) (headerInfo, error) {
-	var header [8]byte
+	var header [headerSize]byte
 
-	if n, err := readerAt.ReadAt(header[:], 0); err != nil || n != 8 {
+	if n, err := readerAt.ReadAt(header[:], 0); err != nil || n != headerSize {
 		return headerInfo{}, fmt.Errorf("invalid header: %v", err)
 	}
 
-	if header[0] != 1 {
-		return headerInfo{}, fmt.Errorf("invalid header format: %v", header[0])
-	}
-
-	return headerInfo{
+	hi := headerInfo{
+		version:    int(header[0]),
 		keySize:    int(header[1]),
 		valueSize:  int(binary.BigEndian.Uint16(header[2:4])),
 		entryCount: int(binary.BigEndian.Uint32(header[4:8])),
-	}, nil
+	}
+
+	var minValueSize int
+	switch hi.version {
+	case Version1:
+		minValueSize = entryV1Size
+	case Version2:
+		minValueSize = entryV2Size
+	default:
+		return headerInfo{}, fmt.Errorf("invalid header format: %v", header[0])
+	}
+
+	if hi.valueSize < minValueSize {
+		return headerInfo{}, fmt.Errorf("invalid entry size for version %v: %v", hi.version, hi.valueSize)
+	}
+
+	return hi, nil
 }
 
 // EntryCount returns the number of block entries in an index.
@@ -58,9 +73,6 @@ func (b *index) EntryCount() int {
 // The iteration ends when the callback returns an error, which is propagated to the caller or when
 // all blocks have been visited.
 func (b *index) Iterate(prefix string, cb func(Info) error) error {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-
 	startPos, err := b.findEntryPosition(prefix)
 	if err != nil {
 		return fmt.Errorf("could not find starting position: %v", err)
@@ -68,7 +80,7 @@ func (b *index) Iterate(prefix string, cb func(Info) error) error {
 	stride := b.hdr.keySize + b.hdr.valueSize
 	entry := make([]byte, stride)
 	for i := startPos; i < b.hdr.entryCount; i++ {
-		n, err := b.readerAt.ReadAt(entry, int64(8+stride*i))
+		n, err := b.readerAt.ReadAt(entry, int64(headerSize+stride*i))
 		if err != nil || n != len(entry) {
 			return fmt.Errorf("unable to read from index: %v", err)
 		}
@@ -98,7 +110,7 @@ func (b *index) findEntryPosition(blockID string) (int, error) {
 		if readErr != nil {
 			return false
 		}
-		_, err := b.readerAt.ReadAt(entryBuf, int64(8+stride*p))
+		_, err := b.readerAt.ReadAt(entryBuf, int64(headerSize+stride*p))
 		if err != nil {
 			readErr = err
 			return false
@@ -126,7 +138,7 @@ func (b *index) findEntry(blockID string) ([]byte, error) {
 	}
 
 	entryBuf := make([]byte, stride)
-	if _, err := b.readerAt.ReadAt(entryBuf, int64(8+stride*position)); err != nil {
+	if _, err := b.readerAt.ReadAt(entryBuf, int64(headerSize+stride*position)); err != nil {
 		return nil, err
 	}
 
@@ -139,9 +151,6 @@ func (b *index) findEntry(blockID string) ([]byte, error) {
 
 // GetInfo returns information about a given block. If a block is not found, nil is returned.
 func (b *index) GetInfo(blockID string) (*Info, error) {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-
 	e, err := b.findEntry(blockID)
 	if err != nil {
 		return nil, err
@@ -159,7 +168,11 @@ func (b *index) GetInfo(blockID string) (*Info, error) {
 }
 
 func (b *index) entryToInfo(blockID string, entryData []byte) (Info, error) {
-	if len(entryData) < 20 {
+	if b.hdr.version == Version2 {
+		return b.entryV2ToInfo(blockID, entryData)
+	}
+
+	if len(entryData) < entryV1Size {
 		return Info{}, fmt.Errorf("invalid entry length: %v", len(entryData))
 	}
 
@@ -168,10 +181,9 @@ func (b *index) entryToInfo(blockID string, entryData []byte) (Info, error) {
 		return Info{}, err
 	}
 
-	packFile := make([]byte, e.PackFileLength())
-	n, err := b.readerAt.ReadAt(packFile, int64(e.PackFileOffset()))
-	if err != nil || n != int(e.PackFileLength()) {
-		return Info{}, fmt.Errorf("can't read pack block ID: %v", err)
+	packFile, err := b.readPackFile(int64(e.PackFileOffset()), int(e.PackFileLength()))
+	if err != nil {
+		return Info{}, err
 	}
 
 	return Info{
@@ -179,12 +191,57 @@ func (b *index) entryToInfo(blockID string, entryData []byte) (Info, error) {
 		Deleted:          e.IsDeleted(),
 		TimestampSeconds: e.TimestampSeconds(),
 		FormatVersion:    e.PackedFormatVersion(),
-		PackOffset:       e.PackedOffset(),
-		Length:           e.PackedLength(),
-		PackFile:         string(packFile),
+		PackOffset:       int64(e.PackedOffset()),
+		Length:           int64(e.PackedLength()),
+		PackFile:         packFile,
 	}, nil
 }
 
+func (b *index) entryV2ToInfo(blockID string, entryData []byte) (Info, error) {
+	var e entryV2
+	if err := e.parse(entryData); err != nil {
+		return Info{}, err
+	}
+
+	if e.packedOffset > math.MaxInt64 || e.packedLength > math.MaxInt64 || e.packFileOffset > math.MaxInt64 || e.payloadLength > math.MaxInt64 {
+		return Info{}, fmt.Errorf("invalid offset or length of %v", blockID)
+	}
+
+	packFile, err := b.readPackFile(int64(e.packFileOffset), int(e.packFileLength))
+	if err != nil {
+		return Info{}, err
+	}
+
+	i := Info{
+		BlockID:          blockID,
+		Deleted:          e.hasFlag(entryFlagDeleted),
+		Compressed:       e.hasFlag(entryFlagCompressed),
+		Encrypted:        e.hasFlag(entryFlagEncrypted),
+		TimestampSeconds: e.timestampSeconds,
+		FormatVersion:    e.formatVersion,
+		PackOffset:       int64(e.packedOffset),
+		Length:           int64(e.packedLength),
+		PayloadLength:    int64(e.payloadLength),
+		PackFile:         packFile,
+	}
+
+	if e.hasFlag(entryFlagChecksum) {
+		i.Checksum = e.checksum
+	}
+
+	return i, nil
+}
+
+func (b *index) readPackFile(offset int64, length int) (string, error) {
+	packFile := make([]byte, length)
+	n, err := b.readerAt.ReadAt(packFile, offset)
+	if err != nil || n != length {
+		return "", fmt.Errorf("can't read pack block ID: %v", err)
+	}
+
+	return string(packFile), nil
+}
+
 // Close closes the index and the underlying reader.
 func (b *index) Close() error {
 	if closer, ok := b.readerAt.(io.Closer); ok {
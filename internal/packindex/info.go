@@ -2,19 +2,28 @@ package packindex
 
 import (
 	"encoding/json"
+	"hash/crc32"
 	"time"
 )
 
+var checksumTable = crc32.MakeTable(crc32.Castagnoli)
+
 // Info is an information about a single block managed by Manager.
 type Info struct {
 	BlockID          string `json:"blockID"`
-	Length           uint32 `json:"length"`
+	Length           int64  `json:"length"`
 	TimestampSeconds int64  `json:"time"`
 	PackFile         string `json:"packFile,omitempty"`
-	PackOffset       uint32 `json:"packOffset,omitempty"`
+	PackOffset       int64  `json:"packOffset,omitempty"`
 	Deleted          bool   `json:"deleted"`
 	Payload          []byte `json:"payload"` // set for payloads stored inline
 	FormatVersion    byte   `json:"formatVersion"`
+
+	// The following fields are only persisted in version 2 indexes.
+	Compressed    bool   `json:"compressed,omitempty"`    // block contents have been compressed
+	Encrypted     bool   `json:"encrypted,omitempty"`     // block contents have been encrypted
+	Checksum      uint32 `json:"checksum,omitempty"`      // Checksum() of the stored block, 0 if unknown
+	PayloadLength int64  `json:"payloadLength,omitempty"` // length of block contents before compression and encryption, 0 if unknown
 }
 
 // Timestamp returns the time when a block was created or deleted.
@@ -26,3 +35,8 @@ func (i Info) String() string {
 	b, _ := json.Marshal(i)
 	return string(b)
 }
+
+// Checksum returns the checksum (CRC-32C) of the stored block data to be recorded in Info.
+func Checksum(data []byte) uint32 {
+	return crc32.Checksum(data, checksumTable)
+}
@@ -37,7 +37,7 @@ func (m Merged) GetInfo(contentID string) (*Info, error) {
 			return nil, err
 		}
 		if i != nil {
-			if best == nil || i.TimestampSeconds > best.TimestampSeconds || (i.TimestampSeconds == best.TimestampSeconds && !i.Deleted) {
+			if best == nil || isBetterInfo(*i, *best) {
 				best = i
 			}
 		}
@@ -45,6 +45,31 @@ func (m Merged) GetInfo(contentID string) (*Info, error) {
 	return best, nil
 }
 
+// isBetterInfo returns true if i should be used instead of other entry describing the same block.
+// Newer entries win, then non-deleted ones and then the ones with checksums, which are only present
+// in version 2 indexes, so that merging indexes of mixed versions does not lose information.
+// Remaining ties are broken by location of the block, so that GetInfo() and Iterate() always
+// choose the same entry regardless of the order in which they see them.
+func isBetterInfo(i, other Info) bool {
+	if i.TimestampSeconds != other.TimestampSeconds {
+		return i.TimestampSeconds > other.TimestampSeconds
+	}
+
+	if i.Deleted != other.Deleted {
+		return !i.Deleted
+	}
+
+	if hasChecksum, otherHasChecksum := i.Checksum != 0, other.Checksum != 0; hasChecksum != otherHasChecksum {
+		return hasChecksum
+	}
+
+	if i.PackFile != other.PackFile {
+		return i.PackFile > other.PackFile
+	}
+
+	return i.PackOffset > other.PackOffset
+}
+
 type nextInfo struct {
 	it Info
 	ch <-chan Info
@@ -121,7 +146,7 @@ func (m Merged) Iterate(prefix string, cb func(i Info) error) error {
 			}
 
 			pendingItem = min.it
-		} else if min.it.TimestampSeconds > pendingItem.TimestampSeconds {
+		} else if isBetterInfo(min.it, pendingItem) {
 			pendingItem = min.it
 		}
 
@@ -42,7 +42,7 @@ func TestMerged(t *testing.T) {
 	if err != nil || i == nil {
 		t.Fatalf("unable to get info: %v", err)
 	}
-	if got, want := i.PackOffset, uint32(33); got != want {
+	if got, want := i.PackOffset, int64(33); got != want {
 		t.Errorf("invalid pack offset %v, wanted %v", got, want)
 	}
 
@@ -77,14 +77,97 @@ func TestMerged(t *testing.T) {
 	}
 }
 
+func TestMergedMixedVersions(t *testing.T) {
+	i1, err := indexVersionWithItems(packindex.Version1,
+		packindex.Info{BlockID: "aabbcc", TimestampSeconds: 1, PackFile: "xx", PackOffset: 11},
+		packindex.Info{BlockID: "ddeeff", TimestampSeconds: 2, PackFile: "xx", PackOffset: 111},
+	)
+	if err != nil {
+		t.Fatalf("can't create index: %v", err)
+	}
+	i2, err := indexVersionWithItems(packindex.Version2,
+		packindex.Info{BlockID: "aabbcc", TimestampSeconds: 1, PackFile: "xx", PackOffset: 11, Checksum: 1234},
+		packindex.Info{BlockID: "ddeeff", TimestampSeconds: 1, PackFile: "yy", PackOffset: 222, Checksum: 5678},
+	)
+	if err != nil {
+		t.Fatalf("can't create index: %v", err)
+	}
+
+	for _, m := range []packindex.Merged{{i1, i2}, {i2, i1}} {
+		got := map[string]packindex.Info{}
+		m.Iterate("", func(i packindex.Info) error {
+			got[i.BlockID] = i
+			return nil
+		})
+
+		for blockID, want := range map[string]uint32{
+			// same entry in both versions, the one with checksum is preferred.
+			"aabbcc": 1234,
+			// newer entry in v1 index wins.
+			"ddeeff": 0,
+		} {
+			if got, want := got[blockID].Checksum, want; got != want {
+				t.Errorf("invalid checksum of iterated %v: %v, want %v", blockID, got, want)
+			}
+
+			i, err := m.GetInfo(blockID)
+			if err != nil || i == nil {
+				t.Fatalf("unable to get info: %v", err)
+			}
+			if got, want := i.Checksum, want; got != want {
+				t.Errorf("invalid checksum of %v: %v, want %v", blockID, got, want)
+			}
+		}
+	}
+}
+
 func indexWithItems(items ...packindex.Info) (packindex.Index, error) {
+	return indexVersionWithItems(packindex.Version1, items...)
+}
+
+func indexVersionWithItems(version int, items ...packindex.Info) (packindex.Index, error) {
 	b := packindex.NewBuilder()
 	for _, it := range items {
 		b.Add(it)
 	}
 	var buf bytes.Buffer
-	if err := b.Build(&buf); err != nil {
+	if err := b.Build(&buf, version); err != nil {
 		return nil, fmt.Errorf("build error: %v", err)
 	}
 	return packindex.Open(bytes.NewReader(buf.Bytes()))
 }
+
+func TestMergedTiesAreConsistent(t *testing.T) {
+	// same block rewritten to another pack within the same second.
+	i1, err := indexWithItems(packindex.Info{BlockID: "aabbcc", TimestampSeconds: 1, PackFile: "xx", PackOffset: 11})
+	if err != nil {
+		t.Fatalf("can't create index: %v", err)
+	}
+	i2, err := indexWithItems(packindex.Info{BlockID: "aabbcc", TimestampSeconds: 1, PackFile: "yy", PackOffset: 22})
+	if err != nil {
+		t.Fatalf("can't create index: %v", err)
+	}
+
+	for _, m := range []packindex.Merged{{i1, i2}, {i2, i1}} {
+		got, err := m.GetInfo("aabbcc")
+		if err != nil || got == nil {
+			t.Fatalf("unable to get info: %v", err)
+		}
+
+		var iterated []packindex.Info
+		if err := m.Iterate("", func(i packindex.Info) error {
+			iterated = append(iterated, i)
+			return nil
+		}); err != nil {
+			t.Fatalf("iterate error: %v", err)
+		}
+
+		if len(iterated) != 1 || !reflect.DeepEqual(iterated[0], *got) {
+			t.Errorf("iteration returned %v, but GetInfo() returned %v", iterated, *got)
+		}
+
+		if got.PackFile != "yy" {
+			t.Errorf("unexpected pack file %v", got.PackFile)
+		}
+	}
+}
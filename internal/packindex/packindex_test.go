@@ -14,6 +14,14 @@ import (
 )
 
 func TestPackIndex(t *testing.T) {
+	for _, version := range []int{packindex.Version1, packindex.Version2} {
+		t.Run(fmt.Sprintf("v%v", version), func(t *testing.T) {
+			verifyPackIndex(t, version)
+		})
+	}
+}
+
+func verifyPackIndex(t *testing.T, version int) {
 	blockNumber := 0
 
 	deterministicBlockID := func(prefix string, id int) string {
@@ -40,15 +48,30 @@ func TestPackIndex(t *testing.T) {
 		return string(fmt.Sprintf("%x", h.Sum(nil)))
 	}
 
-	deterministicPackedOffset := func(id int) uint32 {
+	deterministicPackedOffset := func(id int) int64 {
 		s := rand.NewSource(int64(id + 1))
 		rnd := rand.New(s)
-		return uint32(rnd.Int31())
+		if version == packindex.Version2 {
+			return rnd.Int63()
+		}
+		return int64(rnd.Int31())
 	}
-	deterministicPackedLength := func(id int) uint32 {
+	deterministicPackedLength := func(id int) int64 {
 		s := rand.NewSource(int64(id + 2))
 		rnd := rand.New(s)
-		return uint32(rnd.Int31())
+		if version == packindex.Version2 {
+			return rnd.Int63()
+		}
+		return int64(rnd.Int31())
+	}
+	withV2Fields := func(i packindex.Info, id int) packindex.Info {
+		if version == packindex.Version2 {
+			i.Compressed = id%3 == 0
+			i.Encrypted = id%2 == 0
+			i.Checksum = uint32(id * 7)
+			i.PayloadLength = int64(id * 11)
+		}
+		return i
 	}
 	deterministicFormatVersion := func(id int) byte {
 		return byte(id % 100)
@@ -62,7 +85,7 @@ func TestPackIndex(t *testing.T) {
 
 	// deleted blocks with all information
 	for i := 0; i < 100; i++ {
-		infos = append(infos, packindex.Info{
+		infos = append(infos, withV2Fields(packindex.Info{
 			TimestampSeconds: randomUnixTime(),
 			Deleted:          true,
 			BlockID:          deterministicBlockID("deleted-packed", i),
@@ -70,18 +93,18 @@ func TestPackIndex(t *testing.T) {
 			PackOffset:       deterministicPackedOffset(i),
 			Length:           deterministicPackedLength(i),
 			FormatVersion:    deterministicFormatVersion(i),
-		})
+		}, i))
 	}
 	// non-deleted block
 	for i := 0; i < 100; i++ {
-		infos = append(infos, packindex.Info{
+		infos = append(infos, withV2Fields(packindex.Info{
 			TimestampSeconds: randomUnixTime(),
 			BlockID:          deterministicBlockID("packed", i),
 			PackFile:         deterministicPackFile(i),
 			PackOffset:       deterministicPackedOffset(i),
 			Length:           deterministicPackedLength(i),
 			FormatVersion:    deterministicFormatVersion(i),
-		})
+		}, i))
 	}
 
 	infoMap := map[string]packindex.Info{}
@@ -99,13 +122,13 @@ func TestPackIndex(t *testing.T) {
 	var buf1 bytes.Buffer
 	var buf2 bytes.Buffer
 	var buf3 bytes.Buffer
-	if err := b1.Build(&buf1); err != nil {
+	if err := b1.Build(&buf1, version); err != nil {
 		t.Errorf("unable to build: %v", err)
 	}
-	if err := b1.Build(&buf2); err != nil {
+	if err := b1.Build(&buf2, version); err != nil {
 		t.Errorf("unable to build: %v", err)
 	}
-	if err := b1.Build(&buf3); err != nil {
+	if err := b1.Build(&buf3, version); err != nil {
 		t.Errorf("unable to build: %v", err)
 	}
 	data1 := buf1.Bytes()
@@ -172,3 +195,66 @@ func TestPackIndex(t *testing.T) {
 		t.Logf("found %v elements with prefix %q", cnt2, prefix)
 	}
 }
+
+func TestPackIndexV1Limits(t *testing.T) {
+	for _, info := range []packindex.Info{
+		{BlockID: "aabbcc", PackFile: "xx", PackOffset: 1 << 31},
+		{BlockID: "aabbcc", PackFile: "xx", Length: 1 << 32},
+	} {
+		b := packindex.NewBuilder()
+		b.Add(info)
+
+		var buf bytes.Buffer
+		if err := b.Build(&buf, packindex.Version1); err == nil {
+			t.Errorf("expected error when building v1 index with %v", info)
+		}
+
+		buf.Reset()
+		if err := b.Build(&buf, packindex.Version2); err != nil {
+			t.Fatalf("unable to build v2 index with %v: %v", info, err)
+		}
+
+		ndx, err := packindex.Open(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("can't open index: %v", err)
+		}
+
+		info2, err := ndx.GetInfo(info.BlockID)
+		if err != nil || info2 == nil {
+			t.Fatalf("unable to get info: %v", err)
+		}
+
+		if !reflect.DeepEqual(info, *info2) {
+			t.Errorf("invalid value retrieved: %+v, wanted %+v", *info2, info)
+		}
+	}
+}
+
+func TestPackIndexGetInfoWhileIterating(t *testing.T) {
+	b := packindex.NewBuilder()
+	for i := 0; i < 10; i++ {
+		b.Add(packindex.Info{BlockID: fmt.Sprintf("%02x", i), PackFile: "xx", PackOffset: int64(i)})
+	}
+
+	var buf bytes.Buffer
+	if err := b.Build(&buf, packindex.DefaultVersion); err != nil {
+		t.Fatalf("unable to build index: %v", err)
+	}
+
+	ndx, err := packindex.Open(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("can't open index: %v", err)
+	}
+
+	// lookups from the callback must not block, even when iterating on another goroutine.
+	m := packindex.Merged{ndx}
+	if err := m.Iterate("", func(i packindex.Info) error {
+		i2, err := m.GetInfo(i.BlockID)
+		if err != nil || i2 == nil {
+			return fmt.Errorf("unable to get info for %v: %v", i.BlockID, err)
+		}
+		return nil
+	}); err != nil {
+		t.Errorf("iterate error: %v", err)
+	}
+}
@@ -53,7 +53,7 @@ func indexWithBlockIDs(items []string) (packindex.Index, error) {
 		})
 	}
 	var buf bytes.Buffer
-	if err := b.Build(&buf); err != nil {
+	if err := b.Build(&buf, packindex.Version1); err != nil {
 		return nil, fmt.Errorf("build error: %v", err)
 	}
 	return packindex.Open(bytes.NewReader(buf.Bytes()))
@@ -0,0 +1,104 @@
+// Package repotesting implements test environments with repositories stored in local filesystem.
+package repotesting
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kopia/kopia/repo"
+	"github.com/kopia/kopia/repo/storage"
+	"github.com/kopia/kopia/repo/storage/filesystem"
+)
+
+// Password is the password of test repositories.
+const Password = "foo"
+
+// Environment is a repository created in a temporary directory, which also contains its configuration file.
+type Environment struct {
+	Dir        string
+	StorageDir string
+	ConfigFile string
+	Storage    storage.Storage
+
+	// Repository is the instance of the repository opened by Setup or Reopen.
+	Repository *repo.Repository
+
+	t *testing.T
+}
+
+// Setup creates a new repository with given options in a temporary directory, connects to it and opens it.
+func Setup(t *testing.T, opt *repo.NewRepositoryOptions, connectOpt repo.ConnectOptions) *Environment {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "kopia-test")
+	if err != nil {
+		t.Fatalf("cannot create temp directory: %v", err)
+	}
+
+	e := &Environment{
+		Dir:        dir,
+		StorageDir: filepath.Join(dir, "repo"),
+		ConfigFile: filepath.Join(dir, ".kopia.config"),
+		t:          t,
+	}
+
+	if err := os.Mkdir(e.StorageDir, 0700); err != nil {
+		t.Fatalf("cannot create storage directory: %v", err)
+	}
+
+	e.Storage, err = filesystem.New(ctx, &filesystem.Options{Path: e.StorageDir})
+	if err != nil {
+		t.Fatalf("cannot create storage: %v", err)
+	}
+
+	if opt == nil {
+		opt = &repo.NewRepositoryOptions{}
+	}
+
+	if err := repo.Initialize(ctx, e.Storage, opt, Password); err != nil {
+		t.Fatalf("unable to create repository: %v", err)
+	}
+
+	if err := repo.Connect(ctx, e.ConfigFile, e.Storage, Password, connectOpt); err != nil {
+		t.Fatalf("unable to connect to repository: %v", err)
+	}
+
+	e.Repository = e.Open()
+	return e
+}
+
+// Open opens another instance of the repository, which must be closed by the caller.
+func (e *Environment) Open() *repo.Repository {
+	rep, err := repo.Open(context.Background(), e.ConfigFile, Password, &repo.Options{})
+	if err != nil {
+		e.t.Fatalf("unable to open repository: %v", err)
+	}
+
+	return rep
+}
+
+// Reopen closes the repository and opens it again, discarding any cached state.
+func (e *Environment) Reopen() {
+	if err := e.Repository.Close(context.Background()); err != nil {
+		e.t.Fatalf("unable to close repository: %v", err)
+	}
+
+	e.Repository = e.Open()
+}
+
+// Close closes the repository and removes the temporary directory.
+func (e *Environment) Close() {
+	e.Repository.Close(context.Background()) //nolint:errcheck
+	os.RemoveAll(e.Dir)                      //nolint:errcheck
+}
+
+// TestData returns deterministic data of a given length, which differs for each seed.
+func TestData(seed byte, length int) []byte {
+	b := make([]byte, length)
+	for i := range b {
+		b[i] = seed + byte(i*7%251)
+	}
+	return b
+}
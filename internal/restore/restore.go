@@ -0,0 +1,505 @@
+// Package restore implements restoring snapshot contents to a local filesystem.
+package restore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/kopia/kopia/fs"
+	"github.com/kopia/kopia/internal/ignore"
+	"github.com/kopia/kopia/internal/kopialogging"
+	"github.com/kopia/kopia/internal/parallelwork"
+)
+
+var log = kopialogging.Logger("kopia/restore")
+
+var errCancelled = errors.New("cancelled")
+
+// Stats keeps track of restore statistics.
+type Stats struct {
+	RestoredTotalFileSize int64 `json:"restoredTotalSize"`
+
+	RestoredFileCount    int32 `json:"restoredFileCount"`
+	RestoredDirCount     int32 `json:"restoredDirCount"`
+	RestoredSymlinkCount int32 `json:"restoredSymlinkCount"`
+	SkippedCount         int32 `json:"skippedCount"`
+	ExcludedCount        int32 `json:"excludedCount"`
+	IgnoredErrorCount    int32 `json:"ignoredErrorCount"`
+}
+
+// Restorer supports restoring files, directories and symbolic links from fs.Entry to local filesystem.
+type Restorer struct {
+	// Number of files to restore in parallel.
+	Parallel int
+
+	// Overwrite existing files and symbolic links.
+	Overwrite bool
+
+	// Leave existing files and symbolic links untouched.
+	SkipExisting bool
+
+	// Do not restore file and directory ownership (uid/gid).
+	IgnoreOwnership bool
+
+	// Ignore errors when restoring permissions, modification times and ownership.
+	IgnoreMetadataErrors bool
+
+	// Restore only entries matching at least one of the rules (gitignore syntax, relative to the restore root).
+	IncludeRules []string
+
+	// Do not restore entries matching any of the rules (gitignore syntax, relative to the restore root).
+	ExcludeRules []string
+
+	// Reports the progress of the restore.
+	ProgressCallback func(enqueued, active, completed int64)
+
+	includeMatchers []ignore.Matcher
+	excludeMatchers []ignore.Matcher
+
+	stats     Stats
+	cancelled int32
+
+	mu          sync.Mutex
+	firstError  error
+	directories []*restoredDirectory // directories whose metadata must be applied after contents have been restored
+}
+
+type restoredDirectory struct {
+	path     string
+	metadata *fs.EntryMetadata
+}
+
+// NewRestorer creates new Restorer object.
+func NewRestorer() *Restorer {
+	return &Restorer{
+		Parallel:             1,
+		IgnoreMetadataErrors: true,
+	}
+}
+
+// Cancel requests cancellation of a restore that's in progress.
+func (r *Restorer) Cancel() {
+	atomic.StoreInt32(&r.cancelled, 1)
+}
+
+// IsCancelled returns true if the restore is cancelled.
+func (r *Restorer) IsCancelled() bool {
+	return atomic.LoadInt32(&r.cancelled) != 0
+}
+
+// Restore restores the provided filesystem entry (file, directory or symbolic link) to the target path.
+// When the entry is a directory, target path is the directory where its contents will be restored.
+func (r *Restorer) Restore(ctx context.Context, source fs.Entry, targetPath string) (*Stats, error) {
+	if r.Overwrite && r.SkipExisting {
+		return nil, fmt.Errorf("overwrite and skip-existing are mutually exclusive")
+	}
+
+	if err := r.parseRules(); err != nil {
+		return nil, err
+	}
+
+	targetPath, err := filepath.Abs(targetPath)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target path: %v", err)
+	}
+
+	r.stats = Stats{}
+	r.firstError = nil
+	r.directories = nil
+
+	q := parallelwork.NewQueue()
+	q.ProgressCallback = r.ProgressCallback
+	q.EnqueueBack(func() {
+		r.restoreEntry(ctx, q, source, ".", targetPath, false)
+	})
+
+	parallel := r.Parallel
+	if parallel <= 0 {
+		parallel = 1
+	}
+	q.Process(parallel)
+
+	if r.firstError == nil {
+		r.applyDirectoryMetadata()
+	}
+
+	if r.firstError != nil {
+		return nil, r.firstError
+	}
+
+	if r.IsCancelled() {
+		return nil, errCancelled
+	}
+
+	s := r.stats
+	return &s, nil
+}
+
+func (r *Restorer) parseRules() error {
+	r.includeMatchers = nil
+	r.excludeMatchers = nil
+
+	for _, rule := range r.IncludeRules {
+		m, err := ignore.ParseGitIgnore(".", rule)
+		if err != nil {
+			return fmt.Errorf("invalid include rule %q: %v", rule, err)
+		}
+		r.includeMatchers = append(r.includeMatchers, m)
+	}
+
+	for _, rule := range r.ExcludeRules {
+		m, err := ignore.ParseGitIgnore(".", rule)
+		if err != nil {
+			return fmt.Errorf("invalid exclude rule %q: %v", rule, err)
+		}
+		r.excludeMatchers = append(r.excludeMatchers, m)
+	}
+
+	return nil
+}
+
+func matchesAny(matchers []ignore.Matcher, relativePath string, isDir bool) bool {
+	for _, m := range matchers {
+		if m(relativePath, isDir) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// restoreEntry restores a single entry, 'included' indicates that one of the parent directories
+// already matched an include rule.
+func (r *Restorer) restoreEntry(ctx context.Context, q *parallelwork.Queue, e fs.Entry, relativePath string, targetPath string, included bool) {
+	if r.IsCancelled() || r.hasFailed() {
+		return
+	}
+
+	md := e.Metadata()
+	isDir := md.FileMode().IsDir()
+
+	if relativePath != "." {
+		if matchesAny(r.excludeMatchers, relativePath, isDir) {
+			log.Debugf("excluding %v", relativePath)
+			atomic.AddInt32(&r.stats.ExcludedCount, 1)
+			return
+		}
+
+		if !included && matchesAny(r.includeMatchers, relativePath, isDir) {
+			included = true
+		}
+	}
+
+	if len(r.includeMatchers) == 0 {
+		included = true
+	}
+
+	var err error
+
+	switch e := e.(type) {
+	case fs.Directory:
+		err = r.restoreDirectory(ctx, q, e, relativePath, targetPath, included)
+
+	case fs.File:
+		if !included {
+			return
+		}
+		err = r.restoreFile(ctx, e, targetPath, isSynthesizedRoot(relativePath, md))
+
+	case fs.Symlink:
+		if !included {
+			return
+		}
+		err = r.restoreSymlink(ctx, e, targetPath)
+
+	default:
+		err = fmt.Errorf("unsupported entry type: %v", md.Type)
+	}
+
+	if err != nil {
+		r.reportError(fmt.Errorf("unable to restore %v: %v", relativePath, err))
+	}
+}
+
+func (r *Restorer) restoreDirectory(ctx context.Context, q *parallelwork.Queue, d fs.Directory, relativePath string, targetPath string, included bool) error {
+	entries, err := d.Readdir(ctx)
+	if err != nil {
+		return err
+	}
+
+	if included {
+		// create the directory even if it's empty.
+		if err := r.createDirectory(targetPath); err != nil {
+			return err
+		}
+	}
+
+	if !isSynthesizedRoot(relativePath, d.Metadata()) {
+		r.mu.Lock()
+		r.directories = append(r.directories, &restoredDirectory{targetPath, d.Metadata()})
+		r.mu.Unlock()
+	}
+
+	for _, e := range entries {
+		if !isSafeEntryName(e.Metadata().Name) {
+			return fmt.Errorf("invalid entry name %q", e.Metadata().Name)
+		}
+	}
+
+	for _, e := range entries {
+		e := e
+		childRelativePath := relativePath + "/" + e.Metadata().Name
+		childTargetPath := filepath.Join(targetPath, e.Metadata().Name)
+
+		q.EnqueueBack(func() {
+			r.restoreEntry(ctx, q, e, childRelativePath, childTargetPath, included)
+		})
+	}
+
+	return nil
+}
+
+// isSynthesizedRoot returns true for root entries synthesized from bare object IDs, which have no meaningful metadata.
+func isSynthesizedRoot(relativePath string, md *fs.EntryMetadata) bool {
+	return relativePath == "." && md.ModTime.IsZero()
+}
+
+// isSafeEntryName returns true if the entry name read from the repository can't refer to a location outside of its directory.
+func isSafeEntryName(name string) bool {
+	if name == "" || name == "." || name == ".." {
+		return false
+	}
+
+	return !strings.ContainsRune(name, '/') && !strings.ContainsRune(name, filepath.Separator)
+}
+
+func (r *Restorer) createDirectory(targetPath string) error {
+	st, err := os.Lstat(targetPath)
+	switch {
+	case os.IsNotExist(err):
+		if err := os.MkdirAll(targetPath, 0700); err != nil {
+			return err
+		}
+		atomic.AddInt32(&r.stats.RestoredDirCount, 1)
+		return nil
+
+	case err != nil:
+		return err
+
+	case !st.IsDir():
+		return fmt.Errorf("%v already exists and is not a directory", targetPath)
+
+	default:
+		return nil
+	}
+}
+
+// prepareTarget determines whether an entry should be written at a given path, creating the parent directory if necessary.
+func (r *Restorer) prepareTarget(targetPath string) (bool, error) {
+	st, err := os.Lstat(targetPath)
+	if os.IsNotExist(err) {
+		return true, r.createDirectory(filepath.Dir(targetPath))
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	if st.IsDir() {
+		return false, fmt.Errorf("%v already exists and is a directory", targetPath)
+	}
+
+	switch {
+	case r.SkipExisting:
+		log.Debugf("skipping existing %v", targetPath)
+		atomic.AddInt32(&r.stats.SkippedCount, 1)
+		return false, nil
+
+	case r.Overwrite:
+		return true, nil
+
+	default:
+		return false, fmt.Errorf("%v already exists, use overwrite or skip-existing mode", targetPath)
+	}
+}
+
+func (r *Restorer) restoreFile(ctx context.Context, f fs.File, targetPath string, synthesized bool) error {
+	ok, err := r.prepareTarget(targetPath)
+	if err != nil || !ok {
+		return err
+	}
+
+	rc, err := f.Open(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to open: %v", err)
+	}
+	defer rc.Close() //nolint:errcheck
+
+	// write to temporary file first and atomically rename it to the target path once done.
+	tf, err := ioutil.TempFile(filepath.Dir(targetPath), ".kopia-restore-")
+	if err != nil {
+		return fmt.Errorf("unable to create temporary file: %v", err)
+	}
+
+	written, err := r.copyUnlessCancelled(tf, rc)
+	if cerr := tf.Close(); err == nil {
+		err = cerr
+	}
+
+	switch {
+	case err != nil:
+	case synthesized:
+		// only permissions are known, ownership and modification time are left alone.
+		err = r.maybeIgnoreMetadataError(os.Chmod(tf.Name(), os.FileMode(f.Metadata().Permissions)&os.ModePerm))
+	default:
+		err = r.applyMetadata(tf.Name(), f.Metadata())
+	}
+
+	if err == nil {
+		err = os.Rename(tf.Name(), targetPath)
+	}
+
+	if err != nil {
+		_ = os.Remove(tf.Name())
+		return err
+	}
+
+	atomic.AddInt32(&r.stats.RestoredFileCount, 1)
+	atomic.AddInt64(&r.stats.RestoredTotalFileSize, written)
+	return nil
+}
+
+func (r *Restorer) copyUnlessCancelled(dst io.Writer, src io.Reader) (int64, error) {
+	buf := make([]byte, 128*1024)
+
+	var written int64
+	for !r.IsCancelled() {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := dst.Write(buf[0:n]); werr != nil {
+				return written, werr
+			}
+			written += int64(n)
+		}
+
+		if err == io.EOF {
+			return written, nil
+		}
+
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, errCancelled
+}
+
+func (r *Restorer) restoreSymlink(ctx context.Context, s fs.Symlink, targetPath string) error {
+	ok, err := r.prepareTarget(targetPath)
+	if err != nil || !ok {
+		return err
+	}
+
+	target, err := s.Readlink(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to read symlink: %v", err)
+	}
+
+	if r.Overwrite {
+		if err := os.Remove(targetPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if err := os.Symlink(target, targetPath); err != nil {
+		return err
+	}
+
+	if !r.IgnoreOwnership {
+		md := s.Metadata()
+		if err := r.maybeIgnoreMetadataError(os.Lchown(targetPath, int(md.UserID), int(md.GroupID))); err != nil {
+			return err
+		}
+	}
+
+	atomic.AddInt32(&r.stats.RestoredSymlinkCount, 1)
+	return nil
+}
+
+// applyDirectoryMetadata applies metadata to all restored directories, starting with the most deeply nested ones
+// so that restoring modification times and read-only permissions of parents happens last.
+func (r *Restorer) applyDirectoryMetadata() {
+	sort.Slice(r.directories, func(i, j int) bool {
+		return strings.Count(r.directories[i].path, string(filepath.Separator)) > strings.Count(r.directories[j].path, string(filepath.Separator))
+	})
+
+	for _, d := range r.directories {
+		if _, err := os.Lstat(d.path); os.IsNotExist(err) {
+			// directory was not restored, because nothing in it matched the include rules.
+			continue
+		}
+
+		if err := r.applyMetadata(d.path, d.metadata); err != nil {
+			r.reportError(fmt.Errorf("unable to restore metadata of %v: %v", d.path, err))
+			return
+		}
+	}
+}
+
+func (r *Restorer) applyMetadata(targetPath string, md *fs.EntryMetadata) error {
+	if !r.IgnoreOwnership {
+		if err := r.maybeIgnoreMetadataError(os.Lchown(targetPath, int(md.UserID), int(md.GroupID))); err != nil {
+			return err
+		}
+	}
+
+	if err := r.maybeIgnoreMetadataError(os.Chmod(targetPath, os.FileMode(md.Permissions)&os.ModePerm)); err != nil {
+		return err
+	}
+
+	if md.ModTime.IsZero() {
+		return nil
+	}
+
+	return r.maybeIgnoreMetadataError(os.Chtimes(targetPath, md.ModTime, md.ModTime))
+}
+
+func (r *Restorer) maybeIgnoreMetadataError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if r.IgnoreMetadataErrors {
+		log.Debugf("ignoring metadata error: %v", err)
+		atomic.AddInt32(&r.stats.IgnoredErrorCount, 1)
+		return nil
+	}
+
+	return err
+}
+
+func (r *Restorer) hasFailed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.firstError != nil
+}
+
+func (r *Restorer) reportError(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	log.Warningf("%v", err)
+	if r.firstError == nil {
+		r.firstError = err
+	}
+}
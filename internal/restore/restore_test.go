@@ -0,0 +1,303 @@
+package restore
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kopia/kopia/fs/repofs"
+	"github.com/kopia/kopia/internal/mockfs"
+	"github.com/kopia/kopia/internal/repotesting"
+	"github.com/kopia/kopia/internal/upload"
+	"github.com/kopia/kopia/repo"
+	"github.com/kopia/kopia/repo/object"
+	"github.com/kopia/kopia/snapshot"
+)
+
+func newTestSource() *mockfs.Directory {
+	sourceDir := mockfs.NewDirectory()
+	sourceDir.AddFile("f1", []byte{1, 2, 3}, 0644)
+	sourceDir.AddFile("f2.log", []byte{1, 2, 3, 4}, 0600)
+	sourceDir.AddDir("d1", 0755)
+	sourceDir.AddDir("d1/d2", 0700)
+	sourceDir.AddFile("d1/f3", []byte{1, 2, 3, 4, 5}, 0644)
+	sourceDir.AddFile("d1/d2/f4.log", []byte{1}, 0644)
+	sourceDir.AddDir("d3", 0755)
+	sourceDir.AddFile("d3/f5", []byte{1, 2}, 0644)
+	sourceDir.AddSymlink("l1", "d1/f3", 0777)
+
+	return sourceDir
+}
+
+func listTree(t *testing.T, root string) []string {
+	var result []string
+
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+
+		rel, _ := filepath.Rel(root, path)
+		rel = filepath.ToSlash(rel)
+		switch {
+		case fi.Mode()&os.ModeSymlink != 0:
+			target, _ := os.Readlink(path)
+			result = append(result, rel+" -> "+target)
+		case fi.IsDir():
+			result = append(result, rel+"/ "+fi.Mode().Perm().String())
+		default:
+			result = append(result, rel+" "+fi.Mode().Perm().String())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unable to list %v: %v", root, err)
+	}
+
+	sort.Strings(result)
+	return result
+}
+
+func TestRestore(t *testing.T) {
+	cases := []struct {
+		desc     string
+		includes []string
+		excludes []string
+		want     []string
+	}{
+		{
+			desc: "everything",
+			want: []string{
+				"d1/ -rwxr-xr-x",
+				"d1/d2/ -rwx------",
+				"d1/d2/f4.log -rw-r--r--",
+				"d1/f3 -rw-r--r--",
+				"d3/ -rwxr-xr-x",
+				"d3/f5 -rw-r--r--",
+				"f1 -rw-r--r--",
+				"f2.log -rw-------",
+				"l1 -> d1/f3",
+			},
+		},
+		{
+			desc:     "exclude logs and d3",
+			excludes: []string{"*.log", "d3/"},
+			want: []string{
+				"d1/ -rwxr-xr-x",
+				"d1/d2/ -rwx------",
+				"d1/f3 -rw-r--r--",
+				"f1 -rw-r--r--",
+				"l1 -> d1/f3",
+			},
+		},
+		{
+			desc:     "include logs only",
+			includes: []string{"*.log"},
+			want: []string{
+				"d1/ -rwxr-xr-x",
+				"d1/d2/ -rwx------",
+				"d1/d2/f4.log -rw-r--r--",
+				"f2.log -rw-------",
+			},
+		},
+		{
+			desc:     "include directory",
+			includes: []string{"d1/d2"},
+			want: []string{
+				"d1/ -rwxr-xr-x",
+				"d1/d2/ -rwx------",
+				"d1/d2/f4.log -rw-r--r--",
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			targetDir, err := ioutil.TempDir("", "kopia-restore")
+			if err != nil {
+				t.Fatalf("unable to create temp directory: %v", err)
+			}
+			defer os.RemoveAll(targetDir) //nolint:errcheck
+
+			r := NewRestorer()
+			r.Parallel = 4
+			r.IgnoreOwnership = true
+			r.IncludeRules = tc.includes
+			r.ExcludeRules = tc.excludes
+
+			if _, err := r.Restore(context.Background(), newTestSource(), targetDir); err != nil {
+				t.Fatalf("restore failed: %v", err)
+			}
+
+			if got, want := listTree(t, targetDir), tc.want; !reflect.DeepEqual(got, want) {
+				t.Errorf("unexpected restored files:\n%v\nwant:\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+			}
+		})
+	}
+}
+
+func TestRestoreExisting(t *testing.T) {
+	ctx := context.Background()
+
+	targetDir, err := ioutil.TempDir("", "kopia-restore")
+	if err != nil {
+		t.Fatalf("unable to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(targetDir) //nolint:errcheck
+
+	r := NewRestorer()
+	r.IgnoreOwnership = true
+	st, err := r.Restore(ctx, newTestSource(), targetDir)
+	if err != nil {
+		t.Fatalf("restore failed: %v", err)
+	}
+	if got, want := st.RestoredFileCount, int32(5); got != want {
+		t.Errorf("unexpected number of restored files: %v, want %v", got, want)
+	}
+
+	// modify one of the restored files
+	f1 := filepath.Join(targetDir, "f1")
+	if err = ioutil.WriteFile(f1, []byte{9, 9}, 0644); err != nil {
+		t.Fatalf("unable to modify file: %v", err)
+	}
+
+	if _, err = r.Restore(ctx, newTestSource(), targetDir); err == nil {
+		t.Errorf("expected error when restoring over existing files")
+	}
+
+	r.SkipExisting = true
+	st, err = r.Restore(ctx, newTestSource(), targetDir)
+	if err != nil {
+		t.Fatalf("restore failed: %v", err)
+	}
+	if got, want := st.SkippedCount, int32(6); got != want {
+		t.Errorf("unexpected number of skipped entries: %v, want %v", got, want)
+	}
+	if b, _ := ioutil.ReadFile(f1); !reflect.DeepEqual(b, []byte{9, 9}) {
+		t.Errorf("file was overwritten in skip-existing mode: %v", b)
+	}
+
+	r.SkipExisting = false
+	r.Overwrite = true
+	if _, err = r.Restore(ctx, newTestSource(), targetDir); err != nil {
+		t.Fatalf("restore failed: %v", err)
+	}
+	if b, _ := ioutil.ReadFile(f1); !reflect.DeepEqual(b, []byte{1, 2, 3}) {
+		t.Errorf("file was not overwritten: %v", b)
+	}
+}
+
+func TestRestoreModTime(t *testing.T) {
+	targetDir, err := ioutil.TempDir("", "kopia-restore")
+	if err != nil {
+		t.Fatalf("unable to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(targetDir) //nolint:errcheck
+
+	mtime := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	sourceDir := mockfs.NewDirectory()
+	sourceDir.AddDir("d1", 0755).Metadata().ModTime = mtime
+	sourceDir.AddFile("d1/f1", []byte{1, 2, 3}, 0644).Metadata().ModTime = mtime
+
+	r := NewRestorer()
+	r.IgnoreOwnership = true
+	if _, err := r.Restore(context.Background(), sourceDir, targetDir); err != nil {
+		t.Fatalf("restore failed: %v", err)
+	}
+
+	for _, p := range []string{"d1", "d1/f1"} {
+		fi, err := os.Stat(filepath.Join(targetDir, p))
+		if err != nil {
+			t.Fatalf("unable to stat %v: %v", p, err)
+		}
+
+		if !fi.ModTime().Equal(mtime) {
+			t.Errorf("invalid modification time of %v: %v, want %v", p, fi.ModTime(), mtime)
+		}
+	}
+}
+
+func TestRestoreRejectsUnsafeNames(t *testing.T) {
+	for _, name := range []string{"", ".", "..", "../evil", "d/../../evil", "/evil"} {
+		t.Run(name, func(t *testing.T) {
+			tmpDir, err := ioutil.TempDir("", "kopia-restore")
+			if err != nil {
+				t.Fatalf("unable to create temp directory: %v", err)
+			}
+			defer os.RemoveAll(tmpDir) //nolint:errcheck
+
+			// entry names read from the repository are not validated by mockfs after they're added.
+			sourceDir := mockfs.NewDirectory()
+			sourceDir.AddDir("d", 0755)
+			sourceDir.AddFile("d/evil", []byte{1, 2, 3}, 0644).Metadata().Name = name
+
+			r := NewRestorer()
+			r.IgnoreOwnership = true
+
+			if _, err := r.Restore(context.Background(), sourceDir, filepath.Join(tmpDir, "target")); err == nil {
+				t.Errorf("restore of entry %q succeeded, want error", name)
+			}
+
+			if got, want := listTree(t, tmpDir), []string{"target/ -rwx------", "target/d/ -rwx------"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("unexpected restored files:\n%v\nwant:\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+			}
+		})
+	}
+}
+
+func TestRestoreObjects(t *testing.T) {
+	ctx := context.Background()
+	env := repotesting.Setup(t, nil, repo.ConnectOptions{})
+	defer env.Close()
+
+	u := upload.NewUploader(env.Repository)
+	man, err := u.Upload(ctx, newTestSource(), snapshot.SourceInfo{Host: "host", UserName: "user", Path: "/src"}, nil)
+	if err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+
+	entries, err := repofs.DirectoryEntry(env.Repository, man.RootObjectID(), nil).Readdir(ctx)
+	if err != nil {
+		t.Fatalf("unable to read directory: %v", err)
+	}
+
+	fileID := entries.FindByName("f1").(object.HasObjectID).ObjectID()
+	dirID := entries.FindByName("d3").(object.HasObjectID).ObjectID()
+
+	// bare object IDs have no metadata, which is not an error even in strict mode.
+	restore := func(oid object.ID, targetPath string) {
+		e, err := repofs.ObjectEntry(ctx, env.Repository, oid)
+		if err != nil {
+			t.Fatalf("unable to get object entry: %v", err)
+		}
+
+		r := NewRestorer()
+		r.IgnoreMetadataErrors = false
+		if _, err := r.Restore(ctx, e, targetPath); err != nil {
+			t.Fatalf("restore of %v failed: %v", oid, err)
+		}
+	}
+
+	targetDir := filepath.Join(env.Dir, "target")
+	restore(fileID, filepath.Join(targetDir, "file"))
+	restore(dirID, filepath.Join(targetDir, "dir"))
+
+	want := []string{"dir/ -rwx------", "dir/f5 -rw-r--r--", "file -rw-r--r--"}
+	if got := listTree(t, targetDir); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected restored files:\n%v\nwant:\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	if b, err := ioutil.ReadFile(filepath.Join(targetDir, "file")); err != nil || !reflect.DeepEqual(b, []byte{1, 2, 3}) {
+		t.Errorf("unexpected restored file contents: %v, %v", b, err)
+	}
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"fmt"
+	"net/http"
 )
 
 type apiError struct {
@@ -9,6 +10,16 @@ type apiError struct {
 	message string
 }
 
+func requestError(message string) *apiError {
+	return &apiError{http.StatusBadRequest, message}
+}
+
 func internalServerError(err error) *apiError {
 	return &apiError{500, fmt.Sprintf("internal server error: %v", err)}
 }
+
+var (
+	errUnauthorized = &apiError{http.StatusUnauthorized, "authentication required"}
+	errForbidden    = &apiError{http.StatusForbidden, "access denied"}
+	errNotFound     = &apiError{http.StatusNotFound, "not found"}
+)
@@ -26,7 +26,7 @@ func (s *Server) handlePolicyList(ctx context.Context, r *http.Request) (interfa
 		resp.Policies = append(resp.Policies, &serverapi.PolicyListEntry{
 			ID:     pol.ID(),
 			Target: target,
-			Policy: pol,
+			Policy: redactPolicy(pol),
 		})
 	}
 
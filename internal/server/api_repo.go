@@ -0,0 +1,207 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/kopia/kopia/policy"
+	"github.com/kopia/kopia/repo/manifest"
+	"github.com/kopia/kopia/repo/remote"
+	"github.com/kopia/kopia/repo/storage"
+)
+
+func (s *Server) handleRepoParameters(ctx context.Context, r *http.Request) (interface{}, *apiError) {
+	if s.rep.IsRemote() {
+		return nil, requestError("repository is not directly accessible by the server")
+	}
+
+	p := &remote.Parameters{
+		UniqueID:     s.rep.UniqueID,
+		ObjectFormat: s.rep.Objects.Format,
+	}
+
+	// never send the keys to the clients.
+	p.ObjectFormat.HMACSecret = nil
+	p.ObjectFormat.MasterKey = nil
+
+	return p, nil
+}
+
+func (s *Server) handleRepoGetBlock(ctx context.Context, r *http.Request) (interface{}, *apiError) {
+	if s.rep.IsRemote() {
+		return nil, requestError("repository is not directly accessible by the server")
+	}
+
+	data, err := s.rep.Blocks.GetBlock(ctx, r.URL.Query().Get(":blockID"))
+	switch err {
+	case nil:
+		return &remote.BlockData{Data: data}, nil
+	case storage.ErrBlockNotFound:
+		return nil, errNotFound
+	default:
+		return nil, internalServerError(err)
+	}
+}
+
+func (s *Server) handleRepoBlockInfo(ctx context.Context, r *http.Request) (interface{}, *apiError) {
+	if s.rep.IsRemote() {
+		return nil, requestError("repository is not directly accessible by the server")
+	}
+
+	bi, err := s.rep.Blocks.BlockInfo(ctx, r.URL.Query().Get(":blockID"))
+	switch err {
+	case nil:
+		bi.Payload = nil
+		return &bi, nil
+	case storage.ErrBlockNotFound:
+		return nil, errNotFound
+	default:
+		return nil, internalServerError(err)
+	}
+}
+
+func (s *Server) handleRepoWriteBlock(ctx context.Context, r *http.Request) (interface{}, *apiError) {
+	s.remoteWriteMutex.RLock()
+	defer s.remoteWriteMutex.RUnlock()
+
+	if s.rep.IsRemote() {
+		return nil, requestError("repository is not directly accessible by the server")
+	}
+
+	prefix := r.URL.Query().Get("prefix")
+	if prefix == manifest.BlockPrefix {
+		// manifest blocks can only be written through manifest API, which enforces permissions.
+		return nil, requestError("invalid block prefix")
+	}
+
+	var req remote.BlockData
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, requestError("malformed request body")
+	}
+
+	blockID, err := s.rep.Blocks.WriteBlock(ctx, req.Data, prefix)
+	if err != nil {
+		return nil, internalServerError(err)
+	}
+
+	return &remote.WriteBlockResponse{BlockID: blockID}, nil
+}
+
+func (s *Server) handleRepoFindManifests(ctx context.Context, r *http.Request) (interface{}, *apiError) {
+	labels := map[string]string{}
+	for k, v := range r.URL.Query() {
+		labels[k] = v[0]
+	}
+
+	entries, err := s.rep.Manifests.Find(ctx, labels)
+	if err != nil {
+		return nil, internalServerError(err)
+	}
+
+	return &remote.FindManifestsResponse{Manifests: entries}, nil
+}
+
+func (s *Server) handleRepoGetManifest(ctx context.Context, r *http.Request) (interface{}, *apiError) {
+	id := r.URL.Query().Get(":manifestID")
+
+	md, err := s.rep.Manifests.GetMetadata(ctx, id)
+	if err == manifest.ErrNotFound {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, internalServerError(err)
+	}
+
+	payload, err := s.rep.Manifests.GetRaw(ctx, id)
+	if err != nil {
+		return nil, internalServerError(err)
+	}
+
+	if md.Labels["type"] == "policy" && !userFromContext(ctx).Role.allows(RoleControl) {
+		// policies may contain notification credentials.
+		if payload, err = redactPolicyPayload(payload); err != nil {
+			return nil, internalServerError(err)
+		}
+	}
+
+	return &remote.ManifestResponse{Metadata: md, Payload: payload}, nil
+}
+
+func redactPolicyPayload(payload []byte) ([]byte, error) {
+	pol := &policy.Policy{}
+	if err := json.Unmarshal(payload, pol); err != nil {
+		return nil, fmt.Errorf("invalid policy: %v", err)
+	}
+
+	return json.Marshal(redactPolicy(pol))
+}
+
+func (s *Server) handleRepoPutManifest(ctx context.Context, r *http.Request) (interface{}, *apiError) {
+	s.remoteWriteMutex.RLock()
+	defer s.remoteWriteMutex.RUnlock()
+
+	var req remote.PutManifestRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, requestError("malformed request body")
+	}
+
+	if u := userFromContext(ctx); !u.canWriteManifest(req.Labels) {
+		log.Warningf("user %q is not allowed to write manifest %v", u.Username, req.Labels)
+		return nil, errForbidden
+	}
+
+	if req.Labels["type"] == "policy" {
+		pol := &policy.Policy{}
+		if err := json.Unmarshal(req.Payload, pol); err != nil {
+			return nil, requestError("malformed policy")
+		}
+
+		// notification targets are only accepted from policies set directly on the server.
+		if len(pol.NotificationPolicy.Targets) > 0 {
+			return nil, requestError("notification targets can't be set through the repository API")
+		}
+	}
+
+	id, err := s.rep.Manifests.Put(ctx, req.Labels, req.Payload)
+	if err != nil {
+		return nil, internalServerError(err)
+	}
+
+	return &remote.PutManifestResponse{ID: id}, nil
+}
+
+func (s *Server) handleRepoDeleteManifest(ctx context.Context, r *http.Request) (interface{}, *apiError) {
+	s.remoteWriteMutex.RLock()
+	defer s.remoteWriteMutex.RUnlock()
+
+	id := r.URL.Query().Get(":manifestID")
+
+	md, err := s.rep.Manifests.GetMetadata(ctx, id)
+	if err == manifest.ErrNotFound {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, internalServerError(err)
+	}
+
+	if u := userFromContext(ctx); !u.canWriteManifest(md.Labels) {
+		log.Warningf("user %q is not allowed to delete manifest %v", u.Username, md.Labels)
+		return nil, errForbidden
+	}
+
+	s.rep.Manifests.Delete(id)
+	return &remote.Empty{}, nil
+}
+
+func (s *Server) handleRepoFlush(ctx context.Context, r *http.Request) (interface{}, *apiError) {
+	s.remoteWriteMutex.RLock()
+	defer s.remoteWriteMutex.RUnlock()
+
+	if err := s.rep.Flush(ctx); err != nil {
+		return nil, internalServerError(err)
+	}
+
+	return &remote.Empty{}, nil
+}
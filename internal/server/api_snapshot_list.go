@@ -22,6 +22,8 @@ type snapshotListEntry struct {
 	Summary          *fs.DirectorySummary `json:"summary"`
 	RootEntry        string               `json:"rootID"`
 	RetentionReasons []string             `json:"retention"`
+	Tags             map[string]string    `json:"tags,omitempty"`
+	Pins             []string             `json:"pins,omitempty"`
 }
 
 type snapshotListResponse struct {
@@ -86,6 +88,8 @@ func convertSnapshotManifest(m *snapshot.Manifest) *snapshotListEntry {
 		IncompleteReason: m.IncompleteReason,
 		RootEntry:        m.RootObjectID().String(),
 		RetentionReasons: m.RetentionReasons,
+		Tags:             m.Tags,
+		Pins:             m.Pins,
 	}
 
 	if re := m.RootEntry; re != nil {
@@ -8,6 +8,13 @@ import (
 )
 
 func (s *Server) handleStatus(ctx context.Context, r *http.Request) (interface{}, *apiError) {
+	if s.rep.IsRemote() {
+		return &serverapi.StatusResponse{
+			ConfigFile: s.rep.ConfigFile,
+			Storage:    "server",
+		}, nil
+	}
+
 	bf := s.rep.Blocks.Format
 	bf.HMACSecret = nil
 	bf.MasterKey = nil
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Role determines which API operations a user is allowed to perform.
+type Role string
+
+// Supported roles.
+const (
+	// RoleReadOnly allows reading status, sources, snapshots and policies.
+	RoleReadOnly Role = "read-only"
+
+	// RoleRepository allows all read-only operations and additionally reading and writing repository
+	// contents on behalf of clients connected through the server. Only snapshot manifests can be written
+	// and only for sources matching user's WriteSources.
+	RoleRepository Role = "repository"
+
+	// RoleControl allows all operations, including triggering uploads, pausing, resuming and
+	// cancelling sources, refreshing, flushing and writing manifests of any source.
+	RoleControl Role = "control"
+)
+
+// roleLevels determines the ordering of roles, each role is allowed to perform all operations
+// of the roles below it.
+var roleLevels = map[Role]int{
+	RoleReadOnly:   1,
+	RoleRepository: 2,
+	RoleControl:    3,
+}
+
+func (r Role) allows(required Role) bool {
+	return roleLevels[r] > 0 && roleLevels[r] >= roleLevels[required]
+}
+
+// User describes a user of the API server, who can authenticate using either HTTP basic
+// authentication with Username and Password or a bearer token.
+type User struct {
+	Username string `json:"username"`
+	Password string `json:"password,omitempty"`
+	Token    string `json:"token,omitempty"`
+	Role     Role   `json:"role"`
+
+	// WriteSources is the list of "username@hostname" patterns (which may contain wildcards such as '*')
+	// of sources for which users with repository role are allowed to write manifests.
+	WriteSources []string `json:"writeSources,omitempty"`
+}
+
+// repositoryManifestTypes is the set of manifest types users with repository role are allowed to write.
+// Other manifests, such as policies, affect the server itself and can only be written by users with control role.
+var repositoryManifestTypes = map[string]bool{
+	"snapshot": true,
+}
+
+// canWriteManifest determines whether the user is allowed to write or delete a manifest with given labels.
+func (u *User) canWriteManifest(labels map[string]string) bool {
+	if u.Role == RoleControl {
+		return true
+	}
+
+	if u.Role != RoleRepository || !repositoryManifestTypes[labels["type"]] || labels["username"] == "" || labels["hostname"] == "" {
+		return false
+	}
+
+	src := labels["username"] + "@" + labels["hostname"]
+	for _, pattern := range u.WriteSources {
+		if ok, _ := path.Match(pattern, src); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AuthConfig is the format of the server authentication file.
+type AuthConfig struct {
+	Users []User `json:"users"`
+}
+
+// Validate checks that users in the config are well-formed.
+func (c *AuthConfig) Validate() error {
+	for _, u := range c.Users {
+		if u.Username == "" {
+			return fmt.Errorf("username must be specified")
+		}
+
+		if u.Password == "" && u.Token == "" {
+			return fmt.Errorf("user %q must have password or token", u.Username)
+		}
+
+		if roleLevels[u.Role] == 0 {
+			return fmt.Errorf("user %q has invalid role %q, must be %q, %q or %q", u.Username, u.Role, RoleReadOnly, RoleRepository, RoleControl)
+		}
+
+		for _, p := range u.WriteSources {
+			if _, err := path.Match(p, ""); err != nil {
+				return fmt.Errorf("user %q has invalid source pattern %q", u.Username, p)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ReadAuthConfig reads authentication configuration from a JSON file.
+func ReadAuthConfig(fname string) (*AuthConfig, error) {
+	b, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read auth file: %v", err)
+	}
+
+	c := &AuthConfig{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("invalid auth file: %v", err)
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid auth file: %v", err)
+	}
+
+	return c, nil
+}
+
+// anonymousUser is used when the server does not require authentication.
+var anonymousUser = &User{Role: RoleControl}
+
+// authenticate returns the user making the request, or an API error.
+// When no users are configured, all requests are made by anonymous user with control role.
+func (s *Server) authenticate(r *http.Request) (*User, *apiError) {
+	if len(s.users) == 0 {
+		return anonymousUser, nil
+	}
+
+	if username, password, ok := r.BasicAuth(); ok {
+		for i, u := range s.users {
+			if u.Password != "" && u.Username == username && secretEquals(u.Password, password) {
+				return &s.users[i], nil
+			}
+		}
+
+		return nil, errUnauthorized
+	}
+
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token := strings.TrimPrefix(auth, "Bearer ")
+		for i, u := range s.users {
+			if u.Token != "" && secretEquals(u.Token, token) {
+				return &s.users[i], nil
+			}
+		}
+	}
+
+	return nil, errUnauthorized
+}
+
+type userContextKey struct{}
+
+// userFromContext returns the authenticated user making the API request.
+func userFromContext(ctx context.Context) *User {
+	if u, ok := ctx.Value(userContextKey{}).(*User); ok {
+		return u
+	}
+
+	return anonymousUser
+}
+
+func secretEquals(expected, actual string) bool {
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(actual)) == 1
+}
+
+// requiredRole returns the role needed to perform a given request, requests that may
+// change the state of the server require control role.
+func requiredRole(r *http.Request) Role {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return RoleReadOnly
+	default:
+		return RoleControl
+	}
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/kopia/kopia/internal/notification"
+	"github.com/kopia/kopia/policy"
+	"github.com/kopia/kopia/repo/remote"
+	"github.com/kopia/kopia/snapshot"
+)
+
+func TestCanWriteManifest(t *testing.T) {
+	repoUser := &User{Role: RoleRepository, WriteSources: []string{"alice@laptop", "*@build-*"}}
+	snapshotLabels := func(username, hostname string) map[string]string {
+		return map[string]string{"type": "snapshot", "username": username, "hostname": hostname}
+	}
+
+	cases := []struct {
+		user   *User
+		labels map[string]string
+		want   bool
+	}{
+		{repoUser, snapshotLabels("alice", "laptop"), true},
+		{repoUser, snapshotLabels("bob", "build-1"), true},
+		{repoUser, snapshotLabels("bob", "laptop"), false},
+		{repoUser, snapshotLabels("alice", ""), false},
+		{repoUser, snapshotLabels("", "laptop"), false},
+		{repoUser, map[string]string{"type": "policy", "username": "alice", "hostname": "laptop"}, false},
+		{repoUser, map[string]string{"type": sourceStateManifestType, "username": "alice", "hostname": "laptop"}, false},
+		{repoUser, map[string]string{"username": "alice", "hostname": "laptop"}, false},
+		{&User{Role: RoleRepository}, snapshotLabels("alice", "laptop"), false},
+		{&User{Role: RoleReadOnly, WriteSources: []string{"*"}}, snapshotLabels("alice", "laptop"), false},
+		{&User{Role: RoleControl}, map[string]string{"type": "policy"}, true},
+	}
+
+	for _, tc := range cases {
+		if got := tc.user.canWriteManifest(tc.labels); got != tc.want {
+			t.Errorf("canWriteManifest(%+v, %v) = %v, want %v", tc.user, tc.labels, got, tc.want)
+		}
+	}
+}
+
+func TestRepositoryManifestPermissions(t *testing.T) {
+	ts := newTestServer(t, []User{
+		{Username: "reader", Password: "reader-pass", Role: RoleReadOnly},
+		{Username: "alice", Password: "alice-pass", Role: RoleRepository, WriteSources: []string{"alice@laptop"}},
+		{Username: "admin", Password: "admin-pass", Role: RoleControl},
+	})
+	defer ts.close()
+
+	payload := json.RawMessage(`{"foo":"bar"}`)
+	put := func(username, password string, labels map[string]string) (string, error) {
+		var resp remote.PutManifestResponse
+		err := ts.client(username, password).Post("repo/manifests", &remote.PutManifestRequest{Labels: labels, Payload: payload}, &resp)
+		return resp.ID, err
+	}
+
+	cases := []struct {
+		username, password string
+		labels             map[string]string
+		wantErr            string
+	}{
+		{"alice", "alice-pass", map[string]string{"type": "snapshot", "username": "alice", "hostname": "laptop"}, ""},
+		{"alice", "alice-pass", map[string]string{"type": "snapshot", "username": "bob", "hostname": "laptop"}, "403"},
+		{"alice", "alice-pass", map[string]string{"type": "policy", "username": "alice", "hostname": "laptop"}, "403"},
+		{"alice", "alice-pass", map[string]string{"type": sourceStateManifestType, "username": "alice", "hostname": "laptop"}, "403"},
+		{"alice", "wrong-pass", map[string]string{"type": "snapshot", "username": "alice", "hostname": "laptop"}, "401"},
+		{"reader", "reader-pass", map[string]string{"type": "snapshot", "username": "alice", "hostname": "laptop"}, "403"},
+		{"admin", "admin-pass", map[string]string{"type": sourceStateManifestType, "username": "bob", "hostname": "laptop"}, ""},
+	}
+
+	for _, tc := range cases {
+		_, err := put(tc.username, tc.password, tc.labels)
+		switch {
+		case tc.wantErr == "" && err != nil:
+			t.Errorf("unexpected error writing %v as %v: %v", tc.labels, tc.username, err)
+		case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+			t.Errorf("unexpected result writing %v as %v: %v, want %v", tc.labels, tc.username, err, tc.wantErr)
+		}
+	}
+
+	// manifests of other sources can't be deleted either.
+	id, err := put("admin", "admin-pass", map[string]string{"type": "snapshot", "username": "bob", "hostname": "laptop"})
+	if err != nil {
+		t.Fatalf("unable to write manifest: %v", err)
+	}
+
+	var empty remote.Empty
+	if err := ts.client("alice", "alice-pass").Delete("repo/manifests/"+id, &empty); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("unexpected result deleting manifest of another source: %v", err)
+	}
+}
+
+func TestRepositoryPolicyManifestsAreRedacted(t *testing.T) {
+	ts := newTestServer(t, []User{
+		{Username: "alice", Password: "alice-pass", Role: RoleRepository, WriteSources: []string{"alice@laptop"}},
+		{Username: "admin", Password: "admin-pass", Role: RoleControl},
+	})
+	defer ts.close()
+
+	ctx := context.Background()
+	src := snapshot.SourceInfo{UserName: "alice", Host: "laptop"}
+	if err := policy.SetPolicy(ctx, ts.rep, src, &policy.Policy{
+		NotificationPolicy: notification.Policy{
+			Targets: []notification.Target{
+				{Type: notification.TargetEmail, SMTPServer: "smtp:25", SMTPPassword: "smtp-secret", From: "a@b", To: []string{"c@d"}},
+				{Type: notification.TargetWebhook, URL: "http://hook", Headers: map[string]string{"Authorization": "hook-secret"}},
+			},
+		},
+	}); err != nil {
+		t.Fatalf("unable to set policy: %v", err)
+	}
+
+	entries, err := ts.rep.Manifests.Find(ctx, map[string]string{"type": "policy"})
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("unable to find policy manifest: %v %v", entries, err)
+	}
+
+	get := func(username, password string) string {
+		var resp remote.ManifestResponse
+		if err := ts.client(username, password).Get("repo/manifests/"+entries[0].ID, &resp); err != nil {
+			t.Fatalf("unable to get manifest as %v: %v", username, err)
+		}
+
+		return string(resp.Payload)
+	}
+
+	for _, secret := range []string{"smtp-secret", "hook-secret"} {
+		if p := get("alice", "alice-pass"); strings.Contains(p, secret) {
+			t.Errorf("policy returned to repository user is not redacted: %v", p)
+		}
+
+		if p := get("admin", "admin-pass"); !strings.Contains(p, secret) {
+			t.Errorf("policy returned to control user is redacted: %v", p)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/kopia/kopia/internal/serverapi"
+	"github.com/kopia/kopia/snapshot"
+)
+
+// eventSubscriberBufferSize is the number of events buffered for each subscriber,
+// events published while the buffer is full are dropped for that subscriber.
+const eventSubscriberBufferSize = 100
+
+// eventKeepAliveInterval is the interval between keep-alive comments sent to idle subscribers,
+// it is a variable so that tests can shorten it.
+var eventKeepAliveInterval = 15 * time.Second
+
+// eventBroker delivers published events to all subscribers.
+type eventBroker struct {
+	mu          sync.Mutex
+	subscribers map[chan *serverapi.Event]struct{}
+}
+
+func (b *eventBroker) subscribe() chan *serverapi.Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan *serverapi.Event, eventSubscriberBufferSize)
+	if b.subscribers == nil {
+		b.subscribers = map[chan *serverapi.Event]struct{}{}
+	}
+	b.subscribers[ch] = struct{}{}
+	return ch
+}
+
+func (b *eventBroker) unsubscribe(ch chan *serverapi.Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.subscribers, ch)
+}
+
+// publish sends the event to all subscribers without blocking.
+func (b *eventBroker) publish(ev *serverapi.Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- ev:
+		default:
+			log.Debugf("dropping %v event for slow subscriber", ev.Type)
+		}
+	}
+}
+
+// publishSourceEvent publishes an event concerning a given source.
+func (s *Server) publishSourceEvent(src snapshot.SourceInfo, ev *serverapi.Event) {
+	ev.Source = &src
+	s.events.publish(ev)
+}
+
+// handleEvents streams server events to users with read-only role using Server-Sent Events.
+// Events can be limited to matching sources using the same query parameters as other
+// source APIs ('host', 'userName' and 'path').
+func (s *Server) handleEvents() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := s.authorize(w, r, RoleReadOnly); !ok {
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+
+		ch := s.events.subscribe()
+		defer s.events.unsubscribe(ch)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		filter := r.URL.Query()
+		keepAlive := time.NewTicker(eventKeepAliveInterval)
+		defer keepAlive.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+
+			case <-keepAlive.C:
+				if _, err := fmt.Fprintf(w, ": keep-alive\n\n"); err != nil {
+					return
+				}
+
+			case ev := <-ch:
+				if ev.Source != nil && !sourceMatchesURLFilter(*ev.Source, filter) {
+					continue
+				}
+
+				if err := writeEvent(w, ev); err != nil {
+					log.Debugf("unable to write event: %v", err)
+					return
+				}
+			}
+
+			flusher.Flush()
+		}
+	})
+}
+
+func writeEvent(w http.ResponseWriter, ev *serverapi.Event) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "event: %v\ndata: %s\n\n", ev.Type, b)
+	return err
+}
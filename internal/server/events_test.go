@@ -0,0 +1,245 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kopia/kopia/internal/serverapi"
+	"github.com/kopia/kopia/snapshot"
+)
+
+func (b *eventBroker) subscriberCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.subscribers)
+}
+
+func TestEventBrokerDropsEventsForSlowSubscriber(t *testing.T) {
+	var b eventBroker
+
+	slow := b.subscribe()
+	fast := b.subscribe()
+
+	received := make(chan int)
+	go func() {
+		n := 0
+		for range fast {
+			n++
+			if n == eventSubscriberBufferSize+10 {
+				received <- n
+			}
+		}
+	}()
+
+	// publishing never blocks, even though the slow subscriber does not read events.
+	for i := 0; i < eventSubscriberBufferSize+10; i++ {
+		ev := &serverapi.Event{Type: serverapi.EventUploadProgress}
+		b.publish(ev)
+
+		if ev.Time.IsZero() {
+			t.Fatalf("event time was not set")
+		}
+
+		// give the fast subscriber a chance to keep up.
+		for len(fast) > 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	select {
+	case <-received:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("fast subscriber did not receive all events")
+	}
+
+	if got, want := len(slow), eventSubscriberBufferSize; got != want {
+		t.Errorf("unexpected number of events buffered for slow subscriber: %v, want %v", got, want)
+	}
+
+	// after catching up, the slow subscriber receives new events again.
+	for len(slow) > 0 {
+		<-slow
+	}
+
+	b.publish(&serverapi.Event{Type: serverapi.EventSnapshotStarted})
+	if ev := <-slow; ev.Type != serverapi.EventSnapshotStarted {
+		t.Errorf("unexpected event: %v", ev.Type)
+	}
+
+	b.unsubscribe(slow)
+	b.unsubscribe(fast)
+	close(fast)
+
+	b.publish(&serverapi.Event{Type: serverapi.EventSnapshotStarted})
+	if len(slow) != 0 {
+		t.Errorf("event was delivered after unsubscribing")
+	}
+}
+
+// watchEvents starts watching events using the API client and returns the channel receiving them and
+// the channel receiving the result of serverapi.WatchEvents().
+func (ts *testServer) watchEvents(ctx context.Context, username, password string, filter url.Values, callbackErr error) (events chan *serverapi.Event, result chan error) {
+	events = make(chan *serverapi.Event, 10)
+	result = make(chan error, 1)
+
+	go func() {
+		result <- serverapi.WatchEvents(ctx, ts.client(username, password), filter, func(ev *serverapi.Event) error {
+			events <- ev
+			return callbackErr
+		})
+	}()
+
+	return events, result
+}
+
+func (ts *testServer) waitForSubscribers(n int) {
+	ts.t.Helper()
+	ts.waitFor("event subscribers", func() bool { return ts.server.events.subscriberCount() == n })
+}
+
+func TestWatchEvents(t *testing.T) {
+	ts := newTestServer(t, []User{{Username: "reader", Password: "reader-pass", Role: RoleReadOnly}})
+	defer ts.close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	src1 := snapshot.SourceInfo{Host: "host", UserName: "user", Path: "/path1"}
+	src2 := snapshot.SourceInfo{Host: "host", UserName: "user", Path: "/path2"}
+
+	all, allResult := ts.watchEvents(ctx, "reader", "reader-pass", nil, nil)
+	filtered, filteredResult := ts.watchEvents(ctx, "reader", "reader-pass", url.Values{"path": {"/path2"}}, nil)
+	ts.waitForSubscribers(2)
+
+	ts.server.publishSourceEvent(src1, &serverapi.Event{Type: serverapi.EventSnapshotStarted})
+	ts.server.publishSourceEvent(src2, &serverapi.Event{Type: serverapi.EventSnapshotFinished, SnapshotID: "snap2", Stats: &snapshot.Stats{TotalFileCount: 3}})
+	ts.server.events.publish(&serverapi.Event{Type: serverapi.EventMaintenanceStarted})
+
+	for _, want := range []string{serverapi.EventSnapshotStarted, serverapi.EventSnapshotFinished, serverapi.EventMaintenanceStarted} {
+		if ev := receiveEvent(t, all); ev.Type != want {
+			t.Errorf("unexpected event: %v, want %v", ev.Type, want)
+		}
+	}
+
+	// events of other sources are filtered out, events without source are always delivered.
+	ev := receiveEvent(t, filtered)
+	if ev.Type != serverapi.EventSnapshotFinished || ev.Source == nil || *ev.Source != src2 || ev.SnapshotID != "snap2" || ev.Stats.TotalFileCount != 3 {
+		t.Errorf("unexpected event: %+v", ev)
+	}
+
+	if ev := receiveEvent(t, filtered); ev.Type != serverapi.EventMaintenanceStarted {
+		t.Errorf("unexpected event: %v", ev.Type)
+	}
+
+	cancel()
+
+	for _, result := range []chan error{allResult, filteredResult} {
+		if err := <-result; err != context.Canceled {
+			t.Errorf("unexpected result of watching events: %v", err)
+		}
+	}
+
+	ts.waitForSubscribers(0)
+}
+
+func TestWatchEventsCallbackError(t *testing.T) {
+	ts := newTestServer(t, nil)
+	defer ts.close()
+
+	errStop := errors.New("stop")
+	events, result := ts.watchEvents(context.Background(), "", "", nil, errStop)
+	ts.waitForSubscribers(1)
+
+	ts.server.events.publish(&serverapi.Event{Type: serverapi.EventMaintenanceStarted})
+	receiveEvent(t, events)
+
+	if err := <-result; err != errStop {
+		t.Errorf("unexpected result of watching events: %v", err)
+	}
+
+	ts.waitForSubscribers(0)
+}
+
+func TestWatchEventsRequiresAuthentication(t *testing.T) {
+	ts := newTestServer(t, []User{{Username: "reader", Password: "reader-pass", Role: RoleReadOnly}})
+	defer ts.close()
+
+	_, result := ts.watchEvents(context.Background(), "reader", "wrong-pass", nil, nil)
+	if err := <-result; err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("unexpected result of watching events with invalid password: %v", err)
+	}
+}
+
+func TestEventsKeepAlive(t *testing.T) {
+	defer func(d time.Duration) { eventKeepAliveInterval = d }(eventKeepAliveInterval)
+	eventKeepAliveInterval = 20 * time.Millisecond
+
+	ts := newTestServer(t, nil)
+	defer ts.close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodGet, ts.httpServer.URL+"/api/v1/events", nil)
+	if err != nil {
+		t.Fatalf("unable to create request: %v", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatalf("unable to connect: %v", err)
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("unexpected content type: %v", ct)
+	}
+
+	// idle stream receives keep-alive comments.
+	s := bufio.NewScanner(resp.Body)
+	keepAlives := 0
+	for keepAlives < 2 && s.Scan() {
+		if s.Text() == ": keep-alive" {
+			keepAlives++
+		}
+	}
+
+	if keepAlives < 2 {
+		t.Fatalf("keep-alive was not received: %v", s.Err())
+	}
+
+	// the client ignores them and receives the event.
+	events, _ := ts.watchEvents(ctx, "", "", nil, nil)
+	ts.waitForSubscribers(2)
+	time.Sleep(5 * eventKeepAliveInterval)
+
+	ts.server.events.publish(&serverapi.Event{Type: serverapi.EventMaintenanceFinished})
+	if ev := receiveEvent(t, events); ev.Type != serverapi.EventMaintenanceFinished {
+		t.Errorf("unexpected event: %v", ev.Type)
+	}
+
+	select {
+	case ev := <-events:
+		t.Errorf("unexpected event: %+v", ev)
+	default:
+	}
+}
+
+func receiveEvent(t *testing.T, events chan *serverapi.Event) *serverapi.Event {
+	t.Helper()
+
+	select {
+	case ev := <-events:
+		return ev
+	case <-time.After(10 * time.Second):
+		t.Fatalf("event was not received")
+		return nil
+	}
+}
@@ -0,0 +1,248 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/kopia/kopia/internal/notification"
+	"github.com/kopia/kopia/internal/serverapi"
+	"github.com/kopia/kopia/snapshot/maintenance"
+)
+
+// maintenanceCheckInterval is the maximum interval between checks whether maintenance is due,
+// which picks up changes to maintenance parameters and runs performed by other servers.
+const maintenanceCheckInterval = 15 * time.Minute
+
+// maintenanceManager periodically performs repository maintenance according to maintenance parameters
+// stored in the repository. Only one server connected to the repository performs maintenance at a time.
+type maintenanceManager struct {
+	server *Server
+
+	// runRequested wakes up the run loop to perform maintenance of a given mode on demand.
+	runRequested chan maintenance.Mode
+
+	mu        sync.RWMutex
+	running   maintenance.Mode
+	lastError string
+}
+
+func (m *maintenanceManager) owner() string {
+	return m.server.username + "@" + m.server.hostname
+}
+
+// run performs maintenance until the context is canceled.
+func (m *maintenanceManager) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		mode, wait := m.dueMode(ctx)
+		if mode != "" {
+			if !m.runMaintenance(ctx, mode) {
+				// the run was not recorded in the repository, so it would be due again immediately.
+				sleep(ctx, maintenanceCheckInterval)
+			}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+
+		case mode := <-m.runRequested:
+			log.Infof("%v maintenance requested via API", mode)
+			m.runMaintenance(ctx, mode)
+
+		case <-time.After(wait):
+		}
+	}
+}
+
+// sleep waits for a given duration or until the context is canceled.
+func sleep(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
+
+// dueMode returns the maintenance mode that is due now or the time to wait before the next check.
+func (m *maintenanceManager) dueMode(ctx context.Context) (maintenance.Mode, time.Duration) {
+	p, err := maintenance.GetParams(ctx, m.server.rep)
+	if err != nil {
+		m.setLastError(err)
+		return "", maintenanceCheckInterval
+	}
+
+	history, err := maintenance.History(ctx, m.server.rep)
+	if err != nil {
+		m.setLastError(err)
+		return "", maintenanceCheckInterval
+	}
+
+	sched := maintenance.NextSchedule(p, history)
+	now := time.Now()
+
+	switch {
+	case !sched.NextFullRun.IsZero() && !sched.NextFullRun.After(now):
+		return maintenance.ModeFull, 0
+	case !sched.NextQuickRun.IsZero() && !sched.NextQuickRun.After(now):
+		return maintenance.ModeQuick, 0
+	}
+
+	wait := maintenanceCheckInterval
+	for _, t := range []time.Time{sched.NextFullRun, sched.NextQuickRun} {
+		if !t.IsZero() && t.Sub(now) < wait {
+			wait = t.Sub(now)
+		}
+	}
+
+	return "", wait
+}
+
+// runMaintenance performs maintenance of a given mode and returns true if the run was recorded
+// in the repository or performed by another server.
+func (m *maintenanceManager) runMaintenance(ctx context.Context, mode maintenance.Mode) bool {
+	if mode == maintenance.ModeFull {
+		// garbage collection must not run concurrently with uploads, including writes of remote clients.
+		// Blocks written by remote clients before garbage collection are not referenced until the client
+		// writes the snapshot manifest, so they are only protected by minimum content age.
+		log.Infof("waiting for uploads to finish before full maintenance")
+		m.server.uploadSemaphore <- struct{}{}
+		defer func() { <-m.server.uploadSemaphore }()
+
+		m.server.remoteWriteMutex.Lock()
+		defer m.server.remoteWriteMutex.Unlock()
+	}
+
+	m.mu.Lock()
+	m.running = mode
+	m.mu.Unlock()
+
+	defer func() {
+		m.mu.Lock()
+		m.running = ""
+		m.mu.Unlock()
+	}()
+
+	m.server.events.publish(&serverapi.Event{
+		Type:    serverapi.EventMaintenanceStarted,
+		Message: string(mode),
+	})
+
+	ri, err := maintenance.Run(ctx, m.server.rep, mode, m.owner())
+
+	ev := &serverapi.Event{
+		Type:    serverapi.EventMaintenanceFinished,
+		Message: string(mode),
+	}
+
+	if lhe, ok := err.(*maintenance.LeaseHeldError); ok {
+		log.Infof("skipping %v maintenance: %v", mode, lhe)
+		ev.Message += ", skipped: " + lhe.Error()
+		m.server.events.publish(ev)
+		m.waitForLease(ctx, lhe)
+		return true
+	}
+
+	m.setLastError(err)
+
+	if err != nil {
+		ev.Error = err.Error()
+		m.server.notifyGlobal(ctx, notification.Message{
+			Event:   notification.EventMaintenanceFailed,
+			Error:   err.Error(),
+			Details: fmt.Sprintf("%v maintenance failed.", mode),
+		})
+	}
+	if ri != nil && ri.GC != nil {
+		ev.Message += ", " + maintenanceSummary(ri)
+	}
+	m.server.events.publish(ev)
+
+	return ri != nil
+}
+
+// waitForLease waits until the lease held by another server expires, after which the run loop
+// will notice maintenance performed by the other server. Requests made in the meantime are deferred.
+func (m *maintenanceManager) waitForLease(ctx context.Context, lhe *maintenance.LeaseHeldError) {
+	wait := time.Until(lhe.Expires)
+	if wait > maintenanceCheckInterval {
+		wait = maintenanceCheckInterval
+	}
+
+	sleep(ctx, wait)
+}
+
+func maintenanceSummary(ri *maintenance.RunInfo) string {
+	return fmt.Sprintf("expired %v snapshots, deleted %v packs", ri.ExpiredSnapshots, ri.GC.DeletedPackCount)
+}
+
+func (m *maintenanceManager) setLastError(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err == nil {
+		m.lastError = ""
+		return
+	}
+
+	log.Errorf("maintenance: %v", err)
+	m.lastError = err.Error()
+}
+
+// wakeUpMaintenance sends a non-blocking request to perform maintenance.
+func wakeUpMaintenance(ch chan maintenance.Mode, mode maintenance.Mode) {
+	select {
+	case ch <- mode:
+	default:
+	}
+}
+
+func (s *Server) handleMaintenanceStatus(ctx context.Context, r *http.Request) (interface{}, *apiError) {
+	p, err := maintenance.GetParams(ctx, s.rep)
+	if err != nil {
+		return nil, internalServerError(err)
+	}
+
+	history, err := maintenance.History(ctx, s.rep)
+	if err != nil {
+		return nil, internalServerError(err)
+	}
+
+	resp := &serverapi.MaintenanceStatusResponse{
+		Params:   p,
+		Schedule: maintenance.NextSchedule(p, history),
+		History:  history,
+	}
+
+	if s.maintenance != nil {
+		s.maintenance.mu.RLock()
+		resp.Running = string(s.maintenance.running)
+		resp.LastError = s.maintenance.lastError
+		s.maintenance.mu.RUnlock()
+	}
+
+	return resp, nil
+}
+
+func (s *Server) handleMaintenanceRun(ctx context.Context, r *http.Request) (interface{}, *apiError) {
+	if s.maintenance == nil {
+		return nil, requestError("maintenance is not supported by this server")
+	}
+
+	mode := maintenance.Mode(r.URL.Query().Get("mode"))
+	switch mode {
+	case "":
+		mode = maintenance.ModeQuick
+	case maintenance.ModeQuick, maintenance.ModeFull:
+	default:
+		return nil, requestError("invalid maintenance mode")
+	}
+
+	wakeUpMaintenance(s.maintenance.runRequested, mode)
+	return &serverapi.Empty{}, nil
+}
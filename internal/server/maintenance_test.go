@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kopia/kopia/repo/remote"
+	"github.com/kopia/kopia/snapshot/maintenance"
+)
+
+// startMaintenance starts the maintenance manager with a given lease settle time and returns
+// the function stopping it, which waits for the manager to return.
+func (ts *testServer) startMaintenance(settleTime time.Duration) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	p := maintenance.DefaultParams()
+	p.QuickCycle.Enabled = false
+	p.FullCycle.Enabled = false
+	p.LeaseSettleTime = settleTime
+	if err := maintenance.SetParams(ctx, ts.rep, p); err != nil {
+		ts.t.Fatalf("unable to set maintenance parameters: %v", err)
+	}
+
+	ts.server.maintenance = &maintenanceManager{
+		server:       ts.server,
+		runRequested: make(chan maintenance.Mode, 1),
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ts.server.maintenance.run(ctx)
+	}()
+
+	return func() {
+		cancel()
+
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			ts.t.Fatalf("maintenance manager did not stop")
+		}
+	}
+}
+
+func (ts *testServer) runningMaintenance() maintenance.Mode {
+	ts.server.maintenance.mu.RLock()
+	defer ts.server.maintenance.mu.RUnlock()
+
+	return ts.server.maintenance.running
+}
+
+func TestMaintenanceManagerStops(t *testing.T) {
+	ts := newTestServer(t, nil)
+	defer ts.close()
+
+	// idle manager.
+	stop := ts.startMaintenance(time.Hour)
+	stop()
+
+	// manager waiting for the lease to settle.
+	stop = ts.startMaintenance(time.Hour)
+	wakeUpMaintenance(ts.server.maintenance.runRequested, maintenance.ModeQuick)
+	ts.waitFor("maintenance running", func() bool { return ts.runningMaintenance() == maintenance.ModeQuick })
+	stop()
+}
+
+func TestFullMaintenanceHoldsOffRemoteWrites(t *testing.T) {
+	ts := newTestServer(t, []User{{Username: "alice", Password: "alice-pass", Role: RoleRepository}})
+	defer ts.close()
+
+	write := func() chan error {
+		result := make(chan error, 1)
+		go func() {
+			var resp remote.WriteBlockResponse
+			result <- ts.client("alice", "alice-pass").Post("repo/blocks", &remote.BlockData{Data: []byte("data")}, &resp)
+		}()
+		return result
+	}
+
+	stop := ts.startMaintenance(time.Hour)
+
+	// quick maintenance does not affect remote clients.
+	wakeUpMaintenance(ts.server.maintenance.runRequested, maintenance.ModeQuick)
+	ts.waitFor("maintenance running", func() bool { return ts.runningMaintenance() == maintenance.ModeQuick })
+	if err := <-write(); err != nil {
+		t.Fatalf("unable to write block: %v", err)
+	}
+
+	stop()
+
+	stop = ts.startMaintenance(time.Hour)
+	defer stop()
+
+	wakeUpMaintenance(ts.server.maintenance.runRequested, maintenance.ModeFull)
+	ts.waitFor("maintenance running", func() bool { return ts.runningMaintenance() == maintenance.ModeFull })
+
+	result := write()
+	select {
+	case err := <-result:
+		t.Fatalf("block written during full maintenance: %v", err)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	// the write proceeds after maintenance is done.
+	stop()
+
+	if err := <-result; err != nil {
+		t.Fatalf("unable to write block: %v", err)
+	}
+}
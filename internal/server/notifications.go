@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/kopia/kopia/internal/notification"
+	"github.com/kopia/kopia/policy"
+	"github.com/kopia/kopia/snapshot"
+)
+
+// maxOverdueGracePeriod is the maximum time after a planned snapshot time when the snapshot is considered overdue.
+const maxOverdueGracePeriod = time.Hour
+
+// notifySource sends notification about a given source to targets defined in its effective policy.
+func (s *Server) notifySource(pol *policy.Policy, src snapshot.SourceInfo, msg notification.Message) {
+	if pol == nil || len(pol.NotificationPolicy.Targets) == 0 {
+		return
+	}
+
+	ctx := context.Background()
+	msg.Source = src.String()
+	if err := s.notifier.Notify(ctx, s.allowedSourceTargets(ctx, pol.NotificationPolicy.Targets), msg); err != nil {
+		log.Warningf("%v", err)
+	}
+}
+
+// allowedSourceTargets returns notification targets of the effective policy of a source, except for command targets
+// not defined in the global policy. Policies of individual sources may be written by other users than the one
+// running the server, who must not be able to execute commands on its behalf.
+func (s *Server) allowedSourceTargets(ctx context.Context, targets []notification.Target) []notification.Target {
+	var globalTargets []notification.Target
+
+	global, err := policy.GetDefinedPolicy(ctx, s.rep, policy.GlobalPolicySourceInfo)
+	switch err {
+	case nil:
+		globalTargets = global.NotificationPolicy.Targets
+	case policy.ErrPolicyNotFound:
+	default:
+		log.Warningf("unable to get global policy: %v", err)
+	}
+
+	var result []notification.Target
+	for _, t := range targets {
+		if t.Type == notification.TargetCommand && !containsTarget(globalTargets, t) {
+			log.Warningf("ignoring %v defined outside of global policy", &t)
+			continue
+		}
+
+		result = append(result, t)
+	}
+
+	return result
+}
+
+func containsTarget(targets []notification.Target, t notification.Target) bool {
+	for _, t2 := range targets {
+		if reflect.DeepEqual(t, t2) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// notifyGlobal sends notification to targets defined in the global policy.
+func (s *Server) notifyGlobal(ctx context.Context, msg notification.Message) {
+	pol, err := policy.GetDefinedPolicy(ctx, s.rep, policy.GlobalPolicySourceInfo)
+	if err == policy.ErrPolicyNotFound {
+		return
+	}
+
+	if err != nil {
+		log.Warningf("unable to get global policy: %v", err)
+		return
+	}
+
+	if err := s.notifier.Notify(ctx, pol.NotificationPolicy.Targets, msg); err != nil {
+		log.Warningf("%v", err)
+	}
+}
+
+// checkOverdue notifies when the last complete snapshot of the source is older than expected by its scheduling policy.
+// The snapshot is overdue when it has not been taken within the grace period after its planned time, which is
+// the same as the time between previous snapshot and the planned time, but at most maxOverdueGracePeriod.
+func (s *sourceManager) checkOverdue() {
+	s.mu.RLock()
+	pol := s.pol
+	last := s.lastCompleteSnapshot
+	paused := s.paused
+	s.mu.RUnlock()
+
+	if pol == nil || last == nil || paused {
+		return
+	}
+
+	planned, ok := pol.SchedulingPolicy.NextSnapshotTime(last.StartTime, last.StartTime, s.src.String())
+	if !ok {
+		return
+	}
+
+	grace := planned.Sub(last.StartTime)
+	if grace > maxOverdueGracePeriod {
+		grace = maxOverdueGracePeriod
+	}
+
+	if time.Now().After(planned.Add(grace)) {
+		s.server.notifySource(pol, s.src, notification.Message{
+			Event:   notification.EventSnapshotOverdue,
+			Details: fmt.Sprintf("Last complete snapshot was taken at %v, next snapshot was planned at %v.", last.StartTime.Local().Format(time.RFC1123), planned.Local().Format(time.RFC1123)),
+		})
+	}
+}
+
+// redactPolicy returns a copy of the policy without notification credentials, which must not be
+// exposed to API users.
+func redactPolicy(pol *policy.Policy) *policy.Policy {
+	if pol == nil || len(pol.NotificationPolicy.Targets) == 0 {
+		return pol
+	}
+
+	redacted := *pol
+	redacted.NotificationPolicy.Targets = nil
+	for _, t := range pol.NotificationPolicy.Targets {
+		if t.SMTPPassword != "" {
+			t.SMTPPassword = redactedValue
+		}
+
+		if len(t.Headers) > 0 {
+			headers := map[string]string{}
+			for k := range t.Headers {
+				headers[k] = redactedValue
+			}
+			t.Headers = headers
+		}
+
+		redacted.NotificationPolicy.Targets = append(redacted.NotificationPolicy.Targets, t)
+	}
+
+	return &redacted
+}
+
+const redactedValue = "<redacted>"
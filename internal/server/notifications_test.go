@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kopia/kopia/internal/notification"
+	"github.com/kopia/kopia/policy"
+	"github.com/kopia/kopia/repo/remote"
+	"github.com/kopia/kopia/snapshot"
+)
+
+func TestSourceCommandTargetsMustBeGlobal(t *testing.T) {
+	ts := newTestServer(t, nil)
+	defer ts.close()
+
+	ctx := context.Background()
+	globalCommand := notification.Target{Type: notification.TargetCommand, Command: []string{"notify-admin"}}
+	sourceCommand := notification.Target{Type: notification.TargetCommand, Command: []string{"rm", "-rf", "/"}}
+	sourceWebhook := notification.Target{Type: notification.TargetWebhook, URL: "http://hook"}
+
+	if err := policy.SetPolicy(ctx, ts.rep, policy.GlobalPolicySourceInfo, &policy.Policy{
+		NotificationPolicy: notification.Policy{Targets: []notification.Target{globalCommand}},
+	}); err != nil {
+		t.Fatalf("unable to set policy: %v", err)
+	}
+
+	src := snapshot.SourceInfo{UserName: "alice", Host: "laptop", Path: "/home"}
+	if err := policy.SetPolicy(ctx, ts.rep, src, &policy.Policy{
+		NotificationPolicy: notification.Policy{Targets: []notification.Target{sourceCommand, sourceWebhook}},
+	}); err != nil {
+		t.Fatalf("unable to set policy: %v", err)
+	}
+
+	pol, _, err := policy.GetEffectivePolicy(ctx, ts.rep, src)
+	if err != nil {
+		t.Fatalf("unable to get effective policy: %v", err)
+	}
+
+	if got, want := ts.server.allowedSourceTargets(ctx, pol.NotificationPolicy.Targets), []notification.Target{sourceWebhook}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected targets of source policy: %v, want %v", got, want)
+	}
+
+	// command targets inherited from the global policy are used.
+	inherited := []notification.Target{globalCommand}
+	if got := ts.server.allowedSourceTargets(ctx, inherited); !reflect.DeepEqual(got, inherited) {
+		t.Errorf("unexpected targets of inherited policy: %v, want %v", got, inherited)
+	}
+}
+
+func TestRepositoryPolicyNotificationTargetsRejected(t *testing.T) {
+	ts := newTestServer(t, []User{
+		{Username: "admin", Password: "admin-pass", Role: RoleControl},
+	})
+	defer ts.close()
+
+	labels := map[string]string{"type": "policy", "policyType": "host", "username": "alice", "hostname": "laptop"}
+	put := func(pol *policy.Policy) error {
+		payload, err := json.Marshal(pol)
+		if err != nil {
+			t.Fatalf("unable to marshal policy: %v", err)
+		}
+
+		var resp remote.PutManifestResponse
+		return ts.client("admin", "admin-pass").Post("repo/manifests", &remote.PutManifestRequest{Labels: labels, Payload: payload}, &resp)
+	}
+
+	if err := put(&policy.Policy{}); err != nil {
+		t.Errorf("unable to write policy: %v", err)
+	}
+
+	if err := put(&policy.Policy{
+		NotificationPolicy: notification.Policy{
+			Targets: []notification.Target{{Type: notification.TargetCommand, Command: []string{"sh"}}},
+		},
+	}); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("unexpected result writing policy with notification targets: %v", err)
+	}
+}
@@ -10,9 +10,13 @@ import (
 
 	"github.com/bmizerany/pat"
 	"github.com/kopia/kopia/internal/kopialogging"
+	"github.com/kopia/kopia/internal/notification"
 	"github.com/kopia/kopia/internal/serverapi"
+	"github.com/kopia/kopia/policy"
 	"github.com/kopia/kopia/repo"
 	"github.com/kopia/kopia/snapshot"
+	"github.com/kopia/kopia/snapshot/maintenance"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var log = kopialogging.Logger("kopia/server")
@@ -25,6 +29,21 @@ type Server struct {
 	mu              sync.RWMutex
 	sourceManagers  map[snapshot.SourceInfo]*sourceManager
 	uploadSemaphore chan struct{}
+	users           []User
+	events          eventBroker
+	maintenance     *maintenanceManager // nil when the repository is accessed through another server
+	notifier        *notification.Notifier
+	upload          uploadFunc
+
+	// remoteWriteMutex is held by requests of remote clients writing to the repository
+	// and exclusively during garbage collection.
+	remoteWriteMutex sync.RWMutex
+}
+
+// Options provides optional settings for the Server.
+type Options struct {
+	// Users who are allowed to access the API, when empty the API does not require authentication.
+	Users []User
 }
 
 // APIHandlers handles API requests.
@@ -34,25 +53,58 @@ func (s *Server) APIHandlers() http.Handler {
 	p.Get("/api/v1/sources", s.handleAPI(s.handleSourcesList))
 	p.Get("/api/v1/snapshots", s.handleAPI(s.handleSourceSnapshotList))
 	p.Get("/api/v1/policies", s.handleAPI(s.handlePolicyList))
+	p.Get("/api/v1/events", s.handleEvents())
+	p.Get("/api/v1/maintenance", s.handleAPI(s.handleMaintenanceStatus))
+	p.Post("/api/v1/maintenance/run", s.handleAPI(s.handleMaintenanceRun))
 	p.Post("/api/v1/refresh", s.handleAPI(s.handleRefresh))
 	p.Post("/api/v1/flush", s.handleAPI(s.handleFlush))
 	p.Post("/api/v1/sources/pause", s.handleAPI(s.handlePause))
 	p.Post("/api/v1/sources/resume", s.handleAPI(s.handleResume))
 	p.Post("/api/v1/sources/upload", s.handleAPI(s.handleUpload))
 	p.Post("/api/v1/sources/cancel", s.handleAPI(s.handleCancel))
+
+	p.Get("/api/v1/repo/parameters", s.handleRepositoryAPI(s.handleRepoParameters))
+	p.Get("/api/v1/repo/blocks/:blockID", s.handleRepositoryAPI(s.handleRepoGetBlock))
+	p.Get("/api/v1/repo/blockinfo/:blockID", s.handleRepositoryAPI(s.handleRepoBlockInfo))
+	p.Post("/api/v1/repo/blocks", s.handleRepositoryAPI(s.handleRepoWriteBlock))
+	p.Get("/api/v1/repo/manifests", s.handleRepositoryAPI(s.handleRepoFindManifests))
+	p.Get("/api/v1/repo/manifests/:manifestID", s.handleRepositoryAPI(s.handleRepoGetManifest))
+	p.Post("/api/v1/repo/manifests", s.handleRepositoryAPI(s.handleRepoPutManifest))
+	p.Del("/api/v1/repo/manifests/:manifestID", s.handleRepositoryAPI(s.handleRepoDeleteManifest))
+	p.Post("/api/v1/repo/flush", s.handleRepositoryAPI(s.handleRepoFlush))
 	return p
 }
 
-func (s *Server) handleAPI(f func(ctx context.Context, r *http.Request) (interface{}, *apiError)) http.Handler {
+type apiRequestFunc func(ctx context.Context, r *http.Request) (interface{}, *apiError)
+
+// handleAPI handles requests that control the server, which are serialized.
+func (s *Server) handleAPI(f apiRequestFunc) http.Handler {
+	return s.handleRequest(requiredRole, true, f)
+}
+
+// handleRepositoryAPI handles requests of clients accessing the repository through the server,
+// which can be served concurrently.
+func (s *Server) handleRepositoryAPI(f apiRequestFunc) http.Handler {
+	return s.handleRequest(func(*http.Request) Role { return RoleRepository }, false, f)
+}
+
+func (s *Server) handleRequest(roleFor func(r *http.Request) Role, exclusive bool, f apiRequestFunc) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		s.mu.Lock()
-		defer s.mu.Unlock()
+		user, ok := s.authorize(w, r, roleFor(r))
+		if !ok {
+			return
+		}
+
+		if exclusive {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+		}
 
 		w.Header().Set("Content-Type", "application/json")
 		e := json.NewEncoder(w)
 		e.SetIndent("", "  ")
 
-		v, err := f(context.Background(), r)
+		v, err := f(context.WithValue(context.Background(), userContextKey{}, user), r)
 		log.Debugf("returned %+v", v)
 		if err == nil {
 			if err := e.Encode(v); err != nil {
@@ -65,13 +117,60 @@ func (s *Server) handleAPI(f func(ctx context.Context, r *http.Request) (interfa
 	})
 }
 
+// MetricsHandler returns the handler exposing Prometheus metrics to users with read-only role.
+func (s *Server) MetricsHandler() http.Handler {
+	h := promhttp.Handler()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := s.authorize(w, r, RoleReadOnly); ok {
+			h.ServeHTTP(w, r)
+		}
+	})
+}
+
+// authorize authenticates the user making the request and verifies that they have the required role,
+// otherwise it writes the error response and returns false.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, required Role) (*User, bool) {
+	user, aerr := s.authenticate(r)
+	if aerr == nil && !user.Role.allows(required) {
+		aerr = errForbidden
+	}
+
+	if aerr != nil {
+		log.Warningf("rejected %v %v from %v: %v", r.Method, r.URL.Path, r.RemoteAddr, aerr.message)
+		if aerr == errUnauthorized {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Kopia"`)
+		}
+		http.Error(w, aerr.message, aerr.code)
+		return nil, false
+	}
+
+	return user, true
+}
+
 func (s *Server) handleRefresh(ctx context.Context, r *http.Request) (interface{}, *apiError) {
 	log.Infof("refreshing")
+	if err := s.rep.Refresh(ctx); err != nil {
+		return nil, internalServerError(err)
+	}
+
+	if err := s.syncSourcesLocked(ctx); err != nil {
+		return nil, internalServerError(err)
+	}
+
+	for _, mgr := range s.sourceManagers {
+		mgr.refresh()
+	}
+
 	return &serverapi.Empty{}, nil
 }
 
 func (s *Server) handleFlush(ctx context.Context, r *http.Request) (interface{}, *apiError) {
 	log.Infof("flushing")
+	if err := s.rep.Flush(ctx); err != nil {
+		return nil, internalServerError(err)
+	}
+
 	return &serverapi.Empty{}, nil
 }
 
@@ -119,28 +218,65 @@ func (s *Server) endUpload(src snapshot.SourceInfo) {
 
 // New creates a Server on top of a given Repository.
 // The server will manage sources for a given username@hostname.
-func New(ctx context.Context, rep *repo.Repository, hostname string, username string) (*Server, error) {
+func New(ctx context.Context, rep *repo.Repository, hostname string, username string, opts Options) (*Server, error) {
 	s := &Server{
 		hostname:        hostname,
 		username:        username,
 		rep:             rep,
 		sourceManagers:  map[snapshot.SourceInfo]*sourceManager{},
 		uploadSemaphore: make(chan struct{}, 1),
+		users:           opts.Users,
+		notifier:        notification.NewNotifier(hostname),
+		upload:          uploadSnapshot,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.syncSourcesLocked(ctx); err != nil {
+		return nil, err
 	}
 
-	sources, err := snapshot.ListSources(ctx, rep)
+	if !rep.IsRemote() {
+		s.maintenance = &maintenanceManager{
+			server:       s,
+			runRequested: make(chan maintenance.Mode, 1),
+		}
+		go s.maintenance.run(ctx)
+	}
+
+	return s, nil
+}
+
+// syncSourcesLocked starts source managers for all sources that have snapshots or policies
+// and are not yet managed. Must be called while holding s.mu.
+func (s *Server) syncSourcesLocked(ctx context.Context) error {
+	sources, err := snapshot.ListSources(ctx, s.rep)
+	if err != nil {
+		return fmt.Errorf("unable to list sources: %v", err)
+	}
+
+	policies, err := policy.ListPolicies(ctx, s.rep)
 	if err != nil {
-		return nil, fmt.Errorf("unable to list sources: %v", err)
+		return fmt.Errorf("unable to list policies: %v", err)
+	}
+
+	for _, pol := range policies {
+		// only policies defined for a particular directory describe a source.
+		if target := pol.Target(); target.Path != "" {
+			sources = append(sources, target)
+		}
 	}
 
 	for _, src := range sources {
+		if _, ok := s.sourceManagers[src]; ok {
+			continue
+		}
+
 		sm := newSourceManager(src, s)
 		s.sourceManagers[src] = sm
+		go sm.run(ctx)
 	}
 
-	for _, src := range s.sourceManagers {
-		go src.run(ctx)
-	}
-
-	return s, nil
+	return nil
 }
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kopia/kopia/internal/apiclient"
+	"github.com/kopia/kopia/internal/notification"
+	"github.com/kopia/kopia/internal/repotesting"
+	"github.com/kopia/kopia/repo"
+	"github.com/kopia/kopia/snapshot"
+)
+
+type testServer struct {
+	t          *testing.T
+	env        *repotesting.Environment
+	rep        *repo.Repository
+	server     *Server
+	httpServer *httptest.Server
+}
+
+// newTestServer creates a server on top of a new repository without starting
+// source managers or maintenance, which tests start as needed.
+func newTestServer(t *testing.T, users []User) *testServer {
+	env := repotesting.Setup(t, nil, repo.ConnectOptions{})
+
+	ts := &testServer{t: t, env: env, rep: env.Repository}
+	ts.server = &Server{
+		hostname:        "server-host",
+		username:        "server-user",
+		rep:             ts.rep,
+		sourceManagers:  map[snapshot.SourceInfo]*sourceManager{},
+		uploadSemaphore: make(chan struct{}, 1),
+		users:           users,
+		notifier:        notification.NewNotifier("server-host"),
+		upload:          uploadSnapshot,
+	}
+	ts.httpServer = httptest.NewServer(ts.server.APIHandlers())
+
+	return ts
+}
+
+// openRepository opens another instance of the repository, which must be closed by the caller.
+func (ts *testServer) openRepository() *repo.Repository {
+	return ts.env.Open()
+}
+
+func (ts *testServer) client(username, password string) *apiclient.Client {
+	cli, err := apiclient.NewClient(apiclient.Options{
+		BaseURL:  ts.httpServer.URL,
+		Username: username,
+		Password: password,
+	})
+	if err != nil {
+		ts.t.Fatalf("unable to create client: %v", err)
+	}
+
+	return cli
+}
+
+func (ts *testServer) close() {
+	ts.httpServer.Close()
+	ts.env.Close()
+}
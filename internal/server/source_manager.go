@@ -2,10 +2,13 @@ package server
 
 import (
 	"context"
+	"fmt"
 	"sync"
 	"time"
 
+	"github.com/kopia/kopia/fs"
 	"github.com/kopia/kopia/fs/localfs"
+	"github.com/kopia/kopia/internal/notification"
 	"github.com/kopia/kopia/internal/serverapi"
 	"github.com/kopia/kopia/internal/upload"
 	"github.com/kopia/kopia/policy"
@@ -16,21 +19,33 @@ import (
 // Possible states:
 //
 // - INITIALIZING - fetching configuration from repository
-// - READY - waiting for next snapshot
-// - PAUSED - inactive
-// - FAILED - inactive
+// - WAITING - waiting for next snapshot
+// - PAUSED - scheduled snapshots are disabled, uploads can still be triggered on demand
+// - PENDING - waiting for other uploads to finish
 // - UPLOADING - uploading a snapshot
+// - FAILED - unable to read configuration from repository
+// - REMOTE - source belongs to a different host, the state is only being observed
+// - STOPPED - source manager is no longer running
 type sourceManager struct {
 	server *Server
 	src    snapshot.SourceInfo
 	closed chan struct{}
 
+	// uploadRequested and refreshRequested wake up the run loop, they are buffered
+	// so that requests made while the loop is busy are not lost.
+	uploadRequested  chan struct{}
+	refreshRequested chan struct{}
+
 	mu                   sync.RWMutex
 	pol                  *policy.Policy
 	state                string
+	paused               bool
+	lastError            string
+	retryAfter           time.Time
 	nextSnapshotTime     time.Time
 	lastCompleteSnapshot *snapshot.Manifest
 	lastSnapshot         *snapshot.Manifest
+	uploader             *upload.Uploader
 
 	// state of current upload
 	uploadPath          string
@@ -45,10 +60,15 @@ func (s *sourceManager) Status() serverapi.SourceStatus {
 	st := serverapi.SourceStatus{
 		Source:           s.src,
 		Status:           s.state,
-		LastSnapshotSize: s.lastSnapshot.Stats.TotalFileSize,
-		LastSnapshotTime: s.lastSnapshot.StartTime,
+		Paused:           s.paused,
+		LastError:        s.lastError,
 		NextSnapshotTime: s.nextSnapshotTime,
-		Policy:           s.pol,
+		Policy:           redactPolicy(s.pol),
+	}
+
+	if s.lastSnapshot != nil {
+		st.LastSnapshotSize = s.lastSnapshot.Stats.TotalFileSize
+		st.LastSnapshotTime = s.lastSnapshot.StartTime
 	}
 
 	st.UploadStatus.UploadingPath = s.uploadPath
@@ -64,11 +84,15 @@ func (s *sourceManager) setStatus(stat string) {
 	s.mu.Unlock()
 }
 
+func (s *sourceManager) isLocal() bool {
+	return s.server.hostname == s.src.Host
+}
+
 func (s *sourceManager) run(ctx context.Context) {
 	s.setStatus("INITIALIZING")
 	defer s.setStatus("STOPPED")
 
-	if s.server.hostname == s.src.Host {
+	if s.isLocal() {
 		s.runLocal(ctx)
 	} else {
 		s.runRemote(ctx)
@@ -78,25 +102,49 @@ func (s *sourceManager) run(ctx context.Context) {
 func (s *sourceManager) runLocal(ctx context.Context) {
 	s.refreshStatus(ctx)
 	for {
-		var timeBeforeNextSnapshot time.Duration
-		if !s.nextSnapshotTime.IsZero() {
-			timeBeforeNextSnapshot = time.Until(s.nextSnapshotTime)
-			log.Infof("time to next snapshot %v is %v", s.src, timeBeforeNextSnapshot)
-		} else {
-			timeBeforeNextSnapshot = 24 * time.Hour
+		s.mu.RLock()
+		paused := s.paused
+		nextSnapshotTime := s.nextSnapshotTime
+		failed := s.state == "FAILED"
+		s.mu.RUnlock()
+
+		// scheduled snapshot timer, nil channel disables scheduled snapshots
+		var snapshotTimer <-chan time.Time
+
+		switch {
+		case failed:
+			// keep the state until next successful refresh
+
+		case paused:
+			s.setStatus("PAUSED")
+
+		default:
+			s.setStatus("WAITING")
+			if !nextSnapshotTime.IsZero() {
+				timeBeforeNextSnapshot := time.Until(nextSnapshotTime)
+				log.Infof("time to next snapshot %v is %v", s.src, timeBeforeNextSnapshot)
+				snapshotTimer = time.After(timeBeforeNextSnapshot)
+			}
 		}
 
-		s.setStatus("WAITING")
 		select {
 		case <-s.closed:
 			return
 
+		case <-s.refreshRequested:
+			s.refreshStatus(ctx)
+
 		case <-time.After(15 * time.Second):
 			s.refreshStatus(ctx)
+			s.checkOverdue()
 
-		case <-time.After(timeBeforeNextSnapshot):
+		case <-s.uploadRequested:
+			log.Infof("snapshotting %v on demand", s.src)
+			s.snapshot(ctx)
+			s.refreshStatus(ctx)
+
+		case <-snapshotTimer:
 			log.Infof("snapshotting %v", s.src)
-			s.setStatus("SNAPSHOTTING")
 			s.snapshot(ctx)
 			s.refreshStatus(ctx)
 		}
@@ -110,8 +158,11 @@ func (s *sourceManager) runRemote(ctx context.Context) {
 		select {
 		case <-s.closed:
 			return
+		case <-s.refreshRequested:
+			s.refreshStatus(ctx)
 		case <-time.After(15 * time.Second):
 			s.refreshStatus(ctx)
+			s.checkOverdue()
 		}
 	}
 }
@@ -124,6 +175,23 @@ func (s *sourceManager) Progress(path string, numFiles int, pathCompleted, pathT
 	s.uploadPathCompleted = pathCompleted
 	s.uploadPathTotal = pathTotal
 	log.Debugf("path: %v %v/%v", path, pathCompleted, pathTotal)
+
+	s.server.publishSourceEvent(s.src, &serverapi.Event{
+		Type:          serverapi.EventUploadProgress,
+		Path:          path,
+		NumFiles:      numFiles,
+		PathCompleted: pathCompleted,
+		PathTotal:     pathTotal,
+		Stats:         stats,
+	})
+}
+
+func (s *sourceManager) IgnoredError(path string, err error) {
+	s.server.publishSourceEvent(s.src, &serverapi.Event{
+		Type:  serverapi.EventUploadError,
+		Path:  path,
+		Error: err.Error(),
+	})
 }
 
 func (s *sourceManager) UploadFinished() {
@@ -135,88 +203,263 @@ func (s *sourceManager) UploadFinished() {
 	s.uploadPathTotal = 0
 }
 
+// upload requests a snapshot to be taken as soon as possible, regardless of the schedule.
 func (s *sourceManager) upload() serverapi.SourceActionResponse {
 	log.Infof("upload triggered via API: %v", s.src)
+	if !s.isLocal() {
+		return serverapi.SourceActionResponse{Success: false}
+	}
+
+	wakeUp(s.uploadRequested)
 	return serverapi.SourceActionResponse{Success: true}
 }
 
+// cancel cancels the upload that is in progress or waiting to start.
 func (s *sourceManager) cancel() serverapi.SourceActionResponse {
 	log.Infof("cancel triggered via API: %v", s.src)
-	return serverapi.SourceActionResponse{Success: true}
+
+	// drop any upload request that has not been picked up yet.
+	cancelled := false
+	select {
+	case <-s.uploadRequested:
+		cancelled = true
+	default:
+	}
+
+	s.mu.RLock()
+	u := s.uploader
+	s.mu.RUnlock()
+
+	if u != nil {
+		u.Cancel()
+		cancelled = true
+	}
+
+	return serverapi.SourceActionResponse{Success: cancelled}
 }
 
+// pause disables scheduled snapshots of the source.
 func (s *sourceManager) pause() serverapi.SourceActionResponse {
 	log.Infof("pause triggered via API: %v", s.src)
-	return serverapi.SourceActionResponse{Success: true}
+	return s.setPaused(true)
 }
 
+// resume re-enables scheduled snapshots of the source.
 func (s *sourceManager) resume() serverapi.SourceActionResponse {
 	log.Infof("resume triggered via API: %v", s.src)
+	return s.setPaused(false)
+}
+
+func (s *sourceManager) setPaused(paused bool) serverapi.SourceActionResponse {
+	if !s.isLocal() {
+		return serverapi.SourceActionResponse{Success: false}
+	}
+
+	if err := saveSourceState(context.Background(), s.server.rep, s.src, &sourceState{Paused: paused}); err != nil {
+		log.Errorf("unable to save state of %v: %v", s.src, err)
+		return serverapi.SourceActionResponse{Success: false}
+	}
+
+	s.mu.Lock()
+	s.paused = paused
+	s.mu.Unlock()
+
+	wakeUp(s.refreshRequested)
 	return serverapi.SourceActionResponse{Success: true}
 }
 
+// refresh requests the source manager to re-read its policy and snapshots.
+func (s *sourceManager) refresh() {
+	wakeUp(s.refreshRequested)
+}
+
+func (s *sourceManager) stop() {
+	close(s.closed)
+}
+
 func (s *sourceManager) snapshot(ctx context.Context) {
+	u := upload.NewUploader(s.server.rep)
+
+	s.mu.Lock()
+	s.uploader = u
+	s.state = "PENDING"
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		s.uploader = nil
+		s.mu.Unlock()
+	}()
+
 	s.server.beginUpload(s.src)
 	defer s.server.endUpload(s.src)
 
-	localEntry, err := localfs.NewEntry(s.src.Path)
-	if err != nil {
-		log.Errorf("unable to create local filesystem: %v", err)
+	if u.IsCancelled() {
+		log.Infof("upload of %v cancelled before it started", s.src)
 		return
 	}
-	u := upload.NewUploader(s.server.rep)
+
+	s.setStatus("UPLOADING")
+	s.server.publishSourceEvent(s.src, &serverapi.Event{Type: serverapi.EventSnapshotStarted})
+
 	polGetter, err := policy.FilesPolicyGetter(ctx, s.server.rep, s.src)
 	if err != nil {
-		log.Errorf("unable to create policy getter: %v", err)
+		upload.ReportSnapshotResult(s.src, nil, err)
+		s.snapshotFailed(fmt.Errorf("unable to create policy getter: %v", err))
+		return
 	}
 	u.FilesPolicy = polGetter
 	u.Progress = s
 
-	log.Infof("starting upload of %v", s.src)
-	manifest, err := u.Upload(ctx, localEntry, s.src, s.lastSnapshot)
+	u.Actions, err = policy.ActionsRunner(ctx, s.server.rep, s.src)
 	if err != nil {
-		log.Errorf("upload error: %v", err)
+		upload.ReportSnapshotResult(s.src, nil, err)
+		s.snapshotFailed(fmt.Errorf("unable to load actions: %v", err))
 		return
 	}
 
-	snapshotID, err := snapshot.SaveSnapshot(ctx, s.server.rep, manifest)
+	if err = u.Actions.RunBeforeSnapshotRoot(ctx); err != nil {
+		upload.ReportSnapshotResult(s.src, nil, err)
+		s.snapshotFailed(err)
+		return
+	}
+
+	snapshotID, manifest, err := s.uploadAndSaveSnapshot(ctx, u)
+	if actionErr := u.Actions.RunAfterSnapshotRoot(ctx, snapshotID, err); actionErr != nil && err == nil {
+		err = actionErr
+	}
+
 	if err != nil {
-		log.Errorf("unable to save snapshot: %v", err)
+		s.snapshotFailed(err)
 		return
 	}
 
-	log.Infof("created snapshot %v", snapshotID)
+	s.setLastError(nil)
+	s.server.publishSourceEvent(s.src, &serverapi.Event{
+		Type:       serverapi.EventSnapshotFinished,
+		SnapshotID: snapshotID,
+		Stats:      &manifest.Stats,
+		Message:    manifest.IncompleteReason,
+	})
+}
+
+// uploadAndSaveSnapshot uploads the directory to be snapshotted, which may have been redirected by
+// before-snapshot-root action, and saves the snapshot manifest.
+func (s *sourceManager) uploadAndSaveSnapshot(ctx context.Context, u *upload.Uploader) (string, *snapshot.Manifest, error) {
+	localEntry, err := localfs.NewEntry(u.Actions.SnapshotPath)
+	if err != nil {
+		upload.ReportSnapshotResult(s.src, nil, err)
+		return "", nil, fmt.Errorf("unable to create local filesystem: %v", err)
+	}
+
+	log.Infof("starting upload of %v", s.src)
+	s.mu.RLock()
+	previous := s.lastCompleteSnapshot
+	s.mu.RUnlock()
+
+	manifest, err := s.server.upload(ctx, u, localEntry, s.src, previous)
+	if err != nil {
+		upload.ReportSnapshotResult(s.src, nil, err)
+		return "", nil, fmt.Errorf("upload error: %v", err)
+	}
+
+	snapshotID, err := snapshot.SaveSnapshot(ctx, s.server.rep, manifest)
+	upload.ReportSnapshotResult(s.src, manifest, err)
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to save snapshot: %v", err)
+	}
+
+	if manifest.IncompleteReason != "" {
+		log.Infof("created incomplete snapshot %v (%v)", snapshotID, manifest.IncompleteReason)
+	} else {
+		log.Infof("created snapshot %v", snapshotID)
+	}
+
 	if err := s.server.rep.Flush(ctx); err != nil {
-		log.Errorf("unable to flush: %v", err)
+		return snapshotID, manifest, fmt.Errorf("unable to flush: %v", err)
+	}
+
+	return snapshotID, manifest, nil
+}
+
+// snapshotFailed records the error of the snapshot and notifies subscribers and notification targets.
+func (s *sourceManager) snapshotFailed(err error) {
+	s.setLastError(err)
+
+	s.mu.Lock()
+	s.retryAfter = time.Now().Add(failedSnapshotRetryDelay)
+	s.mu.Unlock()
+
+	s.server.publishSourceEvent(s.src, &serverapi.Event{
+		Type:  serverapi.EventSnapshotFailed,
+		Error: err.Error(),
+	})
+
+	s.mu.RLock()
+	pol := s.pol
+	s.mu.RUnlock()
+
+	s.server.notifySource(pol, s.src, notification.Message{
+		Event: notification.EventSnapshotFailed,
+		Error: err.Error(),
+	})
+}
+
+func (s *sourceManager) setLastError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err == nil {
+		s.lastError = ""
 		return
 	}
+
+	log.Errorf("%v: %v", s.src, err)
+	s.lastError = err.Error()
 }
 
-func (s *sourceManager) findClosestNextSnapshotTime() time.Time {
-	nextSnapshotTime := time.Now().Add(24 * time.Hour)
-	if s.pol != nil {
-		// compute next snapshot time based on interval
-		if interval := s.pol.SchedulingPolicy.IntervalSeconds; interval != 0 {
-			interval := time.Duration(interval) * time.Second
-			nt := s.lastSnapshot.StartTime.Add(interval).Truncate(interval)
-			if nt.Before(nextSnapshotTime) {
-				nextSnapshotTime = nt
-			}
-		}
+// uploadFunc uploads the snapshot of a source using a given uploader, tests replace it to avoid reading
+// the local filesystem.
+type uploadFunc func(ctx context.Context, u *upload.Uploader, source fs.Entry, si snapshot.SourceInfo, previous *snapshot.Manifest) (*snapshot.Manifest, error)
 
-		for _, tod := range s.pol.SchedulingPolicy.TimesOfDay {
-			nowLocalTime := time.Now().Local()
-			localSnapshotTime := time.Date(nowLocalTime.Year(), nowLocalTime.Month(), nowLocalTime.Day(), tod.Hour, tod.Minute, 0, 0, time.Local)
-			if tod.Hour < nowLocalTime.Hour() || (tod.Hour == nowLocalTime.Hour() && tod.Minute < nowLocalTime.Minute()) {
-				localSnapshotTime = localSnapshotTime.Add(24 * time.Hour)
-			}
-			if localSnapshotTime.Before(nextSnapshotTime) {
-				nextSnapshotTime = localSnapshotTime
-			}
-		}
+func uploadSnapshot(ctx context.Context, u *upload.Uploader, source fs.Entry, si snapshot.SourceInfo, previous *snapshot.Manifest) (*snapshot.Manifest, error) {
+	return u.Upload(ctx, source, si, previous)
+}
+
+// failedSnapshotRetryDelay is the minimum delay before a failed scheduled snapshot is retried.
+const failedSnapshotRetryDelay = 5 * time.Minute
+
+// wakeUp sends a non-blocking notification on a given buffered channel.
+func wakeUp(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// computeNextSnapshotTime returns the time of the next scheduled snapshot or zero time if the source
+// is not snapshotted on schedule. Must be called while holding s.mu.
+func (s *sourceManager) computeNextSnapshotTime() time.Time {
+	if s.pol == nil {
+		return time.Time{}
+	}
+
+	var previous time.Time
+	if s.lastSnapshot != nil {
+		previous = s.lastSnapshot.StartTime
 	}
 
-	return nextSnapshotTime
+	next, ok := s.pol.SchedulingPolicy.NextSnapshotTime(previous, time.Now(), s.src.String())
+	if !ok {
+		return time.Time{}
+	}
+
+	// don't retry failed snapshots immediately, even if they are overdue.
+	if next.Before(s.retryAfter) {
+		next = s.retryAfter
+	}
+
+	return next
 }
 
 func (s *sourceManager) refreshStatus(ctx context.Context) {
@@ -224,33 +467,63 @@ func (s *sourceManager) refreshStatus(ctx context.Context) {
 	pol, _, err := policy.GetEffectivePolicy(ctx, s.server.rep, s.src)
 	if err != nil {
 		s.setStatus("FAILED")
+		s.setLastError(fmt.Errorf("unable to get effective policy: %v", err))
 		return
 	}
 
-	s.pol = pol
 	snapshots, err := snapshot.ListSnapshots(ctx, s.server.rep, s.src)
 	if err != nil {
 		s.setStatus("FAILED")
+		s.setLastError(fmt.Errorf("unable to list snapshots: %v", err))
+		return
+	}
+
+	st, err := loadSourceState(ctx, s.server.rep, s.src)
+	if err != nil {
+		s.setStatus("FAILED")
+		s.setLastError(err)
 		return
 	}
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state == "FAILED" {
+		if s.isLocal() {
+			s.state = "INITIALIZING"
+		} else {
+			s.state = "REMOTE"
+		}
+	}
+
+	s.pol = pol
+	s.paused = st.Paused
+	s.lastSnapshot = nil
 	s.lastCompleteSnapshot = nil
+
 	snaps := snapshot.SortByTime(snapshots, true)
+	for _, m := range snaps {
+		if m.IncompleteReason == "" {
+			s.lastCompleteSnapshot = m
+			break
+		}
+	}
+
 	if len(snaps) > 0 {
 		s.lastSnapshot = snaps[0]
-		s.nextSnapshotTime = s.findClosestNextSnapshotTime()
-	} else {
-		s.nextSnapshotTime = time.Time{}
-		s.lastSnapshot = nil
 	}
+
+	s.nextSnapshotTime = s.computeNextSnapshotTime()
 }
 
 func newSourceManager(src snapshot.SourceInfo, server *Server) *sourceManager {
 	m := &sourceManager{
-		src:    src,
-		server: server,
-		state:  "UNKNOWN",
-		closed: make(chan struct{}),
+		src:              src,
+		server:           server,
+		state:            "UNKNOWN",
+		closed:           make(chan struct{}),
+		uploadRequested:  make(chan struct{}, 1),
+		refreshRequested: make(chan struct{}, 1),
 	}
 
 	return m
@@ -0,0 +1,299 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kopia/kopia/fs"
+	"github.com/kopia/kopia/internal/serverapi"
+	"github.com/kopia/kopia/internal/upload"
+	"github.com/kopia/kopia/policy"
+	"github.com/kopia/kopia/snapshot"
+)
+
+// stubUploader replaces uploads of the server, each upload reports progress and then waits until
+// it is allowed to finish or it is cancelled.
+type stubUploader struct {
+	started chan *upload.Uploader
+	finish  chan struct{}
+}
+
+func newStubUploader() *stubUploader {
+	return &stubUploader{
+		started: make(chan *upload.Uploader, 10),
+		finish:  make(chan struct{}),
+	}
+}
+
+func (su *stubUploader) upload(ctx context.Context, u *upload.Uploader, source fs.Entry, si snapshot.SourceInfo, previous *snapshot.Manifest) (*snapshot.Manifest, error) {
+	defer u.Progress.UploadFinished()
+
+	man := &snapshot.Manifest{Source: si, StartTime: time.Now()}
+	u.Progress.Progress(".", 1, 50, 100, &snapshot.Stats{TotalFileCount: 1})
+	su.started <- u
+
+	for !u.IsCancelled() {
+		select {
+		case <-su.finish:
+			man.EndTime = time.Now()
+			return man, nil
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	man.EndTime = time.Now()
+	man.IncompleteReason = "cancelled"
+	return man, nil
+}
+
+// startSourceManager starts the manager of the local source snapshotting the test directory.
+func (ts *testServer) startSourceManager(su *stubUploader) *sourceManager {
+	ts.server.upload = su.upload
+
+	sm := newSourceManager(snapshot.SourceInfo{Host: "server-host", UserName: "server-user", Path: ts.env.Dir}, ts.server)
+	go sm.run(context.Background())
+
+	ts.waitFor("source manager to start", func() bool { return sm.Status().Status == "WAITING" })
+	return sm
+}
+
+func (ts *testServer) stopSourceManager(sm *sourceManager) {
+	sm.stop()
+	ts.waitFor("source manager to stop", func() bool { return sm.Status().Status == "STOPPED" })
+}
+
+func (ts *testServer) waitFor(desc string, cond func() bool) {
+	ts.t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			ts.t.Fatalf("timed out waiting for %v", desc)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func waitForEvent(t *testing.T, ch chan *serverapi.Event, eventType string) *serverapi.Event {
+	t.Helper()
+
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case ev := <-ch:
+			if ev.Type == eventType {
+				return ev
+			}
+
+		case <-timeout:
+			t.Fatalf("timed out waiting for %v event", eventType)
+			return nil
+		}
+	}
+}
+
+func (ts *testServer) snapshotCount(src snapshot.SourceInfo) int {
+	ids, err := snapshot.ListSnapshotManifests(context.Background(), ts.rep, &src)
+	if err != nil {
+		ts.t.Fatalf("unable to list snapshots: %v", err)
+	}
+
+	return len(ids)
+}
+
+func TestSourceManagerPauseIsPersisted(t *testing.T) {
+	ts := newTestServer(t, nil)
+	defer ts.close()
+
+	sm := ts.startSourceManager(newStubUploader())
+	defer ts.stopSourceManager(sm)
+
+	if r := sm.pause(); !r.Success {
+		t.Fatalf("unable to pause source")
+	}
+
+	ts.waitFor("source to be paused", func() bool { return sm.Status().Status == "PAUSED" })
+
+	// paused state is loaded by another server using the repository.
+	rep2 := ts.openRepository()
+	defer rep2.Close(context.Background()) //nolint:errcheck
+
+	sm2 := newSourceManager(sm.src, &Server{hostname: "server-host", rep: rep2})
+	sm2.refreshStatus(context.Background())
+	if !sm2.Status().Paused {
+		t.Errorf("paused state was not persisted")
+	}
+
+	if r := sm.resume(); !r.Success {
+		t.Fatalf("unable to resume source")
+	}
+
+	ts.waitFor("source to be resumed", func() bool { return sm.Status().Status == "WAITING" })
+
+	if err := rep2.Refresh(context.Background()); err != nil {
+		t.Fatalf("unable to refresh repository: %v", err)
+	}
+
+	sm2.refreshStatus(context.Background())
+	if sm2.Status().Paused {
+		t.Errorf("resumed state was not persisted")
+	}
+
+	remote := newSourceManager(snapshot.SourceInfo{Host: "other-host", UserName: "user", Path: "/path"}, ts.server)
+	if r := remote.pause(); r.Success {
+		t.Errorf("unexpected success pausing remote source")
+	}
+}
+
+func TestSourceManagerUploadOnDemand(t *testing.T) {
+	ts := newTestServer(t, nil)
+	defer ts.close()
+
+	su := newStubUploader()
+	sm := ts.startSourceManager(su)
+	defer ts.stopSourceManager(sm)
+
+	events := ts.server.events.subscribe()
+	defer ts.server.events.unsubscribe(events)
+
+	// paused sources can still be uploaded on demand.
+	if r := sm.pause(); !r.Success {
+		t.Fatalf("unable to pause source")
+	}
+
+	if r := sm.upload(); !r.Success {
+		t.Fatalf("unable to request upload")
+	}
+
+	<-su.started
+	if st := sm.Status(); st.Status != "UPLOADING" || st.UploadStatus.UploadingPathCompleted != 50 || st.UploadStatus.UploadingPathTotal != 100 {
+		t.Errorf("unexpected status during upload: %+v", st)
+	}
+
+	if ev := waitForEvent(t, events, serverapi.EventUploadProgress); ev.Stats == nil || ev.Stats.TotalFileCount != 1 {
+		t.Errorf("unexpected progress event: %+v", ev)
+	}
+
+	su.finish <- struct{}{}
+
+	ev := waitForEvent(t, events, serverapi.EventSnapshotFinished)
+	if ev.SnapshotID == "" || ev.Message != "" {
+		t.Errorf("unexpected snapshot event: %+v", ev)
+	}
+
+	ts.waitFor("source to be paused", func() bool { return sm.Status().Status == "PAUSED" })
+
+	st := sm.Status()
+	if st.LastSnapshotTime.IsZero() || st.LastError != "" || st.UploadStatus.UploadingPath != "" {
+		t.Errorf("unexpected status after upload: %+v", st)
+	}
+
+	if got := ts.snapshotCount(sm.src); got != 1 {
+		t.Errorf("unexpected number of snapshots: %v", got)
+	}
+
+	remote := newSourceManager(snapshot.SourceInfo{Host: "other-host", UserName: "user", Path: "/path"}, ts.server)
+	if r := remote.upload(); r.Success {
+		t.Errorf("unexpected success uploading remote source")
+	}
+}
+
+func TestSourceManagerCancel(t *testing.T) {
+	ts := newTestServer(t, nil)
+	defer ts.close()
+
+	su := newStubUploader()
+	sm := ts.startSourceManager(su)
+	defer ts.stopSourceManager(sm)
+
+	events := ts.server.events.subscribe()
+	defer ts.server.events.unsubscribe(events)
+
+	if r := sm.cancel(); r.Success {
+		t.Errorf("unexpected success cancelling when nothing is uploading")
+	}
+
+	// upload in progress produces an incomplete snapshot.
+	sm.upload()
+	<-su.started
+
+	if r := sm.cancel(); !r.Success {
+		t.Errorf("unable to cancel upload")
+	}
+
+	if ev := waitForEvent(t, events, serverapi.EventSnapshotFinished); ev.Message != "cancelled" {
+		t.Errorf("unexpected snapshot event: %+v", ev)
+	}
+
+	ts.waitFor("upload to finish", func() bool { return sm.Status().Status == "WAITING" })
+
+	// upload waiting for other uploads does not start.
+	ts.server.beginUpload(snapshot.SourceInfo{Host: "server-host", Path: "/other"})
+	sm.upload()
+	ts.waitFor("upload to be pending", func() bool { return sm.Status().Status == "PENDING" })
+
+	if r := sm.cancel(); !r.Success {
+		t.Errorf("unable to cancel pending upload")
+	}
+
+	ts.server.endUpload(snapshot.SourceInfo{Host: "server-host", Path: "/other"})
+	ts.waitFor("upload to be cancelled", func() bool { return sm.Status().Status == "WAITING" })
+
+	select {
+	case <-su.started:
+		t.Errorf("cancelled upload was started")
+	default:
+	}
+
+	if got := ts.snapshotCount(sm.src); got != 1 {
+		t.Errorf("unexpected number of snapshots: %v", got)
+	}
+}
+
+func TestSourceManagerRefresh(t *testing.T) {
+	ts := newTestServer(t, nil)
+	defer ts.close()
+
+	ctx := context.Background()
+	sm := ts.startSourceManager(newStubUploader())
+	defer ts.stopSourceManager(sm)
+
+	if st := sm.Status(); !st.NextSnapshotTime.IsZero() || !st.LastSnapshotTime.IsZero() {
+		t.Fatalf("unexpected initial status: %+v", st)
+	}
+
+	// policy and snapshots changed in the repository are picked up on refresh.
+	pol := &policy.Policy{}
+	pol.SchedulingPolicy.IntervalSeconds = 3600
+	if err := policy.SetPolicy(ctx, ts.rep, sm.src, pol); err != nil {
+		t.Fatalf("unable to set policy: %v", err)
+	}
+
+	// the next snapshot is always planned in the future, so that it doesn't start during the test.
+	startTime := time.Now()
+	if _, err := snapshot.SaveSnapshot(ctx, ts.rep, &snapshot.Manifest{Source: sm.src, StartTime: startTime, EndTime: startTime}); err != nil {
+		t.Fatalf("unable to save snapshot: %v", err)
+	}
+
+	if err := ts.rep.Flush(ctx); err != nil {
+		t.Fatalf("unable to flush: %v", err)
+	}
+
+	sm.refresh()
+	ts.waitFor("status to be refreshed", func() bool { return !sm.Status().NextSnapshotTime.IsZero() })
+
+	st := sm.Status()
+	if !st.LastSnapshotTime.Equal(startTime) {
+		t.Errorf("unexpected last snapshot time: %v, want %v", st.LastSnapshotTime, startTime)
+	}
+
+	if st.NextSnapshotTime.Before(startTime) || st.NextSnapshotTime.After(startTime.Add(time.Hour)) {
+		t.Errorf("unexpected next snapshot time: %v", st.NextSnapshotTime)
+	}
+
+	if st.Policy == nil || st.Policy.SchedulingPolicy.IntervalSeconds != 3600 {
+		t.Errorf("unexpected policy: %+v", st.Policy)
+	}
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/kopia/kopia/repo"
+	"github.com/kopia/kopia/snapshot"
+)
+
+const sourceStateManifestType = "serverSourceState"
+
+// sourceState is the persistent state of a source managed by the server, which is stored
+// in the repository so that it survives server restarts.
+type sourceState struct {
+	Paused bool `json:"paused"`
+}
+
+func sourceStateLabels(src snapshot.SourceInfo) map[string]string {
+	return map[string]string{
+		"type":     sourceStateManifestType,
+		"hostname": src.Host,
+		"username": src.UserName,
+		"path":     src.Path,
+	}
+}
+
+// loadSourceState returns the most recently saved state of a given source.
+func loadSourceState(ctx context.Context, rep *repo.Repository, src snapshot.SourceInfo) (*sourceState, error) {
+	entries, err := rep.Manifests.Find(ctx, sourceStateLabels(src))
+	if err != nil {
+		return nil, fmt.Errorf("unable to find source state: %v", err)
+	}
+
+	st := &sourceState{}
+	if len(entries) == 0 {
+		return st, nil
+	}
+
+	latest := entries[0]
+	for _, e := range entries {
+		if e.ModTime.After(latest.ModTime) {
+			latest = e
+		}
+	}
+
+	if err := rep.Manifests.Get(ctx, latest.ID, st); err != nil {
+		return nil, fmt.Errorf("unable to load source state: %v", err)
+	}
+
+	return st, nil
+}
+
+// saveSourceState persists the state of a given source replacing any previously saved state.
+func saveSourceState(ctx context.Context, rep *repo.Repository, src snapshot.SourceInfo, st *sourceState) error {
+	labels := sourceStateLabels(src)
+
+	old, err := rep.Manifests.Find(ctx, labels)
+	if err != nil {
+		return fmt.Errorf("unable to find source state: %v", err)
+	}
+
+	if _, err := rep.Manifests.Put(ctx, labels, st); err != nil {
+		return fmt.Errorf("unable to save source state: %v", err)
+	}
+
+	for _, e := range old {
+		rep.Manifests.Delete(e.ID)
+	}
+
+	return rep.Flush(ctx)
+}
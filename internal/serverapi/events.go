@@ -0,0 +1,29 @@
+package serverapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+
+	"github.com/kopia/kopia/internal/apiclient"
+)
+
+// WatchEvents subscribes to events published by the server and invokes the callback for each of them
+// until the context is cancelled, the server closes the stream or the callback returns an error.
+// The filter can limit events to particular sources using 'host', 'userName' and 'path' parameters.
+func WatchEvents(ctx context.Context, cli *apiclient.Client, filter url.Values, callback func(ev *Event) error) error {
+	path := "events"
+	if len(filter) > 0 {
+		path += "?" + filter.Encode()
+	}
+
+	return cli.StreamEvents(ctx, path, func(eventType string, data []byte) error {
+		ev := &Event{}
+		if err := json.Unmarshal(data, ev); err != nil {
+			return fmt.Errorf("malformed %v event: %v", eventType, err)
+		}
+
+		return callback(ev)
+	})
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/kopia/kopia/policy"
 	"github.com/kopia/kopia/repo/block"
 	"github.com/kopia/kopia/snapshot"
+	"github.com/kopia/kopia/snapshot/maintenance"
 )
 
 // StatusResponse is the response of 'status' HTTP API command.
@@ -25,6 +26,8 @@ type SourcesResponse struct {
 type SourceStatus struct {
 	Source           snapshot.SourceInfo `json:"source"`
 	Status           string              `json:"status"`
+	Paused           bool                `json:"paused,omitempty"`
+	LastError        string              `json:"lastError,omitempty"`
 	Policy           *policy.Policy      `json:"policy"`
 	LastSnapshotSize int64               `json:"lastSnapshotSize,omitempty"`
 	LastSnapshotTime time.Time           `json:"lastSnapshotTime,omitempty"`
@@ -62,3 +65,43 @@ type SourceActionResponse struct {
 type MultipleSourceActionResponse struct {
 	Sources map[string]SourceActionResponse `json:"sources"`
 }
+
+// Types of events published by the server.
+const (
+	EventSnapshotStarted     = "snapshot-started"
+	EventSnapshotFinished    = "snapshot-finished"
+	EventSnapshotFailed      = "snapshot-failed"
+	EventUploadProgress      = "upload-progress"
+	EventUploadError         = "upload-error"
+	EventMaintenanceStarted  = "maintenance-started"
+	EventMaintenanceFinished = "maintenance-finished"
+)
+
+// Event describes a single event published by the server to the 'events' stream.
+type Event struct {
+	Type   string               `json:"type"`
+	Time   time.Time            `json:"time"`
+	Source *snapshot.SourceInfo `json:"source,omitempty"`
+
+	// SnapshotID is the ID of manifest saved by EventSnapshotFinished.
+	SnapshotID string `json:"snapshotID,omitempty"`
+
+	// Path is the directory being uploaded or the file that failed to upload, relative to the source.
+	Path          string `json:"path,omitempty"`
+	NumFiles      int    `json:"numFiles,omitempty"`
+	PathCompleted int64  `json:"pathCompleted,omitempty"`
+	PathTotal     int64  `json:"pathTotal,omitempty"`
+
+	Stats   *snapshot.Stats `json:"stats,omitempty"`
+	Error   string          `json:"error,omitempty"`
+	Message string          `json:"message,omitempty"`
+}
+
+// MaintenanceStatusResponse is the response of 'maintenance' HTTP API command.
+type MaintenanceStatusResponse struct {
+	Params    *maintenance.Params    `json:"params"`
+	Schedule  maintenance.Schedule   `json:"schedule"`
+	History   []*maintenance.RunInfo `json:"history"`
+	Running   string                 `json:"running,omitempty"`
+	LastError string                 `json:"lastError,omitempty"`
+}
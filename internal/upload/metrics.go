@@ -0,0 +1,55 @@
+package upload
+
+import (
+	"time"
+
+	"github.com/kopia/kopia/snapshot"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metricUploadedFiles = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kopia_upload_files_total",
+		Help: "Number of files processed by uploads, by result.",
+	}, []string{"result"})
+
+	metricCachedFiles    = metricUploadedFiles.WithLabelValues("cached")
+	metricNonCachedFiles = metricUploadedFiles.WithLabelValues("hashed")
+	metricReadErrors     = metricUploadedFiles.WithLabelValues("read_error")
+
+	metricUploadDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "kopia_upload_duration_seconds",
+		Help:    "Duration of uploads, by source.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 16),
+	}, []string{"source"})
+
+	metricSnapshotLastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kopia_snapshot_last_success_timestamp_seconds",
+		Help: "Time of the last successfully completed snapshot, by source.",
+	}, []string{"source"})
+
+	metricSnapshotLastAttempt = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kopia_snapshot_last_attempt_timestamp_seconds",
+		Help: "Time of the last snapshot attempt, by source.",
+	}, []string{"source"})
+
+	metricSnapshotErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kopia_snapshot_errors_total",
+		Help: "Number of failed or incomplete snapshots, by source.",
+	}, []string{"source"})
+)
+
+// ReportSnapshotResult records the outcome of snapshotting a given source in metrics.
+// The snapshot is successful if it was saved without error and is complete.
+func ReportSnapshotResult(src snapshot.SourceInfo, man *snapshot.Manifest, err error) {
+	now := float64(time.Now().Unix())
+	metricSnapshotLastAttempt.WithLabelValues(src.String()).Set(now)
+
+	if err != nil || man == nil || man.IncompleteReason != "" {
+		metricSnapshotErrors.WithLabelValues(src.String()).Inc()
+		return
+	}
+
+	metricSnapshotLastSuccess.WithLabelValues(src.String()).Set(now)
+}
@@ -17,6 +17,7 @@ import (
 
 	"github.com/kopia/kopia/fs"
 	"github.com/kopia/kopia/fs/ignorefs"
+	"github.com/kopia/kopia/internal/actions"
 	"github.com/kopia/kopia/internal/dir"
 	"github.com/kopia/kopia/internal/hashcache"
 	"github.com/kopia/kopia/internal/kopialogging"
@@ -50,6 +51,9 @@ type Uploader struct {
 
 	FilesPolicy ignorefs.FilesPolicyGetter
 
+	// Actions, when set, runs before-folder and after-folder actions for directories being uploaded.
+	Actions *actions.Runner
+
 	// automatically cancel the Upload after certain number of bytes
 	MaxUploadBytes int64
 
@@ -73,9 +77,12 @@ type Uploader struct {
 	cacheReader hashcache.Reader
 
 	hashCacheCutoff time.Time
-	stats           snapshot.Stats
 	cancelled       int32
 
+	// stats are updated while workers report progress, which gets a copy of them.
+	statsMutex sync.Mutex
+	stats      snapshot.Stats
+
 	progressMutex          sync.Mutex
 	nextProgressReportTime time.Time
 	currentProgressDir     string // current directory for reporting progress
@@ -94,7 +101,7 @@ func (u *Uploader) cancelReason() string {
 		return "cancelled"
 	}
 
-	if mub := u.MaxUploadBytes; mub > 0 && u.repo.Blocks.Stats().WrittenBytes > mub {
+	if mub := u.MaxUploadBytes; mub > 0 && !u.repo.IsRemote() && u.repo.Blocks.Stats().WrittenBytes > mub {
 		return "limit reached"
 	}
 
@@ -175,10 +182,24 @@ func (u *Uploader) addDirProgress(length int64) {
 	u.progressMutex.Unlock()
 
 	if shouldReport {
-		u.Progress.Progress(u.currentProgressDir, u.currentDirNumFiles, c, u.currentDirTotalSize, &u.stats)
+		stats := u.currentStats()
+		u.Progress.Progress(u.currentProgressDir, u.currentDirNumFiles, c, u.currentDirTotalSize, &stats)
 	}
 }
 
+func (u *Uploader) updateStats(update func(st *snapshot.Stats)) {
+	u.statsMutex.Lock()
+	update(&u.stats)
+	u.statsMutex.Unlock()
+}
+
+func (u *Uploader) currentStats() snapshot.Stats {
+	u.statsMutex.Lock()
+	defer u.statsMutex.Unlock()
+
+	return u.stats
+}
+
 func (u *Uploader) copyWithProgress(path string, dst io.Writer, src io.Reader, completed int64, length int64) (int64, error) {
 	uploadBuf := make([]byte, 128*1024) // 128 KB buffer
 
@@ -386,8 +407,10 @@ func (u *Uploader) prepareWorkItems(ctx context.Context, dirRelativePath string,
 
 		switch entry.(type) {
 		case fs.File:
-			u.stats.TotalFileCount++
-			u.stats.TotalFileSize += e.FileSize
+			u.updateStats(func(st *snapshot.Stats) {
+				st.TotalFileCount++
+				st.TotalFileSize += e.FileSize
+			})
 			summ.TotalFileCount++
 			summ.TotalFileSize += e.FileSize
 			if e.ModTime.After(summ.MaxModTime) {
@@ -396,7 +419,8 @@ func (u *Uploader) prepareWorkItems(ctx context.Context, dirRelativePath string,
 		}
 
 		if cachedHash == computedHash {
-			u.stats.CachedFiles++
+			u.updateStats(func(st *snapshot.Stats) { st.CachedFiles++ })
+			metricCachedFiles.Inc()
 			u.addDirProgress(e.FileSize)
 
 			// compute entryResult now, cachedEntry is short-lived
@@ -427,7 +451,8 @@ func (u *Uploader) prepareWorkItems(ctx context.Context, dirRelativePath string,
 				})
 
 			case fs.File:
-				u.stats.NonCachedFiles++
+				u.updateStats(func(st *snapshot.Stats) { st.NonCachedFiles++ })
+				metricNonCachedFiles.Inc()
 				result = append(result, &uploadWorkItem{
 					entry:             entry,
 					entryRelativePath: entryRelativePath,
@@ -497,8 +522,10 @@ func (u *Uploader) processUploadWorkItems(workItems []*uploadWorkItem, dw *dir.W
 
 		if result.err != nil {
 			if u.IgnoreFileErrors {
-				u.stats.ReadErrors++
+				u.updateStats(func(st *snapshot.Stats) { st.ReadErrors++ })
+				metricReadErrors.Inc()
 				log.Warningf("unable to hash file %q: %s, ignoring", it.entryRelativePath, result.err)
+				u.Progress.IgnoredError(it.entryRelativePath, result.err)
 				continue
 			}
 			return fmt.Errorf("unable to process %q: %s", it.entryRelativePath, result.err)
@@ -531,7 +558,25 @@ func uploadDirInternal(
 	directory fs.Directory,
 	dirRelativePath string,
 ) (object.ID, fs.DirectorySummary, error) {
-	u.stats.TotalDirectoryCount++
+	if err := u.Actions.RunBeforeFolder(ctx, dirRelativePath); err != nil {
+		return "", fs.DirectorySummary{}, err
+	}
+
+	oid, summ, err := uploadDirContents(ctx, u, directory, dirRelativePath)
+	if actionErr := u.Actions.RunAfterFolder(ctx, dirRelativePath); actionErr != nil && err == nil {
+		return "", fs.DirectorySummary{}, actionErr
+	}
+
+	return oid, summ, err
+}
+
+func uploadDirContents(
+	ctx context.Context,
+	u *Uploader,
+	directory fs.Directory,
+	dirRelativePath string,
+) (object.ID, fs.DirectorySummary, error) {
+	u.updateStats(func(st *snapshot.Stats) { st.TotalDirectoryCount++ })
 
 	var summ fs.DirectorySummary
 	summ.TotalDirCount = 1
@@ -615,7 +660,7 @@ func (u *Uploader) Upload(
 	defer u.Progress.UploadFinished()
 
 	u.cacheReader = hashcache.Open(nil)
-	u.stats = snapshot.Stats{}
+	u.updateStats(func(st *snapshot.Stats) { *st = snapshot.Stats{} })
 	if old != nil {
 		log.Debugf("opening hash cache: %v", old.HashCacheID)
 		if r, err := u.repo.Objects.Open(ctx, old.HashCacheID); err == nil {
@@ -636,7 +681,7 @@ func (u *Uploader) Upload(
 	switch entry := source.(type) {
 	case fs.Directory:
 		entry = ignorefs.New(entry, u.FilesPolicy, ignorefs.ReportIgnoredFiles(func(_ string, md *fs.EntryMetadata) {
-			u.stats.AddExcluded(md)
+			u.updateStats(func(st *snapshot.Stats) { st.AddExcluded(md) })
 		}))
 		s.RootEntry, s.HashCacheID, err = u.uploadDir(ctx, entry)
 
@@ -653,8 +698,13 @@ func (u *Uploader) Upload(
 
 	s.IncompleteReason = u.cancelReason()
 	s.EndTime = time.Now()
-	s.Stats = u.stats
-	s.Stats.Block = u.repo.Blocks.Stats()
+	s.Stats = u.currentStats()
+	if !u.repo.IsRemote() {
+		// block statistics are only available when writing directly to the storage.
+		s.Stats.Block = u.repo.Blocks.Stats()
+	}
+
+	metricUploadDuration.WithLabelValues(sourceInfo.String()).Observe(s.EndTime.Sub(s.StartTime).Seconds())
 
 	return s, nil
 }
@@ -4,8 +4,12 @@ import "github.com/kopia/kopia/snapshot"
 
 // Progress is invoked by by uploader to report status of file and directory uploads.
 type Progress interface {
+	// Progress is invoked concurrently by upload workers, stats is a copy owned by the callee.
 	Progress(path string, numFiles int, pathCompleted, pathTotal int64, stats *snapshot.Stats)
 	UploadFinished()
+
+	// IgnoredError is invoked when an error reading a file is ignored and the file is skipped.
+	IgnoredError(path string, err error)
 }
 
 type nullUploadProgress struct {
@@ -17,4 +21,7 @@ func (p *nullUploadProgress) Progress(path string, numFiles int, pathCompleted,
 func (p *nullUploadProgress) UploadFinished() {
 }
 
+func (p *nullUploadProgress) IgnoredError(path string, err error) {
+}
+
 var _ Progress = (*nullUploadProgress)(nil)
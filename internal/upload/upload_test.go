@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"sync"
 	"testing"
 
 	"github.com/kopia/kopia/internal/mockfs"
@@ -181,6 +182,57 @@ func TestUpload(t *testing.T) {
 	}
 }
 
+type statsRecorder struct {
+	nullUploadProgress
+
+	mu    sync.Mutex
+	stats []snapshot.Stats
+}
+
+func (p *statsRecorder) Progress(path string, numFiles int, pathCompleted, pathTotal int64, stats *snapshot.Stats) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.stats = append(p.stats, *stats)
+}
+
+func TestUpload_ProgressStats(t *testing.T) {
+	ctx := context.Background()
+	th := newUploadTestHarness()
+	defer th.cleanup()
+
+	// ignored errors are counted while parallel workers report stats.
+	th.sourceDir.AddDir("d3", 0777)
+	th.sourceDir.AddFile("d3/a", []byte{1}, 0777).FailOpen(errTest)
+	for _, name := range []string{"b", "c", "d", "e"} {
+		th.sourceDir.AddFile("d3/"+name, make([]byte, 300000), 0777)
+	}
+
+	p := &statsRecorder{}
+	u := NewUploader(th.repo)
+	u.Progress = p
+	u.ParallelUploads = 4
+
+	s, err := u.Upload(ctx, th.sourceDir, snapshot.SourceInfo{}, nil)
+	if err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+
+	if s.Stats.ReadErrors != 1 {
+		t.Errorf("unexpected stats: %+v", s.Stats)
+	}
+
+	if len(p.stats) == 0 {
+		t.Fatalf("no progress was reported")
+	}
+
+	for _, st := range p.stats {
+		if st.TotalFileCount > s.Stats.TotalFileCount {
+			t.Errorf("unexpected reported stats: %+v, final %+v", st, s.Stats)
+		}
+	}
+}
+
 func TestUpload_Cancel(t *testing.T) {
 }
 
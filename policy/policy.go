@@ -6,6 +6,8 @@ import (
 	"errors"
 
 	"github.com/kopia/kopia/fs/ignorefs"
+	"github.com/kopia/kopia/internal/actions"
+	"github.com/kopia/kopia/internal/notification"
 	"github.com/kopia/kopia/snapshot"
 )
 
@@ -14,11 +16,13 @@ var ErrPolicyNotFound = errors.New("policy not found")
 
 // Policy describes snapshot policy for a single source.
 type Policy struct {
-	Labels           map[string]string    `json:"-"`
-	RetentionPolicy  RetentionPolicy      `json:"retention,omitempty"`
-	FilesPolicy      ignorefs.FilesPolicy `json:"files,omitempty"`
-	SchedulingPolicy SchedulingPolicy     `json:"scheduling,omitempty"`
-	NoParent         bool                 `json:"noParent,omitempty"`
+	Labels             map[string]string    `json:"-"`
+	RetentionPolicy    RetentionPolicy      `json:"retention,omitempty"`
+	FilesPolicy        ignorefs.FilesPolicy `json:"files,omitempty"`
+	SchedulingPolicy   SchedulingPolicy     `json:"scheduling,omitempty"`
+	NotificationPolicy notification.Policy  `json:"notifications,omitempty"`
+	ActionsPolicy      actions.Policy       `json:"actions,omitempty"`
+	NoParent           bool                 `json:"noParent,omitempty"`
 }
 
 func (p *Policy) String() string {
@@ -58,6 +62,8 @@ func MergePolicies(policies []*Policy) *Policy {
 		merged.RetentionPolicy.Merge(p.RetentionPolicy)
 		merged.FilesPolicy.Merge(p.FilesPolicy)
 		merged.SchedulingPolicy.Merge(p.SchedulingPolicy)
+		merged.NotificationPolicy.Merge(p.NotificationPolicy)
+		merged.ActionsPolicy.Merge(p.ActionsPolicy)
 	}
 
 	// Merge default expiration policy.
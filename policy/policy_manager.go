@@ -8,6 +8,7 @@ import (
 	"strings"
 
 	"github.com/kopia/kopia/fs/ignorefs"
+	"github.com/kopia/kopia/internal/actions"
 	"github.com/kopia/kopia/internal/kopialogging"
 	"github.com/kopia/kopia/repo"
 	"github.com/kopia/kopia/repo/manifest"
@@ -79,6 +80,12 @@ func GetEffectivePolicy(ctx context.Context, rep *repo.Repository, si snapshot.S
 	merged := MergePolicies(policies)
 	merged.Labels = labelsForSource(si)
 
+	// Folder actions are not inherited, only the ones defined for the source itself apply.
+	if len(policies) > 0 && policies[0].Target() == si {
+		merged.ActionsPolicy.BeforeFolder = policies[0].ActionsPolicy.BeforeFolder
+		merged.ActionsPolicy.AfterFolder = policies[0].ActionsPolicy.AfterFolder
+	}
+
 	return merged, policies, nil
 }
 
@@ -203,6 +210,58 @@ func FilesPolicyGetter(ctx context.Context, rep *repo.Repository, si snapshot.So
 
 	result["."] = &pol.FilesPolicy
 
+	defined, err := definedPoliciesUnder(ctx, rep, si)
+	if err != nil {
+		return nil, err
+	}
+
+	for rel, pol := range defined {
+		if rel != "." {
+			result[rel] = &pol.FilesPolicy
+		}
+	}
+
+	return result, nil
+}
+
+// ActionsRunner returns actions.Runner for snapshotting the specified source, which runs snapshot root
+// actions from the effective policy of the source and folder actions from policies defined for the source
+// and its subdirectories.
+// Actions are only run when enabled when connecting to the repository, otherwise the returned runner has no actions.
+func ActionsRunner(ctx context.Context, rep *repo.Repository, si snapshot.SourceInfo) (*actions.Runner, error) {
+	pol, _, err := GetEffectivePolicy(ctx, rep, si)
+	if err != nil {
+		return nil, err
+	}
+
+	defined, err := definedPoliciesUnder(ctx, rep, si)
+	if err != nil {
+		return nil, err
+	}
+
+	folders := map[string]*actions.Policy{}
+	for rel, pol := range defined {
+		if pol.ActionsPolicy.BeforeFolder != nil || pol.ActionsPolicy.AfterFolder != nil {
+			folders[rel] = &pol.ActionsPolicy
+		}
+	}
+
+	if !rep.ActionsEnabled {
+		if pol.ActionsPolicy.BeforeSnapshotRoot != nil || pol.ActionsPolicy.AfterSnapshotRoot != nil || len(folders) > 0 {
+			log.Warningf("ignoring actions defined in policies of %v, actions are not enabled for this connection (see --enable-actions)", si)
+		}
+
+		return actions.NewRunner(si, actions.Policy{}, nil), nil
+	}
+
+	return actions.NewRunner(si, pol.ActionsPolicy, folders), nil
+}
+
+// definedPoliciesUnder returns policies defined for the source path and its subdirectories, keyed by
+// relative path ("." for the source itself, "./sub/dir" for subdirectories).
+func definedPoliciesUnder(ctx context.Context, rep *repo.Repository, si snapshot.SourceInfo) (map[string]*Policy, error) {
+	result := map[string]*Policy{}
+
 	// Find all policies for this host and user
 	policies, err := rep.Manifests.Find(ctx, map[string]string{
 		"type":       "policy",
@@ -214,7 +273,7 @@ func FilesPolicyGetter(ctx context.Context, rep *repo.Repository, si snapshot.So
 		return nil, fmt.Errorf("unable to find manifests for %v@%v: %v", si.UserName, si.Host, err)
 	}
 
-	log.Debugf("found %v policies for %v@%v", si.UserName, si.Host)
+	log.Debugf("found %v policies for %v@%v", len(policies), si.UserName, si.Host)
 
 	for _, id := range policies {
 		em, err := rep.Manifests.GetMetadata(ctx, id.ID)
@@ -224,21 +283,26 @@ func FilesPolicyGetter(ctx context.Context, rep *repo.Repository, si snapshot.So
 
 		policyPath := em.Labels["path"]
 
-		if !strings.HasPrefix(policyPath, si.Path+"/") {
+		var rel string
+		switch {
+		case policyPath == si.Path:
+			rel = "."
+		case strings.HasPrefix(policyPath, si.Path+"/"):
+			r, err := filepath.Rel(si.Path, policyPath)
+			if err != nil {
+				return nil, fmt.Errorf("unable to determine relative path: %v", err)
+			}
+			rel = "./" + r
+		default:
 			continue
 		}
 
-		rel, err := filepath.Rel(si.Path, policyPath)
-		if err != nil {
-			return nil, fmt.Errorf("unable to determine relative path: %v", err)
-		}
-		rel = "./" + rel
 		log.Debugf("loading policy for %v (%v)", policyPath, rel)
 		pol := &Policy{}
 		if err := rep.Manifests.Get(ctx, id.ID, pol); err != nil {
 			return nil, fmt.Errorf("unable to load policy %v: %v", id.ID, err)
 		}
-		result[rel] = &pol.FilesPolicy
+		result[rel] = pol
 	}
 
 	return result, nil
@@ -0,0 +1,51 @@
+package policy
+
+import (
+	"context"
+	"testing"
+
+	"github.com/kopia/kopia/internal/actions"
+	"github.com/kopia/kopia/internal/repotesting"
+	"github.com/kopia/kopia/repo"
+	"github.com/kopia/kopia/snapshot"
+)
+
+func TestActionsRunnerRequiresEnabledActions(t *testing.T) {
+	ctx := context.Background()
+	env := repotesting.Setup(t, nil, repo.ConnectOptions{})
+	defer env.Close()
+
+	rep := env.Repository
+
+	src := snapshot.SourceInfo{Host: "host", UserName: "user", Path: "/src"}
+	action := &actions.Action{Command: []string{"/bin/true"}}
+
+	if err := SetPolicy(ctx, rep, src, &Policy{ActionsPolicy: actions.Policy{BeforeSnapshotRoot: action}}); err != nil {
+		t.Fatalf("unable to set policy: %v", err)
+	}
+
+	sub := snapshot.SourceInfo{Host: "host", UserName: "user", Path: "/src/sub"}
+	if err := SetPolicy(ctx, rep, sub, &Policy{ActionsPolicy: actions.Policy{BeforeFolder: action}}); err != nil {
+		t.Fatalf("unable to set policy: %v", err)
+	}
+
+	r, err := ActionsRunner(ctx, rep, src)
+	if err != nil {
+		t.Fatalf("unable to create actions runner: %v", err)
+	}
+
+	if r.Root.BeforeSnapshotRoot != nil || len(r.Folders) != 0 || r.SnapshotPath != src.Path {
+		t.Errorf("unexpected actions runner when actions are not enabled: %+v", r)
+	}
+
+	rep.ActionsEnabled = true
+
+	r, err = ActionsRunner(ctx, rep, src)
+	if err != nil {
+		t.Fatalf("unable to create actions runner: %v", err)
+	}
+
+	if r.Root.BeforeSnapshotRoot == nil || r.Folders["./sub"] == nil {
+		t.Errorf("unexpected actions runner when actions are enabled: %+v", r)
+	}
+}
@@ -15,6 +15,21 @@ type RetentionPolicy struct {
 	KeepWeekly  *int `json:"keepWeekly,omitempty"`
 	KeepMonthly *int `json:"keepMonthly,omitempty"`
 	KeepAnnual  *int `json:"keepAnnual,omitempty"`
+
+	// KeepWithinSeconds keeps all snapshots younger than the specified number of seconds.
+	KeepWithinSeconds *int64 `json:"keepWithinSeconds,omitempty"`
+
+	// KeepTags keeps all snapshots with tags matching any of the selectors ('key=value' or 'key').
+	KeepTags []string `json:"keepTags,omitempty"`
+}
+
+// KeepWithin returns the age of snapshots which are kept unconditionally, zero if not set.
+func (r *RetentionPolicy) KeepWithin() time.Duration {
+	if r.KeepWithinSeconds == nil {
+		return 0
+	}
+
+	return time.Duration(*r.KeepWithinSeconds) * time.Second
 }
 
 // ComputeRetentionReasons computes the reasons why each snapshot is retained, based on
@@ -37,6 +52,7 @@ func (r *RetentionPolicy) ComputeRetentionReasons(manifests []*snapshot.Manifest
 		daily:   cutoffTime(r.KeepDaily, daysAgo),
 		hourly:  cutoffTime(r.KeepHourly, hoursAgo),
 		weekly:  cutoffTime(r.KeepHourly, weeksAgo),
+		within:  now.Add(-r.KeepWithin()),
 	}
 
 	ids := make(map[string]bool)
@@ -48,11 +64,27 @@ func (r *RetentionPolicy) ComputeRetentionReasons(manifests []*snapshot.Manifest
 }
 
 func (r *RetentionPolicy) getRetentionReasons(i int, s *snapshot.Manifest, cutoff cutoffTimes, ids map[string]bool, idCounters map[string]int) []string {
+	keepReasons := []string{}
+
+	// pinned snapshots are kept even if incomplete.
+	for _, p := range s.Pins {
+		keepReasons = append(keepReasons, "pinned:"+p)
+	}
+
 	if s.IncompleteReason != "" {
-		return nil
+		return keepReasons
+	}
+
+	if r.KeepWithin() > 0 && s.StartTime.After(cutoff.within) {
+		keepReasons = append(keepReasons, "within")
+	}
+
+	for _, sel := range r.KeepTags {
+		if s.MatchesTag(sel) {
+			keepReasons = append(keepReasons, "tag:"+sel)
+		}
 	}
 
-	keepReasons := []string{}
 	var zeroTime time.Time
 
 	yyyy, wk := s.StartTime.ISOWeek()
@@ -99,6 +131,7 @@ type cutoffTimes struct {
 	daily   time.Time
 	hourly  time.Time
 	weekly  time.Time
+	within  time.Time
 }
 
 func yearsAgo(base time.Time, n int) time.Time {
@@ -150,4 +183,10 @@ func (r *RetentionPolicy) Merge(src RetentionPolicy) {
 	if r.KeepAnnual == nil {
 		r.KeepAnnual = src.KeepAnnual
 	}
+	if r.KeepWithinSeconds == nil {
+		r.KeepWithinSeconds = src.KeepWithinSeconds
+	}
+	if len(r.KeepTags) == 0 {
+		r.KeepTags = src.KeepTags
+	}
 }
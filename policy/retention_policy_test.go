@@ -0,0 +1,151 @@
+package policy
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kopia/kopia/internal/repotesting"
+	"github.com/kopia/kopia/repo"
+	"github.com/kopia/kopia/snapshot"
+)
+
+func int64Ptr(n int64) *int64 {
+	return &n
+}
+
+func TestComputeRetentionReasons(t *testing.T) {
+	now := time.Now()
+
+	cases := []struct {
+		desc      string
+		pol       RetentionPolicy
+		snapshots []*snapshot.Manifest
+		want      [][]string
+	}{
+		{
+			desc: "latest",
+			pol:  RetentionPolicy{KeepLatest: intPtr(2)},
+			snapshots: []*snapshot.Manifest{
+				{StartTime: now.Add(-3 * time.Hour)},
+				{StartTime: now.Add(-1 * time.Hour)},
+				{StartTime: now.Add(-2 * time.Hour)},
+			},
+			want: [][]string{{}, {"latest-1"}, {"latest-2"}},
+		},
+		{
+			desc: "pinned",
+			pol:  RetentionPolicy{KeepLatest: intPtr(1)},
+			snapshots: []*snapshot.Manifest{
+				{StartTime: now.Add(-1 * time.Hour)},
+				{StartTime: now.Add(-2 * time.Hour), Pins: []string{"release", "audit"}},
+				{StartTime: now.Add(-3 * time.Hour)},
+			},
+			want: [][]string{{"latest-1"}, {"pinned:release", "pinned:audit"}, {}},
+		},
+		{
+			desc: "pinned incomplete",
+			pol:  RetentionPolicy{KeepLatest: intPtr(3)},
+			snapshots: []*snapshot.Manifest{
+				{StartTime: now.Add(-1 * time.Hour), IncompleteReason: "canceled", Pins: []string{"debug"}},
+				{StartTime: now.Add(-2 * time.Hour), IncompleteReason: "canceled"},
+				{StartTime: now.Add(-3 * time.Hour)},
+			},
+			want: [][]string{{"pinned:debug"}, {}, {"latest-1"}},
+		},
+		{
+			desc: "keep within",
+			pol:  RetentionPolicy{KeepLatest: intPtr(1), KeepWithinSeconds: int64Ptr(3 * 3600)},
+			snapshots: []*snapshot.Manifest{
+				{StartTime: now.Add(-1 * time.Hour)},
+				{StartTime: now.Add(-2 * time.Hour)},
+				{StartTime: now.Add(-2 * time.Hour), IncompleteReason: "canceled"},
+				{StartTime: now.Add(-4 * time.Hour)},
+			},
+			want: [][]string{{"within", "latest-1"}, {"within"}, {}, {}},
+		},
+		{
+			desc: "keep by tag",
+			pol:  RetentionPolicy{KeepTags: []string{"type=monthly", "keep"}},
+			snapshots: []*snapshot.Manifest{
+				{StartTime: now.Add(-1 * time.Hour), Tags: map[string]string{"type": "daily"}},
+				{StartTime: now.Add(-2 * time.Hour), Tags: map[string]string{"type": "monthly"}},
+				{StartTime: now.Add(-3 * time.Hour), Tags: map[string]string{"type": "monthly", "keep": ""}},
+				{StartTime: now.Add(-4 * time.Hour)},
+				{StartTime: now.Add(-5 * time.Hour), Tags: map[string]string{"type": "monthly"}, IncompleteReason: "canceled"},
+			},
+			want: [][]string{{}, {"tag:type=monthly"}, {"tag:type=monthly", "tag:keep"}, {}, {}},
+		},
+	}
+
+	for _, tc := range cases {
+		tc.pol.ComputeRetentionReasons(tc.snapshots)
+
+		for i, s := range tc.snapshots {
+			if !reflect.DeepEqual(s.RetentionReasons, tc.want[i]) {
+				t.Errorf("%v: unexpected retention reasons of snapshot %v: %v, want %v", tc.desc, i, s.RetentionReasons, tc.want[i])
+			}
+		}
+	}
+}
+
+func TestRetentionPolicyMerge(t *testing.T) {
+	src := RetentionPolicy{
+		KeepLatest:        intPtr(5),
+		KeepWithinSeconds: int64Ptr(3600),
+		KeepTags:          []string{"keep"},
+	}
+
+	r := RetentionPolicy{KeepTags: []string{"important"}}
+	r.Merge(src)
+
+	if got, want := r.KeepWithin(), time.Hour; got != want {
+		t.Errorf("unexpected keep within: %v, want %v", got, want)
+	}
+
+	if got, want := r.KeepTags, []string{"important"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected keep tags: %v, want %v", got, want)
+	}
+
+	if r := (RetentionPolicy{}); r.KeepWithin() != 0 {
+		t.Errorf("unexpected keep within of empty policy: %v", r.KeepWithin())
+	}
+}
+
+func TestGetExpiredSnapshotsKeepsPinned(t *testing.T) {
+	ctx := context.Background()
+	env := repotesting.Setup(t, nil, repo.ConnectOptions{})
+	defer env.Close()
+
+	rep := env.Repository
+
+	src := snapshot.SourceInfo{Host: "host", UserName: "user", Path: "/path"}
+	if err := SetPolicy(ctx, rep, src, &Policy{
+		RetentionPolicy: RetentionPolicy{
+			KeepLatest:  intPtr(1),
+			KeepHourly:  intPtr(0),
+			KeepDaily:   intPtr(0),
+			KeepWeekly:  intPtr(0),
+			KeepMonthly: intPtr(0),
+			KeepAnnual:  intPtr(0),
+		},
+	}); err != nil {
+		t.Fatalf("unable to set policy: %v", err)
+	}
+
+	now := time.Now()
+	latest := &snapshot.Manifest{Source: src, StartTime: now.Add(-1 * time.Hour)}
+	pinned := &snapshot.Manifest{Source: src, StartTime: now.Add(-2 * time.Hour), Pins: []string{"release"}}
+	pinnedIncomplete := &snapshot.Manifest{Source: src, StartTime: now.Add(-3 * time.Hour), Pins: []string{"debug"}, IncompleteReason: "canceled"}
+	old := &snapshot.Manifest{Source: src, StartTime: now.Add(-4 * time.Hour)}
+
+	expired, err := GetExpiredSnapshots(ctx, rep, []*snapshot.Manifest{old, pinnedIncomplete, pinned, latest})
+	if err != nil {
+		t.Fatalf("unable to get expired snapshots: %v", err)
+	}
+
+	if want := []*snapshot.Manifest{old}; !reflect.DeepEqual(expired, want) {
+		t.Errorf("unexpected expired snapshots: %v, want %v", expired, want)
+	}
+}
@@ -2,8 +2,12 @@ package policy
 
 import (
 	"fmt"
+	"hash/fnv"
 	"sort"
+	"strings"
 	"time"
+
+	"github.com/kopia/kopia/internal/cron"
 )
 
 // TimeOfDay represents the time of day (hh:mm) using 24-hour time format.
@@ -44,10 +48,66 @@ func SortAndDedupeTimesOfDay(tod []TimeOfDay) []TimeOfDay {
 	return tod
 }
 
+// TimeWindow describes the time of day when snapshots are allowed to start,
+// the window wraps around midnight when End is before Start (e.g. 22:00-06:00).
+type TimeWindow struct {
+	Start TimeOfDay `json:"start"`
+	End   TimeOfDay `json:"end"`
+}
+
+// Parse parses the time window in HH:MM-HH:MM format.
+func (w *TimeWindow) Parse(s string) error {
+	p := strings.Split(s, "-")
+	if len(p) != 2 {
+		return fmt.Errorf("invalid time window %q, must be HH:MM-HH:MM", s)
+	}
+
+	if err := w.Start.Parse(p[0]); err != nil {
+		return err
+	}
+
+	return w.End.Parse(p[1])
+}
+
+func (w TimeWindow) String() string {
+	return w.Start.String() + "-" + w.End.String()
+}
+
+func (w TimeWindow) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	start := w.Start.Hour*60 + w.Start.Minute
+	end := w.End.Hour*60 + w.End.Minute
+
+	if start <= end {
+		return m >= start && m < end
+	}
+
+	return m >= start || m < end
+}
+
 // SchedulingPolicy describes policy for scheduling snapshots.
 type SchedulingPolicy struct {
 	IntervalSeconds int64       `json:"intervalSeconds,omitempty"`
 	TimesOfDay      []TimeOfDay `json:"timeOfDay,omitempty"`
+
+	// Cron contains cron expressions (minute hour day-of-month month day-of-week) determining snapshot times.
+	Cron []string `json:"cron,omitempty"`
+
+	// DaysOfWeek restricts the days when snapshots can start, all days when empty.
+	DaysOfWeek []time.Weekday `json:"daysOfWeek,omitempty"`
+
+	// Window restricts the time of day when snapshots can start, snapshots planned outside of the window are postponed until it opens.
+	Window *TimeWindow `json:"window,omitempty"`
+
+	// JitterSeconds is the maximum random delay added to planned snapshot times to spread the load of many hosts.
+	JitterSeconds int64 `json:"jitterSeconds,omitempty"`
+
+	// Manual disables scheduled snapshots, snapshots are only taken on demand.
+	Manual *bool `json:"manual,omitempty"`
+
+	// RunMissed causes the snapshot to be taken as soon as possible when a time of day or cron-scheduled snapshot was missed,
+	// for example because the machine was not running.
+	RunMissed *bool `json:"runMissed,omitempty"`
 }
 
 // Interval returns the snapshot interval or zero if not specified.
@@ -60,6 +120,21 @@ func (p *SchedulingPolicy) SetInterval(d time.Duration) {
 	p.IntervalSeconds = int64(d.Seconds())
 }
 
+// Jitter returns the maximum random delay added to planned snapshot times.
+func (p *SchedulingPolicy) Jitter() time.Duration {
+	return time.Duration(p.JitterSeconds) * time.Second
+}
+
+// IsManual returns true if scheduled snapshots are disabled.
+func (p *SchedulingPolicy) IsManual() bool {
+	return p.Manual != nil && *p.Manual
+}
+
+// ShouldRunMissed returns true if missed snapshots should be taken as soon as possible.
+func (p *SchedulingPolicy) ShouldRunMissed() bool {
+	return p.RunMissed != nil && *p.RunMissed
+}
+
 // Merge applies default values from the provided policy.
 func (p *SchedulingPolicy) Merge(src SchedulingPolicy) {
 	if p.IntervalSeconds == 0 {
@@ -67,6 +142,231 @@ func (p *SchedulingPolicy) Merge(src SchedulingPolicy) {
 	}
 	p.TimesOfDay = SortAndDedupeTimesOfDay(
 		append(append([]TimeOfDay(nil), src.TimesOfDay...), p.TimesOfDay...))
+	p.Cron = dedupeStrings(append(append([]string(nil), src.Cron...), p.Cron...))
+	if len(p.DaysOfWeek) == 0 {
+		p.DaysOfWeek = append([]time.Weekday(nil), src.DaysOfWeek...)
+	}
+	if p.Window == nil {
+		p.Window = src.Window
+	}
+	if p.JitterSeconds == 0 {
+		p.JitterSeconds = src.JitterSeconds
+	}
+	if p.Manual == nil {
+		p.Manual = src.Manual
+	}
+	if p.RunMissed == nil {
+		p.RunMissed = src.RunMissed
+	}
+}
+
+func dedupeStrings(s []string) []string {
+	var result []string
+
+	seen := map[string]bool{}
+	for _, v := range s {
+		if !seen[v] {
+			seen[v] = true
+			result = append(result, v)
+		}
+	}
+
+	return result
+}
+
+// Validate checks that the scheduling policy is well-formed.
+func (p *SchedulingPolicy) Validate() error {
+	for _, c := range p.Cron {
+		if _, err := cron.Parse(c); err != nil {
+			return err
+		}
+	}
+
+	if p.JitterSeconds < 0 {
+		return fmt.Errorf("jitter must not be negative")
+	}
+
+	if p.Window != nil && p.Window.Start == p.Window.End {
+		return fmt.Errorf("time window %v is empty", p.Window)
+	}
+
+	return nil
+}
+
+// NextSnapshotTime returns the time of the next scheduled snapshot of a source identified by seed
+// (which makes the random jitter stable), given the start time of its previous snapshot (zero if none,
+// in which case the first interval-based snapshot is due immediately).
+// It returns false if snapshots of the source are not scheduled.
+func (p *SchedulingPolicy) NextSnapshotTime(previous, now time.Time, seed string) (time.Time, bool) {
+	if p.IsManual() {
+		return time.Time{}, false
+	}
+
+	var next, slot time.Time
+
+	// consider plans the snapshot at time t for a given schedule slot, which determines its jitter.
+	consider := func(t, s time.Time) {
+		if !t.IsZero() && (next.IsZero() || t.Before(next)) {
+			next, slot = t, s
+		}
+	}
+
+	if interval := p.Interval(); interval != 0 {
+		if previous.IsZero() {
+			consider(now, now.Truncate(interval))
+		} else {
+			t := previous.Add(interval).Truncate(interval)
+			consider(t, t)
+		}
+	}
+
+	for _, t := range p.scheduledTimesAfter(now) {
+		consider(t, t)
+	}
+
+	if p.ShouldRunMissed() && !previous.IsZero() {
+		for _, t := range p.scheduledTimesAfter(previous) {
+			if t.Before(now) {
+				consider(now, t)
+			}
+		}
+	}
+
+	if next.IsZero() {
+		return time.Time{}, false
+	}
+
+	jitter := p.jitterFor(seed, slot)
+	if next.Equal(slot) {
+		next = p.nextAllowedTime(next)
+		if next.IsZero() {
+			return time.Time{}, false
+		}
+
+		// jitter may move the snapshot outside of allowed times, in which case it's postponed further.
+		next = p.nextAllowedTime(next.Add(jitter))
+		return next, !next.IsZero()
+	}
+
+	// snapshot of a past slot is due now, unless the jitter of the slot delays it further.
+	if t := slot.Add(jitter); t.After(next) {
+		next = t
+	}
+
+	next = p.nextAllowedTime(next)
+	return next, !next.IsZero()
+}
+
+// PlannedSnapshotTimes returns up to n next scheduled snapshot times.
+func (p *SchedulingPolicy) PlannedSnapshotTimes(previous, now time.Time, seed string, n int) []time.Time {
+	var result []time.Time
+
+	for len(result) < n {
+		t, ok := p.NextSnapshotTime(previous, now, seed)
+		if !ok {
+			break
+		}
+
+		result = append(result, t)
+		previous = t
+		if t.After(now) {
+			now = t
+		}
+	}
+
+	return result
+}
+
+// scheduledTimesAfter returns the first time after t on an allowed day of week for each time of day and cron expression.
+func (p *SchedulingPolicy) scheduledTimesAfter(t time.Time) []time.Time {
+	var result []time.Time
+
+	local := t.Local()
+	for _, tod := range p.TimesOfDay {
+		for day := 0; day <= 7; day++ {
+			st := time.Date(local.Year(), local.Month(), local.Day()+day, tod.Hour, tod.Minute, 0, 0, time.Local)
+			if st.After(t) && p.isDayAllowed(st.Weekday()) {
+				result = append(result, st)
+				break
+			}
+		}
+	}
+
+	for _, c := range p.Cron {
+		sched, err := cron.Parse(c)
+		if err != nil {
+			log.Warningf("ignoring invalid cron expression: %v", err)
+			continue
+		}
+
+		st := sched.Next(local)
+		for i := 0; i < maxCronDisallowedSlots && !st.IsZero() && !p.isDayAllowed(st.Weekday()); i++ {
+			st = sched.Next(st)
+		}
+
+		if !st.IsZero() && p.isDayAllowed(st.Weekday()) {
+			result = append(result, st)
+		}
+	}
+
+	return result
+}
+
+// maxCronDisallowedSlots is the maximum number of consecutive cron slots on days of week that are not allowed,
+// after which the cron expression is considered to never match an allowed day.
+const maxCronDisallowedSlots = 10000
+
+// nextAllowedTime returns the earliest time not before t that satisfies day of week and time window restrictions.
+func (p *SchedulingPolicy) nextAllowedTime(t time.Time) time.Time {
+	t = t.Local()
+
+	for i := 0; i < 8*3; i++ {
+		midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+
+		if !p.isDayAllowed(t.Weekday()) {
+			t = midnight.AddDate(0, 0, 1)
+			continue
+		}
+
+		if p.Window == nil || p.Window.contains(t) {
+			return t
+		}
+
+		windowStart := time.Date(t.Year(), t.Month(), t.Day(), p.Window.Start.Hour, p.Window.Start.Minute, 0, 0, time.Local)
+		if windowStart.After(t) {
+			t = windowStart
+		} else {
+			t = midnight.AddDate(0, 0, 1)
+		}
+	}
+
+	return time.Time{}
+}
+
+func (p *SchedulingPolicy) isDayAllowed(d time.Weekday) bool {
+	if len(p.DaysOfWeek) == 0 {
+		return true
+	}
+
+	for _, a := range p.DaysOfWeek {
+		if a == d {
+			return true
+		}
+	}
+
+	return false
+}
+
+// jitterFor returns a pseudo-random delay derived from the seed and the schedule slot, so that
+// the same snapshot is planned at the same time each time it is computed.
+func (p *SchedulingPolicy) jitterFor(seed string, slot time.Time) time.Duration {
+	if p.JitterSeconds <= 0 {
+		return 0
+	}
+
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%v@%v", seed, slot.Unix())
+	return time.Duration(h.Sum64()%uint64(p.JitterSeconds)) * time.Second
 }
 
 var defaultSchedulingPolicy = SchedulingPolicy{}
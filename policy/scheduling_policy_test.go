@@ -0,0 +1,291 @@
+package policy
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+// useUTC makes local time zone UTC until the returned function is called, because intervals are aligned
+// to absolute time and would not start at full hours in time zones with fractional offsets.
+func useUTC() func() {
+	old := time.Local
+	time.Local = time.UTC
+	return func() { time.Local = old }
+}
+
+// localTime returns the given time on Wednesday, January 16th 2019 (plus the number of days) in local time zone.
+func localTime(days, hour, minute int) time.Time {
+	return time.Date(2019, 1, 16+days, hour, minute, 0, 0, time.Local)
+}
+
+func TestNextSnapshotTime(t *testing.T) {
+	defer useUTC()()
+
+	cases := []struct {
+		desc     string
+		pol      SchedulingPolicy
+		previous time.Time
+		now      time.Time
+		want     time.Time // zero if not scheduled
+	}{
+		{
+			desc: "no schedule",
+			pol:  SchedulingPolicy{},
+			now:  localTime(0, 10, 0),
+		},
+		{
+			desc: "first interval snapshot is due now",
+			pol:  SchedulingPolicy{IntervalSeconds: 3600},
+			now:  localTime(0, 10, 0),
+			want: localTime(0, 10, 0),
+		},
+		{
+			desc:     "interval",
+			pol:      SchedulingPolicy{IntervalSeconds: 3600},
+			previous: localTime(0, 10, 5),
+			now:      localTime(0, 10, 10),
+			want:     localTime(0, 11, 0),
+		},
+		{
+			desc:     "time of day later today",
+			pol:      SchedulingPolicy{TimesOfDay: []TimeOfDay{{9, 0}, {12, 30}}},
+			previous: localTime(0, 9, 0),
+			now:      localTime(0, 10, 0),
+			want:     localTime(0, 12, 30),
+		},
+		{
+			desc:     "time of day tomorrow",
+			pol:      SchedulingPolicy{TimesOfDay: []TimeOfDay{{9, 0}, {12, 30}}},
+			previous: localTime(0, 12, 30),
+			now:      localTime(0, 13, 0),
+			want:     localTime(1, 9, 0),
+		},
+		{
+			desc:     "cron",
+			pol:      SchedulingPolicy{Cron: []string{"15 */2 * * *"}},
+			previous: localTime(0, 8, 15),
+			now:      localTime(0, 9, 0),
+			want:     localTime(0, 10, 15),
+		},
+		{
+			desc:     "earliest of interval and times of day",
+			pol:      SchedulingPolicy{IntervalSeconds: 4 * 3600, TimesOfDay: []TimeOfDay{{11, 30}}},
+			previous: localTime(0, 10, 0),
+			now:      localTime(0, 10, 0),
+			want:     localTime(0, 11, 30),
+		},
+		{
+			desc:     "manual",
+			pol:      SchedulingPolicy{IntervalSeconds: 3600, TimesOfDay: []TimeOfDay{{12, 0}}, Manual: boolPtr(true)},
+			previous: localTime(0, 10, 0),
+			now:      localTime(0, 10, 0),
+		},
+		{
+			desc:     "postponed until window opens",
+			pol:      SchedulingPolicy{IntervalSeconds: 3600, Window: &TimeWindow{TimeOfDay{22, 0}, TimeOfDay{6, 0}}},
+			previous: localTime(0, 10, 5),
+			now:      localTime(0, 10, 10),
+			want:     localTime(0, 22, 0),
+		},
+		{
+			desc:     "inside window before midnight",
+			pol:      SchedulingPolicy{IntervalSeconds: 3600, Window: &TimeWindow{TimeOfDay{22, 0}, TimeOfDay{6, 0}}},
+			previous: localTime(0, 22, 5),
+			now:      localTime(0, 22, 10),
+			want:     localTime(0, 23, 0),
+		},
+		{
+			desc:     "inside window after midnight",
+			pol:      SchedulingPolicy{IntervalSeconds: 3600, Window: &TimeWindow{TimeOfDay{22, 0}, TimeOfDay{6, 0}}},
+			previous: localTime(1, 4, 5),
+			now:      localTime(1, 4, 10),
+			want:     localTime(1, 5, 0),
+		},
+		{
+			desc:     "window closes",
+			pol:      SchedulingPolicy{IntervalSeconds: 3600, Window: &TimeWindow{TimeOfDay{22, 0}, TimeOfDay{6, 0}}},
+			previous: localTime(1, 5, 5),
+			now:      localTime(1, 5, 10),
+			want:     localTime(1, 22, 0),
+		},
+		{
+			desc:     "interval postponed to allowed day",
+			pol:      SchedulingPolicy{IntervalSeconds: 3600, DaysOfWeek: []time.Weekday{time.Saturday, time.Sunday}},
+			previous: localTime(0, 10, 5),
+			now:      localTime(0, 10, 10),
+			want:     localTime(3, 0, 0),
+		},
+		{
+			desc:     "time of day on allowed day",
+			pol:      SchedulingPolicy{TimesOfDay: []TimeOfDay{{9, 0}}, DaysOfWeek: []time.Weekday{time.Saturday}},
+			previous: localTime(0, 9, 0),
+			now:      localTime(0, 10, 0),
+			want:     localTime(3, 9, 0),
+		},
+		{
+			desc:     "cron on allowed day",
+			pol:      SchedulingPolicy{Cron: []string{"30 8 * * *"}, DaysOfWeek: []time.Weekday{time.Monday}},
+			previous: localTime(0, 8, 30),
+			now:      localTime(0, 10, 0),
+			want:     localTime(5, 8, 30),
+		},
+		{
+			desc:     "allowed day and window",
+			pol:      SchedulingPolicy{IntervalSeconds: 3600, DaysOfWeek: []time.Weekday{time.Friday}, Window: &TimeWindow{TimeOfDay{20, 0}, TimeOfDay{21, 0}}},
+			previous: localTime(0, 10, 5),
+			now:      localTime(0, 10, 10),
+			want:     localTime(2, 20, 0),
+		},
+		{
+			desc:     "missed time of day is not run",
+			pol:      SchedulingPolicy{TimesOfDay: []TimeOfDay{{9, 0}}},
+			previous: localTime(-2, 9, 0),
+			now:      localTime(0, 10, 0),
+			want:     localTime(1, 9, 0),
+		},
+		{
+			desc:     "missed time of day is run",
+			pol:      SchedulingPolicy{TimesOfDay: []TimeOfDay{{9, 0}}, RunMissed: boolPtr(true)},
+			previous: localTime(-2, 9, 0),
+			now:      localTime(0, 10, 0),
+			want:     localTime(0, 10, 0),
+		},
+		{
+			desc:     "nothing missed",
+			pol:      SchedulingPolicy{TimesOfDay: []TimeOfDay{{9, 0}}, RunMissed: boolPtr(true)},
+			previous: localTime(0, 9, 0),
+			now:      localTime(0, 10, 0),
+			want:     localTime(1, 9, 0),
+		},
+		{
+			desc:     "missed snapshot waits for window",
+			pol:      SchedulingPolicy{TimesOfDay: []TimeOfDay{{9, 0}}, RunMissed: boolPtr(true), Window: &TimeWindow{TimeOfDay{12, 0}, TimeOfDay{13, 0}}},
+			previous: localTime(-2, 9, 0),
+			now:      localTime(0, 10, 0),
+			want:     localTime(0, 12, 0),
+		},
+	}
+
+	for _, tc := range cases {
+		got, ok := tc.pol.NextSnapshotTime(tc.previous, tc.now, "user@host:/path")
+		if ok != !tc.want.IsZero() || !got.Equal(tc.want) {
+			t.Errorf("%v: unexpected next snapshot time %v (%v), want %v", tc.desc, got, ok, tc.want)
+		}
+	}
+}
+
+func TestNextSnapshotTimeJitter(t *testing.T) {
+	defer useUTC()()
+
+	pol := SchedulingPolicy{IntervalSeconds: 3600, JitterSeconds: 600}
+	previous := localTime(0, 10, 5)
+
+	next, ok := pol.NextSnapshotTime(previous, localTime(0, 10, 10), "user@host:/path")
+	if !ok || next.Before(localTime(0, 11, 0)) || !next.Before(localTime(0, 11, 10)) {
+		t.Fatalf("unexpected next snapshot time with jitter: %v", next)
+	}
+
+	// jitter is stable for the same slot and differs between sources.
+	sameSource := true
+	for i := 0; i < 10; i++ {
+		now := localTime(0, 10, 10+i)
+		if t2, _ := pol.NextSnapshotTime(previous, now, "user@host:/path"); !t2.Equal(next) {
+			t.Errorf("jitter changed at %v: %v, want %v", now, t2, next)
+		}
+
+		if t2, _ := pol.NextSnapshotTime(previous, now, "user@host:/other"+string(rune('a'+i))); !t2.Equal(next) {
+			sameSource = false
+		}
+	}
+
+	if sameSource {
+		t.Errorf("jitter does not depend on the source")
+	}
+
+	// when the snapshot is due now, jitter of its slot does not change with current time.
+	first, _ := pol.NextSnapshotTime(time.Time{}, localTime(0, 10, 0), "user@host:/path")
+	for m := 0; m < 60; m += 5 {
+		now := localTime(0, 10, m)
+		got, _ := pol.NextSnapshotTime(time.Time{}, now, "user@host:/path")
+		want := first
+		if want.Before(now) {
+			want = now
+		}
+
+		if !got.Equal(want) {
+			t.Errorf("unexpected first snapshot time at %v: %v, want %v", now, got, want)
+		}
+	}
+}
+
+func TestNextSnapshotTimeJitterWithinAllowedTimes(t *testing.T) {
+	defer useUTC()()
+
+	cases := []struct {
+		desc string
+		pol  SchedulingPolicy
+		now  time.Time
+		slot time.Time
+	}{
+		{
+			desc: "slot near the end of window",
+			pol:  SchedulingPolicy{TimesOfDay: []TimeOfDay{{5, 50}}, JitterSeconds: 3600, Window: &TimeWindow{TimeOfDay{22, 0}, TimeOfDay{6, 0}}},
+			now:  localTime(0, 1, 0),
+			slot: localTime(0, 5, 50),
+		},
+		{
+			desc: "slot near the end of allowed day",
+			pol:  SchedulingPolicy{TimesOfDay: []TimeOfDay{{23, 50}}, JitterSeconds: 3600, DaysOfWeek: []time.Weekday{time.Wednesday}},
+			now:  localTime(0, 12, 0),
+			slot: localTime(0, 23, 50),
+		},
+	}
+
+	for _, tc := range cases {
+		jittered := 0
+		for i := 0; i < 20; i++ {
+			seed := fmt.Sprintf("user@host:/path%v", i)
+			next, ok := tc.pol.NextSnapshotTime(time.Time{}, tc.now, seed)
+			if !ok || next.Before(tc.slot) {
+				t.Fatalf("%v: unexpected next snapshot time: %v", tc.desc, next)
+			}
+
+			if !tc.pol.isDayAllowed(next.Weekday()) || (tc.pol.Window != nil && !tc.pol.Window.contains(next)) {
+				t.Errorf("%v: snapshot planned outside of allowed times: %v", tc.desc, next)
+			}
+
+			if !next.Equal(tc.slot) {
+				jittered++
+			}
+		}
+
+		if jittered == 0 {
+			t.Errorf("%v: jitter was not applied", tc.desc)
+		}
+	}
+}
+
+func TestSchedulingPolicyValidate(t *testing.T) {
+	cases := []struct {
+		pol   SchedulingPolicy
+		valid bool
+	}{
+		{SchedulingPolicy{}, true},
+		{SchedulingPolicy{Cron: []string{"0 * * * *"}}, true},
+		{SchedulingPolicy{Cron: []string{"0 * * *"}}, false},
+		{SchedulingPolicy{JitterSeconds: -1}, false},
+		{SchedulingPolicy{Window: &TimeWindow{TimeOfDay{22, 0}, TimeOfDay{6, 0}}}, true},
+		{SchedulingPolicy{Window: &TimeWindow{TimeOfDay{22, 0}, TimeOfDay{22, 0}}}, false},
+	}
+
+	for _, tc := range cases {
+		if err := tc.pol.Validate(); (err == nil) != tc.valid {
+			t.Errorf("unexpected result of validating %+v: %v", tc.pol, err)
+		}
+	}
+}
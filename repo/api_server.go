@@ -0,0 +1,78 @@
+package repo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/kopia/kopia/internal/apiclient"
+	"github.com/kopia/kopia/internal/config"
+	"github.com/kopia/kopia/repo/object"
+	"github.com/kopia/kopia/repo/remote"
+)
+
+// ConnectAPIServer connects to the repository exposed by Kopia API server and persists the configuration
+// in the file provided. The password is the password of the server user, not the repository password.
+// Caching options don't apply to repositories accessed through API server.
+func ConnectAPIServer(ctx context.Context, configFile string, si *config.APIServerInfo, password string, opt ConnectOptions) error {
+	lc := config.LocalConfig{
+		APIServer:     si,
+		EnableActions: opt.EnableActions,
+	}
+
+	d, err := json.MarshalIndent(&lc, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(configFile), 0700); err != nil {
+		return fmt.Errorf("unable to create config directory: %v", err)
+	}
+
+	if err = ioutil.WriteFile(configFile, d, 0600); err != nil {
+		return fmt.Errorf("unable to write config file: %v", err)
+	}
+
+	// now verify that the repository can be opened with the provided config file.
+	r, err := Open(ctx, configFile, password, nil)
+	if err != nil {
+		return err
+	}
+
+	return r.Close(ctx)
+}
+
+func openAPIServer(ctx context.Context, si *config.APIServerInfo, password string, options *Options) (*Repository, error) {
+	log.Debugf("connecting to API server %v", si.BaseURL)
+	cli, err := remote.NewClient(apiclient.Options{
+		BaseURL:                             si.BaseURL,
+		Username:                            si.Username,
+		Password:                            password,
+		TrustedServerCertificateFingerprint: si.TrustedServerCertificateFingerprint,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to create API client: %v", err)
+	}
+
+	p, err := cli.Parameters(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("initializing object manager")
+	om, err := object.NewObjectManager(ctx, cli, p.ObjectFormat, options.ObjectManagerOptions)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open object manager: %v", err)
+	}
+
+	return &Repository{
+		Objects:   om,
+		Manifests: cli.Manifests(),
+		UniqueID:  p.UniqueID,
+
+		remote: cli,
+	}, nil
+}
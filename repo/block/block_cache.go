@@ -1,11 +1,11 @@
 package block
 
 import (
-	"container/heap"
 	"context"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 
@@ -50,8 +50,11 @@ func (c *blockCache) getContentBlock(ctx context.Context, cacheKey string, physi
 	useCache := shouldUseBlockCache(ctx) && c.cacheStorage != nil
 	if useCache {
 		if b := c.readAndVerifyCacheBlock(ctx, cacheKey); b != nil {
+			metricCacheHits.Inc()
 			return b, nil
 		}
+
+		metricCacheMisses.Inc()
 	}
 
 	b, err := c.st.GetBlock(ctx, physicalBlockID, offset, length)
@@ -83,6 +86,7 @@ func (c *blockCache) readAndVerifyCacheBlock(ctx context.Context, cacheKey strin
 		}
 
 		// ignore malformed blocks
+		metricCacheMalformed.Inc()
 		log.Warningf("malformed block %v: %v", cacheKey, err)
 		return nil
 	}
@@ -112,29 +116,16 @@ func (c *blockCache) sweepDirectoryPeriodically(ctx context.Context) {
 	}
 }
 
-// A blockMetadataHeap implements heap.Interface and holds storage.BlockMetadata.
-type blockMetadataHeap []storage.BlockMetadata
-
-func (h blockMetadataHeap) Len() int { return len(h) }
-
-func (h blockMetadataHeap) Less(i, j int) bool {
-	return h[i].Timestamp.Before(h[j].Timestamp)
-}
-
-func (h blockMetadataHeap) Swap(i, j int) {
-	h[i], h[j] = h[j], h[i]
-}
-
-func (h *blockMetadataHeap) Push(x interface{}) {
-	*h = append(*h, x.(storage.BlockMetadata))
-}
+// isMetadataCacheKey returns true if the cache key belongs to a block stored in metadata packs, such as
+// a directory or manifest, or to an index block, which are retained in preference to file contents.
+func isMetadataCacheKey(cacheKey string) bool {
+	// undo adjustCacheKey(), which moved the prefix to the end.
+	blockID := cacheKey
+	if len(cacheKey)%2 == 1 {
+		blockID = cacheKey[len(cacheKey)-1:] + cacheKey[0:len(cacheKey)-1]
+	}
 
-func (h *blockMetadataHeap) Pop() interface{} {
-	old := *h
-	n := len(old)
-	item := old[n-1]
-	*h = old[0 : n-1]
-	return item
+	return packPrefixForBlock(blockID) == MetadataPackBlockPrefix
 }
 
 func (c *blockCache) sweepDirectory(ctx context.Context) (err error) {
@@ -147,27 +138,39 @@ func (c *blockCache) sweepDirectory(ctx context.Context) (err error) {
 
 	t0 := time.Now()
 
-	var h blockMetadataHeap
-	var totalRetainedSize int64
-
+	var items []storage.BlockMetadata
 	err = c.cacheStorage.ListBlocks(ctx, "", func(it storage.BlockMetadata) error {
-		heap.Push(&h, it)
-		totalRetainedSize += it.Length
-
-		if totalRetainedSize > c.maxSizeBytes {
-			oldest := heap.Pop(&h).(storage.BlockMetadata)
-			if delerr := c.cacheStorage.DeleteBlock(ctx, it.BlockID); delerr != nil {
-				log.Warningf("unable to remove %v: %v", it.BlockID, delerr)
-			} else {
-				totalRetainedSize -= oldest.Length
-			}
-		}
+		items = append(items, it)
 		return nil
 	})
 	if err != nil {
 		return fmt.Errorf("error listing cache: %v", err)
 	}
 
+	// retain the most recently used metadata blocks first, followed by the most recently used file contents.
+	sort.Slice(items, func(i, j int) bool {
+		if a, b := isMetadataCacheKey(items[i].BlockID), isMetadataCacheKey(items[j].BlockID); a != b {
+			return a
+		}
+
+		return items[i].Timestamp.After(items[j].Timestamp)
+	})
+
+	var totalRetainedSize int64
+	var full bool
+	for _, it := range items {
+		if !full && totalRetainedSize+it.Length <= c.maxSizeBytes {
+			totalRetainedSize += it.Length
+			continue
+		}
+
+		full = true
+		if delerr := c.cacheStorage.DeleteBlock(ctx, it.BlockID); delerr != nil {
+			log.Warningf("unable to remove %v: %v", it.BlockID, delerr)
+			totalRetainedSize += it.Length
+		}
+	}
+
 	log.Debugf("finished sweeping directory in %v and retained %v/%v bytes (%v %%)", time.Since(t0), totalRetainedSize, c.maxSizeBytes, 100*totalRetainedSize/c.maxSizeBytes)
 	c.lastTotalSizeBytes = totalRetainedSize
 	return nil
@@ -8,6 +8,7 @@ import (
 	"reflect"
 	"sort"
 	"testing"
+	"time"
 
 	"github.com/kopia/kopia/repo/internal/storagetesting"
 	"github.com/kopia/kopia/repo/storage"
@@ -115,6 +116,37 @@ func verifyBlockCache(t *testing.T, cache *blockCache) {
 	})
 }
 
+func TestBlockCacheSweepRetainsMetadata(t *testing.T) {
+	ctx := context.Background()
+	cacheData := map[string][]byte{}
+	keyTime := map[string]time.Time{}
+	cacheStorage := storagetesting.NewMapStorage(cacheData, keyTime, nil)
+
+	// metadata keys end with block prefix, see adjustCacheKey()
+	for i, key := range []string{"f0f0f1x", "f0f0f2x", "f0f0f3", "f0f0f4", "f0f0f5x", "f0f0f6f"} {
+		cacheStorage.PutBlock(ctx, key, make([]byte, 100))
+		keyTime[key] = fakeTime.Add(time.Duration(i) * time.Second)
+	}
+
+	cache, err := newBlockCacheWithCacheStorage(ctx, newUnderlyingStorageForBlockCacheTesting(), cacheStorage, CachingOptions{
+		MaxCacheSizeBytes: 400,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer cache.close()
+
+	// all metadata blocks and the most recent data block are retained.
+	verifyStorageBlockList(t, cacheStorage, "f0f0f1x", "f0f0f2x", "f0f0f5x", "f0f0f6f")
+
+	cache.maxSizeBytes = 200
+	if err := cache.sweepDirectory(ctx); err != nil {
+		t.Fatalf("sweep error: %v", err)
+	}
+
+	verifyStorageBlockList(t, cacheStorage, "f0f0f2x", "f0f0f5x")
+}
+
 func verifyStorageBlockList(t *testing.T, st storage.Storage, expectedBlocks ...string) {
 	t.Helper()
 	var foundBlocks []string
@@ -10,6 +10,8 @@ import (
 	"hash"
 	"sort"
 	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
 // Formatter performs data block ID computation and encryption of a block of data when storing object in a repository.
@@ -24,6 +26,17 @@ type Formatter interface {
 	Decrypt(cipherText []byte, blockID []byte) ([]byte, error)
 }
 
+// authenticatedFormatter is implemented by formatters whose Decrypt verifies the integrity of the data and
+// its association with the block ID, which makes recomputing block IDs of decrypted blocks unnecessary,
+// and which add a fixed number of bytes to the plaintext, so the length of a block can be computed
+// without decrypting it.
+type authenticatedFormatter interface {
+	verifiesIntegrity()
+
+	// overhead returns the number of bytes Encrypt adds to the plaintext.
+	overhead() int
+}
+
 // digestFunction computes the digest (hash, optionally HMAC) of a given block of bytes.
 type digestFunction func([]byte) []byte
 
@@ -81,6 +94,16 @@ func symmetricEncrypt(createCipher func(key []byte) (cipher.Block, error), key [
 //   UNENCRYPTED_HMAC_SHA256_128          - unencrypted, block IDs are 128-bit (32 characters long)
 //   UNENCRYPTED_HMAC_SHA256              - unencrypted, block IDs are 256-bit (64 characters long)
 //   ENCRYPTED_HMAC_SHA256_AES256_SIV     - encrypted with AES-256 (shared key), IV==FOLD(HMAC-SHA256(content), 128)
+//
+// and authenticated encryption formats with per-block key derived from the master key and block ID and random nonce,
+// which don't need to re-hash decrypted blocks to verify their integrity:
+//
+//   ENCRYPTED_HMAC_SHA256_AES256_GCM         - AES-256-GCM, block ID==TRUNCATE(HMAC-SHA256(content), 128)
+//   ENCRYPTED_HMAC_SHA256_XCHACHA20_POLY1305 - XChaCha20-Poly1305, block ID==TRUNCATE(HMAC-SHA256(content), 128)
+//   ENCRYPTED_BLAKE2B_AES256_GCM             - AES-256-GCM, block ID==TRUNCATE(BLAKE2b-256(content, secret), 128)
+//   ENCRYPTED_BLAKE2B_XCHACHA20_POLY1305     - XChaCha20-Poly1305, block ID==TRUNCATE(BLAKE2b-256(content, secret), 128)
+//
+// XChaCha20-Poly1305 and BLAKE2b are faster than AES and HMAC-SHA256 on machines without hardware AES and SHA support.
 var SupportedFormats []string
 
 // FormatterFactories maps known block formatters to their factory functions.
@@ -103,6 +126,10 @@ func init() {
 			}
 			return &syntheticIVEncryptionFormat{computeHMAC(sha256.New, f.HMACSecret, aes.BlockSize), aes.NewCipher, f.MasterKey}, nil
 		},
+		"ENCRYPTED_HMAC_SHA256_AES256_GCM":         newAuthenticatedEncryptionFormat(hmacSHA256Digest(aes.BlockSize), newAES256GCM),
+		"ENCRYPTED_HMAC_SHA256_XCHACHA20_POLY1305": newAuthenticatedEncryptionFormat(hmacSHA256Digest(aes.BlockSize), chacha20poly1305.NewX),
+		"ENCRYPTED_BLAKE2B_AES256_GCM":             newAuthenticatedEncryptionFormat(blake2bDigest(aes.BlockSize), newAES256GCM),
+		"ENCRYPTED_BLAKE2B_XCHACHA20_POLY1305":     newAuthenticatedEncryptionFormat(blake2bDigest(aes.BlockSize), chacha20poly1305.NewX),
 	}
 
 	for k := range FormatterFactories {
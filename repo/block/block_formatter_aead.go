@@ -0,0 +1,143 @@
+package block
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/hkdf"
+)
+
+// aeadKeyDerivationInfo is the HKDF info string used to derive per-block keys.
+const aeadKeyDerivationInfo = "kopia-block-aead"
+
+// authenticatedEncryptionFormat implements encrypted format using an AEAD cipher with key derived from the master key
+// and block ID using HKDF-SHA256 and a random nonce stored at the beginning of the ciphertext, so that encrypting
+// the same block more than once (for example after changing compression or rewriting it) never reuses a nonce.
+// The block ID is also passed as additional authenticated data, which allows Decrypt to detect
+// tampering and mismatched blocks without re-hashing the plaintext.
+type authenticatedEncryptionFormat struct {
+	digestFunc digestFunction
+	newAEAD    func(key []byte) (cipher.AEAD, error)
+	masterKey  []byte
+	nonceSize  int
+	tagSize    int
+}
+
+func (fi *authenticatedEncryptionFormat) ComputeBlockID(data []byte) []byte {
+	return fi.digestFunc(data)
+}
+
+func (fi *authenticatedEncryptionFormat) Encrypt(plainText []byte, blockID []byte) ([]byte, error) {
+	a, err := fi.aeadForBlock(blockID)
+	if err != nil {
+		return nil, err
+	}
+
+	cipherText := make([]byte, fi.nonceSize, fi.nonceSize+len(plainText)+fi.tagSize)
+
+	// Store nonce at the beginning of ciphertext.
+	nonce := cipherText[0:fi.nonceSize]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("unable to generate nonce: %v", err)
+	}
+
+	return a.Seal(cipherText, nonce, plainText, blockID), nil
+}
+
+func (fi *authenticatedEncryptionFormat) Decrypt(cipherText []byte, blockID []byte) ([]byte, error) {
+	if len(cipherText) < fi.nonceSize+fi.tagSize {
+		return nil, fmt.Errorf("unable to decrypt block %x: ciphertext too short", blockID)
+	}
+
+	a, err := fi.aeadForBlock(blockID)
+	if err != nil {
+		return nil, err
+	}
+
+	plainText, err := a.Open(nil, cipherText[0:fi.nonceSize], cipherText[fi.nonceSize:], blockID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt block %x: %v", blockID, err)
+	}
+
+	return plainText, nil
+}
+
+// verifiesIntegrity implements authenticatedFormatter.
+func (fi *authenticatedEncryptionFormat) verifiesIntegrity() {}
+
+// overhead implements authenticatedFormatter.
+func (fi *authenticatedEncryptionFormat) overhead() int {
+	return fi.nonceSize + fi.tagSize
+}
+
+// aeadForBlock returns AEAD cipher for the specified block ID.
+func (fi *authenticatedEncryptionFormat) aeadForBlock(blockID []byte) (cipher.AEAD, error) {
+	kdf := hkdf.New(sha256.New, fi.masterKey, blockID, []byte(aeadKeyDerivationInfo))
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		return nil, fmt.Errorf("unable to derive block key: %v", err)
+	}
+
+	return fi.newAEAD(key)
+}
+
+func newAES256GCM(key []byte) (cipher.AEAD, error) {
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(c)
+}
+
+// newAuthenticatedEncryptionFormat returns a factory of authenticatedEncryptionFormat with the given digest and cipher.
+func newAuthenticatedEncryptionFormat(digest func(f FormattingOptions) (digestFunction, error), newAEAD func(key []byte) (cipher.AEAD, error)) func(f FormattingOptions) (Formatter, error) {
+	return func(f FormattingOptions) (Formatter, error) {
+		if len(f.MasterKey) < 32 {
+			return nil, fmt.Errorf("master key is not set")
+		}
+
+		df, err := digest(f)
+		if err != nil {
+			return nil, err
+		}
+
+		a, err := newAEAD(make([]byte, 32))
+		if err != nil {
+			return nil, err
+		}
+
+		return &authenticatedEncryptionFormat{df, newAEAD, f.MasterKey, a.NonceSize(), a.Overhead()}, nil
+	}
+}
+
+func hmacSHA256Digest(truncate int) func(f FormattingOptions) (digestFunction, error) {
+	return func(f FormattingOptions) (digestFunction, error) {
+		return computeHMAC(sha256.New, f.HMACSecret, truncate), nil
+	}
+}
+
+func blake2bDigest(truncate int) func(f FormattingOptions) (digestFunction, error) {
+	return func(f FormattingOptions) (digestFunction, error) {
+		newHash := func() (hash.Hash, error) {
+			return blake2b.New256(f.HMACSecret)
+		}
+
+		if _, err := newHash(); err != nil {
+			return nil, fmt.Errorf("invalid BLAKE2b key: %v", err)
+		}
+
+		return func(b []byte) []byte {
+			h, _ := newHash()
+			h.Write(b) // nolint:errcheck
+			return h.Sum(nil)[0:truncate]
+		}, nil
+	}
+}
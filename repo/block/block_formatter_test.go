@@ -46,3 +46,87 @@ func TestFormatters(t *testing.T) {
 		}
 	}
 }
+
+func TestAuthenticatedFormattersDetectTampering(t *testing.T) {
+	f := FormattingOptions{HMACSecret: []byte("secret"), MasterKey: make([]byte, 32)}
+
+	for k, v := range FormatterFactories {
+		of, err := v(f)
+		if err != nil {
+			t.Fatalf("error creating object formatter for %v: %v", k, err)
+		}
+
+		if _, ok := of.(authenticatedFormatter); !ok {
+			continue
+		}
+
+		data := make([]byte, 100)
+		rand.Read(data)
+
+		blockID := of.ComputeBlockID(data)
+		cipherText, err := of.Encrypt(data, blockID)
+		if err != nil {
+			t.Fatalf("unable to encrypt using %v: %v", k, err)
+		}
+
+		tampered := append([]byte(nil), cipherText...)
+		tampered[len(tampered)/2] ^= 1
+		if _, err := of.Decrypt(tampered, blockID); err == nil {
+			t.Errorf("%v did not detect tampered ciphertext", k)
+		}
+
+		otherID := of.ComputeBlockID([]byte("other"))
+		if _, err := of.Decrypt(cipherText, otherID); err == nil {
+			t.Errorf("%v did not detect mismatched block ID", k)
+		}
+	}
+}
+
+func TestAuthenticatedFormattersUseUniqueNonces(t *testing.T) {
+	f := FormattingOptions{HMACSecret: []byte("secret"), MasterKey: make([]byte, 32)}
+
+	for k, v := range FormatterFactories {
+		of, err := v(f)
+		if err != nil {
+			t.Fatalf("error creating object formatter for %v: %v", k, err)
+		}
+
+		af, ok := of.(authenticatedFormatter)
+		if !ok {
+			continue
+		}
+
+		data := make([]byte, 100)
+		rand.Read(data)
+		blockID := of.ComputeBlockID(data)
+
+		// same block may be encrypted more than once with different contents, for example compressed,
+		// so encryption must not be deterministic.
+		c1, err := of.Encrypt(data, blockID)
+		if err != nil {
+			t.Fatalf("unable to encrypt using %v: %v", k, err)
+		}
+
+		c2, err := of.Encrypt(data, blockID)
+		if err != nil {
+			t.Fatalf("unable to encrypt using %v: %v", k, err)
+		}
+
+		if bytes.Equal(c1, c2) {
+			t.Errorf("%v reused nonce for block %x", k, blockID)
+		}
+
+		if got, want := len(c1), len(data)+af.overhead(); got != want {
+			t.Errorf("unexpected ciphertext length for %v: %v, want %v", k, got, want)
+		}
+
+		p2, err := of.Decrypt(c2, blockID)
+		if err != nil || !bytes.Equal(p2, data) {
+			t.Errorf("unable to decrypt %v: %v", k, err)
+		}
+
+		if _, err := of.Decrypt(c2[0:af.overhead()-1], blockID); err == nil {
+			t.Errorf("%v decrypted truncated block", k)
+		}
+	}
+}
@@ -39,8 +39,8 @@ func (bm *Manager) RecoverIndexFromPackFile(ctx context.Context, packFile string
 
 type packBlockPostamble struct {
 	localIndexIV     []byte
-	localIndexOffset uint32
-	localIndexLength uint32
+	localIndexOffset uint64
+	localIndexLength uint64
 }
 
 func (p *packBlockPostamble) toBytes() ([]byte, error) {
@@ -52,8 +52,8 @@ func (p *packBlockPostamble) toBytes() ([]byte, error) {
 	n += binary.PutUvarint(buf[n:], uint64(len(p.localIndexIV))) // length of local index IV
 	copy(buf[n:], p.localIndexIV)
 	n += len(p.localIndexIV)
-	n += binary.PutUvarint(buf[n:], uint64(p.localIndexOffset))
-	n += binary.PutUvarint(buf[n:], uint64(p.localIndexLength))
+	n += binary.PutUvarint(buf[n:], p.localIndexOffset)
+	n += binary.PutUvarint(buf[n:], p.localIndexLength)
 
 	checksum := crc32.ChecksumIEEE(buf[0:n])
 	binary.BigEndian.PutUint32(buf[n:], checksum)
@@ -142,14 +142,14 @@ func decodePostamble(payload []byte) *packBlockPostamble {
 
 	return &packBlockPostamble{
 		localIndexIV:     iv,
-		localIndexLength: uint32(length),
-		localIndexOffset: uint32(off),
+		localIndexLength: length,
+		localIndexOffset: off,
 	}
 }
 
 func (bm *Manager) buildLocalIndex(pending packindex.Builder) ([]byte, error) {
 	var buf bytes.Buffer
-	if err := pending.Build(&buf); err != nil {
+	if err := pending.Build(&buf, bm.indexVersion); err != nil {
 		return nil, fmt.Errorf("unable to build local index: %v", err)
 	}
 
@@ -173,8 +173,8 @@ func (bm *Manager) appendPackFileIndexRecoveryData(blockData []byte, pending pac
 
 	postamble := packBlockPostamble{
 		localIndexIV:     localIndexIV,
-		localIndexOffset: uint32(localIndexOffset),
-		localIndexLength: uint32(len(localIndex)),
+		localIndexOffset: uint64(localIndexOffset),
+		localIndexLength: uint64(len(encryptedLocalIndex)),
 	}
 
 	blockData = append(blockData, encryptedLocalIndex...)
@@ -208,7 +208,7 @@ func (bm *Manager) readPackFileLocalIndex(ctx context.Context, packFile string,
 		return nil, fmt.Errorf("unable to find valid postamble in file %v", packFile)
 	}
 
-	if uint64(postamble.localIndexOffset+postamble.localIndexLength) > uint64(len(payload)) {
+	if postamble.localIndexOffset > uint64(len(payload)) || postamble.localIndexLength > uint64(len(payload))-postamble.localIndexOffset {
 		// invalid offset/length
 		return nil, fmt.Errorf("unable to find valid local index in file %v", packFile)
 	}
@@ -218,7 +218,7 @@ func (bm *Manager) readPackFileLocalIndex(ctx context.Context, packFile string,
 		return nil, fmt.Errorf("unable to find valid local index in file %v", packFile)
 	}
 
-	localIndexBytes, err := bm.decryptAndVerify(encryptedLocalIndexBytes, postamble.localIndexIV)
+	localIndexBytes, err := bm.decryptAndVerify(encryptedLocalIndexBytes, postamble.localIndexIV, false)
 	if err != nil {
 		return nil, fmt.Errorf("unable to decrypt local index: %v", err)
 	}
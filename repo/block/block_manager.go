@@ -13,11 +13,13 @@ import (
 	"math/rand"
 	"os"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/kopia/kopia/internal/compression"
 	"github.com/kopia/kopia/internal/kopialogging"
 	"github.com/kopia/kopia/internal/packindex"
 	"github.com/kopia/kopia/repo/storage"
@@ -26,23 +28,38 @@ import (
 var log = kopialogging.Logger("kopia/block")
 var formatLog = kopialogging.Logger("kopia/block/format")
 
-// PackBlockPrefix is the prefix for all pack storage blocks.
+// PackBlockPrefix is the prefix for pack storage blocks holding file contents.
 const PackBlockPrefix = "p"
 
+// MetadataPackBlockPrefix is the prefix for pack storage blocks holding blocks with prefixes,
+// such as directories and manifests, which are kept apart from file contents so that browsing
+// snapshots does not require downloading large packs.
+const MetadataPackBlockPrefix = "q"
+
+// PackBlockPrefixes is the list of prefixes of all pack storage blocks.
+var PackBlockPrefixes = []string{PackBlockPrefix, MetadataPackBlockPrefix}
+
+// IndexBlockPrefix is the prefix for all index storage blocks.
+const IndexBlockPrefix = "n"
+
 const (
 	parallelFetches             = 5                // number of parallel reads goroutines
 	flushPackIndexTimeout       = 10 * time.Minute // time after which all pending indexes are flushes
-	newIndexBlockPrefix         = "n"
 	defaultMinPreambleLength    = 32
 	defaultMaxPreambleLength    = 32
 	defaultPaddingUnit          = 4096
 	autoCompactionMinBlockCount = 4 * parallelFetches
 	autoCompactionMaxBlockCount = 64
+	defaultMaxMetadataPackSize  = 4 << 20
 
 	currentWriteVersion     = 1
 	minSupportedReadVersion = 0
 	maxSupportedReadVersion = currentWriteVersion
 
+	// compressedBlockFormatVersion is the per-block format version recorded in the pack index
+	// for blocks whose payload has been compressed before encryption.
+	compressedBlockFormatVersion = 2
+
 	indexLoadAttempts = 10
 )
 
@@ -69,8 +86,8 @@ type Manager struct {
 	locked                  bool
 	checkInvariantsOnUnlock bool
 
-	currentPackItems      map[string]Info   // blocks that are in the pack block currently being built (all inline)
-	currentPackDataLength int               // total length of all items in the current pack block
+	currentPackItems      map[string]Info   // blocks that are in pack blocks currently being built (all inline)
+	currentPackDataLength map[string]int    // total length of all items in pack blocks currently being built by pack prefix
 	packIndexBuilder      packindex.Builder // blocks that are in index currently being built (current pack and all packs saved but not committed)
 	committedBlocks       *committedBlockIndex
 
@@ -80,9 +97,12 @@ type Manager struct {
 	closed chan struct{}
 
 	writeFormatVersion int32 // format version to write
+	indexVersion       int   // version of pack indexes to write
 
-	maxPackSize int
-	formatter   Formatter
+	maxPackSize         int
+	maxMetadataPackSize int
+	formatter           Formatter
+	compressor          compression.Compressor // optional, nil when compression is disabled
 
 	minPreambleLength int
 	maxPreambleLength int
@@ -148,17 +168,18 @@ func (bm *Manager) addToPackLocked(ctx context.Context, blockID string, data []b
 	bm.assertLocked()
 
 	data = cloneBytes(data)
-	bm.currentPackDataLength += len(data)
+	packPrefix := packPrefixForBlock(blockID)
+	bm.currentPackDataLength[packPrefix] += len(data)
 	bm.setPendingBlock(Info{
 		Deleted:          isDeleted,
 		BlockID:          blockID,
 		Payload:          data,
-		Length:           uint32(len(data)),
+		Length:           int64(len(data)),
 		TimestampSeconds: bm.timeNow().Unix(),
 	})
 
-	if bm.currentPackDataLength >= bm.maxPackSize {
-		if err := bm.finishPackAndMaybeFlushIndexesLocked(ctx); err != nil {
+	if bm.currentPackDataLength[packPrefix] >= bm.PackSizeLimit(packPrefix) {
+		if err := bm.finishPackAndMaybeFlushIndexesLocked(ctx, packPrefix); err != nil {
 			return err
 		}
 	}
@@ -166,13 +187,37 @@ func (bm *Manager) addToPackLocked(ctx context.Context, blockID string, data []b
 	return nil
 }
 
-func (bm *Manager) finishPackAndMaybeFlushIndexesLocked(ctx context.Context) error {
+// packPrefixForBlock returns the prefix of pack blocks that the given block is written to.
+func packPrefixForBlock(blockID string) string {
+	if blockID != "" && validatePrefix(blockID[0:1]) == nil {
+		return MetadataPackBlockPrefix
+	}
+
+	return PackBlockPrefix
+}
+
+// PackSizeLimit returns the size of pending blocks at which a pack with the given name or prefix is written.
+func (bm *Manager) PackSizeLimit(packFile string) int {
+	if strings.HasPrefix(packFile, MetadataPackBlockPrefix) {
+		return bm.maxMetadataPackSize
+	}
+
+	return bm.maxPackSize
+}
+
+func (bm *Manager) finishPackAndMaybeFlushIndexesLocked(ctx context.Context, packPrefix string) error {
 	bm.assertLocked()
-	if err := bm.finishPackLocked(ctx); err != nil {
+	if err := bm.finishPackLocked(ctx, packPrefix); err != nil {
 		return err
 	}
 
 	if bm.timeNow().After(bm.flushPackIndexesAfter) {
+		// pack index can only describe blocks that have been written to packs, so pending packs
+		// with other prefixes must be written first.
+		if err := bm.finishAllPacksLocked(ctx); err != nil {
+			return err
+		}
+
 		if err := bm.flushPackIndexesLocked(ctx); err != nil {
 			return err
 		}
@@ -253,7 +298,7 @@ func (bm *Manager) verifyPackIndexBuilderLocked() {
 			if cpi.PackFile == "" {
 				bm.invariantViolated("block that's not deleted must have a pack block: %+v", cpi)
 			}
-			if cpi.FormatVersion != byte(bm.writeFormatVersion) {
+			if cpi.FormatVersion != byte(bm.writeFormatVersion) && cpi.FormatVersion != compressedBlockFormatVersion {
 				bm.invariantViolated("block that's not deleted must have a valid format version: %+v", cpi)
 			}
 		}
@@ -273,7 +318,7 @@ func (bm *Manager) invariantViolated(msg string, arg ...interface{}) {
 
 func (bm *Manager) startPackIndexLocked() {
 	bm.currentPackItems = make(map[string]Info)
-	bm.currentPackDataLength = 0
+	bm.currentPackDataLength = make(map[string]int)
 }
 
 func (bm *Manager) flushPackIndexesLocked(ctx context.Context) error {
@@ -287,7 +332,7 @@ func (bm *Manager) flushPackIndexesLocked(ctx context.Context) error {
 	if len(bm.packIndexBuilder) > 0 {
 		var buf bytes.Buffer
 
-		if err := bm.packIndexBuilder.Build(&buf); err != nil {
+		if err := bm.packIndexBuilder.Build(&buf, bm.indexVersion); err != nil {
 			return fmt.Errorf("unable to build pack index: %v", err)
 		}
 
@@ -310,24 +355,44 @@ func (bm *Manager) flushPackIndexesLocked(ctx context.Context) error {
 }
 
 func (bm *Manager) writePackIndexesNew(ctx context.Context, data []byte) (string, error) {
-	return bm.encryptAndWriteBlockNotLocked(ctx, data, newIndexBlockPrefix)
+	return bm.encryptAndWriteBlockNotLocked(ctx, data, IndexBlockPrefix)
 }
 
-func (bm *Manager) finishPackLocked(ctx context.Context) error {
-	if len(bm.currentPackItems) == 0 {
-		log.Debugf("no current pack entries")
+func (bm *Manager) finishAllPacksLocked(ctx context.Context) error {
+	for _, packPrefix := range PackBlockPrefixes {
+		if err := bm.finishPackLocked(ctx, packPrefix); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (bm *Manager) finishPackLocked(ctx context.Context, packPrefix string) error {
+	items := map[string]Info{}
+	for blockID, info := range bm.currentPackItems {
+		if packPrefixForBlock(blockID) == packPrefix {
+			items[blockID] = info
+		}
+	}
+
+	if len(items) == 0 {
+		log.Debugf("no current pack entries with prefix %v", packPrefix)
 		return nil
 	}
 
-	if err := bm.writePackBlockLocked(ctx); err != nil {
+	if err := bm.writePackBlockLocked(ctx, packPrefix, items); err != nil {
 		return fmt.Errorf("error writing pack block: %v", err)
 	}
 
-	bm.startPackIndexLocked()
+	for blockID := range items {
+		delete(bm.currentPackItems, blockID)
+	}
+	delete(bm.currentPackDataLength, packPrefix)
 	return nil
 }
 
-func (bm *Manager) writePackBlockLocked(ctx context.Context) error {
+func (bm *Manager) writePackBlockLocked(ctx context.Context, packPrefix string, items map[string]Info) error {
 	bm.assertLocked()
 
 	blockID := make([]byte, 16)
@@ -335,9 +400,9 @@ func (bm *Manager) writePackBlockLocked(ctx context.Context) error {
 		return fmt.Errorf("unable to read crypto bytes: %v", err)
 	}
 
-	packFile := fmt.Sprintf("%v%x", PackBlockPrefix, blockID)
+	packFile := fmt.Sprintf("%v%x", packPrefix, blockID)
 
-	blockData, packFileIndex, err := bm.preparePackDataBlock(packFile)
+	blockData, packFileIndex, err := bm.preparePackDataBlock(packFile, items)
 	if err != nil {
 		return fmt.Errorf("error preparing data block: %v", err)
 	}
@@ -354,8 +419,8 @@ func (bm *Manager) writePackBlockLocked(ctx context.Context) error {
 	return nil
 }
 
-func (bm *Manager) preparePackDataBlock(packFile string) ([]byte, packindex.Builder, error) {
-	formatLog.Debugf("preparing block data with %v items", len(bm.currentPackItems))
+func (bm *Manager) preparePackDataBlock(packFile string, items map[string]Info) ([]byte, packindex.Builder, error) {
+	formatLog.Debugf("preparing block data with %v items", len(items))
 
 	blockData, err := appendRandomBytes(nil, rand.Intn(bm.maxPreambleLength-bm.minPreambleLength+1)+bm.minPreambleLength)
 	if err != nil {
@@ -363,27 +428,36 @@ func (bm *Manager) preparePackDataBlock(packFile string) ([]byte, packindex.Buil
 	}
 
 	packFileIndex := packindex.Builder{}
-	for blockID, info := range bm.currentPackItems {
+	for blockID, info := range items {
 		if info.Payload == nil {
 			continue
 		}
 
+		payload, formatVersion, err := bm.maybeCompressBlockDataForPacking(info.Payload)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to compress %q: %v", blockID, err)
+		}
+
 		var encrypted []byte
-		encrypted, err = bm.maybeEncryptBlockDataForPacking(info.Payload, info.BlockID)
+		encrypted, err = bm.maybeEncryptBlockDataForPacking(payload, info.BlockID)
 		if err != nil {
 			return nil, nil, fmt.Errorf("unable to encrypt %q: %v", blockID, err)
 		}
 
-		formatLog.Debugf("adding %v length=%v deleted=%v", blockID, len(info.Payload), info.Deleted)
+		formatLog.Debugf("adding %v length=%v packed=%v deleted=%v", blockID, len(info.Payload), len(encrypted), info.Deleted)
 
 		packFileIndex.Add(Info{
 			BlockID:          blockID,
 			Deleted:          info.Deleted,
-			FormatVersion:    byte(bm.writeFormatVersion),
+			FormatVersion:    formatVersion,
 			PackFile:         packFile,
-			PackOffset:       uint32(len(blockData)),
-			Length:           uint32(len(info.Payload)),
+			PackOffset:       int64(len(blockData)),
+			Length:           int64(len(encrypted)),
 			TimestampSeconds: info.TimestampSeconds,
+			Compressed:       formatVersion == compressedBlockFormatVersion,
+			Encrypted:        bm.encryptsBlocks(),
+			Checksum:         packindex.Checksum(encrypted),
+			PayloadLength:    int64(len(info.Payload)),
 		})
 
 		blockData = append(blockData, encrypted...)
@@ -409,6 +483,35 @@ func (bm *Manager) preparePackDataBlock(packFile string) ([]byte, packindex.Buil
 	return blockData, packFileIndex, err
 }
 
+// maybeCompressBlockDataForPacking compresses the provided data if compression is enabled and it
+// actually reduces the size of the block. Returns the data to be encrypted and the format version
+// to be recorded in the pack index.
+func (bm *Manager) maybeCompressBlockDataForPacking(data []byte) ([]byte, byte, error) {
+	if bm.compressor == nil || bm.writeFormatVersion == 0 {
+		return data, byte(bm.writeFormatVersion), nil
+	}
+
+	compressed, err := bm.compressor.Compress(data)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if len(compressed) >= len(data) {
+		// incompressible data, store as-is
+		return data, byte(bm.writeFormatVersion), nil
+	}
+
+	atomic.AddInt64(&bm.stats.CompressionSavedBytes, int64(len(data)-len(compressed)))
+	metricCompressionSavedBytes.Add(float64(len(data) - len(compressed)))
+	return compressed, compressedBlockFormatVersion, nil
+}
+
+// encryptsBlocks returns true if the contents of blocks written to packs are encrypted.
+func (bm *Manager) encryptsBlocks() bool {
+	_, unencrypted := bm.formatter.(*unencryptedFormat)
+	return !unencrypted && bm.writeFormatVersion != 0
+}
+
 func (bm *Manager) maybeEncryptBlockDataForPacking(data []byte, blockID string) ([]byte, error) {
 	if bm.writeFormatVersion == 0 {
 		// in v0 the entire block is encrypted together later on
@@ -606,57 +709,88 @@ func (bm *Manager) getBlocksToCompact(indexBlocks []IndexInfo, minSmallBlockCoun
 	return nonCompactedBlocks
 }
 
-// ListBlocks returns IDs of blocks matching given prefix.
+// ListBlocks returns IDs of blocks with a given prefix in the order of block IDs.
 func (bm *Manager) ListBlocks(prefix string) ([]string, error) {
-	bm.lock()
-	defer bm.unlock()
-
 	var result []string
 
-	appendToResult := func(i Info) error {
-		if i.Deleted || !strings.HasPrefix(i.BlockID, prefix) {
-			return nil
-		}
-		if bi, ok := bm.packIndexBuilder[i.BlockID]; ok && bi.Deleted {
-			return nil
-		}
-		result = append(result, i.BlockID)
+	err := bm.IterateBlocks(prefix, func(blockID string) error {
+		result = append(result, blockID)
 		return nil
-	}
-
-	for _, bi := range bm.packIndexBuilder {
-		_ = appendToResult(*bi)
-	}
+	})
 
-	_ = bm.committedBlocks.listBlocks(prefix, appendToResult)
-	return result, nil
+	return result, err
 }
 
-// ListBlockInfos returns the metadata about blocks with a given prefix and kind.
+// ListBlockInfos returns the metadata about blocks with a given prefix in the order of block IDs.
 func (bm *Manager) ListBlockInfos(prefix string, includeDeleted bool) ([]Info, error) {
-	bm.lock()
-	defer bm.unlock()
-
 	var result []Info
 
-	appendToResult := func(i Info) error {
-		if (i.Deleted && !includeDeleted) || !strings.HasPrefix(i.BlockID, prefix) {
-			return nil
+	err := bm.IterateBlockInfos(prefix, includeDeleted, func(i Info) error {
+		result = append(result, i)
+		return nil
+	})
+
+	return result, err
+}
+
+// IterateBlocks invokes the provided callback with IDs of blocks with a given prefix in the order of block IDs.
+func (bm *Manager) IterateBlocks(prefix string, cb func(blockID string) error) error {
+	return bm.IterateBlockInfos(prefix, false, func(i Info) error {
+		return cb(i.BlockID)
+	})
+}
+
+// IterateBlockInfos invokes the provided callback with the metadata about blocks with a given prefix
+// in the order of block IDs, stopping at the first error returned by the callback.
+// It does not hold the lock while iterating nor keep all blocks in memory, so it's suitable for repositories
+// with very large numbers of blocks. The callback may not modify the set of blocks (for example by deleting them).
+func (bm *Manager) IterateBlockInfos(prefix string, includeDeleted bool, cb func(i Info) error) error {
+	bm.lock()
+	var pending []Info
+	for _, bi := range bm.packIndexBuilder {
+		if strings.HasPrefix(bi.BlockID, prefix) {
+			pending = append(pending, *bi)
 		}
-		if bi, ok := bm.packIndexBuilder[i.BlockID]; ok && bi.Deleted {
+	}
+	bm.unlock()
+
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].BlockID < pending[j].BlockID
+	})
+
+	emit := func(i Info) error {
+		if i.Deleted && !includeDeleted {
 			return nil
 		}
-		result = append(result, i)
-		return nil
+		return cb(i)
 	}
 
-	for _, bi := range bm.packIndexBuilder {
-		_ = appendToResult(*bi)
+	if err := bm.committedBlocks.listBlocks(prefix, func(i Info) error {
+		for len(pending) > 0 && pending[0].BlockID <= i.BlockID {
+			p := pending[0]
+			pending = pending[1:]
+			if err := emit(p); err != nil {
+				return err
+			}
+
+			if p.BlockID == i.BlockID {
+				// blocks that are not committed yet supersede committed ones.
+				return nil
+			}
+		}
+
+		return emit(i)
+	}); err != nil {
+		return err
 	}
 
-	_ = bm.committedBlocks.listBlocks(prefix, appendToResult)
+	for _, p := range pending {
+		if err := emit(p); err != nil {
+			return err
+		}
+	}
 
-	return result, nil
+	return nil
 }
 
 func (bm *Manager) compactAndDeleteIndexBlocks(ctx context.Context, indexBlocks []IndexInfo) error {
@@ -675,7 +809,7 @@ func (bm *Manager) compactAndDeleteIndexBlocks(ctx context.Context, indexBlocks
 
 		index, err := packindex.Open(bytes.NewReader(data))
 		if err != nil {
-			return fmt.Errorf("unable to open index block %q: %v", indexBlock, err)
+			return fmt.Errorf("unable to open index block %q: %v", indexBlock.FileName, err)
 		}
 
 		_ = index.Iterate("", func(i Info) error {
@@ -685,7 +819,7 @@ func (bm *Manager) compactAndDeleteIndexBlocks(ctx context.Context, indexBlocks
 	}
 
 	var buf bytes.Buffer
-	if err := bld.Build(&buf); err != nil {
+	if err := bld.Build(&buf, bm.indexVersion); err != nil {
 		return fmt.Errorf("unable to build an index: %v", err)
 	}
 
@@ -715,7 +849,7 @@ func (bm *Manager) Flush(ctx context.Context) error {
 	bm.lock()
 	defer bm.unlock()
 
-	if err := bm.finishPackLocked(ctx); err != nil {
+	if err := bm.finishAllPacksLocked(ctx); err != nil {
 		return fmt.Errorf("error writing pending block: %v", err)
 	}
 
@@ -780,7 +914,9 @@ func validatePrefix(prefix string) error {
 
 func (bm *Manager) writePackFileNotLocked(ctx context.Context, packFile string, data []byte) error {
 	atomic.AddInt32(&bm.stats.WrittenBlocks, 1)
+	metricWrittenBlocks.Inc()
 	atomic.AddInt64(&bm.stats.WrittenBytes, int64(len(data)))
+	metricWrittenBytes.Add(float64(len(data)))
 	bm.listCache.deleteListCache(ctx)
 	return bm.st.PutBlock(ctx, packFile, data)
 }
@@ -791,13 +927,16 @@ func (bm *Manager) encryptAndWriteBlockNotLocked(ctx context.Context, data []byt
 
 	// Encrypt the block in-place.
 	atomic.AddInt64(&bm.stats.EncryptedBytes, int64(len(data)))
+	metricEncryptedBytes.Add(float64(len(data)))
 	data2, err := bm.formatter.Encrypt(data, hash)
 	if err != nil {
 		return "", err
 	}
 
 	atomic.AddInt32(&bm.stats.WrittenBlocks, 1)
+	metricWrittenBlocks.Inc()
 	atomic.AddInt64(&bm.stats.WrittenBytes, int64(len(data)))
+	metricWrittenBytes.Add(float64(len(data)))
 	bm.listCache.deleteListCache(ctx)
 	if err := bm.st.PutBlock(ctx, physicalBlockID, data2); err != nil {
 		return "", err
@@ -810,7 +949,9 @@ func (bm *Manager) hashData(data []byte) []byte {
 	// Hash the block and compute encryption key.
 	blockID := bm.formatter.ComputeBlockID(data)
 	atomic.AddInt32(&bm.stats.HashedBlocks, 1)
+	metricHashedBlocks.Inc()
 	atomic.AddInt64(&bm.stats.HashedBytes, int64(len(data)))
+	metricHashedBytes.Add(float64(len(data)))
 	return blockID
 }
 
@@ -878,61 +1019,81 @@ func (bm *Manager) BlockInfo(ctx context.Context, blockID string) (Info, error)
 	return bi, err
 }
 
+// PayloadLength returns the length of contents of the block described by the provided Info, which may be
+// different from the stored length, or -1 when it can't be determined without reading the compressed block.
+func (bm *Manager) PayloadLength(bi Info) int64 {
+	if bi.PayloadLength > 0 {
+		// recorded in version 2 indexes.
+		return bi.PayloadLength
+	}
+
+	if isCompressed(bi) {
+		return -1
+	}
+
+	l := bi.Length
+	if af, ok := bm.formatter.(authenticatedFormatter); ok {
+		l -= int64(af.overhead())
+	}
+
+	return l
+}
+
 // FindUnreferencedStorageFiles returns the list of unreferenced storage blocks.
 func (bm *Manager) FindUnreferencedStorageFiles(ctx context.Context) ([]storage.BlockMetadata, error) {
-	infos, err := bm.ListBlockInfos("", false)
-	if err != nil {
+	usedPackBlocks := map[string]int{}
+	if err := bm.IterateBlockInfos("", false, func(bi Info) error {
+		usedPackBlocks[bi.PackFile]++
+		return nil
+	}); err != nil {
 		return nil, fmt.Errorf("unable to list index blocks: %v", err)
 	}
 
-	usedPackBlocks := findPackBlocksInUse(infos)
 	var unused []storage.BlockMetadata
-	err = bm.st.ListBlocks(ctx, PackBlockPrefix, func(bi storage.BlockMetadata) error {
-		u := usedPackBlocks[bi.BlockID]
-		if u > 0 {
-			log.Debugf("pack %v, in use by %v blocks", bi.BlockID, u)
+	for _, packPrefix := range PackBlockPrefixes {
+		err := bm.st.ListBlocks(ctx, packPrefix, func(bi storage.BlockMetadata) error {
+			u := usedPackBlocks[bi.BlockID]
+			if u > 0 {
+				log.Debugf("pack %v, in use by %v blocks", bi.BlockID, u)
+				return nil
+			}
+
+			unused = append(unused, bi)
 			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error listing storage blocks: %v", err)
 		}
-
-		unused = append(unused, bi)
-		return nil
-	})
-	if err != nil {
-		return nil, fmt.Errorf("error listing storage blocks: %v", err)
 	}
 
 	return unused, nil
 }
 
-func findPackBlocksInUse(infos []Info) map[string]int {
-	packUsage := map[string]int{}
-
-	for _, bi := range infos {
-		packUsage[bi.PackFile]++
-	}
-
-	return packUsage
-}
-
 func (bm *Manager) getBlockContentsUnlocked(ctx context.Context, bi Info) ([]byte, error) {
 	if bi.Payload != nil {
 		return cloneBytes(bi.Payload), nil
 	}
 
-	payload, err := bm.blockCache.getContentBlock(ctx, bi.BlockID, bi.PackFile, int64(bi.PackOffset), int64(bi.Length))
+	payload, err := bm.blockCache.getContentBlock(ctx, bi.BlockID, bi.PackFile, bi.PackOffset, bi.Length)
 	if err != nil {
 		return nil, err
 	}
 
+	if bi.Checksum != 0 && packindex.Checksum(payload) != bi.Checksum {
+		return nil, fmt.Errorf("invalid checksum at %v offset %v length %v", bi.PackFile, bi.PackOffset, len(payload))
+	}
+
 	atomic.AddInt32(&bm.stats.ReadBlocks, 1)
+	metricReadBlocks.Inc()
 	atomic.AddInt64(&bm.stats.ReadBytes, int64(len(payload)))
+	metricReadBytes.Add(float64(len(payload)))
 
 	iv, err := getPackedBlockIV(bi.BlockID)
 	if err != nil {
 		return nil, err
 	}
 
-	decrypted, err := bm.decryptAndVerify(payload, iv)
+	decrypted, err := bm.decryptAndVerify(payload, iv, isCompressed(bi))
 	if err != nil {
 		return nil, fmt.Errorf("invalid checksum at %v offset %v length %v: %v", bi.PackFile, bi.PackOffset, len(payload), err)
 	}
@@ -940,13 +1101,21 @@ func (bm *Manager) getBlockContentsUnlocked(ctx context.Context, bi Info) ([]byt
 	return decrypted, nil
 }
 
-func (bm *Manager) decryptAndVerify(encrypted []byte, iv []byte) ([]byte, error) {
+func (bm *Manager) decryptAndVerify(encrypted []byte, iv []byte, compressed bool) ([]byte, error) {
 	decrypted, err := bm.formatter.Decrypt(encrypted, iv)
 	if err != nil {
 		return nil, err
 	}
 
 	atomic.AddInt64(&bm.stats.DecryptedBytes, int64(len(decrypted)))
+	metricDecryptedBytes.Add(float64(len(decrypted)))
+
+	if compressed {
+		decrypted, err = compression.Decompress(decrypted)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decompress: %v", err)
+		}
+	}
 
 	// Since the encryption key is a function of data, we must be able to generate exactly the same key
 	// after decrypting the content. This serves as a checksum.
@@ -965,10 +1134,13 @@ func (bm *Manager) getPhysicalBlockInternal(ctx context.Context, blockID string)
 	}
 
 	atomic.AddInt32(&bm.stats.ReadBlocks, 1)
+	metricReadBlocks.Inc()
 	atomic.AddInt64(&bm.stats.ReadBytes, int64(len(payload)))
+	metricReadBytes.Add(float64(len(payload)))
 
 	payload, err = bm.formatter.Decrypt(payload, iv)
 	atomic.AddInt64(&bm.stats.DecryptedBytes, int64(len(payload)))
+	metricDecryptedBytes.Add(float64(len(payload)))
 	if err != nil {
 		return nil, err
 	}
@@ -986,6 +1158,11 @@ func getPackedBlockIV(blockID string) ([]byte, error) {
 	return hex.DecodeString(blockID[len(blockID)-(aes.BlockSize*2):])
 }
 
+// isCompressed returns true if the contents of a block have been compressed before encryption.
+func isCompressed(bi Info) bool {
+	return bi.Compressed || bi.FormatVersion == compressedBlockFormatVersion
+}
+
 func getPhysicalBlockIV(s string) ([]byte, error) {
 	if p := strings.Index(s, "-"); p >= 0 {
 		s = s[0:p]
@@ -994,13 +1171,22 @@ func getPhysicalBlockIV(s string) ([]byte, error) {
 }
 
 func (bm *Manager) verifyChecksum(data []byte, blockID []byte) error {
+	if _, ok := bm.formatter.(authenticatedFormatter); ok {
+		// integrity of the data has already been verified during decryption.
+		atomic.AddInt32(&bm.stats.ValidBlocks, 1)
+		metricValidBlocks.Inc()
+		return nil
+	}
+
 	expected := bm.formatter.ComputeBlockID(data)
 	if !bytes.HasSuffix(blockID, expected) {
 		atomic.AddInt32(&bm.stats.InvalidBlocks, 1)
+		metricInvalidBlocks.Inc()
 		return fmt.Errorf("invalid checksum for blob %x, expected %x", blockID, expected)
 	}
 
 	atomic.AddInt32(&bm.stats.ValidBlocks, 1)
+	metricValidBlocks.Inc()
 	return nil
 }
 
@@ -1044,7 +1230,7 @@ type cachedList struct {
 // listIndexBlocksFromStorage returns the list of index blocks in the given storage.
 // The list of blocks is not guaranteed to be sorted.
 func listIndexBlocksFromStorage(ctx context.Context, st storage.Storage) ([]IndexInfo, error) {
-	snapshot, err := storage.ListAllBlocksConsistent(ctx, st, newIndexBlockPrefix, math.MaxInt32)
+	snapshot, err := storage.ListAllBlocksConsistent(ctx, st, IndexBlockPrefix, math.MaxInt32)
 	if err != nil {
 		return nil, err
 	}
@@ -1077,6 +1263,28 @@ func newManagerWithOptions(ctx context.Context, st storage.Storage, f Formatting
 		return nil, fmt.Errorf("unable to create block formatter: %v", err)
 	}
 
+	compressor, err := createCompressor(f)
+	if err != nil {
+		return nil, err
+	}
+
+	maxMetadataPackSize := f.MaxMetadataPackSize
+	if maxMetadataPackSize == 0 {
+		maxMetadataPackSize = defaultMaxMetadataPackSize
+	}
+	if maxMetadataPackSize > f.MaxPackSize {
+		maxMetadataPackSize = f.MaxPackSize
+	}
+
+	indexVersion := f.IndexVersion
+	if indexVersion == 0 {
+		indexVersion = packindex.DefaultVersion
+	}
+
+	if indexVersion != packindex.Version1 && indexVersion != packindex.Version2 {
+		return nil, fmt.Errorf("unsupported index version: %v", f.IndexVersion)
+	}
+
 	blockCache, err := newBlockCache(ctx, st, caching)
 	if err != nil {
 		return nil, fmt.Errorf("unable to initialize block cache: %v", err)
@@ -1097,7 +1305,9 @@ func newManagerWithOptions(ctx context.Context, st storage.Storage, f Formatting
 		timeNow:               timeNow,
 		flushPackIndexesAfter: timeNow().Add(flushPackIndexTimeout),
 		maxPackSize:           f.MaxPackSize,
+		maxMetadataPackSize:   maxMetadataPackSize,
 		formatter:             formatter,
+		compressor:            compressor,
 		currentPackItems:      make(map[string]Info),
 		packIndexBuilder:      packindex.NewBuilder(),
 		committedBlocks:       blockIndex,
@@ -1109,6 +1319,7 @@ func newManagerWithOptions(ctx context.Context, st storage.Storage, f Formatting
 		st:                    st,
 
 		writeFormatVersion:      int32(f.Version),
+		indexVersion:            indexVersion,
 		closed:                  make(chan struct{}),
 		checkInvariantsOnUnlock: os.Getenv("KOPIA_VERIFY_INVARIANTS") != "",
 	}
@@ -1130,3 +1341,16 @@ func createFormatter(f FormattingOptions) (Formatter, error) {
 
 	return sf(f)
 }
+
+func createCompressor(f FormattingOptions) (compression.Compressor, error) {
+	if f.Compression == "" || f.Compression == "none" {
+		return nil, nil
+	}
+
+	c := compression.Compressors[f.Compression]
+	if c == nil {
+		return nil, fmt.Errorf("unsupported compression: %v", f.Compression)
+	}
+
+	return c, nil
+}
@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"math/rand"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"testing"
@@ -702,7 +703,7 @@ func getIndexCount(d map[string][]byte) int {
 	var cnt int
 
 	for k := range d {
-		if strings.HasPrefix(k, newIndexBlockPrefix) {
+		if strings.HasPrefix(k, IndexBlockPrefix) {
 			cnt++
 		}
 	}
@@ -752,7 +753,7 @@ func verifyBlock(ctx context.Context, t *testing.T, bm *Manager, blockID string,
 		t.Errorf("error getting block info %q: %v", blockID, err)
 	}
 
-	if got, want := bi.Length, uint32(len(b)); got != want {
+	if got, want := bi.Length, int64(len(b)); got != want {
 		t.Errorf("invalid block size for %q: %v, wanted %v", blockID, got, want)
 	}
 
@@ -804,3 +805,483 @@ func dumpBlockManagerData(t *testing.T, data map[string][]byte) {
 		}
 	}
 }
+
+func TestBlockManagerCompression(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	keyTime := map[string]time.Time{}
+
+	newManager := func() *Manager {
+		st := storagetesting.NewMapStorage(data, keyTime, nil)
+		bm, err := newManagerWithOptions(ctx, st, FormattingOptions{
+			Version:     1,
+			BlockFormat: "TESTONLY_MD5",
+			MaxPackSize: maxPackSize,
+			Compression: "zstd",
+		}, CachingOptions{}, fakeTimeNowWithAutoAdvance(fakeTime, 1*time.Second))
+		if err != nil {
+			t.Fatalf("can't create block manager: %v", err)
+		}
+		bm.checkInvariantsOnUnlock = true
+		return bm
+	}
+
+	bm := newManager()
+	compressible := bytes.Repeat([]byte{1, 2, 3, 4}, 100)
+	incompressible := seededRandomData(10, 100)
+
+	compressibleID := writeBlockAndVerify(ctx, t, bm, compressible)
+	incompressibleID := writeBlockAndVerify(ctx, t, bm, incompressible)
+	if err := bm.Flush(ctx); err != nil {
+		t.Fatalf("unable to flush: %v", err)
+	}
+
+	bm = newManager()
+	verifyBlockManagerDataSet(ctx, t, bm, map[string][]byte{
+		compressibleID:   compressible,
+		incompressibleID: incompressible,
+	})
+
+	cases := []struct {
+		blockID       string
+		formatVersion byte
+		compressed    bool
+	}{
+		{compressibleID, compressedBlockFormatVersion, true},
+		{incompressibleID, 1, false},
+	}
+
+	for _, tc := range cases {
+		bi, err := bm.BlockInfo(ctx, tc.blockID)
+		if err != nil {
+			t.Fatalf("error getting block info %q: %v", tc.blockID, err)
+		}
+
+		if got, want := bi.FormatVersion, tc.formatVersion; got != want {
+			t.Errorf("invalid format version for %q: %v, want %v", tc.blockID, got, want)
+		}
+
+		if got, want := bi.Length < 100, tc.compressed; got != want {
+			t.Errorf("invalid stored length for %q: %v", tc.blockID, bi.Length)
+		}
+
+		wantPayloadLength := int64(100)
+		if tc.compressed {
+			wantPayloadLength = -1
+		}
+
+		if got := bm.PayloadLength(bi); got != wantPayloadLength {
+			t.Errorf("invalid payload length for %q: %v, want %v", tc.blockID, got, wantPayloadLength)
+		}
+	}
+}
+
+func TestBlockManagerUnsupportedCompression(t *testing.T) {
+	st := storagetesting.NewMapStorage(map[string][]byte{}, nil, nil)
+	_, err := newManagerWithOptions(context.Background(), st, FormattingOptions{
+		Version:     1,
+		BlockFormat: "TESTONLY_MD5",
+		MaxPackSize: maxPackSize,
+		Compression: "no-such-compression",
+	}, CachingOptions{}, time.Now)
+	if err == nil {
+		t.Errorf("expected error when using unsupported compression")
+	}
+}
+
+func TestAuthenticatedEncryptionFormats(t *testing.T) {
+	for _, format := range []string{
+		"ENCRYPTED_HMAC_SHA256_AES256_GCM",
+		"ENCRYPTED_HMAC_SHA256_XCHACHA20_POLY1305",
+		"ENCRYPTED_BLAKE2B_AES256_GCM",
+		"ENCRYPTED_BLAKE2B_XCHACHA20_POLY1305",
+	} {
+		t.Run(format, func(t *testing.T) {
+			verifyAuthenticatedEncryptionFormat(t, format)
+		})
+	}
+}
+
+func verifyAuthenticatedEncryptionFormat(t *testing.T, format string) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	keyTime := map[string]time.Time{}
+
+	newManager := func() *Manager {
+		st := storagetesting.NewMapStorage(data, keyTime, nil)
+		bm, err := newManagerWithOptions(ctx, st, FormattingOptions{
+			Version:     1,
+			BlockFormat: format,
+			HMACSecret:  []byte("foo"),
+			MasterKey:   []byte("0123456789abcdef0123456789abcdef"),
+			MaxPackSize: maxPackSize,
+			Compression: "zstd",
+		}, CachingOptions{}, fakeTimeNowWithAutoAdvance(fakeTime, 1*time.Second))
+		if err != nil {
+			t.Fatalf("can't create block manager: %v", err)
+		}
+		bm.checkInvariantsOnUnlock = true
+		return bm
+	}
+
+	bm := newManager()
+	dataSet := map[string][]byte{}
+	for _, b := range [][]byte{
+		bytes.Repeat([]byte{1, 2, 3, 4}, 100),
+		seededRandomData(10, 100),
+		seededRandomData(11, 5000),
+	} {
+		blockID, err := bm.WriteBlock(ctx, b, "")
+		if err != nil {
+			t.Fatalf("unable to write block: %v", err)
+		}
+		dataSet[blockID] = b
+	}
+
+	verifyBlockManagerDataSet(ctx, t, bm, dataSet)
+
+	if err := bm.Flush(ctx); err != nil {
+		t.Fatalf("unable to flush: %v", err)
+	}
+
+	bm = newManager()
+	verifyBlockManagerDataSet(ctx, t, bm, dataSet)
+
+	for blockID, b := range dataSet {
+		bi, err := bm.BlockInfo(ctx, blockID)
+		if err != nil {
+			t.Fatalf("error getting block info %q: %v", blockID, err)
+		}
+
+		want := int64(len(b))
+		if bi.FormatVersion == compressedBlockFormatVersion {
+			want = -1
+		}
+
+		if got := bm.PayloadLength(bi); got != want {
+			t.Errorf("invalid payload length of %q: %v, want %v", blockID, got, want)
+		}
+	}
+
+	var packFiles []string
+	for k := range data {
+		if strings.HasPrefix(k, PackBlockPrefix) {
+			packFiles = append(packFiles, k)
+		}
+	}
+
+	if len(packFiles) != 1 {
+		t.Fatalf("unexpected pack files: %v", packFiles)
+	}
+
+	packFile := packFiles[0]
+
+	recovered, err := bm.RecoverIndexFromPackFile(ctx, packFile, int64(len(data[packFile])), false)
+	if err != nil {
+		t.Fatalf("unable to recover index from pack: %v", err)
+	}
+
+	if len(recovered) != len(dataSet) {
+		t.Errorf("unexpected number of recovered blocks: %v, want %v", len(recovered), len(dataSet))
+	}
+
+	// flip a bit in each block stored in the pack, which must be detected when reading.
+	for blockID := range dataSet {
+		bi, err := bm.BlockInfo(ctx, blockID)
+		if err != nil {
+			t.Fatalf("unable to get block info for %v: %v", blockID, err)
+		}
+
+		data[packFile][bi.PackOffset+bi.Length/2] ^= 1
+	}
+
+	bm = newManager()
+	for blockID := range dataSet {
+		if _, err := bm.GetBlock(ctx, blockID); err == nil {
+			t.Errorf("tampered block %v was read successfully", blockID)
+		}
+	}
+}
+
+func TestBlockManagerIndexVersion2(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	keyTime := map[string]time.Time{}
+
+	newManager := func() *Manager {
+		st := storagetesting.NewMapStorage(data, keyTime, nil)
+		bm, err := newManagerWithOptions(ctx, st, FormattingOptions{
+			Version:      1,
+			BlockFormat:  "TESTONLY_MD5",
+			MaxPackSize:  maxPackSize,
+			Compression:  "zstd",
+			IndexVersion: packindex.Version2,
+		}, CachingOptions{}, fakeTimeNowWithAutoAdvance(fakeTime, 1*time.Second))
+		if err != nil {
+			t.Fatalf("can't create block manager: %v", err)
+		}
+		return bm
+	}
+
+	bm := newManager()
+	dataSet := map[string][]byte{}
+	for _, b := range [][]byte{
+		bytes.Repeat([]byte{1, 2, 3, 4}, 100),
+		seededRandomData(10, 100),
+	} {
+		blockID := writeBlockAndVerify(ctx, t, bm, b)
+		dataSet[blockID] = b
+	}
+
+	if err := bm.Flush(ctx); err != nil {
+		t.Fatalf("unable to flush: %v", err)
+	}
+
+	for k, v := range data {
+		if strings.HasPrefix(k, IndexBlockPrefix) && v[0] != packindex.Version2 {
+			t.Errorf("unexpected version of index %v: %v", k, v[0])
+		}
+	}
+
+	bm = newManager()
+	verifyBlockManagerDataSet(ctx, t, bm, dataSet)
+
+	for blockID, b := range dataSet {
+		bi, err := bm.BlockInfo(ctx, blockID)
+		if err != nil {
+			t.Fatalf("error getting block info %q: %v", blockID, err)
+		}
+
+		if bi.Checksum == 0 {
+			t.Errorf("missing checksum of %v", blockID)
+		}
+
+		if got, want := bi.Compressed, bi.FormatVersion == compressedBlockFormatVersion; got != want {
+			t.Errorf("invalid compressed flag of %v: %v, want %v", blockID, got, want)
+		}
+
+		// payload length of compressed blocks is known without reading them.
+		if got, want := bm.PayloadLength(bi), int64(len(b)); got != want {
+			t.Errorf("invalid payload length of %v: %v, want %v", blockID, got, want)
+		}
+
+		// unencrypted format, corruption is only detected by the checksum.
+		data[bi.PackFile][bi.PackOffset+bi.Length/2] ^= 1
+	}
+
+	bm = newManager()
+	for blockID := range dataSet {
+		if _, err := bm.GetBlock(ctx, blockID); err == nil {
+			t.Errorf("corrupted block %v was read successfully", blockID)
+		}
+	}
+}
+
+func TestBlockManagerSeparatesMetadataPacks(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	keyTime := map[string]time.Time{}
+	st := storagetesting.NewMapStorage(data, keyTime, nil)
+	bm, err := newManagerWithOptions(ctx, st, FormattingOptions{
+		Version:             1,
+		BlockFormat:         "TESTONLY_MD5",
+		MaxPackSize:         maxPackSize,
+		MaxMetadataPackSize: maxPackSize / 4,
+	}, CachingOptions{}, fakeTimeNowFrozen(fakeTime))
+	if err != nil {
+		t.Fatalf("can't create block manager: %v", err)
+	}
+
+	if got, want := bm.PackSizeLimit(MetadataPackBlockPrefix+"1234"), maxPackSize/4; got != want {
+		t.Errorf("invalid metadata pack size limit: %v, want %v", got, want)
+	}
+
+	dataSet := map[string][]byte{}
+	for i := 0; i < 10; i++ {
+		for _, prefix := range []string{"", "k", "m"} {
+			b := seededRandomData(i, 100)
+			blockID, err := bm.WriteBlock(ctx, b, prefix)
+			if err != nil {
+				t.Fatalf("unable to write block: %v", err)
+			}
+			dataSet[blockID] = b
+		}
+	}
+
+	// 2000 bytes of metadata blocks exceed the metadata pack size limit but data blocks don't.
+	packCount := map[string]int{}
+	for k := range data {
+		packCount[k[0:1]]++
+	}
+
+	if got, want := packCount[MetadataPackBlockPrefix], 4; got != want {
+		t.Errorf("unexpected number of metadata packs before flush: %v, want %v", got, want)
+	}
+
+	if got, want := packCount[PackBlockPrefix], 0; got != want {
+		t.Errorf("unexpected number of data packs before flush: %v, want %v", got, want)
+	}
+
+	if err := bm.Flush(ctx); err != nil {
+		t.Fatalf("unable to flush: %v", err)
+	}
+
+	bm = newTestBlockManager(data, keyTime, nil)
+	verifyBlockManagerDataSet(ctx, t, bm, dataSet)
+
+	for blockID := range dataSet {
+		bi, err := bm.BlockInfo(ctx, blockID)
+		if err != nil {
+			t.Fatalf("error getting block info %q: %v", blockID, err)
+		}
+
+		want := PackBlockPrefix
+		if blockID[0] == 'k' || blockID[0] == 'm' {
+			want = MetadataPackBlockPrefix
+		}
+
+		if !strings.HasPrefix(bi.PackFile, want) {
+			t.Errorf("block %v written to unexpected pack %v", blockID, bi.PackFile)
+		}
+	}
+
+	unused, err := bm.FindUnreferencedStorageFiles(ctx)
+	if err != nil {
+		t.Fatalf("unable to find unreferenced packs: %v", err)
+	}
+
+	if len(unused) != 0 {
+		t.Errorf("unexpected unreferenced packs: %v", unused)
+	}
+}
+
+func TestIterateBlockInfos(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	keyTime := map[string]time.Time{}
+	bm := newTestBlockManager(data, keyTime, nil)
+
+	var blockIDs []string
+	for i := 0; i < 10; i++ {
+		blockIDs = append(blockIDs, writeBlockAndVerify(ctx, t, bm, seededRandomData(i, 100)))
+	}
+
+	if err := bm.Flush(ctx); err != nil {
+		t.Fatalf("unable to flush: %v", err)
+	}
+
+	// pending changes supersede committed blocks.
+	for i := 10; i < 15; i++ {
+		blockIDs = append(blockIDs, writeBlockAndVerify(ctx, t, bm, seededRandomData(i, 100)))
+	}
+
+	if err := bm.DeleteBlock(blockIDs[0]); err != nil {
+		t.Fatalf("unable to delete block: %v", err)
+	}
+
+	var got []string
+	if err := bm.IterateBlockInfos("", true, func(i Info) error {
+		if i.Deleted != (i.BlockID == blockIDs[0]) {
+			t.Errorf("unexpected deleted flag of %v: %v", i.BlockID, i.Deleted)
+		}
+		got = append(got, i.BlockID)
+		return nil
+	}); err != nil {
+		t.Fatalf("iterate error: %v", err)
+	}
+
+	want := append([]string(nil), blockIDs...)
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected blocks: %v, want %v", got, want)
+	}
+
+	listed, err := bm.ListBlocks("")
+	if err != nil {
+		t.Fatalf("unable to list blocks: %v", err)
+	}
+
+	want = append([]string(nil), blockIDs[1:]...)
+	sort.Strings(want)
+	if !reflect.DeepEqual(listed, want) {
+		t.Errorf("unexpected blocks: %v, want %v", listed, want)
+	}
+
+	errStop := errors.New("stop")
+	var cnt int
+	if err := bm.IterateBlocks("", func(blockID string) error {
+		cnt++
+		if cnt == 3 {
+			return errStop
+		}
+		return nil
+	}); err != errStop {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if cnt != 3 {
+		t.Errorf("iteration not stopped, got %v blocks", cnt)
+	}
+}
+
+func TestBlockManagerIndexFlushWithPendingMetadataPack(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	keyTime := map[string]time.Time{}
+
+	now := fakeTime
+	bm := newTestBlockManager(data, keyTime, func() time.Time { return now })
+	dataSet := map[string][]byte{}
+
+	b := seededRandomData(0, 100)
+	blockID, err := bm.WriteBlock(ctx, b, "k")
+	if err != nil {
+		t.Fatalf("unable to write block: %v", err)
+	}
+	dataSet[blockID] = b
+
+	// data pack fills up after the index flush timeout, while the metadata block is still pending.
+	now = now.Add(flushPackIndexTimeout + time.Minute)
+	for i := 1; i <= 5; i++ {
+		dataSet[writeBlockAndVerify(ctx, t, bm, seededRandomData(i, 1000))] = seededRandomData(i, 1000)
+	}
+
+	if getIndexCount(data) == 0 {
+		t.Fatalf("index was not flushed")
+	}
+
+	if err := bm.Flush(ctx); err != nil {
+		t.Fatalf("unable to flush: %v", err)
+	}
+
+	verifyBlockManagerDataSet(ctx, t, newTestBlockManager(data, keyTime, nil), dataSet)
+}
+
+func TestPackBlockPostambleLargeOffsets(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	keyTime := map[string]time.Time{}
+	bm := newTestBlockManager(data, keyTime, nil)
+
+	postamble := packBlockPostamble{
+		localIndexIV:     []byte{1, 2, 3, 4},
+		localIndexOffset: 5<<30 + 10,
+		localIndexLength: 5,
+	}
+
+	b, err := postamble.toBytes()
+	if err != nil {
+		t.Fatalf("unable to encode postamble: %v", err)
+	}
+
+	pack := append(seededRandomData(1, 100), b...)
+	if pa := findPostamble(pack); pa == nil || !reflect.DeepEqual(*pa, postamble) {
+		t.Errorf("postamble did not round-trip: %+v, want %+v", pa, postamble)
+	}
+
+	// local index beyond the end of the pack file must not be read from the truncated offset.
+	data[PackBlockPrefix+"large"] = pack
+	if _, err := bm.RecoverIndexFromPackFile(ctx, PackBlockPrefix+"large", int64(len(pack)), false); err == nil {
+		t.Errorf("unexpected success recovering index from invalid pack")
+	}
+}
@@ -12,9 +12,17 @@ import (
 type committedBlockIndex struct {
 	cache committedBlockIndexCache
 
+	// maxDeltaIndexBlocks is the number of index blocks not in the merged base index
+	// above which a new base index is built.
+	maxDeltaIndexBlocks int
+
 	mu     sync.Mutex
-	inUse  map[string]packindex.Index
-	merged packindex.Merged
+	base   *mergedIndex               // merged index of most index blocks, may be nil
+	inUse  map[string]packindex.Index // index blocks not in the base index
+	merged packindex.Merged           // base index followed by inUse
+
+	iterating int               // number of listBlocks() calls in progress
+	retired   []packindex.Index // indexes replaced while iterating, closed when the last iteration completes
 }
 
 type committedBlockIndexCache interface {
@@ -22,6 +30,12 @@ type committedBlockIndexCache interface {
 	addBlockToCache(indexBlockID string, data []byte) error
 	openIndex(indexBlockID string) (packindex.Index, error)
 	expireUnused(used []string) error
+
+	addMergedIndexFile(name string, data []byte) error
+	readMergedIndexFile(name string) ([]byte, error)
+	openMergedIndexShard(name string) (packindex.Index, error)
+	listMergedIndexFiles() ([]string, error)
+	expireUnusedMergedIndexFiles(used []string) error
 }
 
 func (b *committedBlockIndex) getBlock(blockID string) (Info, error) {
@@ -50,7 +64,7 @@ func (b *committedBlockIndex) addBlock(indexBlockID string, data []byte, use boo
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	if b.inUse[indexBlockID] != nil {
+	if b.usesIndexBlock(indexBlockID) {
 		return nil
 	}
 
@@ -66,18 +80,56 @@ func (b *committedBlockIndex) addBlock(indexBlockID string, data []byte, use boo
 func (b *committedBlockIndex) listBlocks(prefix string, cb func(i Info) error) error {
 	b.mu.Lock()
 	m := append(packindex.Merged(nil), b.merged...)
+	b.iterating++
 	b.mu.Unlock()
 
+	defer func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		b.iterating--
+		if b.iterating == 0 {
+			b.closeRetiredLocked()
+		}
+	}()
+
 	return m.Iterate(prefix, cb)
 }
 
+// retireLocked closes indexes that are no longer in use, unless they may still be read by listBlocks().
+func (b *committedBlockIndex) retireLocked(indexes ...packindex.Index) {
+	b.retired = append(b.retired, indexes...)
+	if b.iterating == 0 {
+		b.closeRetiredLocked()
+	}
+}
+
+func (b *committedBlockIndex) closeRetiredLocked() {
+	for _, ndx := range b.retired {
+		if err := ndx.Close(); err != nil {
+			log.Warningf("unable to close index: %v", err)
+		}
+	}
+
+	b.retired = nil
+}
+
+func (b *committedBlockIndex) usesIndexBlock(indexBlockID string) bool {
+	return b.inUse[indexBlockID] != nil || (b.base != nil && b.base.sources[indexBlockID])
+}
+
 func (b *committedBlockIndex) packFilesChanged(packFiles []string) bool {
-	if len(packFiles) != len(b.inUse) {
+	cnt := len(b.inUse)
+	if b.base != nil {
+		cnt += len(b.base.sources)
+	}
+
+	if len(packFiles) != cnt {
 		return true
 	}
 
 	for _, packFile := range packFiles {
-		if b.inUse[packFile] == nil {
+		if !b.usesIndexBlock(packFile) {
 			return true
 		}
 	}
@@ -85,6 +137,8 @@ func (b *committedBlockIndex) packFilesChanged(packFiles []string) bool {
 	return false
 }
 
+// use switches to the provided set of index blocks. Index blocks already merged into a base index are not
+// opened again and when too many remain outside of it, they are merged into a new base index.
 func (b *committedBlockIndex) use(packFiles []string) (bool, error) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
@@ -94,13 +148,35 @@ func (b *committedBlockIndex) use(packFiles []string) (bool, error) {
 	}
 	log.Debugf("set of index files has changed (had %v, now %v)", len(b.inUse), len(packFiles))
 
+	wanted := map[string]bool{}
+	for _, e := range packFiles {
+		wanted[e] = true
+	}
+
+	base := b.base
+	if base == nil || !base.coveredBy(wanted) {
+		var err error
+		if base, err = findMergedIndex(b.cache, wanted); err != nil {
+			log.Warningf("unable to open merged index: %v", err)
+			base = nil
+		}
+	}
+
 	var newMerged packindex.Merged
 	newInUse := map[string]packindex.Index{}
 	defer func() {
+		// on error, close everything opened here.
 		newMerged.Close() //nolint:errcheck
+		if base != nil && base != b.base {
+			base.Close() //nolint:errcheck
+		}
 	}()
 
 	for _, e := range packFiles {
+		if base != nil && base.sources[e] {
+			continue
+		}
+
 		ndx, err := b.cache.openIndex(e)
 		if err != nil {
 			return false, fmt.Errorf("unable to open pack index %q: %v", e, err)
@@ -110,12 +186,54 @@ func (b *committedBlockIndex) use(packFiles []string) (bool, error) {
 		newMerged = append(newMerged, ndx)
 		newInUse[e] = ndx
 	}
-	b.merged = newMerged
+
+	if len(newInUse) > b.maxDeltaIndexBlocks {
+		nb, err := buildMergedIndex(b.cache, base, newInUse)
+		if err != nil {
+			// the index is still usable without the base index, just slower.
+			log.Warningf("unable to build merged index: %v", err)
+		} else {
+			// delta indexes and the intermediate base index have been folded into the new base index.
+			newMerged.Close() //nolint:errcheck
+			if base != nil && base != b.base {
+				base.Close() //nolint:errcheck
+			}
+
+			base = nb
+			newInUse = map[string]packindex.Index{}
+			newMerged = nil
+		}
+	}
+
+	var replaced []packindex.Index
+	for _, ndx := range b.inUse {
+		replaced = append(replaced, ndx)
+	}
+	if b.base != nil && b.base != base {
+		replaced = append(replaced, b.base)
+	}
+
+	b.base = base
 	b.inUse = newInUse
+	if base != nil {
+		b.merged = append(packindex.Merged{base}, newMerged...)
+	} else {
+		b.merged = newMerged
+	}
+	b.retireLocked(replaced...)
 
 	if err := b.cache.expireUnused(packFiles); err != nil {
 		log.Warningf("unable to expire unused block index files: %v", err)
 	}
+
+	var usedMergedFiles []string
+	if base != nil {
+		usedMergedFiles = base.manifest.fileNames()
+	}
+
+	if err := b.cache.expireUnusedMergedIndexFiles(usedMergedFiles); err != nil {
+		log.Warningf("unable to expire unused merged index files: %v", err)
+	}
 	newMerged = nil
 
 	return true, nil
@@ -134,7 +252,8 @@ func newCommittedBlockIndex(caching CachingOptions) (*committedBlockIndex, error
 	}
 
 	return &committedBlockIndex{
-		cache: cache,
-		inUse: map[string]packindex.Index{},
+		cache:               cache,
+		maxDeltaIndexBlocks: defaultMaxDeltaIndexBlocks,
+		inUse:               map[string]packindex.Index{},
 	}, nil
 }
@@ -133,3 +133,88 @@ func (c *diskCommittedBlockIndexCache) expireUnused(used []string) error {
 
 	return nil
 }
+
+func (c *diskCommittedBlockIndexCache) mergedIndexDir() string {
+	return filepath.Join(c.dirname, "merged")
+}
+
+func (c *diskCommittedBlockIndexCache) addMergedIndexFile(name string, data []byte) error {
+	fullpath := filepath.Join(c.mergedIndexDir(), name)
+	if _, err := os.Stat(fullpath); err == nil {
+		// file names are derived from contents, so existing file is identical.
+		return nil
+	}
+
+	tmpFile, err := writeTempFileAtomic(c.mergedIndexDir(), data)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpFile, fullpath); err != nil {
+		os.Remove(tmpFile) //nolint:errcheck
+		if _, err2 := os.Stat(fullpath); err2 != nil {
+			return fmt.Errorf("unsuccessful write of %q: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+func (c *diskCommittedBlockIndexCache) readMergedIndexFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(c.mergedIndexDir(), name))
+}
+
+func (c *diskCommittedBlockIndexCache) openMergedIndexShard(name string) (packindex.Index, error) {
+	f, err := mmap.Open(filepath.Join(c.mergedIndexDir(), name))
+	if err != nil {
+		return nil, err
+	}
+
+	return packindex.Open(f)
+}
+
+func (c *diskCommittedBlockIndexCache) listMergedIndexFiles() ([]string, error) {
+	entries, err := ioutil.ReadDir(c.mergedIndexDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't list merged indexes: %v", err)
+	}
+
+	var result []string
+	for _, ent := range entries {
+		result = append(result, ent.Name())
+	}
+
+	return result, nil
+}
+
+func (c *diskCommittedBlockIndexCache) expireUnusedMergedIndexFiles(used []string) error {
+	entries, err := ioutil.ReadDir(c.mergedIndexDir())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("can't list merged indexes: %v", err)
+	}
+
+	inUse := map[string]bool{}
+	for _, u := range used {
+		inUse[u] = true
+	}
+
+	for _, ent := range entries {
+		// merged indexes may be in use by other processes, so keep them for a while.
+		if inUse[ent.Name()] || time.Since(ent.ModTime()) <= unusedCommittedBlockIndexCleanupTime {
+			continue
+		}
+
+		log.Debugf("removing unused merged index file %v %v", ent.Name(), ent.ModTime())
+		if err := os.Remove(filepath.Join(c.mergedIndexDir(), ent.Name())); err != nil {
+			log.Warningf("unable to remove unused merged index file: %v", err)
+		}
+	}
+
+	return nil
+}
@@ -11,6 +11,7 @@ import (
 type memoryCommittedBlockIndexCache struct {
 	mu     sync.Mutex
 	blocks map[string]packindex.Index
+	merged map[string][]byte
 }
 
 func (m *memoryCommittedBlockIndexCache) hasIndexBlockID(indexBlockID string) (bool, error) {
@@ -48,3 +49,66 @@ func (m *memoryCommittedBlockIndexCache) openIndex(indexBlockID string) (packind
 func (m *memoryCommittedBlockIndexCache) expireUnused(used []string) error {
 	return nil
 }
+
+func (m *memoryCommittedBlockIndexCache) addMergedIndexFile(name string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.merged == nil {
+		m.merged = map[string][]byte{}
+	}
+
+	m.merged[name] = append([]byte(nil), data...)
+	return nil
+}
+
+func (m *memoryCommittedBlockIndexCache) readMergedIndexFile(name string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	v, ok := m.merged[name]
+	if !ok {
+		return nil, fmt.Errorf("merged index file not found in cache: %v", name)
+	}
+
+	return v, nil
+}
+
+func (m *memoryCommittedBlockIndexCache) openMergedIndexShard(name string) (packindex.Index, error) {
+	b, err := m.readMergedIndexFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return packindex.Open(bytes.NewReader(b))
+}
+
+func (m *memoryCommittedBlockIndexCache) listMergedIndexFiles() ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var result []string
+	for n := range m.merged {
+		result = append(result, n)
+	}
+
+	return result, nil
+}
+
+func (m *memoryCommittedBlockIndexCache) expireUnusedMergedIndexFiles(used []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	inUse := map[string]bool{}
+	for _, u := range used {
+		inUse[u] = true
+	}
+
+	for n := range m.merged {
+		if !inUse[n] {
+			delete(m.merged, n)
+		}
+	}
+
+	return nil
+}
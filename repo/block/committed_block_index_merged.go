@@ -0,0 +1,364 @@
+package block
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/kopia/kopia/internal/bloom"
+	"github.com/kopia/kopia/internal/packindex"
+)
+
+const (
+	defaultMaxDeltaIndexBlocks        = 16      // number of index blocks not in the merged index above which it's rebuilt
+	maxMergedIndexShardEntries        = 1 << 20 // approximate maximum number of entries in a single shard
+	mergedIndexBloomFalsePositiveRate = 0.01
+
+	mergedIndexManifestSuffix = ".mndx"
+	mergedIndexShardSuffix    = ".shard"
+	mergedIndexBloomSuffix    = ".bloom"
+)
+
+// mergedIndexManifest describes a merged index, which combines entries from a set of index blocks
+// into shards holding blocks whose IDs start with the same characters.
+type mergedIndexManifest struct {
+	Sources      []string           `json:"sources"`      // sorted IDs of index blocks merged into the index
+	PrefixLength int                `json:"prefixLength"` // number of leading characters of block IDs that select the shard
+	Shards       []mergedIndexShard `json:"shards"`       // sorted by prefix
+}
+
+// mergedIndexShard describes a single shard of the merged index, which is stored as a pack index
+// and a bloom filter of its block IDs.
+type mergedIndexShard struct {
+	Prefix     string `json:"prefix"`
+	Name       string `json:"name"` // derived from shard contents, so unchanged shards are shared between merged indexes
+	EntryCount int    `json:"entryCount"`
+}
+
+// fileName returns the name of the file holding the manifest, which is derived from its sources.
+func (m *mergedIndexManifest) fileName() string {
+	h := sha256.New()
+	for _, s := range m.Sources {
+		fmt.Fprintf(h, "%v\n", s)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)[0:16]) + mergedIndexManifestSuffix
+}
+
+// fileNames returns the names of all files that make up the merged index.
+func (m *mergedIndexManifest) fileNames() []string {
+	result := []string{m.fileName()}
+	for _, s := range m.Shards {
+		result = append(result, s.Name+mergedIndexShardSuffix, s.Name+mergedIndexBloomSuffix)
+	}
+
+	return result
+}
+
+// mergedIndex implements packindex.Index on top of the shards of a merged index.
+type mergedIndex struct {
+	manifest mergedIndexManifest
+	sources  map[string]bool
+	shards   map[string]packindex.Index
+	blooms   map[string]*bloom.Filter
+}
+
+func (m *mergedIndex) Close() error {
+	for _, s := range m.shards {
+		if err := s.Close(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *mergedIndex) EntryCount() int {
+	cnt := 0
+	for _, s := range m.manifest.Shards {
+		cnt += s.EntryCount
+	}
+
+	return cnt
+}
+
+func (m *mergedIndex) GetInfo(blockID string) (*Info, error) {
+	if len(blockID) < m.manifest.PrefixLength {
+		return nil, nil
+	}
+
+	prefix := blockID[0:m.manifest.PrefixLength]
+	if bf := m.blooms[prefix]; bf == nil || !bf.MayContain(blockID) {
+		return nil, nil
+	}
+
+	return m.shards[prefix].GetInfo(blockID)
+}
+
+func (m *mergedIndex) Iterate(prefix string, cb func(Info) error) error {
+	// shards are sorted by prefix and all blocks in a shard share it, so they are visited in order.
+	for _, s := range m.manifest.Shards {
+		if !strings.HasPrefix(s.Prefix, prefix) && !strings.HasPrefix(prefix, s.Prefix) {
+			continue
+		}
+
+		if err := m.shards[s.Prefix].Iterate(prefix, cb); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// coveredBy returns true if all index blocks merged into the index are in the provided set.
+func (m *mergedIndex) coveredBy(indexBlocks map[string]bool) bool {
+	for s := range m.sources {
+		if !indexBlocks[s] {
+			return false
+		}
+	}
+
+	return true
+}
+
+var _ packindex.Index = (*mergedIndex)(nil)
+
+// openMergedIndex opens all shards of the merged index described by the manifest.
+func openMergedIndex(cache committedBlockIndexCache, manifest mergedIndexManifest) (*mergedIndex, error) {
+	m := &mergedIndex{
+		manifest: manifest,
+		sources:  map[string]bool{},
+		shards:   map[string]packindex.Index{},
+		blooms:   map[string]*bloom.Filter{},
+	}
+
+	for _, s := range manifest.Sources {
+		m.sources[s] = true
+	}
+
+	for _, s := range manifest.Shards {
+		b, err := cache.readMergedIndexFile(s.Name + mergedIndexBloomSuffix)
+		if err != nil {
+			m.Close() //nolint:errcheck
+			return nil, fmt.Errorf("unable to read bloom filter of shard %q: %v", s.Prefix, err)
+		}
+
+		bf, err := bloom.FromBytes(b)
+		if err != nil {
+			m.Close() //nolint:errcheck
+			return nil, fmt.Errorf("invalid bloom filter of shard %q: %v", s.Prefix, err)
+		}
+
+		ndx, err := cache.openMergedIndexShard(s.Name + mergedIndexShardSuffix)
+		if err != nil {
+			m.Close() //nolint:errcheck
+			return nil, fmt.Errorf("unable to open shard %q: %v", s.Prefix, err)
+		}
+
+		m.shards[s.Prefix] = ndx
+		m.blooms[s.Prefix] = bf
+	}
+
+	return m, nil
+}
+
+// findMergedIndex returns the merged index in the cache with the most sources that are all in the provided set
+// or nil if there's none.
+func findMergedIndex(cache committedBlockIndexCache, indexBlocks map[string]bool) (*mergedIndex, error) {
+	names, err := cache.listMergedIndexFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	var best *mergedIndexManifest
+	for _, n := range names {
+		if !strings.HasSuffix(n, mergedIndexManifestSuffix) {
+			continue
+		}
+
+		b, err := cache.readMergedIndexFile(n)
+		if err != nil {
+			log.Warningf("unable to read merged index %v: %v", n, err)
+			continue
+		}
+
+		man := &mergedIndexManifest{}
+		if err := json.Unmarshal(b, man); err != nil {
+			log.Warningf("invalid merged index %v: %v", n, err)
+			continue
+		}
+
+		if !containsAll(indexBlocks, man.Sources) {
+			continue
+		}
+
+		if best == nil || len(man.Sources) > len(best.Sources) {
+			best = man
+		}
+	}
+
+	if best == nil {
+		return nil, nil
+	}
+
+	log.Debugf("using merged index of %v index blocks", len(best.Sources))
+	return openMergedIndex(cache, *best)
+}
+
+func containsAll(set map[string]bool, items []string) bool {
+	for _, it := range items {
+		if !set[it] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// shardPrefixLength returns the number of leading characters of block IDs that select the shard,
+// so that shards of the merged index with the given number of entries don't exceed maxMergedIndexShardEntries.
+func shardPrefixLength(entryCount int) int {
+	l := 1
+	for shards := 16; entryCount/shards > maxMergedIndexShardEntries; shards *= 16 {
+		l++
+	}
+
+	return l
+}
+
+// buildMergedIndex writes a new merged index to the cache, which combines entries of the (optional) base
+// merged index and delta indexes. Shards of the base index that don't have any entries in delta indexes are reused.
+func buildMergedIndex(cache committedBlockIndexCache, base *mergedIndex, deltas map[string]packindex.Index) (*mergedIndex, error) {
+	var manifest mergedIndexManifest
+
+	sources := map[string]bool{}
+	all := packindex.Merged{}
+	entryCount := 0
+
+	if base != nil {
+		all = append(all, base)
+		entryCount += base.EntryCount()
+		for s := range base.sources {
+			sources[s] = true
+		}
+	}
+
+	for indexBlockID, ndx := range deltas {
+		all = append(all, ndx)
+		entryCount += ndx.EntryCount()
+		sources[indexBlockID] = true
+	}
+
+	for s := range sources {
+		manifest.Sources = append(manifest.Sources, s)
+	}
+	sort.Strings(manifest.Sources)
+
+	manifest.PrefixLength = shardPrefixLength(entryCount)
+
+	baseShards := map[string]mergedIndexShard{}
+	if base != nil && base.manifest.PrefixLength == manifest.PrefixLength {
+		for _, s := range base.manifest.Shards {
+			baseShards[s.Prefix] = s
+		}
+	}
+
+	// find shards with new entries.
+	changed := map[string]bool{}
+	for _, ndx := range deltas {
+		if err := ndx.Iterate("", func(i Info) error {
+			if len(i.BlockID) >= manifest.PrefixLength {
+				changed[i.BlockID[0:manifest.PrefixLength]] = true
+			}
+			return nil
+		}); err != nil {
+			return nil, fmt.Errorf("unable to read index: %v", err)
+		}
+	}
+
+	if len(baseShards) == 0 && base != nil {
+		// shards of the base index can't be reused, rebuild all of them.
+		if err := base.Iterate("", func(i Info) error {
+			if len(i.BlockID) >= manifest.PrefixLength {
+				changed[i.BlockID[0:manifest.PrefixLength]] = true
+			}
+			return nil
+		}); err != nil {
+			return nil, fmt.Errorf("unable to read merged index: %v", err)
+		}
+	}
+
+	for prefix, s := range baseShards {
+		if !changed[prefix] {
+			manifest.Shards = append(manifest.Shards, s)
+		}
+	}
+
+	for prefix := range changed {
+		s, err := writeMergedIndexShard(cache, all, prefix)
+		if err != nil {
+			return nil, err
+		}
+
+		manifest.Shards = append(manifest.Shards, s)
+	}
+
+	sort.Slice(manifest.Shards, func(i, j int) bool {
+		return manifest.Shards[i].Prefix < manifest.Shards[j].Prefix
+	})
+
+	// manifest is written last, so that it only refers to complete shards.
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal merged index: %v", err)
+	}
+
+	if err := cache.addMergedIndexFile(manifest.fileName(), b); err != nil {
+		return nil, fmt.Errorf("unable to write merged index: %v", err)
+	}
+
+	log.Debugf("built merged index of %v index blocks with %v shards (%v rebuilt)", len(manifest.Sources), len(manifest.Shards), len(changed))
+	return openMergedIndex(cache, manifest)
+}
+
+// writeMergedIndexShard writes the shard with the given prefix, which combines entries from all provided indexes.
+func writeMergedIndexShard(cache committedBlockIndexCache, all packindex.Merged, prefix string) (mergedIndexShard, error) {
+	bld := packindex.NewBuilder()
+	if err := all.Iterate(prefix, func(i Info) error {
+		bld.Add(i)
+		return nil
+	}); err != nil {
+		return mergedIndexShard{}, fmt.Errorf("unable to merge indexes: %v", err)
+	}
+
+	bf := bloom.New(len(bld), mergedIndexBloomFalsePositiveRate)
+	for blockID := range bld {
+		bf.Add(blockID)
+	}
+
+	var buf bytes.Buffer
+	if err := bld.Build(&buf, packindex.Version2); err != nil {
+		return mergedIndexShard{}, fmt.Errorf("unable to build shard %q: %v", prefix, err)
+	}
+
+	h := sha256.Sum256(buf.Bytes())
+	s := mergedIndexShard{
+		Prefix:     prefix,
+		Name:       hex.EncodeToString(h[0:16]),
+		EntryCount: len(bld),
+	}
+
+	if err := cache.addMergedIndexFile(s.Name+mergedIndexShardSuffix, buf.Bytes()); err != nil {
+		return mergedIndexShard{}, fmt.Errorf("unable to write shard %q: %v", prefix, err)
+	}
+
+	if err := cache.addMergedIndexFile(s.Name+mergedIndexBloomSuffix, bf.Bytes()); err != nil {
+		return mergedIndexShard{}, fmt.Errorf("unable to write bloom filter of shard %q: %v", prefix, err)
+	}
+
+	return s, nil
+}
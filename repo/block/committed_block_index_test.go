@@ -0,0 +1,347 @@
+package block
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/kopia/kopia/internal/packindex"
+)
+
+// writeTestIndexBlocks creates index blocks, each of which adds new blocks and overwrites or deletes
+// some of the blocks from previous index blocks.
+func writeTestIndexBlocks(t *testing.T, count int) (map[string][]byte, []string) {
+	indexBlocks := map[string][]byte{}
+	var ids []string
+
+	for i := 0; i < count; i++ {
+		bld := packindex.NewBuilder()
+		for j := 0; j < 20; j++ {
+			bld.Add(Info{
+				BlockID:          md5hash(seededRandomData(i*20+j, 10)),
+				PackFile:         fmt.Sprintf("p%v", i),
+				PackOffset:       int64(j * 100),
+				Length:           100,
+				TimestampSeconds: int64(i),
+			})
+		}
+
+		if i > 0 {
+			// overwrite block from the previous index block and delete another one.
+			bld.Add(Info{
+				BlockID:          md5hash(seededRandomData((i-1)*20, 10)),
+				PackFile:         fmt.Sprintf("p%v", i),
+				PackOffset:       5000,
+				Length:           33,
+				TimestampSeconds: int64(i),
+			})
+			bld.Add(Info{
+				BlockID:          md5hash(seededRandomData((i-1)*20+1, 10)),
+				PackFile:         fmt.Sprintf("p%v", i-1),
+				PackOffset:       100,
+				Length:           100,
+				TimestampSeconds: int64(i),
+				Deleted:          true,
+			})
+		}
+
+		var buf bytes.Buffer
+		if err := bld.Build(&buf, packindex.Version1); err != nil {
+			t.Fatalf("unable to build index: %v", err)
+		}
+
+		id := fmt.Sprintf("%v%03d", IndexBlockPrefix, i)
+		indexBlocks[id] = buf.Bytes()
+		ids = append(ids, id)
+	}
+
+	return indexBlocks, ids
+}
+
+// verifyCommittedBlockIndex verifies that the committed index returns the same entries as the plain merge of index blocks.
+func verifyCommittedBlockIndex(t *testing.T, b *committedBlockIndex, indexBlocks map[string][]byte, ids []string) {
+	t.Helper()
+
+	var expected packindex.Merged
+	for _, id := range ids {
+		ndx, err := packindex.Open(bytes.NewReader(indexBlocks[id]))
+		if err != nil {
+			t.Fatalf("unable to open index: %v", err)
+		}
+		expected = append(expected, ndx)
+	}
+
+	var want, got []Info
+	if err := expected.Iterate("", func(i Info) error {
+		want = append(want, i)
+		return nil
+	}); err != nil {
+		t.Fatalf("iterate error: %v", err)
+	}
+
+	if err := b.listBlocks("", func(i Info) error {
+		got = append(got, i)
+		return nil
+	}); err != nil {
+		t.Fatalf("iterate error: %v", err)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected list of blocks: %v, want %v", got, want)
+	}
+
+	for _, i := range want {
+		bi, err := b.getBlock(i.BlockID)
+		if err != nil {
+			t.Errorf("unable to get block %v: %v", i.BlockID, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(bi, i) {
+			t.Errorf("unexpected info for %v: %+v, want %+v", i.BlockID, bi, i)
+		}
+	}
+
+	for _, prefix := range []string{"a", "0f", "zzz"} {
+		var gotPrefix, wantPrefix []Info
+		expected.Iterate(prefix, func(i Info) error { //nolint:errcheck
+			wantPrefix = append(wantPrefix, i)
+			return nil
+		})
+		b.listBlocks(prefix, func(i Info) error { //nolint:errcheck
+			gotPrefix = append(gotPrefix, i)
+			return nil
+		})
+
+		if !reflect.DeepEqual(gotPrefix, wantPrefix) {
+			t.Errorf("unexpected list of blocks with prefix %q: %v, want %v", prefix, gotPrefix, wantPrefix)
+		}
+	}
+
+	if _, err := b.getBlock("no-such-block"); err == nil {
+		t.Errorf("unexpected success getting non-existent block")
+	}
+}
+
+func useIndexBlocks(t *testing.T, b *committedBlockIndex, indexBlocks map[string][]byte, ids []string) {
+	t.Helper()
+
+	for _, id := range ids {
+		if err := b.addBlock(id, indexBlocks[id], false); err != nil {
+			t.Fatalf("unable to add index block: %v", err)
+		}
+	}
+
+	if _, err := b.use(ids); err != nil {
+		t.Fatalf("unable to use index blocks: %v", err)
+	}
+}
+
+func TestCommittedBlockIndexMerging(t *testing.T) {
+	indexBlocks, ids := writeTestIndexBlocks(t, 20)
+
+	b, err := newCommittedBlockIndex(CachingOptions{})
+	if err != nil {
+		t.Fatalf("unable to create committed index: %v", err)
+	}
+	b.maxDeltaIndexBlocks = 3
+
+	useIndexBlocks(t, b, indexBlocks, ids[0:3])
+	if b.base != nil {
+		t.Errorf("unexpected merged index for %v index blocks", len(b.inUse))
+	}
+	verifyCommittedBlockIndex(t, b, indexBlocks, ids[0:3])
+
+	for _, n := range []int{4, 6, 7, 12, 20} {
+		useIndexBlocks(t, b, indexBlocks, ids[0:n])
+		if b.base == nil {
+			t.Fatalf("merged index not built for %v index blocks", n)
+		}
+
+		if len(b.inUse) > b.maxDeltaIndexBlocks {
+			t.Errorf("too many index blocks outside of merged index: %v", len(b.inUse))
+		}
+
+		verifyCommittedBlockIndex(t, b, indexBlocks, ids[0:n])
+	}
+
+	// index blocks that are gone cause merged index to be rebuilt.
+	useIndexBlocks(t, b, indexBlocks, ids[1:20])
+	if b.base.sources[ids[0]] {
+		t.Errorf("merged index includes removed index block")
+	}
+	verifyCommittedBlockIndex(t, b, indexBlocks, ids[1:20])
+}
+
+func TestCommittedBlockIndexMergingReusesShards(t *testing.T) {
+	indexBlocks, ids := writeTestIndexBlocks(t, 10)
+
+	b, err := newCommittedBlockIndex(CachingOptions{})
+	if err != nil {
+		t.Fatalf("unable to create committed index: %v", err)
+	}
+	b.maxDeltaIndexBlocks = 0
+
+	useIndexBlocks(t, b, indexBlocks, ids[0:9])
+	oldShards := map[string]string{}
+	for _, s := range b.base.manifest.Shards {
+		oldShards[s.Prefix] = s.Name
+	}
+
+	useIndexBlocks(t, b, indexBlocks, ids[0:10])
+
+	changed := map[string]bool{}
+	ndx, _ := packindex.Open(bytes.NewReader(indexBlocks[ids[9]]))
+	ndx.Iterate("", func(i Info) error { //nolint:errcheck
+		changed[i.BlockID[0:b.base.manifest.PrefixLength]] = true
+		return nil
+	})
+
+	for _, s := range b.base.manifest.Shards {
+		if reused := oldShards[s.Prefix] == s.Name; reused == changed[s.Prefix] {
+			t.Errorf("unexpected reuse of shard %q: %v", s.Prefix, reused)
+		}
+	}
+
+	verifyCommittedBlockIndex(t, b, indexBlocks, ids[0:10])
+}
+
+func TestCommittedBlockIndexMergedOnDisk(t *testing.T) {
+	indexBlocks, ids := writeTestIndexBlocks(t, 10)
+
+	tmpDir, err := ioutil.TempDir("", "kopia")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	b, err := newCommittedBlockIndex(CachingOptions{CacheDirectory: tmpDir})
+	if err != nil {
+		t.Fatalf("unable to create committed index: %v", err)
+	}
+	b.maxDeltaIndexBlocks = 2
+	useIndexBlocks(t, b, indexBlocks, ids[0:8])
+	verifyCommittedBlockIndex(t, b, indexBlocks, ids[0:8])
+
+	// another instance reuses merged index persisted in the cache.
+	b2, err := newCommittedBlockIndex(CachingOptions{CacheDirectory: tmpDir})
+	if err != nil {
+		t.Fatalf("unable to create committed index: %v", err)
+	}
+	b2.maxDeltaIndexBlocks = 5
+	useIndexBlocks(t, b2, indexBlocks, ids[0:10])
+
+	if b2.base == nil || len(b2.base.sources) != 8 {
+		t.Fatalf("merged index not reused")
+	}
+
+	if got, want := len(b2.inUse), 2; got != want {
+		t.Errorf("unexpected number of index blocks outside of merged index: %v, want %v", got, want)
+	}
+
+	verifyCommittedBlockIndex(t, b2, indexBlocks, ids[0:10])
+}
+
+func TestShardPrefixLength(t *testing.T) {
+	cases := []struct {
+		entryCount int
+		want       int
+	}{
+		{0, 1},
+		{1000, 1},
+		{16 * maxMergedIndexShardEntries, 1},
+		{16*maxMergedIndexShardEntries + 16, 2},
+		{256*maxMergedIndexShardEntries + 256, 3},
+	}
+
+	for _, tc := range cases {
+		if got := shardPrefixLength(tc.entryCount); got != tc.want {
+			t.Errorf("invalid prefix length for %v entries: %v, want %v", tc.entryCount, got, tc.want)
+		}
+	}
+}
+
+// trackingIndexCache keeps track of indexes that have been opened and not closed.
+type trackingIndexCache struct {
+	committedBlockIndexCache
+	open map[*trackedIndex]bool
+}
+
+type trackedIndex struct {
+	packindex.Index
+	cache *trackingIndexCache
+}
+
+func (i *trackedIndex) Close() error {
+	if !i.cache.open[i] {
+		return fmt.Errorf("index closed twice")
+	}
+
+	delete(i.cache.open, i)
+	return nil
+}
+
+func (c *trackingIndexCache) track(ndx packindex.Index, err error) (packindex.Index, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	t := &trackedIndex{ndx, c}
+	c.open[t] = true
+	return t, nil
+}
+
+func (c *trackingIndexCache) openIndex(indexBlockID string) (packindex.Index, error) {
+	return c.track(c.committedBlockIndexCache.openIndex(indexBlockID))
+}
+
+func (c *trackingIndexCache) openMergedIndexShard(name string) (packindex.Index, error) {
+	return c.track(c.committedBlockIndexCache.openMergedIndexShard(name))
+}
+
+func TestCommittedBlockIndexClosesReplacedIndexes(t *testing.T) {
+	indexBlocks, ids := writeTestIndexBlocks(t, 10)
+
+	b, err := newCommittedBlockIndex(CachingOptions{})
+	if err != nil {
+		t.Fatalf("unable to create committed index: %v", err)
+	}
+
+	cache := &trackingIndexCache{b.cache, map[*trackedIndex]bool{}}
+	b.cache = cache
+	b.maxDeltaIndexBlocks = 2
+
+	for _, n := range []int{1, 2, 3, 5, 6, 10} {
+		useIndexBlocks(t, b, indexBlocks, ids[0:n])
+
+		// open indexes are the delta indexes and shards of the base index.
+		want := len(b.inUse)
+		if b.base != nil {
+			want += len(b.base.shards)
+		}
+
+		if got := len(cache.open); got != want {
+			t.Errorf("unexpected number of open indexes after using %v index blocks: %v, want %v", n, got, want)
+		}
+	}
+
+	// indexes replaced during iteration are closed after it completes.
+	if err := b.listBlocks("", func(i Info) error {
+		useIndexBlocks(t, b, indexBlocks, ids[1:10])
+		if len(cache.open) == len(b.base.shards) {
+			t.Errorf("indexes closed during iteration")
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("iterate error: %v", err)
+	}
+
+	if got, want := len(cache.open), len(b.base.shards)+len(b.inUse); got != want {
+		t.Errorf("unexpected number of open indexes after iteration: %v, want %v", got, want)
+	}
+
+	verifyCommittedBlockIndex(t, b, indexBlocks, ids[1:10])
+}
@@ -0,0 +1,41 @@
+package block
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics mirror Stats, but are process-wide and never reset.
+var (
+	metricBlockBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kopia_block_bytes_total",
+		Help: "Number of bytes processed by the block manager, by operation.",
+	}, []string{"operation"})
+
+	metricBlockCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kopia_block_count_total",
+		Help: "Number of blocks processed by the block manager, by operation.",
+	}, []string{"operation"})
+
+	metricBlockCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kopia_block_cache_lookups_total",
+		Help: "Number of block cache lookups, by result.",
+	}, []string{"result"})
+
+	metricReadBytes             = metricBlockBytes.WithLabelValues("read")
+	metricWrittenBytes          = metricBlockBytes.WithLabelValues("written")
+	metricHashedBytes           = metricBlockBytes.WithLabelValues("hashed")
+	metricEncryptedBytes        = metricBlockBytes.WithLabelValues("encrypted")
+	metricDecryptedBytes        = metricBlockBytes.WithLabelValues("decrypted")
+	metricCompressionSavedBytes = metricBlockBytes.WithLabelValues("compression_saved")
+
+	metricReadBlocks    = metricBlockCount.WithLabelValues("read")
+	metricWrittenBlocks = metricBlockCount.WithLabelValues("written")
+	metricHashedBlocks  = metricBlockCount.WithLabelValues("hashed")
+	metricValidBlocks   = metricBlockCount.WithLabelValues("valid")
+	metricInvalidBlocks = metricBlockCount.WithLabelValues("invalid")
+
+	metricCacheHits      = metricBlockCacheLookups.WithLabelValues("hit")
+	metricCacheMisses    = metricBlockCacheLookups.WithLabelValues("miss")
+	metricCacheMalformed = metricBlockCacheLookups.WithLabelValues("malformed")
+)
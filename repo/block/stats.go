@@ -10,6 +10,8 @@ type Stats struct {
 	EncryptedBytes int64 `json:"encryptedBytes,omitempty"`
 	HashedBytes    int64 `json:"hashedBytes,omitempty"`
 
+	CompressionSavedBytes int64 `json:"compressionSavedBytes,omitempty"` // number of bytes saved by compression
+
 	ReadBlocks    int32 `json:"readBlocks,omitempty"`
 	WrittenBlocks int32 `json:"writtenBlocks,omitempty"`
 	CheckedBlocks int32 `json:"checkedBlocks,omitempty"`
@@ -20,6 +20,9 @@ import (
 // ConnectOptions specifies options when persisting configuration to connect to a repository.
 type ConnectOptions struct {
 	block.CachingOptions
+
+	// EnableActions allows running actions defined in policies, which may be written by other users of the repository.
+	EnableActions bool
 }
 
 // Connect connects to the repository in the specified storage and persists the configuration and credentials in the file provided.
@@ -34,8 +37,11 @@ func Connect(ctx context.Context, configFile string, st storage.Storage, passwor
 		return err
 	}
 
+	ci := st.ConnectionInfo()
+
 	var lc config.LocalConfig
-	lc.Storage = st.ConnectionInfo()
+	lc.Storage = &ci
+	lc.EnableActions = opt.EnableActions
 
 	if err = setupCaching(configFile, &lc, opt.CachingOptions, f.UniqueID); err != nil {
 		return fmt.Errorf("unable to set up caching: %v", err)
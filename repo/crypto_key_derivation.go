@@ -14,14 +14,19 @@ import (
 const DefaultKeyDerivationAlgorithm = "scrypt-65536-8-1"
 
 func (f formatBlock) deriveMasterKeyFromPassword(password string) ([]byte, error) {
+	return f.deriveKeyFromPassword(password, f.UniqueID)
+}
+
+// deriveKeyFromPassword computes a key from the password and salt using the key derivation algorithm of the repository.
+func (f formatBlock) deriveKeyFromPassword(password string, salt []byte) ([]byte, error) {
 	const masterKeySize = 32
 
 	switch f.KeyDerivationAlgorithm {
 	case "pbkdf2-sha256-100000":
-		return pbkdf2.Key([]byte(password), f.UniqueID, 100000, masterKeySize, sha256.New), nil
+		return pbkdf2.Key([]byte(password), salt, 100000, masterKeySize, sha256.New), nil
 
 	case "scrypt-65536-8-1":
-		return scrypt.Key([]byte(password), f.UniqueID, 65536, 8, 1, masterKeySize)
+		return scrypt.Key([]byte(password), salt, 65536, 8, 1, masterKeySize)
 
 	default:
 		return nil, fmt.Errorf("unsupported key algorithm: %v", f.KeyDerivationAlgorithm)
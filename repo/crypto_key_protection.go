@@ -1 +1,299 @@
 package repo
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	repositoryKeySize  = 32
+	keyWrapSaltSize    = 32
+	keyFileSecretSize  = 32
+	keySlotIDSize      = 8
+	keyWrapAlgorithmV1 = "AES256_GCM_WRAP"
+)
+
+// KeySlotType describes the kind of credential protecting a key slot.
+type KeySlotType string
+
+// Supported key slot types.
+const (
+	KeySlotPassword KeySlotType = "password" // key-encryption key is derived from a password using the key derivation algorithm
+	KeySlotKeyFile  KeySlotType = "keyfile"  // key-encryption key is derived from a random secret stored in a key file
+)
+
+var (
+	purposeKeyWrap = []byte("KEYWRAP")
+	purposeKeyFile = []byte("KEYFILE")
+)
+
+// keySlot stores the repository key wrapped (encrypted) with a key-encryption key derived from a single credential.
+type keySlot struct {
+	ID         string      `json:"id"`
+	Label      string      `json:"label,omitempty"`
+	Type       KeySlotType `json:"type"`
+	Created    time.Time   `json:"created"`
+	Salt       []byte      `json:"salt"`
+	WrappedKey []byte      `json:"wrappedKey"`
+}
+
+// KeySlotInfo describes a single key slot.
+type KeySlotInfo struct {
+	ID      string      `json:"id"`
+	Label   string      `json:"label,omitempty"`
+	Type    KeySlotType `json:"type"`
+	Created time.Time   `json:"created"`
+}
+
+// NewKeyFileSecret returns new random secret suitable for storing in a key file.
+func NewKeyFileSecret() (string, error) {
+	b, err := secureRandomBytes(keyFileSecretSize)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// openRepositoryKey returns the key that protects the repository format and the ID of the key slot
+// that has been unlocked using the provided secret.
+//
+// Repositories created with key slots store a random repository key, wrapped separately by each
+// credential, which allows credentials to be added, changed and removed without re-encrypting
+// anything else. Legacy repositories use the key derived from the password directly.
+func (f *formatBlock) openRepositoryKey(secret string) ([]byte, string, error) {
+	if f.KeyWrapAlgorithm == "" {
+		key, err := f.deriveMasterKeyFromPassword(secret)
+		return key, "", err
+	}
+
+	// key file slots are cheap to try, so try them before slots requiring password-based key derivation.
+	for _, slotType := range []KeySlotType{KeySlotKeyFile, KeySlotPassword} {
+		for _, s := range f.KeySlots {
+			if s.Type != slotType {
+				continue
+			}
+
+			kek, err := f.deriveKeyEncryptionKey(s.Type, secret, s.Salt)
+			if err != nil {
+				return nil, "", err
+			}
+
+			if key, err := f.unwrapRepositoryKey(&s, kek); err == nil {
+				return key, s.ID, nil
+			}
+		}
+	}
+
+	return nil, "", fmt.Errorf("unable to unlock repository key, invalid password?")
+}
+
+// upgradeToKeySlots converts legacy format block to use key slots. The key previously derived from the password
+// becomes the repository key and is wrapped in a slot whose salt is the unique ID, so that the existing
+// password continues to work. Returns the ID of the slot.
+func (f *formatBlock) upgradeToKeySlots(masterKey []byte) (string, error) {
+	if f.KeyWrapAlgorithm != "" {
+		return "", fmt.Errorf("repository already uses key slots")
+	}
+
+	f.KeyWrapAlgorithm = keyWrapAlgorithmV1
+
+	s, err := f.newKeySlot(KeySlotPassword, "default", f.UniqueID)
+	if err != nil {
+		return "", err
+	}
+
+	if err := f.wrapRepositoryKey(s, masterKey, masterKey); err != nil {
+		return "", err
+	}
+
+	f.KeySlots = append(f.KeySlots, *s)
+	return s.ID, nil
+}
+
+// addKeySlot adds new slot protecting the repository key with the provided secret and returns its ID.
+func (f *formatBlock) addKeySlot(repositoryKey []byte, slotType KeySlotType, label, secret string) (string, error) {
+	salt, err := secureRandomBytes(keyWrapSaltSize)
+	if err != nil {
+		return "", err
+	}
+
+	s, err := f.newKeySlot(slotType, label, salt)
+	if err != nil {
+		return "", err
+	}
+
+	if err := f.rewrapKeySlot(s, repositoryKey, secret); err != nil {
+		return "", err
+	}
+
+	f.KeyWrapAlgorithm = keyWrapAlgorithmV1
+	f.KeySlots = append(f.KeySlots, *s)
+	return s.ID, nil
+}
+
+// changeKeySlotSecret re-wraps the repository key in a given slot using new secret and salt.
+func (f *formatBlock) changeKeySlotSecret(slotID string, repositoryKey []byte, secret string) error {
+	for i := range f.KeySlots {
+		if f.KeySlots[i].ID == slotID {
+			salt, err := secureRandomBytes(keyWrapSaltSize)
+			if err != nil {
+				return err
+			}
+
+			s := f.KeySlots[i]
+			s.Salt = salt
+			if err := f.rewrapKeySlot(&s, repositoryKey, secret); err != nil {
+				return err
+			}
+
+			f.KeySlots[i] = s
+			return nil
+		}
+	}
+
+	return fmt.Errorf("key slot %v not found", slotID)
+}
+
+// removeKeySlot removes a slot with a given ID.
+func (f *formatBlock) removeKeySlot(slotID string) error {
+	for i := range f.KeySlots {
+		if f.KeySlots[i].ID == slotID {
+			if len(f.KeySlots) == 1 {
+				return fmt.Errorf("can't remove the last key slot")
+			}
+
+			f.KeySlots = append(f.KeySlots[0:i:i], f.KeySlots[i+1:]...)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("key slot %v not found", slotID)
+}
+
+// hasKeySlot returns true if the format block has a slot with a given ID.
+func (f *formatBlock) hasKeySlot(slotID string) bool {
+	for _, s := range f.KeySlots {
+		if s.ID == slotID {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f *formatBlock) newKeySlot(slotType KeySlotType, label string, salt []byte) (*keySlot, error) {
+	id, err := secureRandomBytes(keySlotIDSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return &keySlot{
+		ID:      hex.EncodeToString(id),
+		Label:   label,
+		Type:    slotType,
+		Created: time.Now().UTC(),
+		Salt:    salt,
+	}, nil
+}
+
+func (f *formatBlock) rewrapKeySlot(s *keySlot, repositoryKey []byte, secret string) error {
+	kek, err := f.deriveKeyEncryptionKey(s.Type, secret, s.Salt)
+	if err != nil {
+		return err
+	}
+
+	return f.wrapRepositoryKey(s, repositoryKey, kek)
+}
+
+// deriveKeyEncryptionKey computes the key protecting a key slot of a given type.
+func (f *formatBlock) deriveKeyEncryptionKey(slotType KeySlotType, secret string, salt []byte) ([]byte, error) {
+	switch slotType {
+	case KeySlotPassword:
+		return f.deriveKeyFromPassword(secret, salt)
+
+	case KeySlotKeyFile:
+		// key file secrets are random and long enough not to require expensive key derivation.
+		return deriveKeyFromMasterKey([]byte(secret), salt, purposeKeyFile, 32), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported key slot type: %v", slotType)
+	}
+}
+
+func (f *formatBlock) wrapRepositoryKey(s *keySlot, repositoryKey, kek []byte) error {
+	aead, err := initKeyWrapCrypto(kek, s.Salt)
+	if err != nil {
+		return err
+	}
+
+	nonce, err := secureRandomBytes(aead.NonceSize())
+	if err != nil {
+		return err
+	}
+
+	s.WrappedKey = aead.Seal(nonce, nonce, repositoryKey, f.UniqueID)
+	return nil
+}
+
+func (f *formatBlock) unwrapRepositoryKey(s *keySlot, kek []byte) ([]byte, error) {
+	if f.KeyWrapAlgorithm != keyWrapAlgorithmV1 {
+		return nil, fmt.Errorf("unsupported key wrapping algorithm: %v", f.KeyWrapAlgorithm)
+	}
+
+	aead, err := initKeyWrapCrypto(kek, s.Salt)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(s.WrappedKey) < aead.NonceSize() {
+		return nil, fmt.Errorf("invalid wrapped key, too short")
+	}
+
+	nonce := s.WrappedKey[0:aead.NonceSize()]
+	payload := s.WrappedKey[aead.NonceSize():]
+
+	return aead.Open(nil, nonce, payload, f.UniqueID)
+}
+
+func (f *formatBlock) keySlotInfos() []KeySlotInfo {
+	var result []KeySlotInfo
+	for _, s := range f.KeySlots {
+		result = append(result, KeySlotInfo{
+			ID:      s.ID,
+			Label:   s.Label,
+			Type:    s.Type,
+			Created: s.Created,
+		})
+	}
+
+	return result
+}
+
+func initKeyWrapCrypto(kek, salt []byte) (cipher.AEAD, error) {
+	blk, err := aes.NewCipher(deriveKeyFromMasterKey(kek, salt, purposeKeyWrap, 32))
+	if err != nil {
+		return nil, fmt.Errorf("cannot create cipher: %v", err)
+	}
+
+	return cipher.NewGCM(blk)
+}
+
+func newRepositoryKey() ([]byte, error) {
+	return secureRandomBytes(repositoryKeySize)
+}
+
+func secureRandomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return nil, fmt.Errorf("unable to generate random bytes: %v", err)
+	}
+
+	return b, nil
+}
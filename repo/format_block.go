@@ -17,6 +17,14 @@ import (
 // FormatBlockID is the identifier of a storage block that describes repository format.
 const FormatBlockID = "kopia.repository"
 
+const (
+	// formatVersion is the version of format blocks of repositories storing their contents in generation zero.
+	formatVersion = "1"
+
+	// generationFormatVersion is the version of format blocks of repositories storing their contents in StorageGeneration.
+	generationFormatVersion = "2"
+)
+
 var (
 	purposeAESKey   = []byte("AES")
 	purposeAuthData = []byte("CHECKSUM")
@@ -30,10 +38,19 @@ type formatBlock struct {
 	UniqueID               []byte `json:"uniqueID"`
 	KeyDerivationAlgorithm string `json:"keyAlgo"`
 
+	// Random repository key wrapped separately with each credential.
+	// When not set, the key derived from the password is used directly.
+	KeyWrapAlgorithm string    `json:"keyWrap,omitempty"`
+	KeySlots         []keySlot `json:"keySlots,omitempty"`
+
 	Version              string                         `json:"version"`
 	EncryptionAlgorithm  string                         `json:"encryption"`
 	EncryptedFormatBytes []byte                         `json:"encryptedBlockFormat,omitempty"`
 	UnencryptedFormat    *config.RepositoryObjectFormat `json:"blockFormat,omitempty"`
+
+	// Generation of storage blocks holding repository contents, incremented by each format upgrade.
+	// Blocks of generations other than zero are stored with generationPrefix() and Version is generationFormatVersion.
+	StorageGeneration int `json:"storageGeneration,omitempty"`
 }
 
 // encryptedRepositoryConfig contains the configuration of repository that's persisted in encrypted format.
@@ -41,6 +58,15 @@ type encryptedRepositoryConfig struct {
 	Format config.RepositoryObjectFormat `json:"format"`
 }
 
+// generationPrefix returns the prefix of names of storage blocks that belong to a given generation.
+func generationPrefix(generation int) string {
+	if generation == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("g%v", generation)
+}
+
 func parseFormatBlock(b []byte) (*formatBlock, error) {
 	f := &formatBlock{}
 
@@ -48,6 +74,10 @@ func parseFormatBlock(b []byte) (*formatBlock, error) {
 		return nil, fmt.Errorf("invalid format block: %v", err)
 	}
 
+	if f.Version != formatVersion && f.Version != generationFormatVersion {
+		return nil, fmt.Errorf("unsupported repository format version: %v", f.Version)
+	}
+
 	return f, nil
 }
 
@@ -34,6 +34,8 @@ type NewRepositoryOptions struct {
 	BlockFormat         string // identifier of object format
 	ObjectHMACSecret    []byte // force the use of particular object HMAC secret
 	ObjectEncryptionKey []byte // force the use of particular object encryption key
+	Compression         string // compression algorithm applied to blocks before encryption (optional)
+	IndexVersion        int    // version of pack indexes (optional)
 
 	Splitter     string // splitter used to break objects into storage blocks
 	MinBlockSize int    // minimum block size used with dynamic splitter
@@ -60,11 +62,15 @@ func Initialize(ctx context.Context, st storage.Storage, opt *NewRepositoryOptio
 	}
 
 	format := formatBlockFromOptions(opt)
-	masterKey, err := format.deriveMasterKeyFromPassword(password)
+	masterKey, err := newRepositoryKey()
 	if err != nil {
 		return err
 	}
 
+	if _, err := format.addKeySlot(masterKey, KeySlotPassword, "default", password); err != nil {
+		return fmt.Errorf("unable to protect repository key: %v", err)
+	}
+
 	if err := encryptFormatBytes(format, repositoryObjectFormatFromOptions(opt), masterKey, format.UniqueID); err != nil {
 		return err
 	}
@@ -82,7 +88,7 @@ func formatBlockFromOptions(opt *NewRepositoryOptions) *formatBlock {
 		BuildInfo:              BuildInfo,
 		KeyDerivationAlgorithm: applyDefaultString(opt.KeyDerivationAlgorithm, DefaultKeyDerivationAlgorithm),
 		UniqueID:               applyDefaultRandomBytes(opt.UniqueID, 32),
-		Version:                "1",
+		Version:                formatVersion,
 		EncryptionAlgorithm:    applyDefaultString(opt.MetadataEncryptionAlgorithm, DefaultEncryptionAlgorithm),
 	}
 }
@@ -90,11 +96,13 @@ func formatBlockFromOptions(opt *NewRepositoryOptions) *formatBlock {
 func repositoryObjectFormatFromOptions(opt *NewRepositoryOptions) *config.RepositoryObjectFormat {
 	f := &config.RepositoryObjectFormat{
 		FormattingOptions: block.FormattingOptions{
-			Version:     1,
-			BlockFormat: applyDefaultString(opt.BlockFormat, block.DefaultFormat),
-			HMACSecret:  applyDefaultRandomBytes(opt.ObjectHMACSecret, 32),
-			MasterKey:   applyDefaultRandomBytes(opt.ObjectEncryptionKey, 32),
-			MaxPackSize: applyDefaultInt(opt.MaxBlockSize, 20<<20), // 20 MB
+			Version:      1,
+			BlockFormat:  applyDefaultString(opt.BlockFormat, block.DefaultFormat),
+			HMACSecret:   applyDefaultRandomBytes(opt.ObjectHMACSecret, 32),
+			MasterKey:    applyDefaultRandomBytes(opt.ObjectEncryptionKey, 32),
+			MaxPackSize:  applyDefaultInt(opt.MaxBlockSize, 20<<20), // 20 MB
+			Compression:  opt.Compression,
+			IndexVersion: opt.IndexVersion,
 		},
 		Splitter:     applyDefaultString(opt.Splitter, object.DefaultSplitter),
 		MaxBlockSize: applyDefaultInt(opt.MaxBlockSize, 20<<20), // 20MiB
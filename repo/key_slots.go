@@ -0,0 +1,137 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// KeySlots returns the list of key slots protecting the repository key.
+func (r *Repository) KeySlots() []KeySlotInfo {
+	if r.formatBlock == nil {
+		return nil
+	}
+
+	return r.formatBlock.keySlotInfos()
+}
+
+// CurrentKeySlotID returns the ID of the key slot that was used to open the repository,
+// or an empty string when the repository has not been upgraded to use key slots.
+func (r *Repository) CurrentKeySlotID() string {
+	return r.keySlotID
+}
+
+// AddKeySlot adds a new credential that can be used to open the repository and returns the ID of its slot.
+func (r *Repository) AddKeySlot(ctx context.Context, slotType KeySlotType, label, secret string) (string, error) {
+	var slotID string
+
+	err := r.updateFormatBlock(ctx, func(f *formatBlock, currentSlotID string) error {
+		var err error
+		slotID, err = f.addKeySlot(r.masterKey, slotType, label, secret)
+		return err
+	})
+
+	return slotID, err
+}
+
+// RemoveKeySlot removes the credential with a given slot ID.
+//
+// NOTE: Removing a slot prevents its credential from being used to open the repository, but cannot revoke
+// access from clients that have already obtained the repository key using it.
+func (r *Repository) RemoveKeySlot(ctx context.Context, slotID string) error {
+	return r.updateFormatBlock(ctx, func(f *formatBlock, currentSlotID string) error {
+		return f.removeKeySlot(slotID)
+	})
+}
+
+// ChangePassword changes the password protecting the key slot that was used to open the repository,
+// without re-encrypting any data.
+//
+// Repositories created before key slots were introduced are upgraded in place: the key previously derived
+// from the password becomes the repository key, which is then wrapped using the new password.
+func (r *Repository) ChangePassword(ctx context.Context, newPassword string) error {
+	return r.updateFormatBlock(ctx, func(f *formatBlock, currentSlotID string) error {
+		for _, s := range f.KeySlots {
+			if s.ID == currentSlotID && s.Type != KeySlotPassword {
+				return fmt.Errorf("repository was not opened using a password")
+			}
+		}
+
+		return f.changeKeySlotSecret(currentSlotID, r.masterKey, newPassword)
+	})
+}
+
+// updateFormatBlock applies the provided modification to the current format block read from the storage,
+// upgrading it to use key slots if necessary, and writes it back. The modification receives the ID of the
+// key slot used to open the repository.
+//
+// The format block is re-read rather than taken from the copy loaded when the repository was opened,
+// so that changes made by other clients since then (such as removed key slots) are not reverted.
+func (r *Repository) updateFormatBlock(ctx context.Context, modify func(f *formatBlock, currentSlotID string) error) error {
+	if r.formatBlock == nil {
+		return ErrRemoteRepository
+	}
+
+	original, err := r.rootStorage.GetBlock(ctx, FormatBlockID, 0, -1)
+	if err != nil {
+		return fmt.Errorf("unable to read format block: %v", err)
+	}
+
+	f, err := parseFormatBlock(original)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(f.UniqueID, r.formatBlock.UniqueID) {
+		return fmt.Errorf("repository has been replaced since it was opened")
+	}
+
+	if _, err := f.decryptFormatBytes(r.masterKey); err != nil {
+		return fmt.Errorf("unable to decrypt current format block: %v", err)
+	}
+
+	keySlotID := r.keySlotID
+	switch {
+	case f.KeyWrapAlgorithm == "":
+		if keySlotID, err = f.upgradeToKeySlots(r.masterKey); err != nil {
+			return fmt.Errorf("unable to upgrade repository to use key slots: %v", err)
+		}
+
+	case keySlotID == "":
+		return fmt.Errorf("repository has been upgraded to use key slots by another client, connect to it again")
+
+	case !f.hasKeySlot(keySlotID):
+		return fmt.Errorf("key slot used to open the repository has been removed")
+	}
+
+	if err := modify(f, keySlotID); err != nil {
+		return err
+	}
+
+	// storage does not support conditional writes, this narrows the window for losing concurrent changes.
+	current, err := r.rootStorage.GetBlock(ctx, FormatBlockID, 0, -1)
+	if err != nil {
+		return fmt.Errorf("unable to read format block: %v", err)
+	}
+
+	if !bytes.Equal(current, original) {
+		return fmt.Errorf("format block was modified concurrently, try again")
+	}
+
+	if err := writeFormatBlock(ctx, r.rootStorage, f); err != nil {
+		return err
+	}
+
+	if r.CacheDirectory != "" {
+		// remove cached copy of the format block, it will be re-populated on next open.
+		if err := os.Remove(filepath.Join(r.CacheDirectory, FormatBlockID)); err != nil && !os.IsNotExist(err) {
+			log.Warningf("unable to remove cached format block: %v", err)
+		}
+	}
+
+	r.formatBlock = f
+	r.keySlotID = keySlotID
+	return nil
+}
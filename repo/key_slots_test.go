@@ -0,0 +1,276 @@
+package repo
+
+import (
+	"context"
+	"testing"
+
+	"github.com/kopia/kopia/internal/config"
+	"github.com/kopia/kopia/repo/block"
+	"github.com/kopia/kopia/repo/internal/storagetesting"
+	"github.com/kopia/kopia/repo/object"
+	"github.com/kopia/kopia/repo/storage"
+)
+
+// overwritingStorage allows the format block to be replaced, which map storage does not support.
+type overwritingStorage struct {
+	storage.Storage
+}
+
+func (s overwritingStorage) PutBlock(ctx context.Context, id string, data []byte) error {
+	if err := s.Storage.DeleteBlock(ctx, id); err != nil && err != storage.ErrBlockNotFound {
+		return err
+	}
+
+	return s.Storage.PutBlock(ctx, id, data)
+}
+
+func setupPasswordTest(t *testing.T) (storage.Storage, *Repository) {
+	st := overwritingStorage{storagetesting.NewMapStorage(map[string][]byte{}, nil, nil)}
+
+	if err := Initialize(context.Background(), st, &NewRepositoryOptions{
+		BlockFormat:            "TESTONLY_MD5",
+		KeyDerivationAlgorithm: "pbkdf2-sha256-100000",
+	}, masterPassword); err != nil {
+		t.Fatalf("unable to initialize repository: %v", err)
+	}
+
+	return st, mustConnect(t, st, masterPassword)
+}
+
+func TestChangePassword(t *testing.T) {
+	st, r := setupPasswordTest(t)
+	verifyChangePassword(t, st, r)
+}
+
+func TestChangePasswordUpgradesLegacyFormat(t *testing.T) {
+	ctx := context.Background()
+	st, r := setupPasswordTest(t)
+
+	// rewrite the format block the way it was stored before key wrapping was introduced.
+	f := *r.formatBlock
+	repoConfig, err := f.decryptFormatBytes(r.masterKey)
+	if err != nil {
+		t.Fatalf("unable to decrypt format: %v", err)
+	}
+
+	legacyKey, err := f.deriveMasterKeyFromPassword(masterPassword)
+	if err != nil {
+		t.Fatalf("unable to derive key: %v", err)
+	}
+
+	f.KeyWrapAlgorithm = ""
+	f.KeySlots = nil
+	if err = encryptFormatBytes(&f, repoConfig, legacyKey, f.UniqueID); err != nil {
+		t.Fatalf("unable to encrypt format: %v", err)
+	}
+
+	if err = writeFormatBlock(ctx, st, &f); err != nil {
+		t.Fatalf("unable to write format block: %v", err)
+	}
+
+	legacy := mustConnect(t, st, masterPassword)
+	if legacy.formatBlock.KeyWrapAlgorithm != "" {
+		t.Fatalf("expected legacy format block")
+	}
+
+	verifyChangePassword(t, st, legacy)
+}
+
+func verifyChangePassword(t *testing.T, st storage.Storage, r *Repository) {
+	ctx := context.Background()
+
+	w := r.Objects.NewWriter(ctx, object.WriterOptions{})
+	w.Write([]byte("hello world")) //nolint:errcheck
+	oid, err := w.Result()
+	if err != nil {
+		t.Fatalf("unable to write object: %v", err)
+	}
+
+	if err = r.Close(ctx); err != nil {
+		t.Fatalf("unable to close repository: %v", err)
+	}
+
+	const newPassword = "new-password-new-password"
+
+	if err = r.ChangePassword(ctx, newPassword); err != nil {
+		t.Fatalf("unable to change password: %v", err)
+	}
+
+	if _, err = connect(ctx, st, &config.LocalConfig{}, masterPassword, &Options{}, block.CachingOptions{}); err == nil {
+		t.Errorf("expected error when connecting using old password")
+	}
+
+	r2 := mustConnect(t, st, newPassword)
+	if r2.formatBlock.KeyWrapAlgorithm != keyWrapAlgorithmV1 {
+		t.Errorf("unexpected key wrapping algorithm: %v", r2.formatBlock.KeyWrapAlgorithm)
+	}
+
+	if _, _, err := r2.Objects.VerifyObject(ctx, oid); err != nil {
+		t.Errorf("unable to verify object after password change: %v", err)
+	}
+}
+
+func mustConnect(t *testing.T, st storage.Storage, password string) *Repository {
+	t.Helper()
+
+	r, err := connect(context.Background(), st, &config.LocalConfig{}, password, &Options{}, block.CachingOptions{})
+	if err != nil {
+		t.Fatalf("can't connect: %v", err)
+	}
+
+	return r
+}
+
+func TestKeySlots(t *testing.T) {
+	ctx := context.Background()
+	st, r := setupPasswordTest(t)
+
+	if got, want := len(r.KeySlots()), 1; got != want {
+		t.Fatalf("unexpected number of key slots: %v, want %v", got, want)
+	}
+
+	const otherPassword = "other-password-other-password"
+
+	passwordSlot, err := r.AddKeySlot(ctx, KeySlotPassword, "laptop", otherPassword)
+	if err != nil {
+		t.Fatalf("unable to add password slot: %v", err)
+	}
+
+	keyFileSecret, err := NewKeyFileSecret()
+	if err != nil {
+		t.Fatalf("unable to generate key file secret: %v", err)
+	}
+
+	keyFileSlot, err := r.AddKeySlot(ctx, KeySlotKeyFile, "server", keyFileSecret)
+	if err != nil {
+		t.Fatalf("unable to add key file slot: %v", err)
+	}
+
+	if got, want := len(r.KeySlots()), 3; got != want {
+		t.Fatalf("unexpected number of key slots: %v, want %v", got, want)
+	}
+
+	for secret, wantSlot := range map[string]string{
+		masterPassword: r.CurrentKeySlotID(),
+		otherPassword:  passwordSlot,
+		keyFileSecret:  keyFileSlot,
+	} {
+		if got := mustConnect(t, st, secret).CurrentKeySlotID(); got != wantSlot {
+			t.Errorf("opened using unexpected slot %v, want %v", got, wantSlot)
+		}
+	}
+
+	if err = r.RemoveKeySlot(ctx, passwordSlot); err != nil {
+		t.Fatalf("unable to remove key slot: %v", err)
+	}
+
+	if _, err = connect(ctx, st, &config.LocalConfig{}, otherPassword, &Options{}, block.CachingOptions{}); err == nil {
+		t.Errorf("expected error when connecting using removed credential")
+	}
+
+	r2 := mustConnect(t, st, keyFileSecret)
+	if err = r2.ChangePassword(ctx, "foo"); err == nil {
+		t.Errorf("expected error when changing password of key file slot")
+	}
+
+	if err = r2.RemoveKeySlot(ctx, r.CurrentKeySlotID()); err != nil {
+		t.Fatalf("unable to remove key slot: %v", err)
+	}
+
+	if err = r2.RemoveKeySlot(ctx, keyFileSlot); err == nil {
+		t.Errorf("expected error when removing the last key slot")
+	}
+}
+
+func TestKeySlotRemovalIsNotReverted(t *testing.T) {
+	ctx := context.Background()
+	st, r := setupPasswordTest(t)
+
+	const otherPassword = "other-password-other-password"
+
+	revokedSlot, err := r.AddKeySlot(ctx, KeySlotPassword, "stolen laptop", otherPassword)
+	if err != nil {
+		t.Fatalf("unable to add password slot: %v", err)
+	}
+
+	// long-running client opened before the slot was removed by another one.
+	longRunning := mustConnect(t, st, masterPassword)
+	if err = mustConnect(t, st, masterPassword).RemoveKeySlot(ctx, revokedSlot); err != nil {
+		t.Fatalf("unable to remove key slot: %v", err)
+	}
+
+	if _, err = longRunning.AddKeySlot(ctx, KeySlotPassword, "new laptop", "new-password-new-password"); err != nil {
+		t.Fatalf("unable to add password slot: %v", err)
+	}
+
+	if _, err = connect(ctx, st, &config.LocalConfig{}, otherPassword, &Options{}, block.CachingOptions{}); err == nil {
+		t.Errorf("removed key slot was restored")
+	}
+
+	for _, s := range longRunning.KeySlots() {
+		if s.ID == revokedSlot {
+			t.Errorf("removed key slot is still listed")
+		}
+	}
+
+	// client that opened the repository using the removed slot can't modify it.
+	revoked := mustConnect(t, st, "new-password-new-password")
+	if err = longRunning.RemoveKeySlot(ctx, revoked.CurrentKeySlotID()); err != nil {
+		t.Fatalf("unable to remove key slot: %v", err)
+	}
+
+	if _, err = revoked.AddKeySlot(ctx, KeySlotPassword, "backdoor", otherPassword); err == nil {
+		t.Errorf("expected error when modifying key slots using a removed slot")
+	}
+}
+
+// changingStorage modifies the format block after it has been read a given number of times.
+type changingStorage struct {
+	overwritingStorage
+	reads    *int
+	changeAt int
+}
+
+func (s changingStorage) GetBlock(ctx context.Context, id string, offset, length int64) ([]byte, error) {
+	b, err := s.overwritingStorage.GetBlock(ctx, id, offset, length)
+	if err != nil || id != FormatBlockID {
+		return b, err
+	}
+
+	*s.reads++
+	if *s.reads == s.changeAt {
+		f, err := parseFormatBlock(b)
+		if err != nil {
+			return nil, err
+		}
+
+		f.BuildInfo = "changed by another client"
+		if err := writeFormatBlock(ctx, s.overwritingStorage, f); err != nil {
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
+
+func TestKeySlotsConcurrentModification(t *testing.T) {
+	ctx := context.Background()
+	st, _ := setupPasswordTest(t)
+
+	reads := 0
+	r := mustConnect(t, st, masterPassword)
+	r.rootStorage = changingStorage{st.(overwritingStorage), &reads, 1}
+
+	if _, err := r.AddKeySlot(ctx, KeySlotPassword, "laptop", "other-password-other-password"); err == nil {
+		t.Errorf("expected error when format block was modified concurrently")
+	}
+
+	f, err := readAndCacheFormatBlock(ctx, st, "")
+	if err != nil {
+		t.Fatalf("unable to read format block: %v", err)
+	}
+
+	if f.BuildInfo != "changed by another client" || len(f.KeySlots) != 1 {
+		t.Errorf("concurrent modification was overwritten: %+v", f)
+	}
+}
@@ -24,7 +24,8 @@ var log = kopialogging.Logger("kopia/manifest")
 // ErrNotFound is returned when the metadata item is not found.
 var ErrNotFound = errors.New("not found")
 
-const manifestBlockPrefix = "m"
+// BlockPrefix is the prefix of all blocks that store manifests.
+const BlockPrefix = "m"
 const autoCompactionBlockCount = 16
 
 // Manager organizes JSON manifests of various kinds, including snapshot manifests
@@ -149,7 +150,7 @@ func (m *Manager) Find(ctx context.Context, labels map[string]string) ([]*EntryM
 
 	var matches []*EntryMetadata
 	for _, e := range m.pendingEntries {
-		if matchesLabels(e.Labels, labels) {
+		if !e.Deleted && matchesLabels(e.Labels, labels) {
 			matches = append(matches, cloneEntryMetadata(e))
 		}
 	}
@@ -159,7 +160,8 @@ func (m *Manager) Find(ctx context.Context, labels map[string]string) ([]*EntryM
 			continue
 		}
 
-		if matchesLabels(e.Labels, labels) {
+		// deletions remain committed until the manifests are reloaded.
+		if !e.Deleted && matchesLabels(e.Labels, labels) {
 			matches = append(matches, cloneEntryMetadata(e))
 		}
 	}
@@ -223,7 +225,7 @@ func (m *Manager) flushPendingEntriesLocked(ctx context.Context) (string, error)
 		return "", fmt.Errorf("unable to close: %v", err)
 	}
 
-	blockID, err := m.b.WriteBlock(ctx, buf.Bytes(), manifestBlockPrefix)
+	blockID, err := m.b.WriteBlock(ctx, buf.Bytes(), BlockPrefix)
 	if err != nil {
 		return "", err
 	}
@@ -240,6 +242,9 @@ func (m *Manager) flushPendingEntriesLocked(ctx context.Context) (string, error)
 
 // Delete marks the specified manifest ID for deletion.
 func (m *Manager) Delete(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	if m.pendingEntries[id] == nil && m.committedEntries[id] == nil {
 		return
 	}
@@ -262,7 +267,7 @@ func (m *Manager) Refresh(ctx context.Context) error {
 func (m *Manager) loadCommittedBlocksLocked(ctx context.Context) error {
 	log.Debugf("listing manifest blocks")
 	for {
-		blocks, err := m.b.ListBlocks(manifestBlockPrefix)
+		blocks, err := m.b.ListBlocks(BlockPrefix)
 		if err != nil {
 			return fmt.Errorf("unable to list manifest blocks: %v", err)
 		}
@@ -87,8 +87,10 @@ func TestManifest(t *testing.T) {
 	time.Sleep(1 * time.Second)
 	mgr.Delete(id3)
 	verifyItemNotFound(ctx, t, mgr, id3)
+	verifyMatches(ctx, t, mgr, nil, []string{id1, id2})
 	mgr.Flush(ctx)
 	verifyItemNotFound(ctx, t, mgr, id3)
+	verifyMatches(ctx, t, mgr, nil, []string{id1, id2})
 
 	// still found in another
 	verifyItem(ctx, t, mgr2, id3, labels3, item3)
@@ -100,7 +102,7 @@ func TestManifest(t *testing.T) {
 		t.Errorf("can't compact: %v", err)
 	}
 
-	blks, err := mgr.b.ListBlocks(manifestBlockPrefix)
+	blks, err := mgr.b.ListBlocks(BlockPrefix)
 	if err != nil {
 		t.Errorf("unable to list manifest blocks: %v", err)
 	}
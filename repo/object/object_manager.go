@@ -28,6 +28,12 @@ type blockManager interface {
 	WriteBlock(ctx context.Context, data []byte, prefix string) (string, error)
 }
 
+// payloadLengthGetter is implemented by block managers storing blocks whose length differs from the length of their contents.
+type payloadLengthGetter interface {
+	// PayloadLength returns the length of contents of the block or -1 if the block must be read to determine it.
+	PayloadLength(bi block.Info) int64
+}
+
 // Manager implements a content-addressable storage on top of blob storage.
 type Manager struct {
 	Format config.RepositoryObjectFormat
@@ -155,13 +161,33 @@ func (om *Manager) verifyObjectInternal(ctx context.Context, oid ID, blocks *blo
 			return 0, err
 		}
 		blocks.addBlock(blockID)
-		return int64(p.Length), nil
+		return om.blockPayloadLength(ctx, blockID, p)
 	}
 
 	return 0, fmt.Errorf("unrecognized object type: %v", oid)
 
 }
 
+// blockPayloadLength returns the length of contents of a given block, which is read when its length
+// can't be determined from block info.
+func (om *Manager) blockPayloadLength(ctx context.Context, blockID string, bi block.Info) (int64, error) {
+	pl, ok := om.blockMgr.(payloadLengthGetter)
+	if !ok {
+		return int64(bi.Length), nil
+	}
+
+	if l := pl.PayloadLength(bi); l >= 0 {
+		return l, nil
+	}
+
+	b, err := om.blockMgr.GetBlock(ctx, blockID)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(len(b)), nil
+}
+
 // Flush closes any pending pack files. Once this method returns, ObjectIDs returned by ObjectManager are
 // ok to be used.
 func (om *Manager) Flush(ctx context.Context) error {
@@ -55,7 +55,7 @@ func (f *fakeBlockManager) BlockInfo(ctx context.Context, blockID string) (block
 	defer f.mu.Unlock()
 
 	if d, ok := f.data[blockID]; ok {
-		return block.Info{BlockID: blockID, Length: uint32(len(d))}, nil
+		return block.Info{BlockID: blockID, Length: int64(len(d))}, nil
 	}
 
 	return block.Info{}, storage.ErrBlockNotFound
@@ -229,6 +229,65 @@ func TestIndirection(t *testing.T) {
 	}
 }
 
+// compressingBlockManager reports blocks as stored in a compressed form, whose length differs from the length of contents.
+type compressingBlockManager struct {
+	*fakeBlockManager
+}
+
+func (f compressingBlockManager) BlockInfo(ctx context.Context, blockID string) (block.Info, error) {
+	bi, err := f.fakeBlockManager.BlockInfo(ctx, blockID)
+	bi.Length /= 2
+	return bi, err
+}
+
+func (f compressingBlockManager) PayloadLength(bi block.Info) int64 {
+	return -1
+}
+
+func TestVerifyObjectWithCompressedBlocks(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	om, err := NewObjectManager(ctx, compressingBlockManager{&fakeBlockManager{data: data}}, config.RepositoryObjectFormat{
+		FormattingOptions: block.FormattingOptions{
+			Version: 1,
+		},
+		MaxBlockSize: 200,
+		Splitter:     "FIXED",
+	}, ManagerOptions{})
+	if err != nil {
+		t.Fatalf("can't create object manager: %v", err)
+	}
+
+	contentBytes := make([]byte, 1000)
+	writer := om.NewWriter(ctx, WriterOptions{})
+	writer.Write(contentBytes) //nolint:errcheck
+	result, err := writer.Result()
+	if err != nil {
+		t.Fatalf("error getting writer results: %v", err)
+	}
+
+	l, _, err := om.VerifyObject(ctx, result)
+	if err != nil {
+		t.Fatalf("error verifying %q: %v", result, err)
+	}
+
+	if got, want := int(l), len(contentBytes); got != want {
+		t.Errorf("got invalid byte count for %q: %v, wanted %v", result, got, want)
+	}
+
+	// truncate one of the data blocks, which is only detected by reading it.
+	for blockID, b := range data {
+		if b[0] == 0 {
+			data[blockID] = b[1:]
+			break
+		}
+	}
+
+	if _, _, err := om.VerifyObject(ctx, result); err == nil {
+		t.Errorf("expected error verifying %q with truncated block", result)
+	}
+}
+
 func indirectionLevel(oid ID) int {
 	indexObjectID, ok := oid.IndexObjectID()
 	if !ok {
@@ -358,3 +417,63 @@ func verify(ctx context.Context, t *testing.T, om *Manager, objectID ID, expecte
 		}
 	}
 }
+
+func TestRewriteObject(t *testing.T) {
+	ctx := context.Background()
+	_, src := setupTest(t)
+	dstData, dst := setupTest(t)
+
+	for _, dataLength := range []int{100, 250, 10000} {
+		contentBytes := make([]byte, dataLength)
+		cryptorand.Read(contentBytes) //nolint:errcheck
+
+		writer := src.NewWriter(ctx, WriterOptions{})
+		writer.Write(contentBytes) //nolint:errcheck
+		oid, err := writer.Result()
+		if err != nil {
+			t.Fatalf("error getting writer results: %v", err)
+		}
+
+		rewritten := 0
+		newOID, err := dst.RewriteObject(ctx, src, oid, func(blockID string) (string, error) {
+			rewritten++
+			b, err := src.blockMgr.GetBlock(ctx, blockID)
+			if err != nil {
+				return "", err
+			}
+
+			return dst.blockMgr.WriteBlock(ctx, b, "x")
+		})
+		if err != nil {
+			t.Fatalf("unable to rewrite %v: %v", oid, err)
+		}
+
+		if got, want := indirectionLevel(newOID), indirectionLevel(oid); got != want {
+			t.Errorf("unexpected indirection level of %v: %v, want %v", newOID, got, want)
+		}
+
+		if rewritten == 0 {
+			t.Errorf("no blocks of %v rewritten", oid)
+		}
+
+		for blockID := range dstData {
+			if blockID[0] != 'x' {
+				t.Errorf("unexpected block prefix: %v", blockID)
+			}
+		}
+
+		r, err := dst.Open(ctx, newOID)
+		if err != nil {
+			t.Fatalf("unable to open rewritten object %v: %v", newOID, err)
+		}
+
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("unable to read rewritten object %v: %v", newOID, err)
+		}
+
+		if !bytes.Equal(b, contentBytes) {
+			t.Errorf("rewritten object %v has different contents", newOID)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package object
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/kopia/kopia/internal/jsonstream"
+)
+
+// RewriteObject stores the object with a given ID from another object manager and returns its new ID,
+// preserving the way it is split into blocks. Storage blocks of the object are written using the provided
+// function, which returns the new ID of each block, while indirect index objects referencing them
+// are written again.
+func (om *Manager) RewriteObject(ctx context.Context, src *Manager, oid ID, rewriteBlock func(blockID string) (string, error)) (ID, error) {
+	if indexObjectID, ok := oid.IndexObjectID(); ok {
+		rd, err := src.Open(ctx, indexObjectID)
+		if err != nil {
+			return "", err
+		}
+		defer rd.Close() //nolint:errcheck
+
+		seekTable, err := src.flattenListChunk(rd)
+		if err != nil {
+			return "", err
+		}
+
+		var prefix string
+		for i := range seekTable {
+			if seekTable[i].Object, err = om.RewriteObject(ctx, src, seekTable[i].Object, rewriteBlock); err != nil {
+				return "", fmt.Errorf("unable to rewrite part %v of %v: %v", i, oid, err)
+			}
+
+			prefix = blockPrefix(seekTable[i].Object)
+		}
+
+		iw := &objectWriter{
+			ctx:         ctx,
+			repo:        om,
+			description: "LIST(" + string(oid) + ")",
+			splitter:    om.newSplitter(),
+			prefix:      prefix,
+		}
+
+		jw := jsonstream.NewWriter(iw, indirectStreamType)
+		for _, e := range seekTable {
+			if err := jw.Write(&e); err != nil {
+				return "", fmt.Errorf("unable to write indirect block index: %v", err)
+			}
+		}
+		if err := jw.Finalize(); err != nil {
+			return "", fmt.Errorf("unable to finalize indirect block index: %v", err)
+		}
+
+		newIndexObjectID, err := iw.Result()
+		if err != nil {
+			return "", err
+		}
+
+		return IndirectObjectID(newIndexObjectID), nil
+	}
+
+	if blockID, ok := oid.BlockID(); ok {
+		newBlockID, err := rewriteBlock(blockID)
+		if err != nil {
+			return "", err
+		}
+
+		return DirectObjectID(newBlockID), nil
+	}
+
+	return "", fmt.Errorf("unsupported object ID: %v", oid)
+}
+
+// blockPrefix returns the prefix of the block ID of a direct object.
+func blockPrefix(oid ID) string {
+	if blockID, ok := oid.BlockID(); ok && len(blockID)%2 == 1 {
+		return blockID[0:1]
+	}
+
+	return ""
+}
@@ -14,6 +14,8 @@ import (
 	"github.com/kopia/kopia/repo/object"
 	"github.com/kopia/kopia/repo/storage"
 	"github.com/kopia/kopia/repo/storage/logging"
+	"github.com/kopia/kopia/repo/storage/metrics"
+	"github.com/kopia/kopia/repo/storage/prefix"
 )
 
 var log = kopialogging.Logger("kopia/repo")
@@ -50,13 +52,30 @@ func Open(ctx context.Context, configFile string, password string, options *Opti
 		return nil, err
 	}
 
+	if lc.APIServer != nil {
+		r, err := openAPIServer(ctx, lc.APIServer, password, options)
+		if err != nil {
+			return nil, err
+		}
+
+		r.ConfigFile = configFile
+		r.ActionsEnabled = lc.EnableActions
+		return r, nil
+	}
+
+	if lc.Storage == nil {
+		return nil, fmt.Errorf("storage not configured in %v", configFile)
+	}
+
 	log.Debugf("opening storage: %v", lc.Storage.Type)
 
-	st, err := storage.NewStorage(ctx, lc.Storage)
+	st, err := storage.NewStorage(ctx, *lc.Storage)
 	if err != nil {
 		return nil, fmt.Errorf("cannot open storage: %v", err)
 	}
 
+	st = metrics.NewWrapper(st)
+
 	if options.TraceStorage != nil {
 		st = logging.NewWrapper(st, logging.Prefix("[STORAGE] "), logging.Output(options.TraceStorage))
 	}
@@ -68,11 +87,26 @@ func Open(ctx context.Context, configFile string, password string, options *Opti
 	}
 
 	r.ConfigFile = configFile
+	r.ActionsEnabled = lc.EnableActions
 
 	return r, nil
 }
 
 func connect(ctx context.Context, st storage.Storage, lc *config.LocalConfig, password string, options *Options, caching block.CachingOptions) (*Repository, error) {
+	r, err := connectToGeneration(ctx, st, password, options, caching)
+	if err == ErrRepositoryUpgraded && caching.CacheDirectory != "" {
+		// the cached format block refers to the generation retired by the upgrade.
+		log.Infof("repository has been upgraded to a new format, clearing cache")
+		clearCache(caching.CacheDirectory)
+		r, err = connectToGeneration(ctx, st, password, options, caching)
+	}
+
+	return r, err
+}
+
+// connectToGeneration opens the storage generation used by the repository according to its format block,
+// which may be cached.
+func connectToGeneration(ctx context.Context, st storage.Storage, password string, options *Options, caching block.CachingOptions) (*Repository, error) {
 	log.Debugf("reading encrypted format block")
 	// Read cache block, potentially from cache.
 	f, err := readAndCacheFormatBlock(ctx, st, caching.CacheDirectory)
@@ -80,7 +114,7 @@ func connect(ctx context.Context, st storage.Storage, lc *config.LocalConfig, pa
 		return nil, fmt.Errorf("unable to read format block: %v", err)
 	}
 
-	masterKey, err := f.deriveMasterKeyFromPassword(password)
+	masterKey, keySlotID, err := f.openRepositoryKey(password)
 	if err != nil {
 		return nil, err
 	}
@@ -90,6 +124,15 @@ func connect(ctx context.Context, st storage.Storage, lc *config.LocalConfig, pa
 		return nil, fmt.Errorf("unable to decrypt repository config: %v", err)
 	}
 
+	rootStorage := st
+	if f.StorageGeneration > 0 {
+		st = prefix.NewWrapper(st, generationPrefix(f.StorageGeneration))
+	}
+
+	if err := checkGenerationCurrent(ctx, st); err != nil {
+		return nil, err
+	}
+
 	caching.HMACSecret = deriveKeyFromMasterKey(masterKey, f.UniqueID, []byte("local-cache-integrity"), 16)
 
 	fo := repoConfig.FormattingOptions
@@ -122,6 +165,11 @@ func connect(ctx context.Context, st storage.Storage, lc *config.LocalConfig, pa
 		Manifests:      manifests,
 		CacheDirectory: caching.CacheDirectory,
 		UniqueID:       f.UniqueID,
+
+		rootStorage: rootStorage,
+		formatBlock: f,
+		masterKey:   masterKey,
+		keySlotID:   keySlotID,
 	}, nil
 }
 
@@ -137,7 +185,11 @@ func SetCachingConfig(ctx context.Context, configFile string, opt block.CachingO
 		return err
 	}
 
-	st, err := storage.NewStorage(ctx, lc.Storage)
+	if lc.Storage == nil {
+		return ErrRemoteRepository
+	}
+
+	st, err := storage.NewStorage(ctx, *lc.Storage)
 	if err != nil {
 		return fmt.Errorf("cannot open storage: %v", err)
 	}
@@ -0,0 +1,53 @@
+// Package remote implements access to a repository exposed by Kopia API server, which allows clients
+// to read and write repository contents without having direct access to the storage.
+package remote
+
+import (
+	"encoding/json"
+
+	"github.com/kopia/kopia/internal/config"
+	"github.com/kopia/kopia/repo/manifest"
+)
+
+// Parameters describes the repository exposed by the server.
+type Parameters struct {
+	UniqueID []byte `json:"uniqueID"`
+
+	// ObjectFormat describes how objects are split into blocks, encryption keys are never included.
+	ObjectFormat config.RepositoryObjectFormat `json:"objectFormat"`
+}
+
+// BlockData is the request and response payload for writing and reading blocks.
+type BlockData struct {
+	Data []byte `json:"data"`
+}
+
+// WriteBlockResponse is the response of a block write.
+type WriteBlockResponse struct {
+	BlockID string `json:"blockID"`
+}
+
+// PutManifestRequest is the request to store a new manifest.
+type PutManifestRequest struct {
+	Labels  map[string]string `json:"labels"`
+	Payload json.RawMessage   `json:"payload"`
+}
+
+// PutManifestResponse is the response of storing a manifest.
+type PutManifestResponse struct {
+	ID string `json:"id"`
+}
+
+// ManifestResponse is the response of reading a manifest.
+type ManifestResponse struct {
+	Metadata *manifest.EntryMetadata `json:"metadata"`
+	Payload  json.RawMessage         `json:"payload"`
+}
+
+// FindManifestsResponse is the response of finding manifests by labels.
+type FindManifestsResponse struct {
+	Manifests []*manifest.EntryMetadata `json:"manifests"`
+}
+
+// Empty is the empty request or response payload.
+type Empty struct{}
@@ -0,0 +1,189 @@
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+
+	"github.com/kopia/kopia/internal/apiclient"
+	"github.com/kopia/kopia/internal/kopialogging"
+	"github.com/kopia/kopia/repo/block"
+	"github.com/kopia/kopia/repo/manifest"
+	"github.com/kopia/kopia/repo/storage"
+)
+
+var log = kopialogging.Logger("kopia/remote")
+
+// Client provides access to blocks of a repository exposed by the API server.
+type Client struct {
+	cli *apiclient.Client
+}
+
+// Parameters returns the parameters of the repository.
+func (c *Client) Parameters(ctx context.Context) (*Parameters, error) {
+	p := &Parameters{}
+	if err := c.cli.Get("repo/parameters", p); err != nil {
+		return nil, fmt.Errorf("unable to get repository parameters: %v", err)
+	}
+
+	return p, nil
+}
+
+// GetBlock returns the contents of a given block or storage.ErrBlockNotFound.
+func (c *Client) GetBlock(ctx context.Context, blockID string) ([]byte, error) {
+	var resp BlockData
+	if err := c.cli.Get("repo/blocks/"+url.PathEscape(blockID), &resp); err != nil {
+		if err == apiclient.ErrNotFound {
+			return nil, storage.ErrBlockNotFound
+		}
+
+		return nil, fmt.Errorf("unable to get block %v: %v", blockID, err)
+	}
+
+	return resp.Data, nil
+}
+
+// BlockInfo returns information about a given block or storage.ErrBlockNotFound.
+func (c *Client) BlockInfo(ctx context.Context, blockID string) (block.Info, error) {
+	var resp block.Info
+	if err := c.cli.Get("repo/blockinfo/"+url.PathEscape(blockID), &resp); err != nil {
+		if err == apiclient.ErrNotFound {
+			return block.Info{}, storage.ErrBlockNotFound
+		}
+
+		return block.Info{}, fmt.Errorf("unable to get block info %v: %v", blockID, err)
+	}
+
+	return resp, nil
+}
+
+// WriteBlock saves a given block of data on the server and returns its ID.
+func (c *Client) WriteBlock(ctx context.Context, data []byte, prefix string) (string, error) {
+	var resp WriteBlockResponse
+	if err := c.cli.Post("repo/blocks?prefix="+url.QueryEscape(prefix), &BlockData{data}, &resp); err != nil {
+		return "", fmt.Errorf("unable to write block: %v", err)
+	}
+
+	return resp.BlockID, nil
+}
+
+// Flush requests the server to persist all pending blocks and manifests.
+func (c *Client) Flush(ctx context.Context) error {
+	return c.cli.Post("repo/flush", &Empty{}, &Empty{})
+}
+
+// Manifests returns the manager of manifests stored on the server.
+func (c *Client) Manifests() *ManifestManager {
+	return &ManifestManager{c.cli}
+}
+
+// ManifestManager manages manifests stored on the server. Manifest writes and deletions become
+// persistent when the server is flushed.
+type ManifestManager struct {
+	cli *apiclient.Client
+}
+
+// Put serializes the provided payload to JSON and stores it on the server. Returns the ID of the manifest.
+func (m *ManifestManager) Put(ctx context.Context, labels map[string]string, payload interface{}) (string, error) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	var resp PutManifestResponse
+	if err := m.cli.Post("repo/manifests", &PutManifestRequest{labels, b}, &resp); err != nil {
+		return "", fmt.Errorf("unable to put manifest: %v", err)
+	}
+
+	return resp.ID, nil
+}
+
+// GetMetadata returns metadata about provided manifest item or manifest.ErrNotFound if the item can't be found.
+func (m *ManifestManager) GetMetadata(ctx context.Context, id string) (*manifest.EntryMetadata, error) {
+	resp, err := m.get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Metadata, nil
+}
+
+// Get retrieves the contents of the provided manifest item by deserializing it as JSON to provided object.
+func (m *ManifestManager) Get(ctx context.Context, id string, data interface{}) error {
+	b, err := m.GetRaw(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(b, data); err != nil {
+		return fmt.Errorf("unable to unmashal %q: %v", id, err)
+	}
+
+	return nil
+}
+
+// GetRaw returns raw contents of the provided manifest (JSON bytes) or manifest.ErrNotFound if not found.
+func (m *ManifestManager) GetRaw(ctx context.Context, id string) ([]byte, error) {
+	resp, err := m.get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Payload, nil
+}
+
+func (m *ManifestManager) get(id string) (*ManifestResponse, error) {
+	resp := &ManifestResponse{}
+	if err := m.cli.Get("repo/manifests/"+url.PathEscape(id), resp); err != nil {
+		if err == apiclient.ErrNotFound {
+			return nil, manifest.ErrNotFound
+		}
+
+		return nil, fmt.Errorf("unable to get manifest %v: %v", id, err)
+	}
+
+	return resp, nil
+}
+
+// Find returns the list of EntryMetadata for manifest entries matching all provided labels.
+func (m *ManifestManager) Find(ctx context.Context, labels map[string]string) ([]*manifest.EntryMetadata, error) {
+	q := url.Values{}
+	for k, v := range labels {
+		q.Set(k, v)
+	}
+
+	var resp FindManifestsResponse
+	if err := m.cli.Get("repo/manifests?"+q.Encode(), &resp); err != nil {
+		return nil, fmt.Errorf("unable to find manifests: %v", err)
+	}
+
+	return resp.Manifests, nil
+}
+
+// Delete marks the specified manifest ID for deletion.
+func (m *ManifestManager) Delete(id string) {
+	if err := m.cli.Delete("repo/manifests/"+url.PathEscape(id), &Empty{}); err != nil && err != apiclient.ErrNotFound {
+		log.Warningf("unable to delete manifest %v: %v", id, err)
+	}
+}
+
+// Flush is a no-op, manifests are persisted when the server is flushed.
+func (m *ManifestManager) Flush(ctx context.Context) error {
+	return nil
+}
+
+// Refresh is a no-op, the server always returns current manifests.
+func (m *ManifestManager) Refresh(ctx context.Context) error {
+	return nil
+}
+
+// NewClient creates a client of the repository exposed by the API server.
+func NewClient(opt apiclient.Options) (*Client, error) {
+	cli, err := apiclient.NewClient(opt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{cli}, nil
+}
@@ -0,0 +1,198 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/kopia/kopia/internal/apiclient"
+	"github.com/kopia/kopia/repo/manifest"
+	"github.com/kopia/kopia/repo/storage"
+)
+
+// fakeServer implements a subset of repository API sufficient to exercise the client.
+type fakeServer struct {
+	mu        sync.Mutex
+	blocks    map[string][]byte
+	manifests map[string]*ManifestResponse
+	flushes   int
+}
+
+func (s *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u, p, ok := r.BasicAuth(); !ok || u != "user" || p != "pass" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	p := strings.TrimPrefix(r.URL.Path, "/api/v1/repo/")
+	switch {
+	case r.Method == http.MethodPost && p == "blocks":
+		var req BlockData
+		json.NewDecoder(r.Body).Decode(&req) //nolint:errcheck
+		id := r.URL.Query().Get("prefix") + fmt.Sprintf("%x", req.Data)
+		s.blocks[id] = req.Data
+		json.NewEncoder(w).Encode(&WriteBlockResponse{id}) //nolint:errcheck
+
+	case r.Method == http.MethodGet && strings.HasPrefix(p, "blocks/"):
+		b, ok := s.blocks[strings.TrimPrefix(p, "blocks/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(&BlockData{b}) //nolint:errcheck
+
+	case r.Method == http.MethodPost && p == "manifests":
+		var req PutManifestRequest
+		json.NewDecoder(r.Body).Decode(&req) //nolint:errcheck
+		id := fmt.Sprintf("m%v", len(s.manifests))
+		s.manifests[id] = &ManifestResponse{
+			Metadata: &manifest.EntryMetadata{ID: id, Labels: req.Labels, Length: len(req.Payload)},
+			Payload:  req.Payload,
+		}
+		json.NewEncoder(w).Encode(&PutManifestResponse{id}) //nolint:errcheck
+
+	case r.Method == http.MethodGet && p == "manifests":
+		resp := &FindManifestsResponse{}
+		for _, m := range s.manifests {
+			if m.Metadata.Labels["type"] == r.URL.Query().Get("type") {
+				resp.Manifests = append(resp.Manifests, m.Metadata)
+			}
+		}
+		json.NewEncoder(w).Encode(resp) //nolint:errcheck
+
+	case r.Method == http.MethodGet && strings.HasPrefix(p, "manifests/"):
+		m, ok := s.manifests[strings.TrimPrefix(p, "manifests/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(m) //nolint:errcheck
+
+	case r.Method == http.MethodDelete && strings.HasPrefix(p, "manifests/"):
+		delete(s.manifests, strings.TrimPrefix(p, "manifests/"))
+		json.NewEncoder(w).Encode(&Empty{}) //nolint:errcheck
+
+	case r.Method == http.MethodPost && p == "flush":
+		s.flushes++
+		json.NewEncoder(w).Encode(&Empty{}) //nolint:errcheck
+
+	default:
+		http.Error(w, "unsupported", http.StatusBadRequest)
+	}
+}
+
+func newTestClient(t *testing.T, password string) (*Client, *fakeServer, func()) {
+	fs := &fakeServer{
+		blocks:    map[string][]byte{},
+		manifests: map[string]*ManifestResponse{},
+	}
+
+	srv := httptest.NewServer(fs)
+	cli, err := NewClient(apiclient.Options{
+		BaseURL:  srv.URL,
+		Username: "user",
+		Password: password,
+	})
+	if err != nil {
+		t.Fatalf("unable to create client: %v", err)
+	}
+
+	return cli, fs, srv.Close
+}
+
+func TestClientBlocks(t *testing.T) {
+	ctx := context.Background()
+	cli, fs, closer := newTestClient(t, "pass")
+	defer closer()
+
+	blockID, err := cli.WriteBlock(ctx, []byte{1, 2, 3}, "k")
+	if err != nil {
+		t.Fatalf("unable to write block: %v", err)
+	}
+
+	if got, want := blockID, "k010203"; got != want {
+		t.Errorf("unexpected block ID: %v, want %v", got, want)
+	}
+
+	data, err := cli.GetBlock(ctx, blockID)
+	if err != nil {
+		t.Fatalf("unable to get block: %v", err)
+	}
+
+	if !bytes.Equal(data, []byte{1, 2, 3}) {
+		t.Errorf("unexpected block data: %x", data)
+	}
+
+	if _, err := cli.GetBlock(ctx, "no-such-block"); err != storage.ErrBlockNotFound {
+		t.Errorf("unexpected error when getting non-existent block: %v", err)
+	}
+
+	if err := cli.Flush(ctx); err != nil {
+		t.Errorf("unable to flush: %v", err)
+	}
+
+	if fs.flushes != 1 {
+		t.Errorf("unexpected number of flushes: %v", fs.flushes)
+	}
+}
+
+func TestClientManifests(t *testing.T) {
+	ctx := context.Background()
+	cli, _, closer := newTestClient(t, "pass")
+	defer closer()
+
+	mm := cli.Manifests()
+
+	labels := map[string]string{"type": "item", "username": "u", "hostname": "h"}
+	id, err := mm.Put(ctx, labels, map[string]int{"value": 42})
+	if err != nil {
+		t.Fatalf("unable to put manifest: %v", err)
+	}
+
+	var payload map[string]int
+	if err := mm.Get(ctx, id, &payload); err != nil {
+		t.Fatalf("unable to get manifest: %v", err)
+	}
+
+	if payload["value"] != 42 {
+		t.Errorf("unexpected payload: %v", payload)
+	}
+
+	entries, err := mm.Find(ctx, map[string]string{"type": "item"})
+	if err != nil {
+		t.Fatalf("unable to find manifests: %v", err)
+	}
+
+	if len(entries) != 1 || entries[0].ID != id || entries[0].Labels["hostname"] != "h" {
+		t.Errorf("unexpected entries: %v", entries)
+	}
+
+	mm.Delete(id)
+
+	if _, err := mm.GetMetadata(ctx, id); err != manifest.ErrNotFound {
+		t.Errorf("unexpected error when getting deleted manifest: %v", err)
+	}
+}
+
+func TestClientInvalidCredentials(t *testing.T) {
+	ctx := context.Background()
+	cli, _, closer := newTestClient(t, "wrong")
+	defer closer()
+
+	if _, err := cli.Parameters(ctx); err == nil {
+		t.Errorf("expected error with invalid credentials")
+	}
+
+	if _, err := cli.WriteBlock(ctx, []byte{1}, ""); err == nil {
+		t.Errorf("expected error with invalid credentials")
+	}
+}
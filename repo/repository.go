@@ -2,25 +2,61 @@ package repo
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/kopia/kopia/repo/block"
 	"github.com/kopia/kopia/repo/manifest"
 	"github.com/kopia/kopia/repo/object"
+	"github.com/kopia/kopia/repo/remote"
 	"github.com/kopia/kopia/repo/storage"
 )
 
+// ManifestManager manages JSON manifests stored in the repository.
+type ManifestManager interface {
+	Put(ctx context.Context, labels map[string]string, payload interface{}) (string, error)
+	GetMetadata(ctx context.Context, id string) (*manifest.EntryMetadata, error)
+	Get(ctx context.Context, id string, data interface{}) error
+	GetRaw(ctx context.Context, id string) ([]byte, error)
+	Find(ctx context.Context, labels map[string]string) ([]*manifest.EntryMetadata, error)
+	Delete(id string)
+	Flush(ctx context.Context) error
+	Refresh(ctx context.Context) error
+}
+
+// ErrRemoteRepository is returned by operations that require direct access to the storage
+// when the repository is accessed through API server.
+var ErrRemoteRepository = errors.New("operation not supported when connected to repository server")
+
 // Repository represents storage where both content-addressable and user-addressable data is kept.
+//
+// When connected to a repository through API server, Blocks and Storage are nil and
+// all reads and writes are performed by the server.
 type Repository struct {
 	Blocks    *block.Manager
 	Objects   *object.Manager
 	Storage   storage.Storage
-	Manifests *manifest.Manager
+	Manifests ManifestManager
 	UniqueID  []byte
 
 	ConfigFile     string
 	CacheDirectory string
+
+	// ActionsEnabled is true when actions defined in policies may be run, as configured when connecting.
+	ActionsEnabled bool
+
+	rootStorage storage.Storage // storage holding the format block, Storage only contains blocks of the current generation
+	formatBlock *formatBlock
+	masterKey   []byte
+	keySlotID   string // ID of the key slot used to open the repository, empty for legacy repositories
+
+	remote *remote.Client // set when connected through API server
+}
+
+// IsRemote returns true if the repository is accessed through API server.
+func (r *Repository) IsRemote() bool {
+	return r.remote != nil
 }
 
 // Close closes the repository and releases all resources.
@@ -31,6 +67,9 @@ func (r *Repository) Close(ctx context.Context) error {
 	if err := r.Objects.Close(ctx); err != nil {
 		return err
 	}
+	if r.remote != nil {
+		return r.remote.Flush(ctx)
+	}
 	if err := r.Blocks.Flush(ctx); err != nil {
 		return err
 	}
@@ -49,11 +88,24 @@ func (r *Repository) Flush(ctx context.Context) error {
 		return err
 	}
 
+	if r.remote != nil {
+		return r.remote.Flush(ctx)
+	}
+
 	return r.Blocks.Flush(ctx)
 }
 
 // Refresh periodically makes external changes visible to repository.
 func (r *Repository) Refresh(ctx context.Context) error {
+	if r.remote != nil {
+		// the server always serves its current state.
+		return nil
+	}
+
+	if err := checkGenerationCurrent(ctx, r.Storage); err != nil {
+		return err
+	}
+
 	updated, err := r.Blocks.Refresh(ctx)
 	if err != nil {
 		return fmt.Errorf("error refreshing block index: %v", err)
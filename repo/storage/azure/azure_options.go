@@ -0,0 +1,35 @@
+package azure
+
+import (
+	"net/url"
+	"strings"
+)
+
+// Options defines options for Azure Blob Storage-backed storage.
+type Options struct {
+	// Container is the name of the blob container where data is stored.
+	Container string `json:"container"`
+
+	// Prefix specifies additional string to prepend to all objects.
+	Prefix string `json:"prefix,omitempty"`
+
+	StorageAccount string `json:"storageAccount"`
+	StorageKey     string `json:"storageKey,omitempty" kopia:"sensitive"`
+
+	// SASToken is a shared access signature (query string) used instead of the storage key.
+	SASToken string `json:"sasToken,omitempty" kopia:"sensitive"`
+
+	// Endpoint overrides the blob service URL, which defaults to https://<account>.blob.core.windows.net.
+	Endpoint string `json:"endpoint,omitempty"`
+
+	MaxUploadSpeedBytesPerSecond int `json:"maxUploadSpeedBytesPerSecond,omitempty"`
+
+	MaxDownloadSpeedBytesPerSecond int `json:"maxDownloadSpeedBytesPerSecond,omitempty"`
+}
+
+// ApplyURL sets container name and prefix from a URL in the form azure://container/prefix.
+func (o *Options) ApplyURL(u *url.URL, subScheme string) error {
+	o.Container = u.Host
+	o.Prefix = strings.TrimPrefix(u.Path, "/")
+	return nil
+}
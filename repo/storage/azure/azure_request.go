@@ -0,0 +1,171 @@
+package azure
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kopia/kopia/internal/retry"
+)
+
+const apiVersion = "2018-03-28"
+
+type retriableError struct {
+	inner error
+}
+
+func (e *retriableError) Error() string {
+	return fmt.Sprintf("retriable: %v", e.inner)
+}
+
+// executeRequest builds, signs and executes a request, retrying on network and server errors.
+func (az *azStorage) executeRequest(method, urlStr string, header http.Header, body []byte) (*http.Response, error) {
+	v, err := retry.WithExponentialBackoff(fmt.Sprintf("%v %v", method, urlStr), func() (interface{}, error) {
+		var r io.Reader
+		if len(body) > 0 {
+			r = bytes.NewReader(body)
+		}
+
+		req, err := http.NewRequest(method, az.withSASToken(urlStr), r)
+		if err != nil {
+			return nil, err
+		}
+
+		for k, v := range header {
+			req.Header[k] = v
+		}
+
+		if err = az.signRequest(req); err != nil {
+			return nil, err
+		}
+
+		resp, err := az.client.Do(req)
+		if err != nil {
+			// Failed to receive response.
+			return nil, &retriableError{err}
+		}
+
+		if resp.StatusCode >= 500 && resp.StatusCode < 600 {
+			// Retry on server errors, which include throttling (503 Server Busy).
+			resp.Body.Close() //nolint:errcheck
+			return nil, &retriableError{fmt.Errorf("server returned status %v", resp.StatusCode)}
+		}
+
+		return resp, nil
+	}, func(e error) bool {
+		_, ok := e.(*retriableError)
+		return ok
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return v.(*http.Response), nil
+}
+
+// withSASToken appends shared access signature to the provided URL, if one is configured.
+func (az *azStorage) withSASToken(urlStr string) string {
+	sas := strings.TrimPrefix(az.SASToken, "?")
+	if sas == "" {
+		return urlStr
+	}
+
+	if strings.Contains(urlStr, "?") {
+		return urlStr + "&" + sas
+	}
+
+	return urlStr + "?" + sas
+}
+
+// signRequest sets the headers required by the Blob service and, when the storage key is used,
+// authorizes the request using Shared Key authorization.
+func (az *azStorage) signRequest(req *http.Request) error {
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", apiVersion)
+
+	if az.StorageKey == "" {
+		// requests are authorized using SAS token included in the URL.
+		return nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(az.StorageKey)
+	if err != nil {
+		return fmt.Errorf("invalid storage key: %v", err)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("SharedKey %v:%v", az.StorageAccount, sharedKeySignature(req, az.StorageAccount, key)))
+	return nil
+}
+
+// sharedKeySignature computes Shared Key signature of a request as described in
+// https://docs.microsoft.com/en-us/rest/api/storageservices/authorize-with-shared-key
+func sharedKeySignature(req *http.Request, account string, key []byte) string {
+	contentLength := ""
+	if req.ContentLength > 0 {
+		contentLength = fmt.Sprintf("%v", req.ContentLength)
+	}
+
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		contentLength,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date, x-ms-date is used instead
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+		canonicalizedHeaders(req) + canonicalizedResource(req, account),
+	}, "\n")
+
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(stringToSign)) //nolint:errcheck
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func canonicalizedHeaders(req *http.Request) string {
+	var names []string
+	for k := range req.Header {
+		if lk := strings.ToLower(k); strings.HasPrefix(lk, "x-ms-") {
+			names = append(names, lk)
+		}
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, n := range names {
+		fmt.Fprintf(&sb, "%v:%v\n", n, strings.TrimSpace(req.Header.Get(n)))
+	}
+
+	return sb.String()
+}
+
+func canonicalizedResource(req *http.Request, account string) string {
+	var sb strings.Builder
+	sb.WriteString("/" + account + req.URL.EscapedPath())
+
+	q := req.URL.Query()
+	var names []string
+	for k := range q {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	for _, n := range names {
+		values := append([]string(nil), q[n]...)
+		sort.Strings(values)
+		fmt.Fprintf(&sb, "\n%v:%v", strings.ToLower(n), strings.Join(values, ","))
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,252 @@
+// Package azure implements Storage based on an Azure Blob Storage container.
+package azure
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/efarrer/iothrottler"
+	"github.com/kopia/kopia/internal/throttle"
+	"github.com/kopia/kopia/repo/storage"
+)
+
+const (
+	azStorageType = "azure"
+)
+
+type azStorage struct {
+	Options
+
+	endpoint string
+	client   *http.Client
+
+	downloadThrottler *iothrottler.IOThrottlerPool
+	uploadThrottler   *iothrottler.IOThrottlerPool
+}
+
+func (az *azStorage) GetBlock(ctx context.Context, b string, offset, length int64) ([]byte, error) {
+	h := http.Header{}
+	if length > 0 {
+		h.Set("x-ms-range", fmt.Sprintf("bytes=%v-%v", offset, offset+length-1))
+	}
+
+	resp, err := az.executeRequest("GET", az.blobURL(b), h, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+		return ioutil.ReadAll(resp.Body)
+	case http.StatusNotFound:
+		return nil, storage.ErrBlockNotFound
+	default:
+		return nil, responseError("GetBlock", b, resp)
+	}
+}
+
+func (az *azStorage) PutBlock(ctx context.Context, b string, data []byte) error {
+	progressCallback := storage.ProgressCallback(ctx)
+	if progressCallback != nil {
+		progressCallback(b, 0, int64(len(data)))
+		defer progressCallback(b, int64(len(data)), int64(len(data)))
+	}
+
+	h := http.Header{}
+	h.Set("x-ms-blob-type", "BlockBlob")
+	h.Set("Content-Type", "application/x-kopia")
+
+	resp, err := az.executeRequest("PUT", az.blobURL(b), h, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode != http.StatusCreated {
+		return responseError("PutBlock", b, resp)
+	}
+
+	return nil
+}
+
+func (az *azStorage) DeleteBlock(ctx context.Context, b string) error {
+	resp, err := az.executeRequest("DELETE", az.blobURL(b), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	switch resp.StatusCode {
+	case http.StatusAccepted, http.StatusOK, http.StatusNotFound:
+		return nil
+	default:
+		return responseError("DeleteBlock", b, resp)
+	}
+}
+
+type listBlobsResult struct {
+	Blobs []struct {
+		Name       string `xml:"Name"`
+		Properties struct {
+			LastModified  string `xml:"Last-Modified"`
+			ContentLength int64  `xml:"Content-Length"`
+		} `xml:"Properties"`
+	} `xml:"Blobs>Blob"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+func (az *azStorage) ListBlocks(ctx context.Context, prefix string, callback func(storage.BlockMetadata) error) error {
+	marker := ""
+
+	for {
+		q := url.Values{}
+		q.Set("restype", "container")
+		q.Set("comp", "list")
+		q.Set("prefix", az.getObjectNameString(prefix))
+		if marker != "" {
+			q.Set("marker", marker)
+		}
+
+		res, err := az.listBlobs(q)
+		if err != nil {
+			return err
+		}
+
+		for _, bl := range res.Blobs {
+			ts, err := time.Parse(http.TimeFormat, bl.Properties.LastModified)
+			if err != nil {
+				return fmt.Errorf("invalid modification time of %q: %v", bl.Name, err)
+			}
+
+			if err := callback(storage.BlockMetadata{
+				BlockID:   bl.Name[len(az.Prefix):],
+				Length:    bl.Properties.ContentLength,
+				Timestamp: ts,
+			}); err != nil {
+				return err
+			}
+		}
+
+		if res.NextMarker == "" {
+			return nil
+		}
+
+		marker = res.NextMarker
+	}
+}
+
+func (az *azStorage) listBlobs(q url.Values) (*listBlobsResult, error) {
+	resp, err := az.executeRequest("GET", az.containerURL()+"?"+q.Encode(), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError("ListBlocks", q.Get("prefix"), resp)
+	}
+
+	var res listBlobsResult
+	if err := xml.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("unable to parse list results: %v", err)
+	}
+
+	return &res, nil
+}
+
+func (az *azStorage) getObjectNameString(blockID string) string {
+	return az.Prefix + blockID
+}
+
+func (az *azStorage) containerURL() string {
+	return az.endpoint + "/" + url.PathEscape(az.Container)
+}
+
+func (az *azStorage) blobURL(blockID string) string {
+	return az.containerURL() + "/" + (&url.URL{Path: az.getObjectNameString(blockID)}).EscapedPath()
+}
+
+func (az *azStorage) ConnectionInfo() storage.ConnectionInfo {
+	return storage.ConnectionInfo{
+		Type:   azStorageType,
+		Config: &az.Options,
+	}
+}
+
+func (az *azStorage) Close(ctx context.Context) error {
+	return nil
+}
+
+func (az *azStorage) String() string {
+	return fmt.Sprintf("azure://%v/%v", az.Container, az.Prefix)
+}
+
+// responseError returns an error describing unexpected response, including the error code returned by the service.
+func responseError(op, b string, resp *http.Response) error {
+	if code := resp.Header.Get("x-ms-error-code"); code != "" {
+		return fmt.Errorf("%v(%q) failed with status %v: %v", op, b, resp.StatusCode, code)
+	}
+
+	return fmt.Errorf("%v(%q) failed with status %v", op, b, resp.StatusCode)
+}
+
+func toBandwidth(bytesPerSecond int) iothrottler.Bandwidth {
+	if bytesPerSecond <= 0 {
+		return iothrottler.Unlimited
+	}
+
+	return iothrottler.Bandwidth(bytesPerSecond) * iothrottler.BytesPerSecond
+}
+
+// New creates new Azure Blob Storage-backed storage with specified options:
+//
+// - the 'Container' and 'StorageAccount' fields are required, as well as either 'StorageKey' or 'SASToken'.
+func New(ctx context.Context, opt *Options) (storage.Storage, error) {
+	if opt.Container == "" {
+		return nil, errors.New("container name must be specified")
+	}
+
+	if opt.StorageAccount == "" {
+		return nil, errors.New("storage account must be specified")
+	}
+
+	if opt.StorageKey == "" && opt.SASToken == "" {
+		return nil, errors.New("either storage key or SAS token must be specified")
+	}
+
+	az := &azStorage{
+		Options:           *opt,
+		downloadThrottler: iothrottler.NewIOThrottlerPool(toBandwidth(opt.MaxDownloadSpeedBytesPerSecond)),
+		uploadThrottler:   iothrottler.NewIOThrottlerPool(toBandwidth(opt.MaxUploadSpeedBytesPerSecond)),
+	}
+
+	az.endpoint = strings.TrimSuffix(opt.Endpoint, "/")
+	if az.endpoint == "" {
+		az.endpoint = fmt.Sprintf("https://%v.blob.core.windows.net", opt.StorageAccount)
+	}
+
+	az.client = &http.Client{
+		Transport: throttle.NewRoundTripper(http.DefaultTransport, az.downloadThrottler, az.uploadThrottler),
+	}
+
+	return az, nil
+}
+
+func init() {
+	storage.AddSupportedStorage(
+		azStorageType,
+		func() interface{} {
+			return &Options{}
+		},
+		func(ctx context.Context, o interface{}) (storage.Storage, error) {
+			return New(ctx, o.(*Options))
+		})
+}
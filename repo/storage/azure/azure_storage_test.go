@@ -0,0 +1,286 @@
+package azure
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kopia/kopia/repo/internal/storagetesting"
+)
+
+const (
+	testAccount   = "kopiatest"
+	testContainer = "container"
+	testSASToken  = "sv=2018-03-28&sig=test-signature"
+)
+
+var testStorageKey = base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+
+type fakeBlob struct {
+	data     []byte
+	modified time.Time
+}
+
+// fakeBlobService implements the subset of Azure Blob Storage REST API used by azStorage.
+type fakeBlobService struct {
+	useSAS   bool
+	pageSize int
+
+	mu            sync.Mutex
+	blobs         map[string]fakeBlob
+	failNextCalls int
+}
+
+func (s *fakeBlobService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		w.Header().Set("x-ms-error-code", "AuthenticationFailed")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.failNextCalls > 0 {
+		s.failNextCalls--
+		w.Header().Set("x-ms-error-code", "ServerBusy")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	containerPrefix := "/" + testContainer
+	if r.URL.Path == containerPrefix && r.URL.Query().Get("comp") == "list" {
+		s.list(w, r)
+		return
+	}
+
+	if !strings.HasPrefix(r.URL.Path, containerPrefix+"/") {
+		w.Header().Set("x-ms-error-code", "ContainerNotFound")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, containerPrefix+"/")
+
+	switch r.Method {
+	case "PUT":
+		if r.Header.Get("x-ms-blob-type") != "BlockBlob" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		data, _ := ioutil.ReadAll(r.Body)
+		s.blobs[name] = fakeBlob{data, time.Now()}
+		w.WriteHeader(http.StatusCreated)
+
+	case "GET":
+		b, ok := s.blobs[name]
+		if !ok {
+			w.Header().Set("x-ms-error-code", "BlobNotFound")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if rng := r.Header.Get("x-ms-range"); rng != "" {
+			var start, end int
+			if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &start, &end); err != nil || end >= len(b.data) || start > end {
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(b.data[start : end+1]) //nolint:errcheck
+			return
+		}
+
+		w.Write(b.data) //nolint:errcheck
+
+	case "DELETE":
+		if _, ok := s.blobs[name]; !ok {
+			w.Header().Set("x-ms-error-code", "BlobNotFound")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		delete(s.blobs, name)
+		w.WriteHeader(http.StatusAccepted)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *fakeBlobService) authorized(r *http.Request) bool {
+	if r.Header.Get("x-ms-version") == "" || r.Header.Get("x-ms-date") == "" {
+		return false
+	}
+
+	if s.useSAS {
+		return r.URL.Query().Get("sig") == "test-signature" && r.Header.Get("Authorization") == ""
+	}
+
+	key, _ := base64.StdEncoding.DecodeString(testStorageKey)
+	return r.Header.Get("Authorization") == "SharedKey "+testAccount+":"+sharedKeySignature(r, testAccount, key)
+}
+
+func (s *fakeBlobService) list(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	marker := r.URL.Query().Get("marker")
+
+	var names []string
+	for n := range s.blobs {
+		if strings.HasPrefix(n, prefix) && n > marker {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+
+	var res listBlobsResult
+	if len(names) > s.pageSize {
+		names = names[0:s.pageSize]
+		// real service uses opaque markers, the fake uses the last returned name.
+		res.NextMarker = names[len(names)-1]
+	}
+
+	for _, n := range names {
+		var e struct {
+			Name       string `xml:"Name"`
+			Properties struct {
+				LastModified  string `xml:"Last-Modified"`
+				ContentLength int64  `xml:"Content-Length"`
+			} `xml:"Properties"`
+		}
+		e.Name = n
+		e.Properties.LastModified = s.blobs[n].modified.UTC().Format(http.TimeFormat)
+		e.Properties.ContentLength = int64(len(s.blobs[n].data))
+		res.Blobs = append(res.Blobs, e)
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(struct { //nolint:errcheck
+		XMLName xml.Name `xml:"EnumerationResults"`
+		listBlobsResult
+	}{listBlobsResult: res})
+}
+
+func newFakeBlobService(useSAS bool) (*fakeBlobService, *httptest.Server) {
+	s := &fakeBlobService{
+		useSAS:   useSAS,
+		pageSize: 2,
+		blobs:    map[string]fakeBlob{},
+	}
+
+	return s, httptest.NewServer(s)
+}
+
+func TestAzureStorage(t *testing.T) {
+	for _, useSAS := range []bool{false, true} {
+		svc, server := newFakeBlobService(useSAS)
+
+		opt := &Options{
+			Container:      testContainer,
+			StorageAccount: testAccount,
+			Endpoint:       server.URL,
+			Prefix:         "some/prefix-",
+		}
+
+		if useSAS {
+			opt.SASToken = "?" + testSASToken
+		} else {
+			opt.StorageKey = testStorageKey
+		}
+
+		ctx := context.Background()
+		st, err := New(ctx, opt)
+		if err != nil {
+			t.Fatalf("unable to create storage: %v", err)
+		}
+
+		storagetesting.VerifyStorage(ctx, t, st)
+
+		if err := st.DeleteBlock(ctx, "abff4585856ebf0748fd989e1dd623a8963d"); err != nil {
+			t.Errorf("unable to delete block: %v", err)
+		}
+
+		if err := st.DeleteBlock(ctx, "no-such-block"); err != nil {
+			t.Errorf("unable to delete non-existent block: %v", err)
+		}
+
+		storagetesting.AssertGetBlockNotFound(ctx, t, st, "abff4585856ebf0748fd989e1dd623a8963d")
+		storagetesting.AssertListResults(ctx, t, st, "ab", "abcdbbf4f0507d054ed5a80a5b65086f602b", "abgc3dca496d510f492c858a2df1eb824e62")
+
+		for n := range svc.blobs {
+			if !strings.HasPrefix(n, "some/prefix-") {
+				t.Errorf("blob %q stored without prefix", n)
+			}
+		}
+
+		st.Close(ctx) //nolint:errcheck
+		server.Close()
+	}
+}
+
+func TestAzureStorageRetriesServerErrors(t *testing.T) {
+	svc, server := newFakeBlobService(false)
+	defer server.Close()
+
+	ctx := context.Background()
+	st, err := New(ctx, &Options{
+		Container:      testContainer,
+		StorageAccount: testAccount,
+		StorageKey:     testStorageKey,
+		Endpoint:       server.URL,
+	})
+	if err != nil {
+		t.Fatalf("unable to create storage: %v", err)
+	}
+
+	svc.failNextCalls = 1
+	if err := st.PutBlock(ctx, "block1", []byte{1, 2, 3, 4}); err != nil {
+		t.Fatalf("unable to put block: %v", err)
+	}
+
+	storagetesting.AssertGetBlock(ctx, t, st, "block1", []byte{1, 2, 3, 4})
+}
+
+func TestAzureStorageInvalidCredentials(t *testing.T) {
+	_, server := newFakeBlobService(false)
+	defer server.Close()
+
+	ctx := context.Background()
+	st, err := New(ctx, &Options{
+		Container:      testContainer,
+		StorageAccount: testAccount,
+		StorageKey:     base64.StdEncoding.EncodeToString([]byte("wrong key")),
+		Endpoint:       server.URL,
+	})
+	if err != nil {
+		t.Fatalf("unable to create storage: %v", err)
+	}
+
+	if _, err := st.GetBlock(ctx, "block1", 0, -1); err == nil || !strings.Contains(err.Error(), "AuthenticationFailed") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestAzureStorageOptionsValidation(t *testing.T) {
+	ctx := context.Background()
+	for _, opt := range []*Options{
+		{StorageAccount: testAccount, StorageKey: testStorageKey},
+		{Container: testContainer, StorageKey: testStorageKey},
+		{Container: testContainer, StorageAccount: testAccount},
+	} {
+		if _, err := New(ctx, opt); err == nil {
+			t.Errorf("expected error for %+v", opt)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package b2
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/kopia/kopia/internal/retry"
+	"github.com/kopia/kopia/repo/storage"
+)
+
+// authorizeAccountURL is the B2 API endpoint used to obtain authorization token and URLs of other endpoints.
+var authorizeAccountURL = "https://api.backblazeb2.com/b2api/v2/b2_authorize_account"
+
+// apiError is an error returned by the B2 API.
+type apiError struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("B2 error %v (%v): %v", e.Status, e.Code, e.Message)
+}
+
+type retriableError struct {
+	inner error
+}
+
+func (e *retriableError) Error() string {
+	return fmt.Sprintf("retriable: %v", e.inner)
+}
+
+type authorizeAccountResponse struct {
+	AccountID          string `json:"accountId"`
+	AuthorizationToken string `json:"authorizationToken"`
+	APIURL             string `json:"apiUrl"`
+	DownloadURL        string `json:"downloadUrl"`
+}
+
+type uploadURL struct {
+	UploadURL          string `json:"uploadUrl"`
+	AuthorizationToken string `json:"authorizationToken"`
+}
+
+type fileInfo struct {
+	FileID          string `json:"fileId"`
+	FileName        string `json:"fileName"`
+	ContentLength   int64  `json:"contentLength"`
+	Action          string `json:"action"`
+	UploadTimestamp int64  `json:"uploadTimestamp"`
+}
+
+// b2Client is a minimal client of the B2 native API, which takes care of re-authorizing when
+// the authorization token expires and pools upload URLs, each of which can only be used
+// by a single upload at a time.
+type b2Client struct {
+	keyID string
+	key   string
+	hc    *http.Client
+
+	mu         sync.Mutex
+	auth       *authorizeAccountResponse
+	uploadURLs []*uploadURL
+}
+
+func (c *b2Client) withRetry(desc string, attempt retry.AttemptFunc) (interface{}, error) {
+	return retry.WithExponentialBackoff(desc, attempt, func(e error) bool {
+		_, ok := e.(*retriableError)
+		return ok
+	})
+}
+
+// authorization returns current account authorization, obtaining it when necessary.
+func (c *b2Client) authorization() (*authorizeAccountResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.auth != nil {
+		return c.auth, nil
+	}
+
+	req, err := http.NewRequest("GET", authorizeAccountURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(c.keyID, c.key)
+
+	var auth authorizeAccountResponse
+	if err := c.do(req, &auth); err != nil {
+		return nil, err
+	}
+
+	c.auth = &auth
+	return c.auth, nil
+}
+
+// invalidateAuthorization discards the authorization token after it has expired.
+func (c *b2Client) invalidateAuthorization(auth *authorizeAccountResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.auth == auth {
+		c.auth = nil
+		c.uploadURLs = nil
+	}
+}
+
+// do executes the request and decodes JSON response, errors are wrapped in retriableError
+// when it is safe to retry the request.
+func (c *b2Client) do(req *http.Request, result interface{}) error {
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return &retriableError{err}
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return responseError(resp)
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	if b, ok := result.(*[]byte); ok {
+		*b, err = ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return &retriableError{err}
+		}
+		return nil
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return &retriableError{fmt.Errorf("unable to decode response: %v", err)}
+	}
+
+	return nil
+}
+
+func responseError(resp *http.Response) error {
+	e := &apiError{Status: resp.StatusCode}
+	json.NewDecoder(resp.Body).Decode(e) //nolint:errcheck
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized && (e.Code == "expired_auth_token" || e.Code == "bad_auth_token"):
+		return &retriableError{e}
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return &retriableError{e}
+	default:
+		return e
+	}
+}
+
+// handleAuthError invalidates the authorization when the error indicates it has expired.
+func (c *b2Client) handleAuthError(auth *authorizeAccountResponse, err error) {
+	if re, ok := err.(*retriableError); ok {
+		if ae, ok := re.inner.(*apiError); ok && ae.Status == http.StatusUnauthorized {
+			c.invalidateAuthorization(auth)
+		}
+	}
+}
+
+// apiCall invokes the specified B2 API operation with retries.
+func (c *b2Client) apiCall(op string, request, result interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.withRetry(op, func() (interface{}, error) {
+		auth, err := c.authorization()
+		if err != nil {
+			return nil, err
+		}
+
+		req, err := http.NewRequest("POST", auth.APIURL+"/b2api/v2/"+op, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", auth.AuthorizationToken)
+
+		err = c.do(req, result)
+		c.handleAuthError(auth, err)
+		return nil, err
+	})
+
+	return err
+}
+
+// download returns the contents of a given file or its range.
+func (c *b2Client) download(bucketName, fileName string, offset, length int64) ([]byte, error) {
+	v, err := c.withRetry(fmt.Sprintf("download(%q)", fileName), func() (interface{}, error) {
+		auth, err := c.authorization()
+		if err != nil {
+			return nil, err
+		}
+
+		req, err := http.NewRequest("GET", auth.DownloadURL+"/file/"+url.PathEscape(bucketName)+"/"+escapeFileName(fileName), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", auth.AuthorizationToken)
+		if length > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%v-%v", offset, offset+length-1))
+		}
+
+		var data []byte
+		err = c.do(req, &data)
+		c.handleAuthError(auth, err)
+		if ae, ok := err.(*apiError); ok && ae.Status == http.StatusNotFound {
+			return nil, storage.ErrBlockNotFound
+		}
+
+		return data, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return v.([]byte), nil
+}
+
+// upload uploads a file using one of the pooled upload URLs.
+func (c *b2Client) upload(bucketID, fileName string, data []byte) error {
+	sum := sha1.Sum(data)
+
+	_, err := c.withRetry(fmt.Sprintf("upload(%q)", fileName), func() (interface{}, error) {
+		u, err := c.getUploadURL(bucketID)
+		if err != nil {
+			return nil, err
+		}
+
+		var r io.Reader
+		if len(data) > 0 {
+			r = bytes.NewReader(data)
+		}
+
+		req, err := http.NewRequest("POST", u.UploadURL, r)
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = int64(len(data))
+		req.Header.Set("Authorization", u.AuthorizationToken)
+		req.Header.Set("X-Bz-File-Name", escapeFileName(fileName))
+		req.Header.Set("Content-Type", "application/x-kopia")
+		req.Header.Set("X-Bz-Content-Sha1", hex.EncodeToString(sum[:]))
+
+		var fi fileInfo
+		if err := c.do(req, &fi); err != nil {
+			// upload URL may no longer be usable, do not return it to the pool.
+			if ae, ok := err.(*apiError); ok && ae.Status == http.StatusUnauthorized {
+				return nil, &retriableError{err}
+			}
+
+			return nil, err
+		}
+
+		c.releaseUploadURL(u)
+		return nil, nil
+	})
+
+	return err
+}
+
+func (c *b2Client) getUploadURL(bucketID string) (*uploadURL, error) {
+	c.mu.Lock()
+	if n := len(c.uploadURLs); n > 0 {
+		u := c.uploadURLs[n-1]
+		c.uploadURLs = c.uploadURLs[0 : n-1]
+		c.mu.Unlock()
+		return u, nil
+	}
+	c.mu.Unlock()
+
+	var u uploadURL
+	if err := c.apiCall("b2_get_upload_url", map[string]string{"bucketId": bucketID}, &u); err != nil {
+		return nil, err
+	}
+
+	return &u, nil
+}
+
+func (c *b2Client) releaseUploadURL(u *uploadURL) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.uploadURLs = append(c.uploadURLs, u)
+}
+
+// escapeFileName percent-encodes file name as required by B2, preserving slashes.
+func escapeFileName(fileName string) string {
+	parts := strings.Split(fileName, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+
+	return strings.Join(parts, "/")
+}
@@ -0,0 +1,29 @@
+package b2
+
+import (
+	"net/url"
+	"strings"
+)
+
+// Options defines options for Backblaze B2-backed storage.
+type Options struct {
+	// BucketName is the name of the bucket where data is stored.
+	BucketName string `json:"bucket"`
+
+	// Prefix specifies additional string to prepend to all objects.
+	Prefix string `json:"prefix,omitempty"`
+
+	KeyID string `json:"keyID"`
+	Key   string `json:"key" kopia:"sensitive"`
+
+	MaxUploadSpeedBytesPerSecond int `json:"maxUploadSpeedBytesPerSecond,omitempty"`
+
+	MaxDownloadSpeedBytesPerSecond int `json:"maxDownloadSpeedBytesPerSecond,omitempty"`
+}
+
+// ApplyURL sets bucket name and prefix from a URL in the form b2://bucket/prefix.
+func (o *Options) ApplyURL(u *url.URL, subScheme string) error {
+	o.BucketName = u.Host
+	o.Prefix = strings.TrimPrefix(u.Path, "/")
+	return nil
+}
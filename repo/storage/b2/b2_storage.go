@@ -0,0 +1,231 @@
+// Package b2 implements Storage based on a Backblaze B2 bucket using the native B2 API.
+package b2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/efarrer/iothrottler"
+	"github.com/kopia/kopia/internal/throttle"
+	"github.com/kopia/kopia/repo/storage"
+)
+
+const (
+	b2StorageType = "b2"
+
+	maxFileCount = 1000
+)
+
+type b2Storage struct {
+	Options
+
+	cli      *b2Client
+	bucketID string
+
+	downloadThrottler *iothrottler.IOThrottlerPool
+	uploadThrottler   *iothrottler.IOThrottlerPool
+}
+
+func (s *b2Storage) GetBlock(ctx context.Context, b string, offset, length int64) ([]byte, error) {
+	return s.cli.download(s.BucketName, s.getObjectNameString(b), offset, length)
+}
+
+func (s *b2Storage) PutBlock(ctx context.Context, b string, data []byte) error {
+	progressCallback := storage.ProgressCallback(ctx)
+	if progressCallback != nil {
+		progressCallback(b, 0, int64(len(data)))
+		defer progressCallback(b, int64(len(data)), int64(len(data)))
+	}
+
+	return s.cli.upload(s.bucketID, s.getObjectNameString(b), data)
+}
+
+// DeleteBlock deletes all versions of a given file, B2 keeps previous versions of files
+// that have been overwritten and hiding a file would not reclaim any space.
+func (s *b2Storage) DeleteBlock(ctx context.Context, b string) error {
+	fileName := s.getObjectNameString(b)
+
+	var versions []fileInfo
+	req := map[string]interface{}{
+		"bucketId":      s.bucketID,
+		"startFileName": fileName,
+		"prefix":        fileName,
+		"maxFileCount":  maxFileCount,
+	}
+
+	for {
+		var resp struct {
+			Files        []fileInfo `json:"files"`
+			NextFileName *string    `json:"nextFileName"`
+			NextFileID   *string    `json:"nextFileId"`
+		}
+
+		if err := s.cli.apiCall("b2_list_file_versions", req, &resp); err != nil {
+			return fmt.Errorf("unable to list versions of %v: %v", b, err)
+		}
+
+		for _, f := range resp.Files {
+			if f.FileName == fileName {
+				versions = append(versions, f)
+			}
+		}
+
+		if resp.NextFileName == nil || *resp.NextFileName != fileName || resp.NextFileID == nil {
+			break
+		}
+
+		req["startFileId"] = *resp.NextFileID
+	}
+
+	for _, f := range versions {
+		err := s.cli.apiCall("b2_delete_file_version", map[string]string{
+			"fileName": f.FileName,
+			"fileId":   f.FileID,
+		}, nil)
+
+		if ae, ok := err.(*apiError); ok && ae.Status == http.StatusBadRequest && ae.Code == "file_not_present" {
+			// deleted concurrently
+			continue
+		}
+
+		if err != nil {
+			return fmt.Errorf("unable to delete version %v of %v: %v", f.FileID, b, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *b2Storage) getObjectNameString(b string) string {
+	return s.Prefix + b
+}
+
+func (s *b2Storage) ListBlocks(ctx context.Context, prefix string, callback func(storage.BlockMetadata) error) error {
+	req := map[string]interface{}{
+		"bucketId":     s.bucketID,
+		"prefix":       s.getObjectNameString(prefix),
+		"maxFileCount": maxFileCount,
+	}
+
+	for {
+		var resp struct {
+			Files        []fileInfo `json:"files"`
+			NextFileName *string    `json:"nextFileName"`
+		}
+
+		if err := s.cli.apiCall("b2_list_file_names", req, &resp); err != nil {
+			return err
+		}
+
+		for _, f := range resp.Files {
+			if f.Action != "upload" {
+				continue
+			}
+
+			if err := callback(storage.BlockMetadata{
+				BlockID:   f.FileName[len(s.Prefix):],
+				Length:    f.ContentLength,
+				Timestamp: time.Unix(0, f.UploadTimestamp*int64(time.Millisecond)),
+			}); err != nil {
+				return err
+			}
+		}
+
+		if resp.NextFileName == nil {
+			return nil
+		}
+
+		req["startFileName"] = *resp.NextFileName
+	}
+}
+
+func (s *b2Storage) ConnectionInfo() storage.ConnectionInfo {
+	return storage.ConnectionInfo{
+		Type:   b2StorageType,
+		Config: &s.Options,
+	}
+}
+
+func (s *b2Storage) Close(ctx context.Context) error {
+	return nil
+}
+
+func (s *b2Storage) String() string {
+	return fmt.Sprintf("b2://%v/%v", s.BucketName, s.Prefix)
+}
+
+func toBandwidth(bytesPerSecond int) iothrottler.Bandwidth {
+	if bytesPerSecond <= 0 {
+		return iothrottler.Unlimited
+	}
+
+	return iothrottler.Bandwidth(bytesPerSecond) * iothrottler.BytesPerSecond
+}
+
+// New creates new B2-backed storage with specified options:
+//
+// - the 'BucketName', 'KeyID' and 'Key' fields are required and all other parameters are optional.
+func New(ctx context.Context, opt *Options) (storage.Storage, error) {
+	if opt.BucketName == "" {
+		return nil, errors.New("bucket name must be specified")
+	}
+
+	if opt.KeyID == "" || opt.Key == "" {
+		return nil, errors.New("key ID and key must be specified")
+	}
+
+	downloadThrottler := iothrottler.NewIOThrottlerPool(toBandwidth(opt.MaxDownloadSpeedBytesPerSecond))
+	uploadThrottler := iothrottler.NewIOThrottlerPool(toBandwidth(opt.MaxUploadSpeedBytesPerSecond))
+
+	cli := &b2Client{
+		keyID: opt.KeyID,
+		key:   opt.Key,
+		hc: &http.Client{
+			Transport: throttle.NewRoundTripper(http.DefaultTransport, downloadThrottler, uploadThrottler),
+		},
+	}
+
+	auth, err := cli.authorization()
+	if err != nil {
+		return nil, fmt.Errorf("unable to authorize: %v", err)
+	}
+
+	var resp struct {
+		Buckets []struct {
+			BucketID string `json:"bucketId"`
+		} `json:"buckets"`
+	}
+
+	if err := cli.apiCall("b2_list_buckets", map[string]string{
+		"accountId":  auth.AccountID,
+		"bucketName": opt.BucketName,
+	}, &resp); err != nil {
+		return nil, fmt.Errorf("unable to look up bucket: %v", err)
+	}
+
+	if len(resp.Buckets) != 1 {
+		return nil, fmt.Errorf("bucket %q not found", opt.BucketName)
+	}
+
+	return &b2Storage{
+		Options:           *opt,
+		cli:               cli,
+		bucketID:          resp.Buckets[0].BucketID,
+		downloadThrottler: downloadThrottler,
+		uploadThrottler:   uploadThrottler,
+	}, nil
+}
+
+func init() {
+	storage.AddSupportedStorage(
+		b2StorageType,
+		func() interface{} {
+			return &Options{}
+		},
+		func(ctx context.Context, o interface{}) (storage.Storage, error) {
+			return New(ctx, o.(*Options))
+		})
+}
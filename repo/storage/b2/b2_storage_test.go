@@ -0,0 +1,495 @@
+package b2
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kopia/kopia/repo/internal/storagetesting"
+)
+
+const (
+	testKeyID      = "test-key-id"
+	testKey        = "test-key"
+	testBucketName = "kopia-bucket"
+	testBucketID   = "bucket-id-1"
+)
+
+type fakeFileVersion struct {
+	id       string
+	name     string
+	data     []byte
+	uploaded time.Time
+}
+
+// fakeB2 implements the subset of B2 native API used by b2Storage.
+type fakeB2 struct {
+	server   *httptest.Server
+	pageSize int
+
+	mu              sync.Mutex
+	versions        []*fakeFileVersion // in upload order
+	nextID          int
+	token           string
+	uploadTokens    map[string]bool
+	authorizeCount  int
+	failNextUploads int
+}
+
+func newFakeB2() *fakeB2 {
+	f := &fakeB2{
+		pageSize:     2,
+		uploadTokens: map[string]bool{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/b2api/v2/b2_authorize_account", f.authorizeAccount)
+	mux.HandleFunc("/b2api/v2/b2_list_buckets", f.apiHandler(f.listBuckets))
+	mux.HandleFunc("/b2api/v2/b2_get_upload_url", f.apiHandler(f.getUploadURL))
+	mux.HandleFunc("/b2api/v2/b2_list_file_names", f.apiHandler(f.listFileNames))
+	mux.HandleFunc("/b2api/v2/b2_list_file_versions", f.apiHandler(f.listFileVersions))
+	mux.HandleFunc("/b2api/v2/b2_delete_file_version", f.apiHandler(f.deleteFileVersion))
+	mux.HandleFunc("/upload/", f.upload)
+	mux.HandleFunc("/file/", f.download)
+
+	f.server = httptest.NewServer(mux)
+	return f
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(apiError{Status: status, Code: code, Message: code}) //nolint:errcheck
+}
+
+func (f *fakeB2) expireToken() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.token = ""
+	f.uploadTokens = map[string]bool{}
+}
+
+func (f *fakeB2) authorizeAccount(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if u, p, ok := r.BasicAuth(); !ok || u != testKeyID || p != testKey {
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	f.authorizeCount++
+	f.token = fmt.Sprintf("token-%v", f.authorizeCount)
+
+	json.NewEncoder(w).Encode(authorizeAccountResponse{ //nolint:errcheck
+		AccountID:          "account-1",
+		AuthorizationToken: f.token,
+		APIURL:             f.server.URL,
+		DownloadURL:        f.server.URL,
+	})
+}
+
+func (f *fakeB2) apiHandler(h func(req map[string]interface{}) (interface{}, int, string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		if f.token == "" || r.Header.Get("Authorization") != f.token {
+			writeError(w, http.StatusUnauthorized, "expired_auth_token")
+			return
+		}
+
+		var req map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "bad_request")
+			return
+		}
+
+		resp, status, code := h(req)
+		if status != http.StatusOK {
+			writeError(w, status, code)
+			return
+		}
+
+		json.NewEncoder(w).Encode(resp) //nolint:errcheck
+	}
+}
+
+func (f *fakeB2) listBuckets(req map[string]interface{}) (interface{}, int, string) {
+	type bucket struct {
+		BucketID string `json:"bucketId"`
+	}
+
+	var buckets []bucket
+	if req["bucketName"] == testBucketName {
+		buckets = append(buckets, bucket{testBucketID})
+	}
+
+	return map[string]interface{}{"buckets": buckets}, http.StatusOK, ""
+}
+
+func (f *fakeB2) getUploadURL(req map[string]interface{}) (interface{}, int, string) {
+	if req["bucketId"] != testBucketID {
+		return nil, http.StatusBadRequest, "bad_bucket_id"
+	}
+
+	f.nextID++
+	token := fmt.Sprintf("upload-token-%v", f.nextID)
+	f.uploadTokens[token] = true
+
+	return uploadURL{
+		UploadURL:          f.server.URL + "/upload/" + testBucketID,
+		AuthorizationToken: token,
+	}, http.StatusOK, ""
+}
+
+// sortedVersions returns file versions sorted by name and reverse upload order, like B2 does.
+func (f *fakeB2) sortedVersions() []*fakeFileVersion {
+	result := append([]*fakeFileVersion(nil), f.versions...)
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].name != result[j].name {
+			return result[i].name < result[j].name
+		}
+
+		return result[i].uploaded.After(result[j].uploaded)
+	})
+
+	return result
+}
+
+func toFileInfo(v *fakeFileVersion) fileInfo {
+	return fileInfo{
+		FileID:          v.id,
+		FileName:        v.name,
+		ContentLength:   int64(len(v.data)),
+		Action:          "upload",
+		UploadTimestamp: v.uploaded.UnixNano() / int64(time.Millisecond),
+	}
+}
+
+func (f *fakeB2) listFileNames(req map[string]interface{}) (interface{}, int, string) {
+	prefix, _ := req["prefix"].(string)
+	start, _ := req["startFileName"].(string)
+
+	var files []fileInfo
+	var nextFileName *string
+	lastName := ""
+
+	for _, v := range f.sortedVersions() {
+		if v.name == lastName || !strings.HasPrefix(v.name, prefix) || v.name < start {
+			continue
+		}
+		lastName = v.name
+
+		if len(files) == f.pageSize {
+			n := v.name
+			nextFileName = &n
+			break
+		}
+
+		files = append(files, toFileInfo(v))
+	}
+
+	return map[string]interface{}{"files": files, "nextFileName": nextFileName}, http.StatusOK, ""
+}
+
+func (f *fakeB2) listFileVersions(req map[string]interface{}) (interface{}, int, string) {
+	prefix, _ := req["prefix"].(string)
+	startName, _ := req["startFileName"].(string)
+	startID, _ := req["startFileId"].(string)
+
+	var files []fileInfo
+	var nextFileName, nextFileID *string
+	started := startID == ""
+
+	for _, v := range f.sortedVersions() {
+		if !strings.HasPrefix(v.name, prefix) || v.name < startName {
+			continue
+		}
+
+		if !started {
+			if v.id != startID {
+				continue
+			}
+			started = true
+		}
+
+		if len(files) == f.pageSize {
+			n, id := v.name, v.id
+			nextFileName, nextFileID = &n, &id
+			break
+		}
+
+		files = append(files, toFileInfo(v))
+	}
+
+	return map[string]interface{}{"files": files, "nextFileName": nextFileName, "nextFileId": nextFileID}, http.StatusOK, ""
+}
+
+func (f *fakeB2) deleteFileVersion(req map[string]interface{}) (interface{}, int, string) {
+	for i, v := range f.versions {
+		if v.id == req["fileId"] && v.name == req["fileName"] {
+			f.versions = append(f.versions[0:i], f.versions[i+1:]...)
+			return map[string]interface{}{}, http.StatusOK, ""
+		}
+	}
+
+	return nil, http.StatusBadRequest, "file_not_present"
+}
+
+func (f *fakeB2) upload(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	token := r.Header.Get("Authorization")
+	if !f.uploadTokens[token] {
+		writeError(w, http.StatusUnauthorized, "expired_auth_token")
+		return
+	}
+
+	if f.failNextUploads > 0 {
+		f.failNextUploads--
+		// B2 asks clients to obtain a new upload URL after such failures.
+		delete(f.uploadTokens, token)
+		writeError(w, http.StatusServiceUnavailable, "service_unavailable")
+		return
+	}
+
+	data, _ := ioutil.ReadAll(r.Body)
+	sum := sha1.Sum(data)
+	if r.Header.Get("X-Bz-Content-Sha1") != hex.EncodeToString(sum[:]) {
+		writeError(w, http.StatusBadRequest, "bad_request")
+		return
+	}
+
+	name, err := url.PathUnescape(r.Header.Get("X-Bz-File-Name"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request")
+		return
+	}
+
+	f.nextID++
+	v := &fakeFileVersion{
+		id:       fmt.Sprintf("file-%v", f.nextID),
+		name:     name,
+		data:     data,
+		uploaded: time.Now().Add(time.Duration(f.nextID) * time.Millisecond),
+	}
+	f.versions = append(f.versions, v)
+
+	json.NewEncoder(w).Encode(toFileInfo(v)) //nolint:errcheck
+}
+
+func (f *fakeB2) download(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.token == "" || r.Header.Get("Authorization") != f.token {
+		writeError(w, http.StatusUnauthorized, "expired_auth_token")
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/file/"+testBucketName+"/")
+
+	var latest *fakeFileVersion
+	for _, v := range f.versions {
+		if v.name == name {
+			latest = v
+		}
+	}
+
+	if latest == nil {
+		writeError(w, http.StatusNotFound, "not_found")
+		return
+	}
+
+	if rng := r.Header.Get("Range"); rng != "" {
+		var start, end int
+		if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &start, &end); err != nil || end >= len(latest.data) || start > end {
+			writeError(w, http.StatusRequestedRangeNotSatisfiable, "range_not_satisfiable")
+			return
+		}
+
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(latest.data[start : end+1]) //nolint:errcheck
+		return
+	}
+
+	w.Write(latest.data) //nolint:errcheck
+}
+
+func (f *fakeB2) versionCount(name string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	cnt := 0
+	for _, v := range f.versions {
+		if v.name == name {
+			cnt++
+		}
+	}
+
+	return cnt
+}
+
+func newTestStorage(t *testing.T) (*fakeB2, *b2Storage, func()) {
+	f := newFakeB2()
+
+	oldURL := authorizeAccountURL
+	authorizeAccountURL = f.server.URL + "/b2api/v2/b2_authorize_account"
+
+	st, err := New(context.Background(), &Options{
+		BucketName: testBucketName,
+		Prefix:     "prefix/",
+		KeyID:      testKeyID,
+		Key:        testKey,
+	})
+	if err != nil {
+		t.Fatalf("unable to create storage: %v", err)
+	}
+
+	return f, st.(*b2Storage), func() {
+		authorizeAccountURL = oldURL
+		f.server.Close()
+	}
+}
+
+func TestB2Storage(t *testing.T) {
+	_, st, cleanup := newTestStorage(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	storagetesting.VerifyStorage(ctx, t, st)
+
+	if err := st.DeleteBlock(ctx, "no-such-block"); err != nil {
+		t.Errorf("unable to delete non-existent block: %v", err)
+	}
+
+	if err := st.DeleteBlock(ctx, "abff4585856ebf0748fd989e1dd623a8963d"); err != nil {
+		t.Errorf("unable to delete block: %v", err)
+	}
+
+	storagetesting.AssertGetBlockNotFound(ctx, t, st, "abff4585856ebf0748fd989e1dd623a8963d")
+	storagetesting.AssertListResults(ctx, t, st, "ab", "abcdbbf4f0507d054ed5a80a5b65086f602b", "abgc3dca496d510f492c858a2df1eb824e62")
+}
+
+func TestB2StorageDeletesAllVersions(t *testing.T) {
+	f, st, cleanup := newTestStorage(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	// more versions than fit on a single page of results.
+	for i := 0; i < 5; i++ {
+		if err := st.PutBlock(ctx, "block1", []byte{byte(i), 1}); err != nil {
+			t.Fatalf("unable to put block: %v", err)
+		}
+	}
+
+	if err := st.PutBlock(ctx, "block10", []byte{1, 2}); err != nil {
+		t.Fatalf("unable to put block: %v", err)
+	}
+
+	storagetesting.AssertGetBlock(ctx, t, st, "block1", []byte{4, 1})
+
+	if got, want := f.versionCount("prefix/block1"), 5; got != want {
+		t.Errorf("unexpected number of versions: %v, want %v", got, want)
+	}
+
+	if err := st.DeleteBlock(ctx, "block1"); err != nil {
+		t.Fatalf("unable to delete block: %v", err)
+	}
+
+	if got := f.versionCount("prefix/block1"); got != 0 {
+		t.Errorf("some versions were not deleted: %v", got)
+	}
+
+	storagetesting.AssertGetBlockNotFound(ctx, t, st, "block1")
+	storagetesting.AssertGetBlock(ctx, t, st, "block10", []byte{1, 2})
+	storagetesting.AssertListResults(ctx, t, st, "block", "block10")
+}
+
+func TestB2StorageReauthorizes(t *testing.T) {
+	f, st, cleanup := newTestStorage(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	if err := st.PutBlock(ctx, "block1", []byte{1, 2}); err != nil {
+		t.Fatalf("unable to put block: %v", err)
+	}
+
+	f.expireToken()
+	storagetesting.AssertGetBlock(ctx, t, st, "block1", []byte{1, 2})
+
+	f.expireToken()
+	if err := st.PutBlock(ctx, "block2", []byte{3, 4}); err != nil {
+		t.Fatalf("unable to put block after token expiration: %v", err)
+	}
+
+	f.expireToken()
+	storagetesting.AssertListResults(ctx, t, st, "", "block1", "block2")
+
+	if f.authorizeCount < 4 {
+		t.Errorf("expected client to re-authorize, got %v authorizations", f.authorizeCount)
+	}
+}
+
+func TestB2StorageReusesUploadURLs(t *testing.T) {
+	f, st, cleanup := newTestStorage(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		if err := st.PutBlock(ctx, fmt.Sprintf("block%v", i), []byte{1, 2}); err != nil {
+			t.Fatalf("unable to put block: %v", err)
+		}
+	}
+
+	if got := len(f.uploadTokens); got != 1 {
+		t.Errorf("unexpected number of upload URLs: %v", got)
+	}
+
+	// failed upload discards the upload URL and retries using a new one.
+	f.failNextUploads = 1
+	if err := st.PutBlock(ctx, "block-retried", []byte{1, 2}); err != nil {
+		t.Fatalf("unable to put block: %v", err)
+	}
+
+	storagetesting.AssertGetBlock(ctx, t, st, "block-retried", []byte{1, 2})
+}
+
+func TestB2StorageInvalidCredentials(t *testing.T) {
+	f := newFakeB2()
+	defer f.server.Close()
+
+	oldURL := authorizeAccountURL
+	authorizeAccountURL = f.server.URL + "/b2api/v2/b2_authorize_account"
+	defer func() { authorizeAccountURL = oldURL }()
+
+	if _, err := New(context.Background(), &Options{
+		BucketName: testBucketName,
+		KeyID:      testKeyID,
+		Key:        "wrong-key",
+	}); err == nil {
+		t.Errorf("expected error")
+	}
+
+	if _, err := New(context.Background(), &Options{
+		BucketName: "no-such-bucket",
+		KeyID:      testKeyID,
+		Key:        testKey,
+	}); err == nil {
+		t.Errorf("expected error")
+	}
+}
@@ -1,6 +1,10 @@
 package filesystem
 
-import "os"
+import (
+	"errors"
+	"net/url"
+	"os"
+)
 
 // Options defines options for Filesystem-backed storage.
 type Options struct {
@@ -38,3 +42,19 @@ func (fso *Options) shards() []int {
 
 	return fso.DirectoryShards
 }
+
+// ApplyURL sets the path from a URL in the form filesystem:///path/to/repository.
+func (fso *Options) ApplyURL(u *url.URL, subScheme string) error {
+	if u.Opaque != "" {
+		// relative path, such as filesystem:path/to/repository
+		fso.Path = u.Opaque
+	} else {
+		fso.Path = u.Host + u.Path
+	}
+
+	if fso.Path == "" {
+		return errors.New("path must be specified")
+	}
+
+	return nil
+}
@@ -1,5 +1,10 @@
 package gcs
 
+import (
+	"net/url"
+	"strings"
+)
+
 // Options defines options Google Cloud Storage-backed storage.
 type Options struct {
 	// BucketName is the name of the GCS bucket where data is stored.
@@ -18,3 +23,10 @@ type Options struct {
 
 	MaxDownloadSpeedBytesPerSecond int `json:"maxDownloadSpeedBytesPerSecond,omitempty"`
 }
+
+// ApplyURL sets bucket name and prefix from a URL in the form gcs://bucket/prefix.
+func (o *Options) ApplyURL(u *url.URL, subScheme string) error {
+	o.BucketName = u.Host
+	o.Prefix = strings.TrimPrefix(u.Path, "/")
+	return nil
+}
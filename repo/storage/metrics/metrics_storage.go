@@ -0,0 +1,96 @@
+// Package metrics implements wrapper around Storage that exposes Prometheus metrics of all storage operations.
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/kopia/kopia/repo/storage"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metricOperations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kopia_storage_operations_total",
+		Help: "Number of storage operations, by storage type, method and result.",
+	}, []string{"storage", "method", "result"})
+
+	metricOperationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "kopia_storage_operation_duration_seconds",
+		Help:    "Duration of storage operations, by storage type and method.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"storage", "method"})
+
+	metricBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kopia_storage_bytes_total",
+		Help: "Number of bytes transferred to and from storage, by storage type and direction.",
+	}, []string{"storage", "direction"})
+)
+
+type metricsStorage struct {
+	base        storage.Storage
+	storageType string
+}
+
+func (s *metricsStorage) observe(method string, t0 time.Time, err error) {
+	result := "success"
+	switch err {
+	case nil:
+	case storage.ErrBlockNotFound:
+		result = "not_found"
+	default:
+		result = "error"
+	}
+
+	metricOperations.WithLabelValues(s.storageType, method, result).Inc()
+	metricOperationDuration.WithLabelValues(s.storageType, method).Observe(time.Since(t0).Seconds())
+}
+
+func (s *metricsStorage) GetBlock(ctx context.Context, id string, offset, length int64) ([]byte, error) {
+	t0 := time.Now()
+	result, err := s.base.GetBlock(ctx, id, offset, length)
+	s.observe("GetBlock", t0, err)
+	metricBytes.WithLabelValues(s.storageType, "read").Add(float64(len(result)))
+	return result, err
+}
+
+func (s *metricsStorage) PutBlock(ctx context.Context, id string, data []byte) error {
+	t0 := time.Now()
+	err := s.base.PutBlock(ctx, id, data)
+	s.observe("PutBlock", t0, err)
+	if err == nil {
+		metricBytes.WithLabelValues(s.storageType, "write").Add(float64(len(data)))
+	}
+	return err
+}
+
+func (s *metricsStorage) DeleteBlock(ctx context.Context, id string) error {
+	t0 := time.Now()
+	err := s.base.DeleteBlock(ctx, id)
+	s.observe("DeleteBlock", t0, err)
+	return err
+}
+
+func (s *metricsStorage) ListBlocks(ctx context.Context, prefix string, callback func(storage.BlockMetadata) error) error {
+	t0 := time.Now()
+	err := s.base.ListBlocks(ctx, prefix, callback)
+	s.observe("ListBlocks", t0, err)
+	return err
+}
+
+func (s *metricsStorage) Close(ctx context.Context) error {
+	return s.base.Close(ctx)
+}
+
+func (s *metricsStorage) ConnectionInfo() storage.ConnectionInfo {
+	return s.base.ConnectionInfo()
+}
+
+// NewWrapper returns a Storage wrapper that records metrics of all storage operations.
+func NewWrapper(wrapped storage.Storage) storage.Storage {
+	return &metricsStorage{
+		base:        wrapped,
+		storageType: wrapped.ConnectionInfo().Type,
+	}
+}
@@ -0,0 +1,37 @@
+package metrics
+
+import (
+	"context"
+	"testing"
+
+	"github.com/kopia/kopia/repo/internal/storagetesting"
+	"github.com/kopia/kopia/repo/storage"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsStorage(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	r := NewWrapper(storagetesting.NewMapStorage(data, nil, nil))
+
+	storagetesting.VerifyStorage(ctx, t, r)
+
+	// map storage reports empty storage type
+	before := testutil.ToFloat64(metricOperations.WithLabelValues("", "GetBlock", "not_found"))
+	if _, err := r.GetBlock(ctx, "no-such-block", 0, -1); err != storage.ErrBlockNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if got, want := testutil.ToFloat64(metricOperations.WithLabelValues("", "GetBlock", "not_found")), before+1; got != want {
+		t.Errorf("unexpected not_found count: %v, want %v", got, want)
+	}
+
+	written := testutil.ToFloat64(metricBytes.WithLabelValues("", "write"))
+	if err := r.PutBlock(ctx, "some-block", []byte{1, 2, 3, 4}); err != nil {
+		t.Fatalf("unable to put block: %v", err)
+	}
+
+	if got, want := testutil.ToFloat64(metricBytes.WithLabelValues("", "write")), written+4; got != want {
+		t.Errorf("unexpected written bytes: %v, want %v", got, want)
+	}
+}
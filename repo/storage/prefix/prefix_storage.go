@@ -0,0 +1,46 @@
+// Package prefix implements wrapper around Storage that stores all blocks with a common name prefix.
+package prefix
+
+import (
+	"context"
+
+	"github.com/kopia/kopia/repo/storage"
+)
+
+type prefixStorage struct {
+	base   storage.Storage
+	prefix string
+}
+
+func (s *prefixStorage) GetBlock(ctx context.Context, id string, offset, length int64) ([]byte, error) {
+	return s.base.GetBlock(ctx, s.prefix+id, offset, length)
+}
+
+func (s *prefixStorage) PutBlock(ctx context.Context, id string, data []byte) error {
+	return s.base.PutBlock(ctx, s.prefix+id, data)
+}
+
+func (s *prefixStorage) DeleteBlock(ctx context.Context, id string) error {
+	return s.base.DeleteBlock(ctx, s.prefix+id)
+}
+
+func (s *prefixStorage) ListBlocks(ctx context.Context, prefix string, callback func(storage.BlockMetadata) error) error {
+	return s.base.ListBlocks(ctx, s.prefix+prefix, func(bm storage.BlockMetadata) error {
+		bm.BlockID = bm.BlockID[len(s.prefix):]
+		return callback(bm)
+	})
+}
+
+func (s *prefixStorage) Close(ctx context.Context) error {
+	return s.base.Close(ctx)
+}
+
+func (s *prefixStorage) ConnectionInfo() storage.ConnectionInfo {
+	return s.base.ConnectionInfo()
+}
+
+// NewWrapper returns a Storage wrapper that adds the provided prefix to names of all blocks
+// and only lists blocks whose names start with it.
+func NewWrapper(wrapped storage.Storage, prefix string) storage.Storage {
+	return &prefixStorage{base: wrapped, prefix: prefix}
+}
@@ -0,0 +1,31 @@
+package prefix
+
+import (
+	"context"
+	"testing"
+
+	"github.com/kopia/kopia/repo/internal/storagetesting"
+)
+
+func TestPrefixStorage(t *testing.T) {
+	ctx := context.Background()
+	data := map[string][]byte{}
+	base := storagetesting.NewMapStorage(data, nil, nil)
+	r := NewWrapper(base, "g1")
+
+	storagetesting.VerifyStorage(ctx, t, r)
+
+	if err := base.PutBlock(ctx, "xyz1", []byte{1}); err != nil {
+		t.Fatalf("unable to put block: %v", err)
+	}
+
+	if err := r.PutBlock(ctx, "xyz1", []byte{2}); err != nil {
+		t.Fatalf("unable to put block: %v", err)
+	}
+
+	storagetesting.AssertGetBlock(ctx, t, base, "g1xyz1", []byte{2})
+	storagetesting.AssertGetBlock(ctx, t, r, "xyz1", []byte{2})
+	storagetesting.AssertGetBlock(ctx, t, base, "xyz1", []byte{1})
+	storagetesting.AssertListResults(ctx, t, r, "xy", "xyz1")
+	storagetesting.AssertListResults(ctx, t, base, "xy", "xyz1")
+}
@@ -3,6 +3,11 @@ package providers
 
 import (
 	// Register well-known blob storage providers
+	_ "github.com/kopia/kopia/repo/storage/azure"
+	_ "github.com/kopia/kopia/repo/storage/b2"
 	_ "github.com/kopia/kopia/repo/storage/filesystem"
 	_ "github.com/kopia/kopia/repo/storage/gcs"
+	_ "github.com/kopia/kopia/repo/storage/s3"
+	_ "github.com/kopia/kopia/repo/storage/sftp"
+	_ "github.com/kopia/kopia/repo/storage/webdav"
 )
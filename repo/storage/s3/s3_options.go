@@ -1,5 +1,10 @@
 package s3
 
+import (
+	"net/url"
+	"strings"
+)
+
 // Options defines options for S3-based storage.
 type Options struct {
 	// BucketName is the name of the bucket where data is stored.
@@ -18,3 +23,14 @@ type Options struct {
 
 	MaxDownloadSpeedBytesPerSecond int `json:"maxDownloadSpeedBytesPerSecond,omitempty"`
 }
+
+// ApplyURL sets bucket name and prefix from a URL in the form s3://bucket/prefix.
+func (o *Options) ApplyURL(u *url.URL, subScheme string) error {
+	o.BucketName = u.Host
+	o.Prefix = strings.TrimPrefix(u.Path, "/")
+	if o.Endpoint == "" {
+		o.Endpoint = defaultEndpoint
+	}
+
+	return nil
+}
@@ -16,7 +16,8 @@ import (
 )
 
 const (
-	s3storageType = "s3"
+	s3storageType   = "s3"
+	defaultEndpoint = "s3.amazonaws.com"
 )
 
 type s3Storage struct {
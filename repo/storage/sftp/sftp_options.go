@@ -0,0 +1,66 @@
+package sftp
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+)
+
+// Options defines options for SFTP-backed storage.
+type Options struct {
+	// Path is the directory on the remote host where the repository is stored.
+	Path string `json:"path"`
+
+	Host     string `json:"host"`
+	Port     int    `json:"port,omitempty"`
+	Username string `json:"username"`
+
+	// Keyfile is the path to the private key file used for authentication, KeyData may be used
+	// to specify the PEM-encoded key directly instead.
+	Keyfile string `json:"keyfile,omitempty"`
+	KeyData string `json:"keyData,omitempty" kopia:"sensitive"`
+
+	// KnownHostsFile is the path to known_hosts file used to verify the identity of the host.
+	KnownHostsFile string `json:"knownHostsFile"`
+
+	DirectoryShards []int `json:"dirShards"`
+}
+
+func (o *Options) port() int {
+	if o.Port == 0 {
+		return defaultPort
+	}
+
+	return o.Port
+}
+
+func (o *Options) shards() []int {
+	if o.DirectoryShards == nil {
+		return fsDefaultShards
+	}
+
+	return o.DirectoryShards
+}
+
+// ApplyURL sets host, port, user name and path from a URL in the form sftp://user@host[:port]/path.
+func (o *Options) ApplyURL(u *url.URL, subScheme string) error {
+	if u.Hostname() == "" {
+		return errors.New("host must be specified")
+	}
+
+	o.Host = u.Hostname()
+	if p := u.Port(); p != "" {
+		port, err := strconv.Atoi(p)
+		if err != nil {
+			return err
+		}
+		o.Port = port
+	}
+
+	if u.User != nil {
+		o.Username = u.User.Username()
+	}
+
+	o.Path = u.Path
+	return nil
+}
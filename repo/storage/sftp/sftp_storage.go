@@ -0,0 +1,346 @@
+// Package sftp implements Storage on a remote host accessed using SFTP.
+package sftp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/kopia/kopia/internal/kopialogging"
+	"github.com/kopia/kopia/repo/storage"
+	psftp "github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var log = kopialogging.Logger("kopia/sftp")
+
+const (
+	sftpStorageType      = "sftp"
+	fsStorageChunkSuffix = ".f"
+	defaultPort          = 22
+)
+
+var (
+	fsDefaultShards = []int{3, 3}
+)
+
+// sftpStorage implements storage.Storage on top of a remote directory accessed over SFTP.
+// It uses the same sharded directory layout as the filesystem storage, so a repository may be
+// accessed using SFTP or File interchangeably.
+type sftpStorage struct {
+	Options
+
+	conn *ssh.Client
+	cli  *psftp.Client
+}
+
+func (s *sftpStorage) GetBlock(ctx context.Context, blockID string, offset, length int64) ([]byte, error) {
+	_, p := s.getShardedPathAndFilePath(blockID)
+
+	f, err := s.cli.Open(p)
+	if isNotExist(err) {
+		return nil, storage.ErrBlockNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() //nolint:errcheck
+
+	if length < 0 {
+		return ioutil.ReadAll(f)
+	}
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(io.LimitReader(f, length))
+}
+
+func getBlockIDFromFileName(name string) (string, bool) {
+	if strings.HasSuffix(name, fsStorageChunkSuffix) {
+		return name[0 : len(name)-len(fsStorageChunkSuffix)], true
+	}
+
+	return "", false
+}
+
+func makeFileName(blockID string) string {
+	return blockID + fsStorageChunkSuffix
+}
+
+func (s *sftpStorage) ListBlocks(ctx context.Context, prefix string, callback func(storage.BlockMetadata) error) error {
+	var walkDir func(string, string) error
+
+	walkDir = func(directory string, currentPrefix string) error {
+		entries, err := s.cli.ReadDir(directory)
+		if err != nil {
+			return err
+		}
+
+		// unlike ioutil.ReadDir(), SFTP returns entries in arbitrary order.
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].Name() < entries[j].Name()
+		})
+
+		for _, e := range entries {
+			if e.IsDir() {
+				newPrefix := currentPrefix + e.Name()
+				var match bool
+
+				if len(prefix) > len(newPrefix) {
+					match = strings.HasPrefix(prefix, newPrefix)
+				} else {
+					match = strings.HasPrefix(newPrefix, prefix)
+				}
+
+				if match {
+					if err := walkDir(directory+"/"+e.Name(), currentPrefix+e.Name()); err != nil {
+						return err
+					}
+				}
+			} else if fullID, ok := getBlockIDFromFileName(currentPrefix + e.Name()); ok {
+				if strings.HasPrefix(fullID, prefix) {
+					if err := callback(storage.BlockMetadata{
+						BlockID:   fullID,
+						Length:    e.Size(),
+						Timestamp: e.ModTime(),
+					}); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		return nil
+	}
+
+	return walkDir(s.Path, "")
+}
+
+func (s *sftpStorage) PutBlock(ctx context.Context, blockID string, data []byte) error {
+	dirPath, p := s.getShardedPathAndFilePath(blockID)
+
+	tempFile := fmt.Sprintf("%s.tmp.%d", p, rand.Int())
+	f, err := s.createTempFileAndDir(dirPath, tempFile)
+	if err != nil {
+		return fmt.Errorf("cannot create temporary file: %v", err)
+	}
+
+	if _, err = f.Write(data); err != nil {
+		f.Close() //nolint:errcheck
+		s.removeTempFile(tempFile)
+		return fmt.Errorf("can't write temporary file: %v", err)
+	}
+
+	if err = f.Close(); err != nil {
+		s.removeTempFile(tempFile)
+		return fmt.Errorf("can't close temporary file: %v", err)
+	}
+
+	if err = s.rename(tempFile, p); err != nil {
+		s.removeTempFile(tempFile)
+		return err
+	}
+
+	return nil
+}
+
+// rename atomically replaces the target file, plain SFTP rename fails when the target exists,
+// so the POSIX rename extension is preferred when supported by the server.
+func (s *sftpStorage) rename(oldPath, newPath string) error {
+	if err := s.cli.PosixRename(oldPath, newPath); err == nil {
+		return nil
+	}
+
+	return s.cli.Rename(oldPath, newPath)
+}
+
+func (s *sftpStorage) removeTempFile(tempFile string) {
+	if err := s.cli.Remove(tempFile); err != nil && !isNotExist(err) {
+		log.Warningf("can't remove temp file: %v", err)
+	}
+}
+
+func (s *sftpStorage) createTempFileAndDir(dirPath, tempFile string) (*psftp.File, error) {
+	flags := os.O_CREATE | os.O_WRONLY | os.O_EXCL
+	f, err := s.cli.OpenFile(tempFile, flags)
+	if isNotExist(err) {
+		if err = s.cli.MkdirAll(dirPath); err != nil {
+			return nil, fmt.Errorf("cannot create directory: %v", err)
+		}
+		return s.cli.OpenFile(tempFile, flags)
+	}
+
+	return f, err
+}
+
+func (s *sftpStorage) DeleteBlock(ctx context.Context, blockID string) error {
+	_, p := s.getShardedPathAndFilePath(blockID)
+	err := s.cli.Remove(p)
+	if err == nil || isNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+func (s *sftpStorage) getShardDirectory(blockID string) (string, string) {
+	shardPath := s.Path
+	if len(blockID) < 20 {
+		return shardPath, blockID
+	}
+	for _, size := range s.shards() {
+		shardPath = path.Join(shardPath, blockID[0:size])
+		blockID = blockID[size:]
+	}
+
+	return shardPath, blockID
+}
+
+func (s *sftpStorage) getShardedPathAndFilePath(blockID string) (string, string) {
+	shardPath, blockID := s.getShardDirectory(blockID)
+	result := path.Join(shardPath, makeFileName(blockID))
+	return shardPath, result
+}
+
+func (s *sftpStorage) ConnectionInfo() storage.ConnectionInfo {
+	return storage.ConnectionInfo{
+		Type:   sftpStorageType,
+		Config: &s.Options,
+	}
+}
+
+func (s *sftpStorage) Close(ctx context.Context) error {
+	s.cli.Close() //nolint:errcheck
+	return s.conn.Close()
+}
+
+func (s *sftpStorage) String() string {
+	return fmt.Sprintf("sftp://%v@%v:%v%v", s.Username, s.Host, s.port(), s.Path)
+}
+
+func isNotExist(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if os.IsNotExist(err) {
+		return true
+	}
+
+	if se, ok := err.(*psftp.StatusError); ok {
+		return se.FxCode() == psftp.ErrSSHFxNoSuchFile
+	}
+
+	return false
+}
+
+func getSigner(opt *Options) (ssh.Signer, error) {
+	var key []byte
+
+	switch {
+	case opt.KeyData != "":
+		key = []byte(opt.KeyData)
+
+	case opt.Keyfile != "":
+		var err error
+		if key, err = ioutil.ReadFile(opt.Keyfile); err != nil {
+			return nil, fmt.Errorf("unable to read private key: %v", err)
+		}
+
+	default:
+		return nil, errors.New("private key must be specified")
+	}
+
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse private key: %v", err)
+	}
+
+	return signer, nil
+}
+
+func createSSHConfig(opt *Options) (*ssh.ClientConfig, error) {
+	if opt.KnownHostsFile == "" {
+		return nil, errors.New("known hosts file must be specified")
+	}
+
+	hostKeyCallback, err := knownhosts.New(opt.KnownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load known hosts: %v", err)
+	}
+
+	signer, err := getSigner(opt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ssh.ClientConfig{
+		User:            opt.Username,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+	}, nil
+}
+
+// New creates new SFTP-backed storage in a specified directory on the remote host.
+//
+// The identity of the host is verified using the provided known_hosts file and the
+// connection is authenticated using the private key.
+func New(ctx context.Context, opt *Options) (storage.Storage, error) {
+	if opt.Host == "" {
+		return nil, errors.New("host must be specified")
+	}
+
+	if opt.Path == "" {
+		return nil, errors.New("path must be specified")
+	}
+
+	config, err := createSSHConfig(opt)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := net.JoinHostPort(opt.Host, fmt.Sprintf("%v", opt.port()))
+	conn, err := ssh.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to %v: %v", addr, err)
+	}
+
+	cli, err := psftp.NewClient(conn)
+	if err != nil {
+		conn.Close() //nolint:errcheck
+		return nil, fmt.Errorf("unable to create SFTP client: %v", err)
+	}
+
+	if _, err := cli.Stat(opt.Path); err != nil {
+		cli.Close()  //nolint:errcheck
+		conn.Close() //nolint:errcheck
+		return nil, fmt.Errorf("cannot access storage path: %v", err)
+	}
+
+	return &sftpStorage{
+		Options: *opt,
+		conn:    conn,
+		cli:     cli,
+	}, nil
+}
+
+func init() {
+	storage.AddSupportedStorage(
+		sftpStorageType,
+		func() interface{} { return &Options{} },
+		func(ctx context.Context, o interface{}) (storage.Storage, error) {
+			return New(ctx, o.(*Options))
+		})
+}
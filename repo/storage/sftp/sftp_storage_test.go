@@ -0,0 +1,262 @@
+package sftp
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/kopia/kopia/repo/internal/storagetesting"
+	"github.com/kopia/kopia/repo/storage/filesystem"
+	psftp "github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testServer is an embedded SSH server exposing the local filesystem over SFTP.
+type testServer struct {
+	listener  net.Listener
+	hostKey   ssh.Signer
+	clientKey ssh.PublicKey
+}
+
+func newTestServer(t *testing.T, clientKey ssh.PublicKey) *testServer {
+	_, hostPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate host key: %v", err)
+	}
+
+	hostKey, err := ssh.NewSignerFromKey(hostPriv)
+	if err != nil {
+		t.Fatalf("unable to create host key signer: %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+
+	s := &testServer{listener: l, hostKey: hostKey, clientKey: clientKey}
+	go s.acceptLoop()
+	return s
+}
+
+func (s *testServer) acceptLoop() {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), s.clientKey.Marshal()) {
+				return nil, nil
+			}
+
+			return nil, ssh.ErrNoAuth
+		},
+	}
+	config.AddHostKey(s.hostKey)
+
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go s.serveConn(c, config)
+	}
+}
+
+func (s *testServer) serveConn(c net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(c, config)
+	if err != nil {
+		return
+	}
+
+	go ssh.DiscardRequests(reqs)
+
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "unsupported channel type") //nolint:errcheck
+			continue
+		}
+
+		ch, requests, err := nc.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil) //nolint:errcheck
+				if !ok {
+					continue
+				}
+
+				srv, err := psftp.NewServer(ch)
+				if err != nil {
+					return
+				}
+
+				srv.Serve() //nolint:errcheck
+				srv.Close() //nolint:errcheck
+			}
+		}()
+	}
+}
+
+func (s *testServer) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *testServer) close() {
+	s.listener.Close() //nolint:errcheck
+}
+
+func generateClientKey(t *testing.T) (ssh.PublicKey, string) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate client key: %v", err)
+	}
+
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatalf("unable to marshal client key: %v", err)
+	}
+
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("unable to convert public key: %v", err)
+	}
+
+	return sshPub, string(pem.EncodeToMemory(block))
+}
+
+func writeKnownHosts(t *testing.T, dir string, port int, key ssh.PublicKey) string {
+	fn := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{net.JoinHostPort("127.0.0.1", strconv.Itoa(port))}, key)
+	if err := ioutil.WriteFile(fn, []byte(line+"\n"), 0600); err != nil {
+		t.Fatalf("unable to write known hosts: %v", err)
+	}
+
+	return fn
+}
+
+func TestSFTPStorage(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "sftp")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	repoDir := filepath.Join(tmpDir, "repo")
+	if err := os.Mkdir(repoDir, 0700); err != nil {
+		t.Fatalf("unable to create repo dir: %v", err)
+	}
+
+	clientPub, clientKey := generateClientKey(t)
+	srv := newTestServer(t, clientPub)
+	defer srv.close()
+
+	ctx := context.Background()
+
+	opt := &Options{
+		Path:           repoDir,
+		Host:           "127.0.0.1",
+		Port:           srv.port(),
+		Username:       "kopia",
+		KeyData:        clientKey,
+		KnownHostsFile: writeKnownHosts(t, tmpDir, srv.port(), srv.hostKey.PublicKey()),
+	}
+
+	st, err := New(ctx, opt)
+	if err != nil {
+		t.Fatalf("unable to connect: %v", err)
+	}
+	defer st.Close(ctx) //nolint:errcheck
+
+	storagetesting.VerifyStorage(ctx, t, st)
+
+	// overwriting existing block must succeed.
+	if err := st.PutBlock(ctx, "abcdbbf4f0507d054ed5a80a5b65086f602b", []byte{2, 3}); err != nil {
+		t.Errorf("unable to overwrite block: %v", err)
+	}
+	storagetesting.AssertGetBlock(ctx, t, st, "abcdbbf4f0507d054ed5a80a5b65086f602b", []byte{2, 3})
+
+	// repository written using SFTP must be readable using the filesystem storage.
+	fst, err := filesystem.New(ctx, &filesystem.Options{Path: repoDir})
+	if err != nil {
+		t.Fatalf("unable to open filesystem storage: %v", err)
+	}
+
+	storagetesting.AssertGetBlock(ctx, t, fst, "abcdbbf4f0507d054ed5a80a5b65086f602b", []byte{2, 3})
+	storagetesting.AssertGetBlock(ctx, t, fst, "abff4585856ebf0748fd989e1dd623a8963d", bytes.Repeat([]byte{1}, 1000))
+
+	if err := st.DeleteBlock(ctx, "abff4585856ebf0748fd989e1dd623a8963d"); err != nil {
+		t.Errorf("unable to delete block: %v", err)
+	}
+
+	if err := st.DeleteBlock(ctx, "no-such-block"); err != nil {
+		t.Errorf("unable to delete non-existent block: %v", err)
+	}
+
+	storagetesting.AssertGetBlockNotFound(ctx, t, fst, "abff4585856ebf0748fd989e1dd623a8963d")
+	storagetesting.AssertListResults(ctx, t, st, "ab", "abcdbbf4f0507d054ed5a80a5b65086f602b", "abgc3dca496d510f492c858a2df1eb824e62")
+}
+
+func TestSFTPStorageRejectsUnknownHost(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "sftp")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	clientPub, clientKey := generateClientKey(t)
+	srv := newTestServer(t, clientPub)
+	defer srv.close()
+
+	// known_hosts contains a different key for the host.
+	otherKey, _ := generateClientKey(t)
+
+	_, err = New(context.Background(), &Options{
+		Path:           tmpDir,
+		Host:           "127.0.0.1",
+		Port:           srv.port(),
+		Username:       "kopia",
+		KeyData:        clientKey,
+		KnownHostsFile: writeKnownHosts(t, tmpDir, srv.port(), otherKey),
+	})
+	if err == nil {
+		t.Errorf("expected error when connecting to host with unknown key")
+	}
+}
+
+func TestSFTPStorageRejectsUnauthorizedKey(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "sftp")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	clientPub, _ := generateClientKey(t)
+	srv := newTestServer(t, clientPub)
+	defer srv.close()
+
+	_, otherClientKey := generateClientKey(t)
+
+	_, err = New(context.Background(), &Options{
+		Path:           tmpDir,
+		Host:           "127.0.0.1",
+		Port:           srv.port(),
+		Username:       "kopia",
+		KeyData:        otherClientKey,
+		KnownHostsFile: writeKnownHosts(t, tmpDir, srv.port(), srv.hostKey.PublicKey()),
+	})
+	if err == nil {
+		t.Errorf("expected error when authenticating with unauthorized key")
+	}
+}
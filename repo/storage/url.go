@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// URLOptions is implemented by storage options that can be initialized from a connection URL.
+//
+// ApplyURL receives the parsed URL and the optional sub-scheme following '+' in the URL scheme
+// (for example "http" in "webdav+http://host/path") and sets provider-specific fields based on its
+// host, path and user information. Query parameters are applied separately by matching their
+// names against JSON field names of the options.
+type URLOptions interface {
+	ApplyURL(u *url.URL, subScheme string) error
+}
+
+// NewStorageFromURL creates new storage based on a connection URL, such as
+// "s3://bucket/prefix?endpoint=host:port" or "filesystem:///path/to/repository".
+// The storage type must be previously registered using AddSupportedStorage.
+func NewStorageFromURL(ctx context.Context, storageURL string) (Storage, error) {
+	ci, err := ConnectionInfoFromURL(storageURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewStorage(ctx, ci)
+}
+
+// ConnectionInfoFromURL parses the connection URL into ConnectionInfo.
+func ConnectionInfoFromURL(storageURL string) (ConnectionInfo, error) {
+	u, err := url.Parse(storageURL)
+	if err != nil {
+		return ConnectionInfo{}, fmt.Errorf("invalid storage URL: %v", err)
+	}
+
+	storageType, subScheme := u.Scheme, ""
+	if p := strings.Index(storageType, "+"); p >= 0 {
+		storageType, subScheme = storageType[0:p], storageType[p+1:]
+	}
+
+	f := factories[storageType]
+	if f == nil {
+		return ConnectionInfo{}, fmt.Errorf("unknown storage type: %q", storageType)
+	}
+
+	cfg := f.defaultConfigFunc()
+	uo, ok := cfg.(URLOptions)
+	if !ok {
+		return ConnectionInfo{}, fmt.Errorf("storage type %q does not support connection URLs", storageType)
+	}
+
+	if err := uo.ApplyURL(u, subScheme); err != nil {
+		return ConnectionInfo{}, fmt.Errorf("invalid %v URL: %v", storageType, err)
+	}
+
+	if err := applyURLQuery(cfg, u.Query()); err != nil {
+		return ConnectionInfo{}, fmt.Errorf("invalid %v URL: %v", storageType, err)
+	}
+
+	return ConnectionInfo{
+		Type:   storageType,
+		Config: cfg,
+	}, nil
+}
+
+// applyURLQuery sets fields of the provided struct pointer whose JSON names match query parameters.
+func applyURLQuery(cfg interface{}, q url.Values) error {
+	v := reflect.ValueOf(cfg).Elem()
+	fields := map[string]reflect.Value{}
+	for i := 0; i < v.NumField(); i++ {
+		name := strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			fields[name] = v.Field(i)
+		}
+	}
+
+	for name, values := range q {
+		fv, ok := fields[name]
+		if !ok {
+			return fmt.Errorf("unsupported parameter %q", name)
+		}
+
+		if err := setFieldFromString(fv, values[len(values)-1]); err != nil {
+			return fmt.Errorf("invalid value of %q: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+func setFieldFromString(fv reflect.Value, s string) error {
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(s)
+
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		fv.SetBool(b)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 0, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetInt(n)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 0, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetUint(n)
+
+	case reflect.Ptr:
+		p := reflect.New(fv.Type().Elem())
+		if err := setFieldFromString(p.Elem(), s); err != nil {
+			return err
+		}
+		fv.Set(p)
+
+	case reflect.Slice:
+		// comma-separated list, empty string denotes empty list
+		parts := strings.Split(s, ",")
+		if s == "" {
+			parts = nil
+		}
+
+		sl := reflect.MakeSlice(fv.Type(), len(parts), len(parts))
+		for i, p := range parts {
+			if err := setFieldFromString(sl.Index(i), p); err != nil {
+				return err
+			}
+		}
+		fv.Set(sl)
+
+	default:
+		return fmt.Errorf("unsupported field type: %v", fv.Type())
+	}
+
+	return nil
+}
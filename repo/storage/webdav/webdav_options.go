@@ -1,5 +1,10 @@
 package webdav
 
+import (
+	"errors"
+	"net/url"
+)
+
 // Options defines options for Filesystem-backed storage.
 type Options struct {
 	URL             string `json:"url"`
@@ -15,3 +20,23 @@ func (fso *Options) shards() []int {
 
 	return fso.DirectoryShards
 }
+
+// ApplyURL sets the server URL and credentials from a URL in the form webdav://[user[:password]@]host/path,
+// which uses HTTPS, or webdav+http://host/path.
+func (fso *Options) ApplyURL(u *url.URL, subScheme string) error {
+	if u.Host == "" {
+		return errors.New("host must be specified")
+	}
+
+	if subScheme == "" {
+		subScheme = "https"
+	}
+
+	if u.User != nil {
+		fso.Username = u.User.Username()
+		fso.Password, _ = u.User.Password()
+	}
+
+	fso.URL = (&url.URL{Scheme: subScheme, Host: u.Host, Path: u.Path}).String()
+	return nil
+}
@@ -0,0 +1,333 @@
+package repo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/kopia/kopia/internal/config"
+	"github.com/kopia/kopia/repo/block"
+	"github.com/kopia/kopia/repo/manifest"
+	"github.com/kopia/kopia/repo/object"
+	"github.com/kopia/kopia/repo/storage"
+	"github.com/kopia/kopia/repo/storage/prefix"
+)
+
+// upgradeStateBlockID is the identifier of a storage block that describes the upgrade in progress.
+const upgradeStateBlockID = "kopia.upgrade"
+
+// retiredGenerationBlockID is the identifier of a storage block written to the generation replaced by the upgrade,
+// so that clients still using it fail to open or refresh the repository instead of writing contents that would be lost.
+// It's named like an index block, which makes builds not aware of storage generations fail to load indexes,
+// since its name is not a valid block ID.
+const retiredGenerationBlockID = block.IndexBlockPrefix + "retired_storage_generation_marker"
+
+// ErrRepositoryUpgraded is returned when the repository has been upgraded to a new format by another client
+// since it was opened.
+var ErrRepositoryUpgraded = errors.New("repository has been upgraded to a new format, it must be opened again")
+
+// UpgradeOptions specifies the new format of repository contents, empty fields keep the current value.
+type UpgradeOptions struct {
+	BlockFormat string `json:"blockFormat"`
+	Splitter    string `json:"splitter"`
+}
+
+// upgradeState is persisted in the storage while the upgrade is in progress, so that it can be resumed
+// and so that blocks of the previous generation can be removed if the upgrade is interrupted after the switch.
+type upgradeState struct {
+	UpgradeOptions
+
+	PreviousGeneration int       `json:"previousGeneration"`
+	Generation         int       `json:"generation"`
+	StartTime          time.Time `json:"startTime"`
+}
+
+// Upgrade is a migration of repository contents to a new block format or splitter in progress.
+//
+// Blocks, objects and manifests written through it are stored in a new generation of storage blocks,
+// which is ignored by clients using the current format until Commit() switches the repository to it.
+// When the upgrade is interrupted, BeginUpgrade() with the same options resumes it, keeping everything
+// that was flushed so far.
+type Upgrade struct {
+	Blocks    *block.Manager
+	Objects   *object.Manager
+	Manifests *manifest.Manager
+
+	// Format is the new format of repository contents.
+	Format config.RepositoryObjectFormat
+
+	// Resumed is true when the upgrade continues where a previous one was interrupted.
+	Resumed bool
+
+	rep   *Repository
+	state upgradeState
+}
+
+// Format returns the current format of repository contents.
+func (r *Repository) Format() (*config.RepositoryObjectFormat, error) {
+	if r.formatBlock == nil {
+		return nil, ErrRemoteRepository
+	}
+
+	return r.formatBlock.decryptFormatBytes(r.masterKey)
+}
+
+// BeginUpgrade starts or resumes the upgrade of repository contents to a new format.
+//
+// Other clients must not write to the repository until the upgrade is committed, otherwise their changes will be lost.
+func (r *Repository) BeginUpgrade(ctx context.Context, opt UpgradeOptions) (*Upgrade, error) {
+	current, err := r.Format()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = checkGenerationCurrent(ctx, r.Storage); err != nil {
+		return nil, err
+	}
+
+	if err = r.finishCommittedUpgrade(ctx); err != nil {
+		return nil, err
+	}
+
+	format := *current
+	if opt.BlockFormat != "" {
+		format.BlockFormat = opt.BlockFormat
+	}
+	if opt.Splitter != "" {
+		format.Splitter = opt.Splitter
+	}
+	if format.MaxPackSize == 0 {
+		format.MaxPackSize = format.MaxBlockSize
+	}
+
+	if format.BlockFormat == current.BlockFormat && format.Splitter == current.Splitter {
+		return nil, fmt.Errorf("repository already uses block format %v and splitter %v", format.BlockFormat, format.Splitter)
+	}
+
+	requested := upgradeState{
+		UpgradeOptions:     UpgradeOptions{BlockFormat: format.BlockFormat, Splitter: format.Splitter},
+		PreviousGeneration: r.formatBlock.StorageGeneration,
+		Generation:         r.formatBlock.StorageGeneration + 1,
+		StartTime:          time.Now(),
+	}
+
+	resumed := true
+	state, err := r.readUpgradeState(ctx)
+	switch {
+	case err == storage.ErrBlockNotFound:
+		resumed = false
+		state = &requested
+		if err = r.writeUpgradeState(ctx, state); err != nil {
+			return nil, err
+		}
+
+	case err != nil:
+		return nil, err
+
+	case state.UpgradeOptions != requested.UpgradeOptions:
+		return nil, fmt.Errorf("upgrade to block format %v and splitter %v started at %v is in progress, it must be aborted first",
+			state.BlockFormat, state.Splitter, state.StartTime.Local().Format(time.RFC3339))
+	}
+
+	st := prefix.NewWrapper(r.rootStorage, generationPrefix(state.Generation))
+
+	bm, err := block.NewManager(ctx, st, format.FormattingOptions, block.CachingOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to open block manager: %v", err)
+	}
+
+	om, err := object.NewObjectManager(ctx, bm, format, object.ManagerOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to open object manager: %v", err)
+	}
+
+	mm, err := manifest.NewManager(ctx, bm)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open manifests: %v", err)
+	}
+
+	return &Upgrade{
+		Blocks:    bm,
+		Objects:   om,
+		Manifests: mm,
+		Format:    format,
+		Resumed:   resumed,
+		rep:       r,
+		state:     *state,
+	}, nil
+}
+
+// Flush persists all contents written to the upgrade, so that they are kept if it is interrupted.
+func (u *Upgrade) Flush(ctx context.Context) error {
+	if err := u.Manifests.Flush(ctx); err != nil {
+		return err
+	}
+
+	if err := u.Objects.Flush(ctx); err != nil {
+		return err
+	}
+
+	return u.Blocks.Flush(ctx)
+}
+
+// Commit switches the repository to the new format and removes storage blocks of the previous one.
+// The repository must be reopened afterwards.
+func (u *Upgrade) Commit(ctx context.Context) error {
+	if err := u.Flush(ctx); err != nil {
+		return fmt.Errorf("unable to flush upgraded contents: %v", err)
+	}
+
+	r := u.rep
+	if err := r.updateFormatBlock(ctx, func(f *formatBlock, currentSlotID string) error {
+		if f.StorageGeneration != u.state.PreviousGeneration {
+			return ErrRepositoryUpgraded
+		}
+
+		f.Version = generationFormatVersion
+		f.StorageGeneration = u.state.Generation
+		return encryptFormatBytes(f, &u.Format, r.masterKey, f.UniqueID)
+	}); err != nil {
+		return fmt.Errorf("unable to write format block: %v", err)
+	}
+
+	clearCache(r.CacheDirectory)
+
+	// the repository already uses the new format, so the cleanup is retried by the next upgrade when it fails.
+	return r.finishCommittedUpgrade(ctx)
+}
+
+// clearCache removes all contents of the cache directory, which are no longer valid after the upgrade,
+// since cached blocks and indexes are keyed by IDs, which may be the same in both generations.
+func clearCache(cacheDirectory string) {
+	if cacheDirectory == "" {
+		return
+	}
+
+	if err := os.RemoveAll(cacheDirectory); err != nil {
+		log.Warningf("unable to clear cache: %v", err)
+	}
+
+	if err := os.MkdirAll(cacheDirectory, 0700); err != nil {
+		log.Warningf("unable to create cache directory: %v", err)
+	}
+}
+
+// checkGenerationCurrent returns ErrRepositoryUpgraded if the generation in a given storage has been retired by the upgrade.
+func checkGenerationCurrent(ctx context.Context, st storage.Storage) error {
+	_, err := st.GetBlock(ctx, retiredGenerationBlockID, 0, -1)
+	switch err {
+	case nil:
+		return ErrRepositoryUpgraded
+	case storage.ErrBlockNotFound:
+		return nil
+	default:
+		return fmt.Errorf("unable to check storage generation: %v", err)
+	}
+}
+
+// AbortUpgrade discards the upgrade in progress and all contents written to it.
+func (r *Repository) AbortUpgrade(ctx context.Context) error {
+	if r.formatBlock == nil {
+		return ErrRemoteRepository
+	}
+
+	state, err := r.readUpgradeState(ctx)
+	if err == storage.ErrBlockNotFound {
+		return fmt.Errorf("no upgrade in progress")
+	}
+	if err != nil {
+		return err
+	}
+
+	if state.Generation == r.formatBlock.StorageGeneration {
+		return fmt.Errorf("upgrade has already been committed")
+	}
+
+	if err := deleteGeneration(ctx, r.rootStorage, state.Generation); err != nil {
+		return err
+	}
+
+	return r.rootStorage.DeleteBlock(ctx, upgradeStateBlockID)
+}
+
+// finishCommittedUpgrade removes blocks of the previous generation left behind by the upgrade
+// that was interrupted after switching the repository to the new format.
+func (r *Repository) finishCommittedUpgrade(ctx context.Context) error {
+	state, err := r.readUpgradeState(ctx)
+	if err == storage.ErrBlockNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if state.Generation != r.formatBlock.StorageGeneration {
+		// not committed yet
+		return nil
+	}
+
+	// retire the previous generation before removing its blocks, so that clients still using it don't see it as empty.
+	retiredID := generationPrefix(state.PreviousGeneration) + retiredGenerationBlockID
+	if err := r.rootStorage.PutBlock(ctx, retiredID, []byte("storage generation retired by format upgrade\n")); err != nil {
+		return fmt.Errorf("unable to retire generation %v: %v", state.PreviousGeneration, err)
+	}
+
+	log.Infof("removing storage blocks of generation %v", state.PreviousGeneration)
+	if err := deleteGeneration(ctx, r.rootStorage, state.PreviousGeneration); err != nil {
+		return err
+	}
+
+	return r.rootStorage.DeleteBlock(ctx, upgradeStateBlockID)
+}
+
+func (r *Repository) readUpgradeState(ctx context.Context) (*upgradeState, error) {
+	b, err := r.rootStorage.GetBlock(ctx, upgradeStateBlockID, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &upgradeState{}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("invalid upgrade state: %v", err)
+	}
+
+	return s, nil
+}
+
+func (r *Repository) writeUpgradeState(ctx context.Context, s *upgradeState) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to marshal upgrade state: %v", err)
+	}
+
+	if err := r.rootStorage.PutBlock(ctx, upgradeStateBlockID, b); err != nil {
+		return fmt.Errorf("unable to write upgrade state: %v", err)
+	}
+
+	return nil
+}
+
+// deleteGeneration removes all pack and index blocks of a given generation, except for the marker of retired generation.
+func deleteGeneration(ctx context.Context, st storage.Storage, generation int) error {
+	for _, p := range append([]string{block.IndexBlockPrefix}, block.PackBlockPrefixes...) {
+		blocks, err := storage.ListAllBlocks(ctx, st, generationPrefix(generation)+p)
+		if err != nil {
+			return fmt.Errorf("unable to list blocks of generation %v: %v", generation, err)
+		}
+
+		for _, b := range blocks {
+			if b.BlockID == generationPrefix(generation)+retiredGenerationBlockID {
+				continue
+			}
+
+			if err := st.DeleteBlock(ctx, b.BlockID); err != nil && err != storage.ErrBlockNotFound {
+				return fmt.Errorf("unable to delete %v: %v", b.BlockID, err)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,165 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/kopia/kopia/repo/internal/storagetesting"
+	"github.com/kopia/kopia/repo/object"
+)
+
+func TestUpgrade(t *testing.T) {
+	ctx := context.Background()
+	st, r := setupPasswordTest(t)
+
+	content := bytes.Repeat([]byte("hello world "), 10000)
+	oid := writeObject(ctx, t, r, content, "upgrade")
+	if _, err := r.Manifests.Put(ctx, map[string]string{"type": "test"}, map[string]string{"object": string(oid)}); err != nil {
+		t.Fatalf("unable to put manifest: %v", err)
+	}
+
+	if err := r.Flush(ctx); err != nil {
+		t.Fatalf("unable to flush: %v", err)
+	}
+
+	opt := UpgradeOptions{BlockFormat: "ENCRYPTED_HMAC_SHA256_AES256_GCM", Splitter: "DYNAMIC"}
+
+	u := mustBeginUpgrade(t, r, opt)
+	if u.Resumed {
+		t.Errorf("new upgrade reported as resumed")
+	}
+
+	// a different upgrade can't start until this one is aborted.
+	if _, err := r.BeginUpgrade(ctx, UpgradeOptions{BlockFormat: "UNENCRYPTED_HMAC_SHA256"}); err == nil || !strings.Contains(err.Error(), "in progress") {
+		t.Errorf("unexpected error starting a different upgrade: %v", err)
+	}
+
+	newOID := rewriteObject(t, r, u, oid)
+	if err := u.Flush(ctx); err != nil {
+		t.Fatalf("unable to flush upgrade: %v", err)
+	}
+
+	// contents written so far are visible when the upgrade is resumed.
+	u = mustBeginUpgrade(t, r, opt)
+	if !u.Resumed {
+		t.Errorf("interrupted upgrade not resumed")
+	}
+
+	if _, err := u.Manifests.Put(ctx, map[string]string{"type": "test"}, map[string]string{"object": string(newOID)}); err != nil {
+		t.Fatalf("unable to put manifest: %v", err)
+	}
+
+	if err := u.Commit(ctx); err != nil {
+		t.Fatalf("unable to commit upgrade: %v", err)
+	}
+
+	storagetesting.AssertListResults(ctx, t, st, "p")
+	storagetesting.AssertListResults(ctx, t, st, "n", retiredGenerationBlockID)
+	storagetesting.AssertGetBlockNotFound(ctx, t, st, upgradeStateBlockID)
+
+	if err := r.Refresh(ctx); err != ErrRepositoryUpgraded {
+		t.Errorf("unexpected error refreshing repository after the upgrade: %v", err)
+	}
+
+	r2 := mustConnect(t, st, masterPassword)
+	if got, want := r2.formatBlock.StorageGeneration, 1; got != want {
+		t.Errorf("unexpected storage generation: %v, want %v", got, want)
+	}
+
+	if got, want := r2.formatBlock.Version, generationFormatVersion; got != want {
+		t.Errorf("unexpected format version: %v, want %v", got, want)
+	}
+
+	f, err := r2.Format()
+	if err != nil {
+		t.Fatalf("unable to get format: %v", err)
+	}
+
+	if f.BlockFormat != opt.BlockFormat || f.Splitter != opt.Splitter {
+		t.Errorf("unexpected format after upgrade: %v %v", f.BlockFormat, f.Splitter)
+	}
+
+	entries, err := r2.Manifests.Find(ctx, map[string]string{"type": "test"})
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("unexpected manifests after upgrade: %v %v", entries, err)
+	}
+
+	verify(ctx, t, r2, newOID, content, "upgraded")
+}
+
+func TestAbortUpgrade(t *testing.T) {
+	ctx := context.Background()
+	st, r := setupPasswordTest(t)
+
+	oid := writeObject(ctx, t, r, []byte("hello world"), "abort")
+	if err := r.Flush(ctx); err != nil {
+		t.Fatalf("unable to flush: %v", err)
+	}
+
+	if err := r.AbortUpgrade(ctx); err == nil {
+		t.Errorf("expected error aborting when no upgrade is in progress")
+	}
+
+	u := mustBeginUpgrade(t, r, UpgradeOptions{BlockFormat: "UNENCRYPTED_HMAC_SHA256"})
+	rewriteObject(t, r, u, oid)
+	if err := u.Flush(ctx); err != nil {
+		t.Fatalf("unable to flush upgrade: %v", err)
+	}
+
+	if err := r.AbortUpgrade(ctx); err != nil {
+		t.Fatalf("unable to abort upgrade: %v", err)
+	}
+
+	storagetesting.AssertListResults(ctx, t, st, "g")
+	storagetesting.AssertGetBlockNotFound(ctx, t, st, upgradeStateBlockID)
+
+	r2 := mustConnect(t, st, masterPassword)
+	verify(ctx, t, r2, oid, []byte("hello world"), "aborted")
+
+	if u := mustBeginUpgrade(t, r2, UpgradeOptions{BlockFormat: "ENCRYPTED_HMAC_SHA256_AES256_GCM"}); u.Resumed {
+		t.Errorf("upgrade after abort reported as resumed")
+	}
+}
+
+func mustBeginUpgrade(t *testing.T, r *Repository, opt UpgradeOptions) *Upgrade {
+	t.Helper()
+
+	u, err := r.BeginUpgrade(context.Background(), opt)
+	if err != nil {
+		t.Fatalf("unable to begin upgrade: %v", err)
+	}
+
+	return u
+}
+
+func rewriteObject(t *testing.T, r *Repository, u *Upgrade, oid object.ID) object.ID {
+	t.Helper()
+
+	ctx := context.Background()
+
+	rd, err := r.Objects.Open(ctx, oid)
+	if err != nil {
+		t.Fatalf("unable to open %v: %v", oid, err)
+	}
+	defer rd.Close() //nolint:errcheck
+
+	b, err := ioutil.ReadAll(rd)
+	if err != nil {
+		t.Fatalf("unable to read %v: %v", oid, err)
+	}
+
+	w := u.Objects.NewWriter(ctx, object.WriterOptions{})
+	defer w.Close() //nolint:errcheck
+
+	w.Write(b) //nolint:errcheck
+
+	newOID, err := w.Result()
+	if err != nil {
+		t.Fatalf("unable to write object: %v", err)
+	}
+
+	return newOID
+}
@@ -0,0 +1,343 @@
+// Package gc implements garbage collection of blocks that are no longer referenced by any snapshot.
+package gc
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/kopia/kopia/fs"
+	"github.com/kopia/kopia/internal/dir"
+	"github.com/kopia/kopia/internal/kopialogging"
+	"github.com/kopia/kopia/repo"
+	"github.com/kopia/kopia/repo/block"
+	"github.com/kopia/kopia/repo/manifest"
+	"github.com/kopia/kopia/repo/object"
+	"github.com/kopia/kopia/repo/storage"
+	"github.com/kopia/kopia/snapshot"
+)
+
+var log = kopialogging.Logger("kopia/snapshot/gc")
+
+// Options controls the behavior of garbage collection.
+type Options struct {
+	// Actually delete and rewrite blocks, when false only statistics are computed.
+	Delete bool
+
+	// Blocks and pack files younger than this are never deleted or repacked, which prevents
+	// racing with concurrent writers whose snapshot manifests have not been written yet.
+	MinContentAge time.Duration
+
+	// Pack files where the ratio of live bytes to total length is below the threshold get
+	// their live blocks rewritten into new packs. Zero disables repacking.
+	RepackThreshold float64
+}
+
+// Stats describes the results of garbage collection.
+type Stats struct {
+	InUseBlockCount        int   `json:"inUseBlockCount"`
+	InUseBytes             int64 `json:"inUseBytes"`
+	UnreferencedBlockCount int   `json:"unreferencedBlockCount"`
+	UnreferencedBytes      int64 `json:"unreferencedBytes"`
+	TooRecentBlockCount    int   `json:"tooRecentBlockCount"`
+	TooRecentBytes         int64 `json:"tooRecentBytes"`
+	RepackedPackCount      int   `json:"repackedPackCount"`
+	RewrittenBlockCount    int   `json:"rewrittenBlockCount"`
+	RewrittenBytes         int64 `json:"rewrittenBytes"`
+	DeletedPackCount       int   `json:"deletedPackCount"`
+	DeletedPackBytes       int64 `json:"deletedPackBytes"`
+}
+
+// Run performs mark-and-sweep garbage collection of blocks that are not reachable from any snapshot manifest,
+// repacks pack files with low ratio of live data and removes pack files that no longer contain any live blocks.
+//
+// NOTE: Blocks that are unreferenced but younger than Options.MinContentAge are left untouched, but a concurrent
+// writer may still reuse an older unreferenced block, so garbage collection should not run while
+// snapshots are being created.
+func Run(ctx context.Context, rep *repo.Repository, opt Options) (*Stats, error) {
+	if rep.IsRemote() {
+		return nil, repo.ErrRemoteRepository
+	}
+
+	if err := rep.Flush(ctx); err != nil {
+		return nil, fmt.Errorf("unable to flush repository: %v", err)
+	}
+
+	inUse, err := findInUseBlocks(ctx, rep)
+	if err != nil {
+		return nil, err
+	}
+
+	st := &Stats{}
+	cutoff := time.Now().Add(-opt.MinContentAge)
+
+	// cancellation is checked before each step that modifies the repository.
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := deleteUnreferencedBlocks(rep, inUse, cutoff, opt, st); err != nil {
+		return nil, err
+	}
+
+	if opt.RepackThreshold > 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		if err := repackPacks(ctx, rep, cutoff, opt, st); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := deleteUnreferencedPacks(ctx, rep, cutoff, opt, st); err != nil {
+		return nil, err
+	}
+
+	return st, nil
+}
+
+// findInUseBlocks returns the set of block IDs reachable from all snapshot manifests.
+func findInUseBlocks(ctx context.Context, rep *repo.Repository) (map[string]bool, error) {
+	ids, err := snapshot.ListSnapshotManifests(ctx, rep, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list snapshot manifests: %v", err)
+	}
+
+	manifests, err := snapshot.LoadSnapshots(ctx, rep, ids)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load snapshot manifests: %v", err)
+	}
+
+	w := &marker{
+		rep:            rep,
+		inUse:          map[string]bool{},
+		visitedObjects: map[object.ID]bool{},
+	}
+
+	for _, m := range manifests {
+		log.Debugf("marking blocks of snapshot %v of %v", m.ID, m.Source)
+
+		if m.HashCacheID != "" {
+			if err := w.markObject(ctx, m.HashCacheID); err != nil {
+				return nil, fmt.Errorf("unable to mark hash cache of %v: %v", m.ID, err)
+			}
+		}
+
+		if m.RootEntry == nil {
+			continue
+		}
+
+		if err := w.markEntry(ctx, m.RootEntry); err != nil {
+			return nil, fmt.Errorf("unable to mark blocks of snapshot %v: %v", m.ID, err)
+		}
+	}
+
+	return w.inUse, nil
+}
+
+type marker struct {
+	rep            *repo.Repository
+	inUse          map[string]bool
+	visitedObjects map[object.ID]bool
+}
+
+// markObject marks all blocks backing a given object as in use.
+func (w *marker) markObject(ctx context.Context, oid object.ID) error {
+	_, blocks, err := w.rep.Objects.VerifyObject(ctx, oid)
+	if err != nil {
+		return fmt.Errorf("unable to verify object %v: %v", oid, err)
+	}
+
+	for _, b := range blocks {
+		w.inUse[b] = true
+	}
+
+	return nil
+}
+
+func (w *marker) markEntry(ctx context.Context, e *dir.Entry) error {
+	if w.visitedObjects[e.ObjectID] {
+		// identical subtrees are shared between snapshots, no need to walk them again
+		return nil
+	}
+	w.visitedObjects[e.ObjectID] = true
+
+	if err := w.markObject(ctx, e.ObjectID); err != nil {
+		return err
+	}
+
+	if e.Type != fs.EntryTypeDirectory {
+		return nil
+	}
+
+	r, err := w.rep.Objects.Open(ctx, e.ObjectID)
+	if err != nil {
+		return fmt.Errorf("unable to open directory %v: %v", e.ObjectID, err)
+	}
+	defer r.Close() //nolint:errcheck
+
+	entries, _, err := dir.ReadEntries(r)
+	if err != nil {
+		return fmt.Errorf("unable to read directory %v: %v", e.ObjectID, err)
+	}
+
+	for _, child := range entries {
+		if err := w.markEntry(ctx, child); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func deleteUnreferencedBlocks(rep *repo.Repository, inUse map[string]bool, cutoff time.Time, opt Options, st *Stats) error {
+	var unreferenced []string
+
+	err := rep.Blocks.IterateBlockInfos("", false, func(bi block.Info) error {
+		if strings.HasPrefix(bi.BlockID, manifest.BlockPrefix) || inUse[bi.BlockID] {
+			st.InUseBlockCount++
+			st.InUseBytes += int64(bi.Length)
+			return nil
+		}
+
+		if bi.Timestamp().After(cutoff) {
+			st.TooRecentBlockCount++
+			st.TooRecentBytes += int64(bi.Length)
+			return nil
+		}
+
+		st.UnreferencedBlockCount++
+		st.UnreferencedBytes += int64(bi.Length)
+		unreferenced = append(unreferenced, bi.BlockID)
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("unable to list blocks: %v", err)
+	}
+
+	if !opt.Delete {
+		return nil
+	}
+
+	// unreferenced blocks are collected first, because deleting them changes the set of blocks being listed.
+	for _, blockID := range unreferenced {
+		log.Debugf("deleting unreferenced block %v", blockID)
+		if err := rep.Blocks.DeleteBlock(blockID); err != nil {
+			return fmt.Errorf("unable to delete block %v: %v", blockID, err)
+		}
+	}
+
+	return nil
+}
+
+// repackPacks rewrites live blocks from pack files whose live ratio is below the threshold.
+func repackPacks(ctx context.Context, rep *repo.Repository, cutoff time.Time, opt Options, st *Stats) error {
+	if opt.Delete {
+		// make deletions visible to subsequent listing
+		if err := rep.Blocks.Flush(ctx); err != nil {
+			return fmt.Errorf("unable to flush blocks: %v", err)
+		}
+	}
+
+	var packs []storage.BlockMetadata
+	for _, prefix := range block.PackBlockPrefixes {
+		p, err := storage.ListAllBlocks(ctx, rep.Storage, prefix)
+		if err != nil {
+			return fmt.Errorf("unable to list pack files: %v", err)
+		}
+
+		packs = append(packs, p...)
+	}
+
+	liveBytesByPack := map[string]int64{}
+	if err := rep.Blocks.IterateBlockInfos("", false, func(bi block.Info) error {
+		liveBytesByPack[bi.PackFile] += int64(bi.Length)
+		return nil
+	}); err != nil {
+		return fmt.Errorf("unable to list blocks: %v", err)
+	}
+
+	repacked := map[string]bool{}
+	for _, p := range packs {
+		live := liveBytesByPack[p.BlockID]
+		if live == 0 || p.Length == 0 || p.Timestamp.After(cutoff) {
+			continue
+		}
+
+		if float64(live)/float64(p.Length) >= opt.RepackThreshold {
+			continue
+		}
+
+		st.RepackedPackCount++
+		log.Debugf("repacking %v (%v live bytes out of %v)", p.BlockID, live, p.Length)
+		repacked[p.BlockID] = true
+	}
+
+	if len(repacked) == 0 {
+		return nil
+	}
+
+	// rewritten blocks are collected first, because rewriting them changes their packs.
+	var rewrite []string
+	if err := rep.Blocks.IterateBlockInfos("", false, func(bi block.Info) error {
+		if repacked[bi.PackFile] {
+			st.RewrittenBlockCount++
+			st.RewrittenBytes += int64(bi.Length)
+			rewrite = append(rewrite, bi.BlockID)
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("unable to list blocks: %v", err)
+	}
+
+	if !opt.Delete {
+		return nil
+	}
+
+	for _, blockID := range rewrite {
+		if err := rep.Blocks.RewriteBlock(ctx, blockID); err != nil {
+			return fmt.Errorf("unable to rewrite block %v: %v", blockID, err)
+		}
+	}
+
+	return nil
+}
+
+// deleteUnreferencedPacks deletes pack files that do not contain any live blocks.
+func deleteUnreferencedPacks(ctx context.Context, rep *repo.Repository, cutoff time.Time, opt Options, st *Stats) error {
+	if !opt.Delete {
+		return nil
+	}
+
+	if err := rep.Blocks.Flush(ctx); err != nil {
+		return fmt.Errorf("unable to flush blocks: %v", err)
+	}
+
+	unused, err := rep.Blocks.FindUnreferencedStorageFiles(ctx)
+	if err != nil {
+		return fmt.Errorf("error looking for unreferenced storage files: %v", err)
+	}
+
+	for _, u := range unused {
+		if u.Timestamp.After(cutoff) {
+			continue
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		log.Debugf("deleting unreferenced pack %v (%v bytes)", u.BlockID, u.Length)
+		if err := rep.Storage.DeleteBlock(ctx, u.BlockID); err != nil {
+			return fmt.Errorf("unable to delete pack %v: %v", u.BlockID, err)
+		}
+
+		st.DeletedPackCount++
+		st.DeletedPackBytes += u.Length
+	}
+
+	return nil
+}
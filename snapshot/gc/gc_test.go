@@ -0,0 +1,404 @@
+package gc
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/kopia/kopia/fs"
+	"github.com/kopia/kopia/fs/repofs"
+	"github.com/kopia/kopia/internal/mockfs"
+	"github.com/kopia/kopia/internal/repotesting"
+	"github.com/kopia/kopia/internal/upload"
+	"github.com/kopia/kopia/repo"
+	"github.com/kopia/kopia/repo/block"
+	"github.com/kopia/kopia/repo/object"
+	"github.com/kopia/kopia/repo/storage"
+	"github.com/kopia/kopia/snapshot"
+)
+
+type gcTestHarness struct {
+	t   *testing.T
+	env *repotesting.Environment
+	rep *repo.Repository
+
+	// expected contents of files in snapshots by snapshot manifest ID
+	contents map[string]map[string][]byte
+}
+
+func newGCTestHarness(t *testing.T) *gcTestHarness {
+	// small blocks so that larger files are stored as indirect objects.
+	env := repotesting.Setup(t, &repo.NewRepositoryOptions{
+		Splitter:     "FIXED",
+		MaxBlockSize: 4096,
+	}, repo.ConnectOptions{})
+
+	th := &gcTestHarness{
+		t:        t,
+		env:      env,
+		contents: map[string]map[string][]byte{},
+	}
+	th.rep = env.Repository
+
+	return th
+}
+
+func (th *gcTestHarness) close() {
+	th.env.Close()
+}
+
+func (th *gcTestHarness) reopen() {
+	th.env.Reopen()
+	th.rep = th.env.Repository
+}
+
+// snapshot uploads a directory with given files and returns the ID of its snapshot manifest.
+func (th *gcTestHarness) snapshot(path string, files map[string][]byte, previous *snapshot.Manifest) (string, *snapshot.Manifest) {
+	ctx := context.Background()
+	sourceDir := mockfs.NewDirectory()
+	for name, content := range files {
+		sourceDir.AddFile(name, content, 0644)
+	}
+
+	u := upload.NewUploader(th.rep)
+	man, err := u.Upload(ctx, sourceDir, snapshot.SourceInfo{Host: "host", UserName: "user", Path: path}, previous)
+	if err != nil {
+		th.t.Fatalf("upload failed: %v", err)
+	}
+
+	id, err := snapshot.SaveSnapshot(ctx, th.rep, man)
+	if err != nil {
+		th.t.Fatalf("unable to save snapshot: %v", err)
+	}
+
+	if err := th.rep.Flush(ctx); err != nil {
+		th.t.Fatalf("unable to flush: %v", err)
+	}
+
+	th.contents[id] = files
+	return id, man
+}
+
+func (th *gcTestHarness) deleteSnapshot(id string) {
+	th.rep.Manifests.Delete(id)
+	delete(th.contents, id)
+	if err := th.rep.Flush(context.Background()); err != nil {
+		th.t.Fatalf("unable to flush: %v", err)
+	}
+}
+
+func (th *gcTestHarness) run(opt Options) *Stats {
+	// index entries have 1-second resolution and deletions or rewrites within the same second as
+	// the original write don't supersede it, which doesn't happen outside of tests because of MinContentAge.
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+
+	st, err := Run(context.Background(), th.rep, opt)
+	if err != nil {
+		th.t.Fatalf("gc failed: %v", err)
+	}
+
+	th.reopen()
+	return st
+}
+
+// verifySnapshots verifies that all remaining snapshots and their hash caches are readable and have expected contents.
+func (th *gcTestHarness) verifySnapshots() {
+	th.t.Helper()
+	ctx := context.Background()
+
+	ids, err := snapshot.ListSnapshotManifests(ctx, th.rep, nil)
+	if err != nil {
+		th.t.Fatalf("unable to list snapshots: %v", err)
+	}
+
+	if len(ids) != len(th.contents) {
+		th.t.Errorf("unexpected number of snapshots: %v, want %v", len(ids), len(th.contents))
+	}
+
+	for _, id := range ids {
+		man, err := snapshot.LoadSnapshot(ctx, th.rep, id)
+		if err != nil {
+			th.t.Fatalf("unable to load snapshot %v: %v", id, err)
+		}
+
+		if man.HashCacheID != "" {
+			if _, _, err := th.rep.Objects.VerifyObject(ctx, man.HashCacheID); err != nil {
+				th.t.Errorf("hash cache of snapshot %v is not readable: %v", id, err)
+			}
+		}
+
+		entries, err := repofs.DirectoryEntry(th.rep, man.RootObjectID(), nil).Readdir(ctx)
+		if err != nil {
+			th.t.Fatalf("unable to read snapshot root of %v: %v", id, err)
+		}
+
+		want := th.contents[id]
+		if len(entries) != len(want) {
+			th.t.Errorf("unexpected number of files in snapshot %v: %v, want %v", id, len(entries), len(want))
+		}
+
+		for _, e := range entries {
+			r, err := e.(fs.File).Open(ctx)
+			if err != nil {
+				th.t.Errorf("unable to open %v in snapshot %v: %v", e.Metadata().Name, id, err)
+				continue
+			}
+
+			got, err := ioutil.ReadAll(r)
+			r.Close() //nolint:errcheck
+			if err != nil {
+				th.t.Errorf("unable to read %v in snapshot %v: %v", e.Metadata().Name, id, err)
+				continue
+			}
+
+			if !bytes.Equal(got, want[e.Metadata().Name]) {
+				th.t.Errorf("invalid contents of %v in snapshot %v", e.Metadata().Name, id)
+			}
+		}
+	}
+}
+
+// fileBlocks returns IDs of blocks that store the file with a given name in the root of the snapshot,
+// including blocks of its indirect object.
+func (th *gcTestHarness) fileBlocks(man *snapshot.Manifest, name string) []string {
+	entries, err := repofs.DirectoryEntry(th.rep, man.RootObjectID(), nil).Readdir(context.Background())
+	if err != nil {
+		th.t.Fatalf("unable to read snapshot root: %v", err)
+	}
+
+	e := entries.FindByName(name)
+	if e == nil {
+		th.t.Fatalf("file %v not found in snapshot", name)
+	}
+
+	return th.objectBlocks(e.(object.HasObjectID).ObjectID())
+}
+
+func (th *gcTestHarness) blockExists(blockID string) bool {
+	bi, err := th.rep.Blocks.BlockInfo(context.Background(), blockID)
+	return err == nil && !bi.Deleted
+}
+
+func (th *gcTestHarness) listPacks() map[string]bool {
+	result := map[string]bool{}
+	for _, prefix := range block.PackBlockPrefixes {
+		blocks, err := storage.ListAllBlocks(context.Background(), th.env.Storage, prefix)
+		if err != nil {
+			th.t.Fatalf("unable to list packs: %v", err)
+		}
+
+		for _, b := range blocks {
+			result[b.BlockID] = true
+		}
+	}
+
+	return result
+}
+
+func TestGCDeletesUnreferencedBlocks(t *testing.T) {
+	th := newGCTestHarness(t)
+	defer th.close()
+
+	// 'big' files span multiple blocks and are stored as indirect objects.
+	_, m1 := th.snapshot("/src1", map[string][]byte{"small": repotesting.TestData(1, 100), "big": repotesting.TestData(2, 20000)}, nil)
+	th.snapshot("/src1", map[string][]byte{"small": repotesting.TestData(1, 100), "big": repotesting.TestData(2, 20000), "new": repotesting.TestData(3, 50)}, m1)
+	id3, _ := th.snapshot("/src2", map[string][]byte{"gone": repotesting.TestData(4, 30000)}, nil)
+
+	man3 := th.loadSnapshot(id3)
+	goneBlocks := th.objectBlocks(man3.RootObjectID())
+	goneBlocks = append(goneBlocks, th.objectBlocks(man3.HashCacheID)...)
+	goneBlocks = append(goneBlocks, th.fileBlocks(man3, "gone")...)
+	th.deleteSnapshot(id3)
+
+	// dry run doesn't delete anything.
+	st := th.run(Options{})
+	if st.UnreferencedBlockCount == 0 {
+		t.Errorf("expected unreferenced blocks, got %+v", st)
+	}
+
+	for _, b := range goneBlocks {
+		if !th.blockExists(b) {
+			t.Errorf("block %v deleted during dry run", b)
+		}
+	}
+
+	st = th.run(Options{Delete: true})
+	if st.UnreferencedBlockCount == 0 {
+		t.Errorf("expected unreferenced blocks, got %+v", st)
+	}
+
+	for _, b := range goneBlocks {
+		if th.blockExists(b) {
+			t.Errorf("unreferenced block %v was not deleted", b)
+		}
+	}
+
+	th.verifySnapshots()
+
+	// nothing is left to collect.
+	st = th.run(Options{Delete: true})
+	if st.UnreferencedBlockCount != 0 {
+		t.Errorf("unexpected unreferenced blocks on second run: %+v", st)
+	}
+
+	th.verifySnapshots()
+}
+
+func (th *gcTestHarness) loadSnapshot(manifestID string) *snapshot.Manifest {
+	man, err := snapshot.LoadSnapshot(context.Background(), th.rep, manifestID)
+	if err != nil {
+		th.t.Fatalf("unable to load snapshot: %v", err)
+	}
+
+	return man
+}
+
+// objectBlocks returns IDs of blocks that store the given object.
+func (th *gcTestHarness) objectBlocks(oid object.ID) []string {
+	_, blocks, err := th.rep.Objects.VerifyObject(context.Background(), oid)
+	if err != nil {
+		th.t.Fatalf("unable to verify %v: %v", oid, err)
+	}
+
+	return blocks
+}
+
+func TestGCKeepsReferencedBlocks(t *testing.T) {
+	th := newGCTestHarness(t)
+	defer th.close()
+
+	_, m1 := th.snapshot("/src", map[string][]byte{"a": repotesting.TestData(1, 100), "big": repotesting.TestData(2, 50000)}, nil)
+	if m1.HashCacheID == "" {
+		t.Fatalf("snapshot has no hash cache")
+	}
+
+	inUse := th.objectBlocks(m1.RootObjectID())
+	inUse = append(inUse, th.objectBlocks(m1.HashCacheID)...)
+
+	big := th.fileBlocks(m1, "big")
+	if len(big) < 2 {
+		t.Fatalf("expected file to span multiple blocks, got %v", big)
+	}
+	inUse = append(inUse, big...)
+
+	st := th.run(Options{Delete: true})
+	if st.UnreferencedBlockCount != 0 || st.DeletedPackCount != 0 {
+		t.Errorf("unexpected deletions: %+v", st)
+	}
+
+	for _, b := range inUse {
+		if !th.blockExists(b) {
+			t.Errorf("referenced block %v was deleted", b)
+		}
+	}
+
+	th.verifySnapshots()
+}
+
+func TestGCHonorsMinContentAge(t *testing.T) {
+	th := newGCTestHarness(t)
+	defer th.close()
+
+	th.snapshot("/src1", map[string][]byte{"a": repotesting.TestData(1, 100)}, nil)
+	id2, _ := th.snapshot("/src2", map[string][]byte{"b": repotesting.TestData(2, 10000)}, nil)
+	blocks2 := th.objectBlocks(th.loadSnapshot(id2).RootObjectID())
+	th.deleteSnapshot(id2)
+
+	packsBefore := th.listPacks()
+
+	st := th.run(Options{Delete: true, MinContentAge: time.Hour, RepackThreshold: 0.9})
+	if st.UnreferencedBlockCount != 0 || st.TooRecentBlockCount == 0 {
+		t.Errorf("unexpected stats: %+v", st)
+	}
+
+	if st.RepackedPackCount != 0 || st.DeletedPackCount != 0 {
+		t.Errorf("recent packs were modified: %+v", st)
+	}
+
+	for _, b := range blocks2 {
+		if !th.blockExists(b) {
+			t.Errorf("recent unreferenced block %v was deleted", b)
+		}
+	}
+
+	for p := range packsBefore {
+		if !th.listPacks()[p] {
+			t.Errorf("recent pack %v was deleted", p)
+		}
+	}
+
+	th.verifySnapshots()
+}
+
+func TestGCRepacksPacks(t *testing.T) {
+	th := newGCTestHarness(t)
+	defer th.close()
+
+	// both snapshots are written to the same packs.
+	ctx := context.Background()
+	u := upload.NewUploader(th.rep)
+	files := map[string]map[string][]byte{
+		"/live": {"a": repotesting.TestData(1, 1000)},
+		"/gone": {"b": repotesting.TestData(2, 40000)},
+	}
+
+	ids := map[string]string{}
+	for path, f := range files {
+		sourceDir := mockfs.NewDirectory()
+		for name, content := range f {
+			sourceDir.AddFile(name, content, 0644)
+		}
+
+		man, err := u.Upload(ctx, sourceDir, snapshot.SourceInfo{Host: "host", UserName: "user", Path: path}, nil)
+		if err != nil {
+			t.Fatalf("upload failed: %v", err)
+		}
+
+		id, err := snapshot.SaveSnapshot(ctx, th.rep, man)
+		if err != nil {
+			t.Fatalf("unable to save snapshot: %v", err)
+		}
+
+		ids[path] = id
+		th.contents[id] = f
+	}
+
+	if err := th.rep.Flush(ctx); err != nil {
+		t.Fatalf("unable to flush: %v", err)
+	}
+
+	liveRoot := th.objectBlocks(th.loadSnapshot(ids["/live"]).RootObjectID())[0]
+	bi, err := th.rep.Blocks.BlockInfo(ctx, liveRoot)
+	if err != nil {
+		t.Fatalf("unable to get block info: %v", err)
+	}
+	oldPack := bi.PackFile
+
+	th.deleteSnapshot(ids["/gone"])
+
+	st := th.run(Options{Delete: true, RepackThreshold: 0.5})
+	if st.RepackedPackCount == 0 || st.RewrittenBlockCount == 0 {
+		t.Errorf("expected packs to be repacked: %+v", st)
+	}
+
+	if st.DeletedPackCount == 0 {
+		t.Errorf("expected repacked packs to be deleted: %+v", st)
+	}
+
+	bi, err = th.rep.Blocks.BlockInfo(ctx, liveRoot)
+	if err != nil {
+		t.Fatalf("unable to get block info: %v", err)
+	}
+
+	if bi.PackFile == oldPack {
+		t.Errorf("block was not rewritten to a new pack")
+	}
+
+	if th.listPacks()[oldPack] {
+		t.Errorf("repacked pack %v was not deleted", oldPack)
+	}
+
+	th.verifySnapshots()
+}
@@ -0,0 +1,228 @@
+package maintenance
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/kopia/kopia/repo"
+	"github.com/kopia/kopia/repo/manifest"
+)
+
+// LeaseManifestType is the type of manifests storing maintenance leases.
+const LeaseManifestType = "maintenanceLease"
+
+// LeaseHeldError is returned when maintenance is being performed by another owner.
+type LeaseHeldError struct {
+	Owner   string
+	Expires time.Time
+}
+
+func (e *LeaseHeldError) Error() string {
+	return fmt.Sprintf("maintenance is being performed by %v until %v", e.Owner, e.Expires.Local().Format(time.RFC3339))
+}
+
+// lease is stored in the repository by the owner performing maintenance.
+type lease struct {
+	Owner    string    `json:"owner"`
+	Acquired time.Time `json:"acquired"`
+	Expires  time.Time `json:"expires"`
+
+	id string
+}
+
+func (l *lease) wins(other *lease) bool {
+	if !l.Acquired.Equal(other.Acquired) {
+		return l.Acquired.Before(other.Acquired)
+	}
+
+	return l.id < other.id
+}
+
+func leaseLabels() map[string]string {
+	return map[string]string{"type": LeaseManifestType}
+}
+
+func loadLeases(ctx context.Context, rep *repo.Repository) ([]*lease, error) {
+	if err := rep.Refresh(ctx); err != nil {
+		if err == repo.ErrRepositoryUpgraded {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("unable to refresh repository: %v", err)
+	}
+
+	entries, err := rep.Manifests.Find(ctx, leaseLabels())
+	if err != nil {
+		return nil, fmt.Errorf("unable to find maintenance leases: %v", err)
+	}
+
+	var result []*lease
+	for _, e := range entries {
+		l := &lease{}
+		if err := rep.Manifests.Get(ctx, e.ID, l); err != nil {
+			if err == manifest.ErrNotFound {
+				// deleted concurrently
+				continue
+			}
+			return nil, fmt.Errorf("unable to load maintenance lease: %v", err)
+		}
+		l.id = e.ID
+		result = append(result, l)
+	}
+
+	return result, nil
+}
+
+// acquireLease takes the repository-wide maintenance lease for a given owner.
+//
+// Any valid lease is held, even when it has the same owner, since the owner name does not identify
+// the process performing maintenance and the lease expires when the process is gone.
+//
+// Manifests written by different servers only become visible to each other after they are flushed and listed,
+// so after writing its own lease the owner waits for settleTime, re-reads all leases and backs off unless its
+// lease is the oldest valid one. Two owners can only both succeed if their leases weren't visible to each other
+// after settleTime.
+func acquireLease(ctx context.Context, rep *repo.Repository, owner string, duration, settleTime time.Duration) (*lease, error) {
+	leases, err := loadLeases(ctx, rep)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for _, l := range leases {
+		if l.Expires.After(now) {
+			return nil, &LeaseHeldError{l.Owner, l.Expires}
+		}
+	}
+
+	mine := &lease{Owner: owner, Acquired: now, Expires: now.Add(duration)}
+	mine.id, err = rep.Manifests.Put(ctx, leaseLabels(), mine)
+	if err != nil {
+		return nil, fmt.Errorf("unable to write maintenance lease: %v", err)
+	}
+
+	// all leases loaded above are expired at this point.
+	for _, l := range leases {
+		rep.Manifests.Delete(l.id)
+	}
+
+	if err := rep.Flush(ctx); err != nil {
+		return nil, fmt.Errorf("unable to flush maintenance lease: %v", err)
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, abandonLease(ctx, rep, mine, ctx.Err())
+	case <-time.After(settleTime):
+	}
+
+	leases, err = loadLeases(ctx, rep)
+	if err != nil {
+		return nil, abandonLease(ctx, rep, mine, err)
+	}
+
+	for _, l := range leases {
+		if l.id != mine.id && l.Expires.After(now) && l.wins(mine) {
+			log.Infof("maintenance lease acquired concurrently by %v, backing off", l.Owner)
+			return nil, abandonLease(ctx, rep, mine, &LeaseHeldError{l.Owner, l.Expires})
+		}
+	}
+
+	return mine, nil
+}
+
+// abandonLease releases the lease that could not be acquired and returns the error that caused it.
+func abandonLease(ctx context.Context, rep *repo.Repository, l *lease, err error) error {
+	if rerr := releaseLease(ctx, rep, l); rerr != nil {
+		log.Warningf("unable to release maintenance lease: %v", rerr)
+	}
+
+	return err
+}
+
+// renewLease extends the lease by a given duration, keeping its acquisition time so that it still wins over
+// leases written concurrently by other owners.
+func renewLease(ctx context.Context, rep *repo.Repository, l *lease, duration time.Duration) error {
+	leases, err := loadLeases(ctx, rep)
+	if err != nil {
+		return err
+	}
+
+	if !containsLease(leases, l.id) {
+		return fmt.Errorf("maintenance lease was deleted by another owner")
+	}
+
+	renewed := &lease{Owner: l.Owner, Acquired: l.Acquired, Expires: time.Now().Add(duration)}
+
+	renewed.id, err = rep.Manifests.Put(ctx, leaseLabels(), renewed)
+	if err != nil {
+		return fmt.Errorf("unable to write maintenance lease: %v", err)
+	}
+
+	rep.Manifests.Delete(l.id)
+	if err := rep.Flush(ctx); err != nil {
+		return fmt.Errorf("unable to flush maintenance lease: %v", err)
+	}
+
+	*l = *renewed
+	return nil
+}
+
+// leaseRenewalsPerDuration is the number of times the lease is renewed during its duration,
+// so that it doesn't expire when some renewals fail or are delayed.
+const leaseRenewalsPerDuration = 4
+
+// keepLease renews the lease in the background until stop is closed. If renewal fails, abort is called
+// and the error is returned from the returned channel, which is closed when renewal stops.
+func keepLease(ctx context.Context, rep *repo.Repository, l *lease, duration time.Duration, stop <-chan struct{}, abort func()) <-chan error {
+	result := make(chan error, 1)
+
+	go func() {
+		defer close(result)
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(duration / leaseRenewalsPerDuration):
+			}
+
+			err := renewLease(ctx, rep, l, duration)
+			if err == repo.ErrRepositoryUpgraded {
+				// the storage generation holding the lease has been retired by the upgrade,
+				// which holds the lease until then, so there's nothing left to renew.
+				return
+			}
+
+			if err != nil {
+				log.Warningf("unable to renew maintenance lease, aborting: %v", err)
+				abort()
+				result <- err
+				return
+			}
+		}
+	}()
+
+	return result
+}
+
+func containsLease(leases []*lease, id string) bool {
+	for _, l := range leases {
+		if l.id == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+func releaseLease(ctx context.Context, rep *repo.Repository, l *lease) error {
+	if err := rep.Refresh(ctx); err == repo.ErrRepositoryUpgraded {
+		// the lease has been retired with the storage generation, which must not be written to.
+		return nil
+	}
+
+	rep.Manifests.Delete(l.id)
+	return rep.Flush(ctx)
+}
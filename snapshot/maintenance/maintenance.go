@@ -0,0 +1,307 @@
+// Package maintenance implements periodic repository maintenance, which keeps indexes compact
+// and removes snapshots and data that are no longer needed.
+package maintenance
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/kopia/kopia/internal/kopialogging"
+	"github.com/kopia/kopia/policy"
+	"github.com/kopia/kopia/repo"
+	"github.com/kopia/kopia/repo/manifest"
+	"github.com/kopia/kopia/snapshot"
+	"github.com/kopia/kopia/snapshot/gc"
+)
+
+var log = kopialogging.Logger("kopia/snapshot/maintenance")
+
+// Mode determines the kind of maintenance to perform.
+type Mode string
+
+// Supported maintenance modes.
+const (
+	ModeQuick Mode = "quick"
+	ModeFull  Mode = "full"
+)
+
+const runManifestType = "maintenanceRun"
+
+// maxRunHistory is the number of past runs of each mode kept in the repository.
+const maxRunHistory = 5
+
+// RunInfo describes the result of a single maintenance run.
+type RunInfo struct {
+	Mode    Mode      `json:"mode"`
+	Owner   string    `json:"owner"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Success bool      `json:"success"`
+	Error   string    `json:"error,omitempty"`
+
+	ExpiredSnapshots int       `json:"expiredSnapshots,omitempty"`
+	GC               *gc.Stats `json:"gc,omitempty"`
+}
+
+// Schedule describes when maintenance should run next.
+type Schedule struct {
+	NextQuickRun time.Time `json:"nextQuickRun,omitempty"`
+	NextFullRun  time.Time `json:"nextFullRun,omitempty"`
+}
+
+// Run performs maintenance of a given mode on behalf of the owner (typically username@hostname).
+// It returns *LeaseHeldError when another owner is performing maintenance. The result of the run
+// is recorded in the repository, even if maintenance fails.
+func Run(ctx context.Context, rep *repo.Repository, mode Mode, owner string) (*RunInfo, error) {
+	if rep.IsRemote() {
+		return nil, repo.ErrRemoteRepository
+	}
+
+	if mode != ModeQuick && mode != ModeFull {
+		return nil, fmt.Errorf("invalid maintenance mode: %v", mode)
+	}
+
+	p, err := GetParams(ctx, rep)
+	if err != nil {
+		return nil, err
+	}
+
+	var ri *RunInfo
+	err = withLease(ctx, rep, owner, p, func(ctx context.Context) error {
+		log.Infof("starting %v maintenance", mode)
+		ri = &RunInfo{
+			Mode:  mode,
+			Owner: owner,
+			Start: time.Now(),
+		}
+
+		if mode == ModeFull {
+			return runFull(ctx, rep, p, ri)
+		}
+
+		return runQuick(ctx, rep, p)
+	})
+	if ri == nil {
+		// lease not acquired.
+		return nil, err
+	}
+
+	ri.End = time.Now()
+	ri.Success = err == nil
+	if err != nil {
+		ri.Error = err.Error()
+	}
+
+	if rerr := recordRun(ctx, rep, ri); rerr != nil {
+		log.Warningf("unable to record maintenance run: %v", rerr)
+	}
+
+	log.Infof("finished %v maintenance in %v", mode, ri.End.Sub(ri.Start))
+	return ri, err
+}
+
+// WithLease runs a function on behalf of the owner while holding the maintenance lease, so that it's not run
+// concurrently with maintenance. The context passed to the function is cancelled when the lease can't be renewed.
+// It returns *LeaseHeldError when another owner is performing maintenance.
+func WithLease(ctx context.Context, rep *repo.Repository, owner string, run func(ctx context.Context) error) error {
+	if rep.IsRemote() {
+		return repo.ErrRemoteRepository
+	}
+
+	p, err := GetParams(ctx, rep)
+	if err != nil {
+		return err
+	}
+
+	return withLease(ctx, rep, owner, p, run)
+}
+
+func withLease(ctx context.Context, rep *repo.Repository, owner string, p *Params, run func(ctx context.Context) error) error {
+	l, err := acquireLease(ctx, rep, owner, p.LeaseDuration, p.LeaseSettleTime)
+	if err != nil {
+		return err
+	}
+
+	// run is aborted when the lease can't be renewed, since another owner may take it over after it expires.
+	runCtx, abort := context.WithCancel(ctx)
+	stopRenewal := make(chan struct{})
+	renewalErr := keepLease(ctx, rep, l, p.LeaseDuration, stopRenewal, abort)
+
+	err = run(runCtx)
+	if runCtx.Err() != nil && ctx.Err() == nil {
+		err = fmt.Errorf("aborted after failing to renew maintenance lease: %v", <-renewalErr)
+	}
+
+	close(stopRenewal)
+	<-renewalErr
+	abort()
+
+	if err := releaseLease(ctx, rep, l); err != nil {
+		log.Warningf("unable to release maintenance lease: %v", err)
+	}
+
+	return err
+}
+
+func runQuick(ctx context.Context, rep *repo.Repository, p *Params) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := rep.Blocks.CompactIndexes(ctx, p.IndexCompactionThreshold, p.IndexCompactionThreshold); err != nil {
+		return fmt.Errorf("unable to compact indexes: %v", err)
+	}
+
+	if mm, ok := rep.Manifests.(*manifest.Manager); ok {
+		if err := mm.Compact(ctx); err != nil {
+			return fmt.Errorf("unable to compact manifests: %v", err)
+		}
+	}
+
+	return rep.Flush(ctx)
+}
+
+func runFull(ctx context.Context, rep *repo.Repository, p *Params, ri *RunInfo) error {
+	expired, err := expireSnapshots(ctx, rep)
+	if err != nil {
+		return err
+	}
+	ri.ExpiredSnapshots = expired
+
+	ri.GC, err = gc.Run(ctx, rep, gc.Options{
+		Delete:          true,
+		MinContentAge:   p.MinContentAge,
+		RepackThreshold: p.RepackThreshold,
+	})
+	if err != nil {
+		return fmt.Errorf("garbage collection failed: %v", err)
+	}
+
+	return runQuick(ctx, rep, p)
+}
+
+// expireSnapshots deletes snapshots of all sources according to their retention policies.
+func expireSnapshots(ctx context.Context, rep *repo.Repository) (int, error) {
+	names, err := snapshot.ListSnapshotManifests(ctx, rep, nil)
+	if err != nil {
+		return 0, fmt.Errorf("unable to list snapshots: %v", err)
+	}
+
+	snapshots, err := snapshot.LoadSnapshots(ctx, rep, names)
+	if err != nil {
+		return 0, fmt.Errorf("unable to load snapshots: %v", err)
+	}
+
+	toDelete, err := policy.GetExpiredSnapshots(ctx, rep, snapshots)
+	if err != nil {
+		return 0, fmt.Errorf("unable to determine expired snapshots: %v", err)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, m := range toDelete {
+		rep.Manifests.Delete(m.ID)
+	}
+
+	if err := rep.Flush(ctx); err != nil {
+		return 0, fmt.Errorf("unable to flush: %v", err)
+	}
+
+	log.Infof("expired %v snapshots", len(toDelete))
+	return len(toDelete), nil
+}
+
+func runLabels(mode Mode) map[string]string {
+	return map[string]string{
+		"type": runManifestType,
+		"mode": string(mode),
+	}
+}
+
+// recordRun saves the result of a maintenance run, keeping maxRunHistory most recent runs of each mode.
+func recordRun(ctx context.Context, rep *repo.Repository, ri *RunInfo) error {
+	if _, err := rep.Manifests.Put(ctx, runLabels(ri.Mode), ri); err != nil {
+		return err
+	}
+
+	entries, err := rep.Manifests.Find(ctx, runLabels(ri.Mode))
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime.After(entries[j].ModTime)
+	})
+
+	for i := maxRunHistory; i < len(entries); i++ {
+		rep.Manifests.Delete(entries[i].ID)
+	}
+
+	return rep.Flush(ctx)
+}
+
+// History returns recorded maintenance runs of all modes, most recent first.
+func History(ctx context.Context, rep *repo.Repository) ([]*RunInfo, error) {
+	entries, err := rep.Manifests.Find(ctx, map[string]string{"type": runManifestType})
+	if err != nil {
+		return nil, fmt.Errorf("unable to find maintenance runs: %v", err)
+	}
+
+	var result []*RunInfo
+	for _, e := range entries {
+		ri := &RunInfo{}
+		if err := rep.Manifests.Get(ctx, e.ID, ri); err != nil {
+			return nil, fmt.Errorf("unable to load maintenance run: %v", err)
+		}
+		result = append(result, ri)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Start.After(result[j].Start)
+	})
+
+	return result, nil
+}
+
+// NextSchedule computes when enabled maintenance cycles should run next based on the history of runs.
+// Cycles that never ran are due immediately.
+func NextSchedule(p *Params, history []*RunInfo) Schedule {
+	var s Schedule
+
+	if p.QuickCycle.Enabled {
+		s.NextQuickRun = nextRunTime(p.QuickCycle.Interval, lastRun(history, ModeQuick, ModeFull))
+	}
+
+	if p.FullCycle.Enabled {
+		s.NextFullRun = nextRunTime(p.FullCycle.Interval, lastRun(history, ModeFull))
+	}
+
+	return s
+}
+
+// lastRun returns the most recent run of any of given modes, full maintenance includes quick maintenance.
+func lastRun(history []*RunInfo, modes ...Mode) *RunInfo {
+	var last *RunInfo
+
+	for _, ri := range history {
+		for _, m := range modes {
+			if ri.Mode == m && (last == nil || ri.Start.After(last.Start)) {
+				last = ri
+			}
+		}
+	}
+
+	return last
+}
+
+func nextRunTime(interval time.Duration, last *RunInfo) time.Time {
+	if last == nil {
+		return time.Now()
+	}
+
+	return last.Start.Add(interval)
+}
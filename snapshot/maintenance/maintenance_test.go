@@ -0,0 +1,315 @@
+package maintenance
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kopia/kopia/internal/repotesting"
+	"github.com/kopia/kopia/repo"
+)
+
+type maintenanceTestHarness struct {
+	env  *repotesting.Environment
+	reps []*repo.Repository
+}
+
+func newMaintenanceTestHarness(t *testing.T) *maintenanceTestHarness {
+	return &maintenanceTestHarness{env: repotesting.Setup(t, nil, repo.ConnectOptions{})}
+}
+
+// open opens another instance of the repository, as used by a different server.
+func (th *maintenanceTestHarness) open() *repo.Repository {
+	rep := th.env.Open()
+	th.reps = append(th.reps, rep)
+	return rep
+}
+
+func (th *maintenanceTestHarness) close() {
+	for _, rep := range th.reps {
+		rep.Close(context.Background()) //nolint:errcheck
+	}
+	th.env.Close()
+}
+
+func TestLeaseExclusion(t *testing.T) {
+	th := newMaintenanceTestHarness(t)
+	defer th.close()
+
+	ctx := context.Background()
+	rep1, rep2 := th.open(), th.open()
+
+	l, err := acquireLease(ctx, rep1, "owner1", time.Hour, 0)
+	if err != nil {
+		t.Fatalf("unable to acquire lease: %v", err)
+	}
+
+	_, err = acquireLease(ctx, rep2, "owner2", time.Hour, 0)
+	if lhe, ok := err.(*LeaseHeldError); !ok || lhe.Owner != "owner1" {
+		t.Fatalf("unexpected result of acquiring held lease: %v", err)
+	}
+
+	// the same owner name may be used by another process, e.g. CLI running on the same host as the server.
+	_, err = acquireLease(ctx, rep2, "owner1", time.Hour, 0)
+	if _, ok := err.(*LeaseHeldError); !ok {
+		t.Fatalf("unexpected result of acquiring held lease by the same owner: %v", err)
+	}
+
+	if err := releaseLease(ctx, rep1, l); err != nil {
+		t.Fatalf("unable to release lease: %v", err)
+	}
+
+	if l, err = acquireLease(ctx, rep2, "owner2", time.Hour, 0); err != nil {
+		t.Fatalf("unable to acquire released lease: %v", err)
+	}
+
+	leases, err := loadLeases(ctx, rep1)
+	if err != nil {
+		t.Fatalf("unable to load leases: %v", err)
+	}
+
+	if len(leases) != 1 || leases[0].id != l.id {
+		t.Errorf("unexpected leases: %v", leases)
+	}
+}
+
+func TestLeaseExpiration(t *testing.T) {
+	th := newMaintenanceTestHarness(t)
+	defer th.close()
+
+	ctx := context.Background()
+	rep1, rep2 := th.open(), th.open()
+
+	if _, err := acquireLease(ctx, rep1, "owner1", 50*time.Millisecond, 0); err != nil {
+		t.Fatalf("unable to acquire lease: %v", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if _, err := acquireLease(ctx, rep2, "owner2", time.Hour, 0); err != nil {
+		t.Fatalf("unable to acquire expired lease: %v", err)
+	}
+}
+
+func TestConcurrentLeaseAcquisition(t *testing.T) {
+	th := newMaintenanceTestHarness(t)
+	defer th.close()
+
+	ctx := context.Background()
+	owners := []string{"owner1", "owner2", "owner3"}
+	reps := map[string]*repo.Repository{}
+	for _, o := range owners {
+		reps[o] = th.open()
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(owners))
+	for i, o := range owners {
+		wg.Add(1)
+		go func(i int, o string) {
+			defer wg.Done()
+			_, errs[i] = acquireLease(ctx, reps[o], o, time.Hour, 500*time.Millisecond)
+		}(i, o)
+	}
+	wg.Wait()
+
+	acquired := 0
+	for i, err := range errs {
+		switch err.(type) {
+		case nil:
+			acquired++
+		case *LeaseHeldError:
+		default:
+			t.Errorf("unexpected error acquiring lease by %v: %v", owners[i], err)
+		}
+	}
+
+	if acquired != 1 {
+		t.Errorf("lease acquired by %v owners, want 1: %v", acquired, errs)
+	}
+}
+
+func TestLeaseRenewal(t *testing.T) {
+	th := newMaintenanceTestHarness(t)
+	defer th.close()
+
+	ctx := context.Background()
+	rep1, rep2 := th.open(), th.open()
+
+	const duration = 200 * time.Millisecond
+
+	l, err := acquireLease(ctx, rep1, "owner1", duration, 0)
+	if err != nil {
+		t.Fatalf("unable to acquire lease: %v", err)
+	}
+	acquired := l.Acquired
+
+	stop := make(chan struct{})
+	aborted := make(chan struct{})
+	renewalErr := keepLease(ctx, rep1, l, duration, stop, func() { close(aborted) })
+
+	// lease is held by the owner well beyond its original duration.
+	time.Sleep(3 * duration)
+	if _, err := acquireLease(ctx, rep2, "owner2", time.Hour, 0); err == nil {
+		t.Fatalf("renewed lease was acquired by another owner")
+	}
+
+	close(stop)
+	if err := <-renewalErr; err != nil {
+		t.Errorf("unexpected renewal error: %v", err)
+	}
+
+	leases, err := loadLeases(ctx, rep2)
+	if err != nil {
+		t.Fatalf("unable to load leases: %v", err)
+	}
+
+	if len(leases) != 1 || !leases[0].Acquired.Equal(acquired) || !leases[0].Expires.After(acquired.Add(duration)) {
+		t.Errorf("unexpected leases after renewal: %+v", leases)
+	}
+
+	select {
+	case <-aborted:
+		t.Errorf("maintenance aborted")
+	default:
+	}
+}
+
+func TestLeaseRenewalFailureAborts(t *testing.T) {
+	th := newMaintenanceTestHarness(t)
+	defer th.close()
+
+	ctx := context.Background()
+	rep := th.open()
+
+	const duration = 100 * time.Millisecond
+
+	l, err := acquireLease(ctx, rep, "owner1", duration, 0)
+	if err != nil {
+		t.Fatalf("unable to acquire lease: %v", err)
+	}
+
+	// make the storage unwritable.
+	storageDir := th.env.StorageDir
+	if err := os.RemoveAll(storageDir); err != nil {
+		t.Fatalf("unable to remove storage: %v", err)
+	}
+	if err := ioutil.WriteFile(storageDir, nil, 0600); err != nil {
+		t.Fatalf("unable to replace storage: %v", err)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	aborted := make(chan struct{})
+	renewalErr := keepLease(ctx, rep, l, duration, stop, func() { close(aborted) })
+
+	select {
+	case <-aborted:
+	case <-time.After(10 * duration):
+		t.Fatalf("maintenance not aborted after renewal failure")
+	}
+
+	if err := <-renewalErr; err == nil {
+		t.Errorf("renewal error not reported")
+	}
+}
+
+func TestLeaseRenewalAbortsWhenLeaseDeleted(t *testing.T) {
+	th := newMaintenanceTestHarness(t)
+	defer th.close()
+
+	ctx := context.Background()
+	rep1, rep2 := th.open(), th.open()
+
+	const duration = 100 * time.Millisecond
+
+	l, err := acquireLease(ctx, rep1, "owner1", duration, 0)
+	if err != nil {
+		t.Fatalf("unable to acquire lease: %v", err)
+	}
+
+	if err := rep2.Refresh(ctx); err != nil {
+		t.Fatalf("unable to refresh: %v", err)
+	}
+
+	rep2.Manifests.Delete(l.id)
+	if err := rep2.Flush(ctx); err != nil {
+		t.Fatalf("unable to flush: %v", err)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	aborted := make(chan struct{})
+	renewalErr := keepLease(ctx, rep1, l, duration, stop, func() { close(aborted) })
+
+	select {
+	case <-aborted:
+	case <-time.After(10 * duration):
+		t.Fatalf("maintenance not aborted after lease was deleted")
+	}
+
+	if err := <-renewalErr; err == nil {
+		t.Errorf("renewal error not reported")
+	}
+}
+
+func TestNextSchedule(t *testing.T) {
+	t0 := time.Date(2019, 1, 1, 12, 0, 0, 0, time.UTC)
+	run := func(mode Mode, start time.Time) *RunInfo {
+		return &RunInfo{Mode: mode, Start: start}
+	}
+
+	p := DefaultParams()
+	p.FullCycle.Enabled = true
+
+	quickOnly := DefaultParams()
+	quickOnly.FullCycle.Enabled = false
+
+	cases := []struct {
+		desc      string
+		params    *Params
+		history   []*RunInfo
+		wantQuick time.Time
+		wantFull  time.Time
+	}{
+		{
+			desc:      "quick after quick",
+			params:    p,
+			history:   []*RunInfo{run(ModeQuick, t0), run(ModeQuick, t0.Add(-time.Hour)), run(ModeFull, t0.Add(-3*time.Hour))},
+			wantQuick: t0.Add(time.Hour),
+			wantFull:  t0.Add(21 * time.Hour),
+		},
+		{
+			desc:      "full run includes quick",
+			params:    p,
+			history:   []*RunInfo{run(ModeQuick, t0.Add(-2*time.Hour)), run(ModeFull, t0)},
+			wantQuick: t0.Add(time.Hour),
+			wantFull:  t0.Add(24 * time.Hour),
+		},
+		{
+			desc:      "full disabled",
+			params:    quickOnly,
+			history:   []*RunInfo{run(ModeQuick, t0)},
+			wantQuick: t0.Add(time.Hour),
+		},
+	}
+
+	for _, tc := range cases {
+		s := NextSchedule(tc.params, tc.history)
+		if !s.NextQuickRun.Equal(tc.wantQuick) || !s.NextFullRun.Equal(tc.wantFull) {
+			t.Errorf("%v: unexpected schedule %v, want quick %v full %v", tc.desc, s, tc.wantQuick, tc.wantFull)
+		}
+	}
+
+	// cycles that never ran are due now.
+	before := time.Now()
+	s := NextSchedule(p, nil)
+	if s.NextQuickRun.Before(before) || s.NextFullRun.Before(before) || s.NextFullRun.After(time.Now()) {
+		t.Errorf("unexpected schedule without history: %v", s)
+	}
+}
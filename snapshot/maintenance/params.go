@@ -0,0 +1,123 @@
+package maintenance
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/kopia/kopia/repo"
+)
+
+const paramsManifestType = "maintenance"
+
+// CycleParams determines whether and how often a maintenance cycle runs.
+type CycleParams struct {
+	Enabled  bool          `json:"enabled"`
+	Interval time.Duration `json:"interval"`
+}
+
+// Params describes repository-wide maintenance settings, which are shared by all servers
+// connected to the repository.
+type Params struct {
+	// QuickCycle compacts indexes and manifests.
+	QuickCycle CycleParams `json:"quick"`
+
+	// FullCycle expires snapshots according to their retention policies, collects garbage and
+	// then performs the quick cycle.
+	FullCycle CycleParams `json:"full"`
+
+	// IndexCompactionThreshold is the number of small index blocks above which indexes get compacted.
+	IndexCompactionThreshold int `json:"indexCompactionThreshold"`
+
+	// MinContentAge and RepackThreshold are passed to garbage collection, see gc.Options.
+	MinContentAge   time.Duration `json:"minContentAge"`
+	RepackThreshold float64       `json:"repackThreshold"`
+
+	// LeaseDuration is the time after which the lease of a server that did not finish maintenance expires.
+	// Leases are renewed while maintenance is running.
+	LeaseDuration time.Duration `json:"leaseDuration"`
+
+	// LeaseSettleTime is the time to wait after writing the lease before checking for competing leases,
+	// which must be longer than it takes for manifests flushed by one server to be listed by others.
+	LeaseSettleTime time.Duration `json:"leaseSettleTime"`
+}
+
+// DefaultParams returns maintenance parameters used when none have been set.
+// Full maintenance deletes data, so it must be enabled explicitly.
+func DefaultParams() *Params {
+	return &Params{
+		QuickCycle: CycleParams{
+			Enabled:  true,
+			Interval: time.Hour,
+		},
+		FullCycle: CycleParams{
+			Enabled:  false,
+			Interval: 24 * time.Hour,
+		},
+		IndexCompactionThreshold: 16,
+		MinContentAge:            24 * time.Hour,
+		RepackThreshold:          0.5,
+		LeaseDuration:            4 * time.Hour,
+		LeaseSettleTime:          time.Minute,
+	}
+}
+
+func paramsLabels() map[string]string {
+	return map[string]string{"type": paramsManifestType}
+}
+
+// GetParams returns the maintenance parameters of the repository or DefaultParams() if none have been set.
+func GetParams(ctx context.Context, rep *repo.Repository) (*Params, error) {
+	entries, err := rep.Manifests.Find(ctx, paramsLabels())
+	if err != nil {
+		return nil, fmt.Errorf("unable to find maintenance parameters: %v", err)
+	}
+
+	if len(entries) == 0 {
+		return DefaultParams(), nil
+	}
+
+	latest := entries[0]
+	for _, e := range entries {
+		if e.ModTime.After(latest.ModTime) {
+			latest = e
+		}
+	}
+
+	p := DefaultParams()
+	if err := rep.Manifests.Get(ctx, latest.ID, p); err != nil {
+		return nil, fmt.Errorf("unable to load maintenance parameters: %v", err)
+	}
+
+	return p, nil
+}
+
+// SetParams stores the maintenance parameters of the repository replacing any previously set.
+func SetParams(ctx context.Context, rep *repo.Repository, p *Params) error {
+	if p.QuickCycle.Interval <= 0 || p.FullCycle.Interval <= 0 {
+		return fmt.Errorf("maintenance intervals must be positive")
+	}
+
+	if p.LeaseDuration <= 0 {
+		return fmt.Errorf("lease duration must be positive")
+	}
+
+	if p.LeaseSettleTime < 0 || p.LeaseSettleTime >= p.LeaseDuration/2 {
+		return fmt.Errorf("lease settle time must not be negative and shorter than half of lease duration")
+	}
+
+	old, err := rep.Manifests.Find(ctx, paramsLabels())
+	if err != nil {
+		return fmt.Errorf("unable to find maintenance parameters: %v", err)
+	}
+
+	if _, err := rep.Manifests.Put(ctx, paramsLabels(), p); err != nil {
+		return fmt.Errorf("unable to save maintenance parameters: %v", err)
+	}
+
+	for _, e := range old {
+		rep.Manifests.Delete(e.ID)
+	}
+
+	return nil
+}
@@ -73,6 +73,24 @@ func SaveSnapshot(ctx context.Context, rep *repo.Repository, manifest *Manifest)
 	return rep.Manifests.Put(ctx, sourceInfoToLabels(manifest.Source), manifest)
 }
 
+// UpdateSnapshot replaces the persisted snapshot manifest with the given one, which must have been loaded
+// from the repository, and updates its ID.
+func UpdateSnapshot(ctx context.Context, rep *repo.Repository, manifest *Manifest) error {
+	if manifest.ID == "" {
+		return fmt.Errorf("snapshot manifest has no ID")
+	}
+
+	newID, err := SaveSnapshot(ctx, rep, manifest)
+	if err != nil {
+		return err
+	}
+
+	rep.Manifests.Delete(manifest.ID)
+	manifest.ID = newID
+
+	return nil
+}
+
 // LoadSnapshots efficiently loads and parses a given list of snapshot IDs.
 func LoadSnapshots(ctx context.Context, rep *repo.Repository, names []string) ([]*Manifest, error) {
 	result := make([]*Manifest, len(names))
@@ -0,0 +1,64 @@
+package snapshot
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kopia/kopia/internal/repotesting"
+	"github.com/kopia/kopia/repo"
+)
+
+func TestUpdateSnapshot(t *testing.T) {
+	ctx := context.Background()
+	env := repotesting.Setup(t, nil, repo.ConnectOptions{})
+	defer env.Close()
+
+	rep := env.Repository
+
+	src := SourceInfo{Host: "host", UserName: "user", Path: "/path"}
+	m := &Manifest{Source: src, StartTime: time.Now().Truncate(time.Second).UTC(), Description: "original"}
+
+	if err := UpdateSnapshot(ctx, rep, m); err == nil {
+		t.Errorf("unexpected success updating snapshot that was not saved")
+	}
+
+	id, err := SaveSnapshot(ctx, rep, m)
+	if err != nil {
+		t.Fatalf("unable to save snapshot: %v", err)
+	}
+
+	loaded, err := LoadSnapshot(ctx, rep, id)
+	if err != nil {
+		t.Fatalf("unable to load snapshot: %v", err)
+	}
+
+	loaded.Tags = map[string]string{"type": "monthly"}
+	loaded.Pins = []string{"release"}
+	if err := UpdateSnapshot(ctx, rep, loaded); err != nil {
+		t.Fatalf("unable to update snapshot: %v", err)
+	}
+
+	if loaded.ID == id {
+		t.Errorf("snapshot ID was not updated")
+	}
+
+	ids, err := ListSnapshotManifests(ctx, rep, &src)
+	if err != nil {
+		t.Fatalf("unable to list snapshots: %v", err)
+	}
+
+	if want := []string{loaded.ID}; !reflect.DeepEqual(ids, want) {
+		t.Fatalf("unexpected snapshots after update: %v, want %v", ids, want)
+	}
+
+	updated, err := LoadSnapshot(ctx, rep, loaded.ID)
+	if err != nil {
+		t.Fatalf("unable to load updated snapshot: %v", err)
+	}
+
+	if !reflect.DeepEqual(updated, loaded) {
+		t.Errorf("unexpected updated snapshot: %+v, want %+v", updated, loaded)
+	}
+}
@@ -2,6 +2,7 @@ package snapshot
 
 import (
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/kopia/kopia/internal/dir"
@@ -24,9 +25,27 @@ type Manifest struct {
 
 	RootEntry *dir.Entry `json:"rootEntry"`
 
+	// Tags are free-form key/value labels assigned by the user.
+	Tags map[string]string `json:"tags,omitempty"`
+
+	// Pins prevent the snapshot from being expired as long as there is at least one.
+	Pins []string `json:"pins,omitempty"`
+
 	RetentionReasons []string `json:"-"`
 }
 
+// MatchesTag returns true if the snapshot has a tag matching the selector, which is either
+// 'key=value' or just 'key' matching any value.
+func (m *Manifest) MatchesTag(selector string) bool {
+	if p := strings.Index(selector, "="); p >= 0 {
+		v, ok := m.Tags[selector[0:p]]
+		return ok && v == selector[p+1:]
+	}
+
+	_, ok := m.Tags[selector]
+	return ok
+}
+
 // RootObjectID returns the ID of a root object.
 func (m *Manifest) RootObjectID() object.ID {
 	if m.RootEntry != nil {
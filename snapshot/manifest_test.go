@@ -0,0 +1,35 @@
+package snapshot
+
+import "testing"
+
+func TestMatchesTag(t *testing.T) {
+	m := &Manifest{Tags: map[string]string{"type": "monthly", "keep": "", "owner": "a=b"}}
+
+	cases := []struct {
+		selector string
+		want     bool
+	}{
+		{"type", true},
+		{"type=monthly", true},
+		{"type=daily", false},
+		{"type=", false},
+		{"keep", true},
+		{"keep=", true},
+		{"keep=yes", false},
+		{"owner=a=b", true},
+		{"owner=a", false},
+		{"missing", false},
+		{"missing=", false},
+		{"", false},
+	}
+
+	for _, tc := range cases {
+		if got := m.MatchesTag(tc.selector); got != tc.want {
+			t.Errorf("unexpected result of matching %q: %v, want %v", tc.selector, got, tc.want)
+		}
+	}
+
+	if (&Manifest{}).MatchesTag("type") {
+		t.Errorf("snapshot without tags matches a tag")
+	}
+}
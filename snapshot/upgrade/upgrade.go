@@ -0,0 +1,609 @@
+// Package upgrade implements migration of repository contents to a new block format or splitter.
+package upgrade
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/kopia/kopia/fs"
+	"github.com/kopia/kopia/internal/dir"
+	"github.com/kopia/kopia/internal/hashcache"
+	"github.com/kopia/kopia/internal/jsonstream"
+	"github.com/kopia/kopia/internal/kopialogging"
+	"github.com/kopia/kopia/repo"
+	"github.com/kopia/kopia/repo/object"
+	"github.com/kopia/kopia/snapshot"
+	"github.com/kopia/kopia/snapshot/maintenance"
+)
+
+var log = kopialogging.Logger("kopia/snapshot/upgrade")
+
+const (
+	checkpointManifestType = "upgradeCheckpoint"
+	mappingStreamType      = "kopia:upgrade-mapping"
+	snapshotManifestType   = "snapshot"
+)
+
+// DefaultCheckpointInterval is the default maximum time between checkpoints of the upgrade progress.
+const DefaultCheckpointInterval = 5 * time.Minute
+
+// Options controls the behavior of the upgrade.
+type Options struct {
+	repo.UpgradeOptions
+
+	// Owner of the maintenance lease held during the upgrade (typically username@hostname).
+	Owner string
+
+	// Progress of the upgrade is persisted at most this often, so that it can be resumed when interrupted.
+	CheckpointInterval time.Duration
+}
+
+// Stats describes the results of the upgrade.
+type Stats struct {
+	Resumed bool `json:"resumed"`
+
+	ManifestCount        int   `json:"manifestCount"`
+	SnapshotCount        int   `json:"snapshotCount"`
+	DeletedManifestCount int   `json:"deletedManifestCount"`
+	ObjectCount          int   `json:"objectCount"`
+	BlockCount           int   `json:"blockCount"`
+	Bytes                int64 `json:"bytes"`
+}
+
+// checkpoint is stored as a manifest in the new generation to allow resuming the upgrade.
+type checkpoint struct {
+	// Object in the new generation storing the mapping of object IDs.
+	MappingObjectID object.ID `json:"mapping"`
+
+	// Maps IDs of migrated manifests to their new IDs.
+	Manifests map[string]string `json:"manifests"`
+}
+
+type mappingEntry struct {
+	Old object.ID `json:"o"`
+	New object.ID `json:"n"`
+}
+
+// Run migrates all snapshots and other manifests to the new format and switches the repository to it.
+//
+// Block IDs of each live block are mapped to new IDs by re-encoding it with the new formatter, directory objects
+// and hash caches referencing them are rewritten and snapshot manifests are updated to point at the new objects.
+// When the splitter changes, contents of files are split again instead. Blocks which are not reachable
+// from any manifest are not migrated. The repository must be reopened afterwards.
+//
+// The maintenance lease is held until the upgrade is committed, so maintenance is not performed concurrently
+// and it returns *maintenance.LeaseHeldError when maintenance is running. Clients using the current format fail
+// to refresh or open the repository after the upgrade, but other clients must not write to the repository while
+// the upgrade is running, since their changes may be lost.
+func Run(ctx context.Context, rep *repo.Repository, opt Options) (*Stats, error) {
+	if rep.IsRemote() {
+		return nil, repo.ErrRemoteRepository
+	}
+
+	if opt.CheckpointInterval == 0 {
+		opt.CheckpointInterval = DefaultCheckpointInterval
+	}
+
+	var stats *Stats
+	err := maintenance.WithLease(ctx, rep, opt.Owner, func(ctx context.Context) error {
+		var err error
+		stats, err = run(ctx, rep, opt)
+		return err
+	})
+
+	return stats, err
+}
+
+func run(ctx context.Context, rep *repo.Repository, opt Options) (*Stats, error) {
+	u, err := rep.BeginUpgrade(ctx, opt.UpgradeOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := newMigrator(ctx, rep, u)
+	if err != nil {
+		return nil, err
+	}
+
+	live, err := m.migrateManifests(ctx, opt.CheckpointInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	// remove manifests that were deleted in the current generation while the upgrade was running.
+	for oldID, newID := range m.manifests {
+		if !live[oldID] {
+			log.Debugf("removing deleted manifest %v", oldID)
+			u.Manifests.Delete(newID)
+			m.stats.DeletedManifestCount++
+		}
+	}
+
+	if err := m.deleteCheckpoints(ctx); err != nil {
+		return nil, err
+	}
+
+	if err := u.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("unable to commit upgrade: %v", err)
+	}
+
+	return m.stats, nil
+}
+
+// newMigrator returns a migrator of repository contents to the upgrade, which continues
+// from the latest checkpoint when the upgrade is resumed.
+func newMigrator(ctx context.Context, rep *repo.Repository, u *repo.Upgrade) (*migrator, error) {
+	m := &migrator{
+		rep:            rep,
+		upgrade:        u,
+		resplit:        u.Format.Splitter != rep.Objects.Format.Splitter,
+		objects:        map[object.ID]object.ID{},
+		blocks:         map[string]string{},
+		manifests:      map[string]string{},
+		lastCheckpoint: time.Now(),
+		stats:          &Stats{Resumed: u.Resumed},
+	}
+
+	if u.Resumed {
+		if err := m.loadCheckpoint(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+type migrator struct {
+	rep     *repo.Repository
+	upgrade *repo.Upgrade
+	resplit bool
+
+	objects   map[object.ID]object.ID // old object ID -> new object ID
+	blocks    map[string]string       // old block ID -> new block ID
+	manifests map[string]string       // old manifest ID -> new manifest ID
+
+	lastCheckpoint time.Time
+	stats          *Stats
+}
+
+// migrateManifests copies all manifests to the new generation until there are no new ones and returns the set of IDs
+// of manifests present in the current generation.
+func (m *migrator) migrateManifests(ctx context.Context, checkpointInterval time.Duration) (map[string]bool, error) {
+	for {
+		if err := m.rep.Refresh(ctx); err != nil {
+			return nil, fmt.Errorf("unable to refresh repository: %v", err)
+		}
+
+		entries, err := m.rep.Manifests.Find(ctx, nil)
+		if err != nil {
+			return nil, fmt.Errorf("unable to list manifests: %v", err)
+		}
+
+		live := map[string]bool{}
+		migrated := 0
+
+		for _, e := range entries {
+			live[e.ID] = true
+			if m.manifests[e.ID] != "" {
+				continue
+			}
+
+			if e.Labels["type"] == maintenance.LeaseManifestType {
+				// leases are only valid in the current generation, including the one held by the upgrade.
+				continue
+			}
+
+			if err := m.migrateManifest(ctx, e.ID, e.Labels); err != nil {
+				return nil, err
+			}
+			migrated++
+
+			if time.Since(m.lastCheckpoint) > checkpointInterval {
+				if err := m.writeCheckpoint(ctx); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		if migrated == 0 {
+			return live, nil
+		}
+	}
+}
+
+func (m *migrator) migrateManifest(ctx context.Context, id string, labels map[string]string) error {
+	var payload interface{}
+
+	if labels["type"] == snapshotManifestType {
+		man, err := snapshot.LoadSnapshot(ctx, m.rep, id)
+		if err != nil {
+			return fmt.Errorf("unable to load snapshot %v: %v", id, err)
+		}
+
+		log.Infof("migrating snapshot of %v at %v", man.Source, man.StartTime.Local().Format(time.RFC3339))
+
+		if err := m.migrateSnapshot(ctx, man); err != nil {
+			return fmt.Errorf("unable to migrate snapshot %v: %v", id, err)
+		}
+
+		payload = man
+		m.stats.SnapshotCount++
+	} else {
+		b, err := m.rep.Manifests.GetRaw(ctx, id)
+		if err != nil {
+			return fmt.Errorf("unable to load manifest %v: %v", id, err)
+		}
+
+		payload = json.RawMessage(b)
+	}
+
+	newID, err := m.upgrade.Manifests.Put(ctx, labels, payload)
+	if err != nil {
+		return fmt.Errorf("unable to write manifest: %v", err)
+	}
+
+	m.manifests[id] = newID
+	m.stats.ManifestCount++
+
+	return nil
+}
+
+func (m *migrator) migrateSnapshot(ctx context.Context, man *snapshot.Manifest) error {
+	if man.RootEntry != nil {
+		oid, err := m.migrateEntry(ctx, man.RootEntry)
+		if err != nil {
+			return err
+		}
+
+		man.RootEntry.ObjectID = oid
+	}
+
+	if man.HashCacheID != "" {
+		oid, err := m.migrateHashCache(ctx, man.HashCacheID)
+		if err != nil {
+			return fmt.Errorf("unable to migrate hash cache: %v", err)
+		}
+
+		man.HashCacheID = oid
+	}
+
+	return nil
+}
+
+func (m *migrator) migrateEntry(ctx context.Context, e *dir.Entry) (object.ID, error) {
+	if e.Type == fs.EntryTypeDirectory {
+		return m.migrateDirectory(ctx, e.ObjectID)
+	}
+
+	return m.migrateFile(ctx, e.ObjectID)
+}
+
+func (m *migrator) migrateDirectory(ctx context.Context, oid object.ID) (object.ID, error) {
+	if newOID, ok := m.objects[oid]; ok {
+		// identical subtrees are shared between snapshots, no need to walk them again
+		return newOID, nil
+	}
+
+	r, err := m.rep.Objects.Open(ctx, oid)
+	if err != nil {
+		return "", fmt.Errorf("unable to open directory %v: %v", oid, err)
+	}
+	defer r.Close() //nolint:errcheck
+
+	entries, summ, err := dir.ReadEntries(r)
+	if err != nil {
+		return "", fmt.Errorf("unable to read directory %v: %v", oid, err)
+	}
+
+	for _, e := range entries {
+		if e.ObjectID, err = m.migrateEntry(ctx, e); err != nil {
+			return "", err
+		}
+	}
+
+	w := m.upgrade.Objects.NewWriter(ctx, object.WriterOptions{
+		Description: "DIR:" + string(oid),
+		Prefix:      objectPrefix(oid),
+	})
+	defer w.Close() //nolint:errcheck
+
+	dw := dir.NewWriter(w)
+	for _, e := range entries {
+		if err := dw.WriteEntry(e); err != nil {
+			return "", fmt.Errorf("unable to write directory entry: %v", err)
+		}
+	}
+
+	if err := dw.Finalize(summ); err != nil {
+		return "", fmt.Errorf("unable to finalize directory: %v", err)
+	}
+
+	return m.addObject(oid, w)
+}
+
+func (m *migrator) migrateFile(ctx context.Context, oid object.ID) (object.ID, error) {
+	if newOID, ok := m.objects[oid]; ok {
+		return newOID, nil
+	}
+
+	if !m.resplit {
+		newOID, err := m.upgrade.Objects.RewriteObject(ctx, m.rep.Objects, oid, func(blockID string) (string, error) {
+			return m.migrateBlock(ctx, blockID)
+		})
+		if err != nil {
+			return "", fmt.Errorf("unable to rewrite object %v: %v", oid, err)
+		}
+
+		m.objects[oid] = newOID
+		m.stats.ObjectCount++
+		return newOID, nil
+	}
+
+	r, err := m.rep.Objects.Open(ctx, oid)
+	if err != nil {
+		return "", fmt.Errorf("unable to open object %v: %v", oid, err)
+	}
+	defer r.Close() //nolint:errcheck
+
+	w := m.upgrade.Objects.NewWriter(ctx, object.WriterOptions{
+		Description: "FILE:" + string(oid),
+		Prefix:      objectPrefix(oid),
+	})
+	defer w.Close() //nolint:errcheck
+
+	n, err := io.Copy(w, r)
+	if err != nil {
+		return "", fmt.Errorf("unable to copy object %v: %v", oid, err)
+	}
+
+	m.stats.Bytes += n
+
+	return m.addObject(oid, w)
+}
+
+// migrateHashCache rewrites object IDs in the hash cache, entries referencing objects that were not
+// migrated are dropped, which only causes the files to be hashed again by the next snapshot.
+func (m *migrator) migrateHashCache(ctx context.Context, oid object.ID) (object.ID, error) {
+	if newOID, ok := m.objects[oid]; ok {
+		return newOID, nil
+	}
+
+	r, err := m.rep.Objects.Open(ctx, oid)
+	if err != nil {
+		return "", fmt.Errorf("unable to open hash cache %v: %v", oid, err)
+	}
+	defer r.Close() //nolint:errcheck
+
+	w := m.upgrade.Objects.NewWriter(ctx, object.WriterOptions{
+		Description: "HASHCACHE:" + string(oid),
+		Prefix:      objectPrefix(oid),
+	})
+	defer w.Close() //nolint:errcheck
+
+	hw := &hashCacheMapper{hashcache.NewWriter(w), m.objects}
+	if err := hashcache.Open(r).CopyTo(hw); err != nil {
+		return "", fmt.Errorf("unable to rewrite hash cache: %v", err)
+	}
+
+	if err := hw.Finalize(); err != nil {
+		return "", fmt.Errorf("unable to finalize hash cache: %v", err)
+	}
+
+	return m.addObject(oid, w)
+}
+
+type hashCacheMapper struct {
+	hashcache.Writer
+	objects map[object.ID]object.ID
+}
+
+func (w *hashCacheMapper) WriteEntry(e hashcache.Entry) error {
+	newOID, ok := w.objects[e.ObjectID]
+	if !ok {
+		return nil
+	}
+
+	e.ObjectID = newOID
+	return w.Writer.WriteEntry(e)
+}
+
+func (m *migrator) migrateBlock(ctx context.Context, blockID string) (string, error) {
+	if newBlockID, ok := m.blocks[blockID]; ok {
+		return newBlockID, nil
+	}
+
+	data, err := m.rep.Blocks.GetBlock(ctx, blockID)
+	if err != nil {
+		return "", fmt.Errorf("unable to read block %v: %v", blockID, err)
+	}
+
+	newBlockID, err := m.upgrade.Blocks.WriteBlock(ctx, data, blockPrefix(blockID))
+	if err != nil {
+		return "", fmt.Errorf("unable to write block: %v", err)
+	}
+
+	m.blocks[blockID] = newBlockID
+	m.stats.BlockCount++
+	m.stats.Bytes += int64(len(data))
+
+	return newBlockID, nil
+}
+
+func (m *migrator) addObject(oid object.ID, w object.Writer) (object.ID, error) {
+	newOID, err := w.Result()
+	if err != nil {
+		return "", err
+	}
+
+	m.objects[oid] = newOID
+	m.stats.ObjectCount++
+
+	return newOID, nil
+}
+
+// writeCheckpoint persists the mapping of objects and manifests migrated so far together with their contents.
+func (m *migrator) writeCheckpoint(ctx context.Context) error {
+	w := m.upgrade.Objects.NewWriter(ctx, object.WriterOptions{
+		Description: "UPGRADE-MAPPING",
+	})
+	defer w.Close() //nolint:errcheck
+
+	jw := jsonstream.NewWriter(w, mappingStreamType)
+	for o, n := range m.objects {
+		if err := jw.Write(&mappingEntry{o, n}); err != nil {
+			return fmt.Errorf("unable to write object mapping: %v", err)
+		}
+	}
+
+	if err := jw.Finalize(); err != nil {
+		return fmt.Errorf("unable to finalize object mapping: %v", err)
+	}
+
+	mappingOID, err := w.Result()
+	if err != nil {
+		return err
+	}
+
+	if err := m.deleteCheckpoints(ctx); err != nil {
+		return err
+	}
+
+	if _, err := m.upgrade.Manifests.Put(ctx, checkpointLabels(), &checkpoint{
+		MappingObjectID: mappingOID,
+		Manifests:       m.manifests,
+	}); err != nil {
+		return fmt.Errorf("unable to write checkpoint: %v", err)
+	}
+
+	if err := m.upgrade.Flush(ctx); err != nil {
+		return fmt.Errorf("unable to flush checkpoint: %v", err)
+	}
+
+	log.Debugf("checkpoint after %v manifests and %v objects", len(m.manifests), len(m.objects))
+	m.lastCheckpoint = time.Now()
+
+	return nil
+}
+
+// loadCheckpoint restores the progress of the interrupted upgrade from the latest checkpoint and removes
+// manifests that were persisted after it, since they would otherwise be migrated again.
+func (m *migrator) loadCheckpoint(ctx context.Context) error {
+	entries, err := m.upgrade.Manifests.Find(ctx, checkpointLabels())
+	if err != nil {
+		return fmt.Errorf("unable to find checkpoints: %v", err)
+	}
+
+	if len(entries) > 0 {
+		// entries are sorted by time, the latest checkpoint includes all earlier ones.
+		if err := m.loadCheckpointEntry(ctx, entries[len(entries)-1].ID); err != nil {
+			return err
+		}
+	}
+
+	all, err := m.upgrade.Manifests.Find(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("unable to list manifests: %v", err)
+	}
+
+	checkpointed := map[string]bool{}
+	for _, newID := range m.manifests {
+		checkpointed[newID] = true
+	}
+
+	for _, e := range all {
+		if e.Labels["type"] != checkpointManifestType && !checkpointed[e.ID] {
+			m.upgrade.Manifests.Delete(e.ID)
+		}
+	}
+
+	log.Infof("resuming upgrade after %v manifests and %v objects", len(m.manifests), len(m.objects))
+
+	return nil
+}
+
+func (m *migrator) loadCheckpointEntry(ctx context.Context, id string) error {
+	cp := &checkpoint{}
+	if err := m.upgrade.Manifests.Get(ctx, id, cp); err != nil {
+		return fmt.Errorf("unable to load checkpoint: %v", err)
+	}
+
+	r, err := m.upgrade.Objects.Open(ctx, cp.MappingObjectID)
+	if err != nil {
+		return fmt.Errorf("unable to open object mapping: %v", err)
+	}
+	defer r.Close() //nolint:errcheck
+
+	jr, err := jsonstream.NewReader(bufio.NewReader(r), mappingStreamType, nil)
+	if err != nil {
+		return fmt.Errorf("unable to read object mapping: %v", err)
+	}
+
+	for {
+		var e mappingEntry
+
+		err := jr.Read(&e)
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return fmt.Errorf("unable to read object mapping: %v", err)
+		}
+
+		m.objects[e.Old] = e.New
+	}
+
+	for o, n := range cp.Manifests {
+		m.manifests[o] = n
+	}
+
+	return nil
+}
+
+func (m *migrator) deleteCheckpoints(ctx context.Context) error {
+	entries, err := m.upgrade.Manifests.Find(ctx, checkpointLabels())
+	if err != nil {
+		return fmt.Errorf("unable to find checkpoints: %v", err)
+	}
+
+	for _, e := range entries {
+		m.upgrade.Manifests.Delete(e.ID)
+	}
+
+	return nil
+}
+
+func checkpointLabels() map[string]string {
+	return map[string]string{"type": checkpointManifestType}
+}
+
+// objectPrefix returns the prefix of blocks of the specified object.
+func objectPrefix(oid object.ID) string {
+	for {
+		indexObjectID, ok := oid.IndexObjectID()
+		if !ok {
+			break
+		}
+
+		oid = indexObjectID
+	}
+
+	if blockID, ok := oid.BlockID(); ok {
+		return blockPrefix(blockID)
+	}
+
+	return ""
+}
+
+// blockPrefix returns the single-character prefix of the block ID, if any.
+func blockPrefix(blockID string) string {
+	if len(blockID)%2 == 1 {
+		return blockID[0:1]
+	}
+
+	return ""
+}
@@ -0,0 +1,537 @@
+package upgrade
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/kopia/kopia/fs"
+	"github.com/kopia/kopia/fs/repofs"
+	"github.com/kopia/kopia/internal/config"
+	"github.com/kopia/kopia/internal/hashcache"
+	"github.com/kopia/kopia/internal/mockfs"
+	"github.com/kopia/kopia/internal/repotesting"
+	"github.com/kopia/kopia/internal/upload"
+	"github.com/kopia/kopia/repo"
+	"github.com/kopia/kopia/repo/block"
+	"github.com/kopia/kopia/repo/storage"
+	"github.com/kopia/kopia/snapshot"
+	"github.com/kopia/kopia/snapshot/maintenance"
+)
+
+var testSource = snapshot.SourceInfo{Host: "host", UserName: "user", Path: "/src"}
+
+type upgradeTestHarness struct {
+	t   *testing.T
+	env *repotesting.Environment
+	rep *repo.Repository
+
+	// expected contents of files in snapshots by snapshot manifest ID
+	contents map[string]map[string][]byte
+
+	snapshotCount int
+}
+
+func newUpgradeTestHarness(t *testing.T) *upgradeTestHarness {
+	// small blocks so that larger files are stored as indirect objects.
+	env := repotesting.Setup(t, &repo.NewRepositoryOptions{
+		Splitter:     "FIXED",
+		MaxBlockSize: 4096,
+	}, repo.ConnectOptions{})
+
+	th := &upgradeTestHarness{
+		t:        t,
+		env:      env,
+		contents: map[string]map[string][]byte{},
+	}
+	th.rep = env.Repository
+
+	// the upgrade holds the maintenance lease, which is acquired without waiting for it to settle.
+	// Maintenance parameters are stored in a manifest, which is migrated along with the others.
+	p := maintenance.DefaultParams()
+	p.LeaseSettleTime = 0
+	if err := maintenance.SetParams(context.Background(), th.rep, p); err != nil {
+		t.Fatalf("unable to set maintenance parameters: %v", err)
+	}
+
+	return th
+}
+
+func (th *upgradeTestHarness) close() {
+	th.env.Close()
+}
+
+func (th *upgradeTestHarness) reopen() {
+	th.env.Reopen()
+	th.rep = th.env.Repository
+}
+
+// snapshot uploads a directory with given files, which may be in subdirectories, and returns its snapshot manifest.
+func (th *upgradeTestHarness) snapshot(files map[string][]byte) *snapshot.Manifest {
+	ctx := context.Background()
+	sourceDir := mockfs.NewDirectory()
+	subdirs := map[string]bool{}
+	for name, content := range files {
+		if d := path.Dir(name); d != "." && !subdirs[d] {
+			sourceDir.AddDir(d, 0755)
+			subdirs[d] = true
+		}
+
+		sourceDir.AddFile(name, content, 0644)
+	}
+
+	u := upload.NewUploader(th.rep)
+	man, err := u.Upload(ctx, sourceDir, testSource, nil)
+	if err != nil {
+		th.t.Fatalf("upload failed: %v", err)
+	}
+
+	id, err := snapshot.SaveSnapshot(ctx, th.rep, man)
+	if err != nil {
+		th.t.Fatalf("unable to save snapshot: %v", err)
+	}
+
+	if err := th.rep.Flush(ctx); err != nil {
+		th.t.Fatalf("unable to flush: %v", err)
+	}
+
+	man.ID = id
+	th.contents[id] = files
+	return man
+}
+
+func (th *upgradeTestHarness) deleteSnapshot(id string) {
+	th.rep.Manifests.Delete(id)
+	delete(th.contents, id)
+	if err := th.rep.Flush(context.Background()); err != nil {
+		th.t.Fatalf("unable to flush: %v", err)
+	}
+}
+
+func (th *upgradeTestHarness) run(opt Options) *Stats {
+	st, err := Run(context.Background(), th.rep, opt)
+	if err != nil {
+		th.t.Fatalf("upgrade failed: %v", err)
+	}
+
+	th.reopen()
+	return st
+}
+
+func (th *upgradeTestHarness) verifyFormat(blockFormat, splitter string) {
+	th.t.Helper()
+
+	f, err := th.rep.Format()
+	if err != nil {
+		th.t.Fatalf("unable to get repository format: %v", err)
+	}
+
+	if f.BlockFormat != blockFormat || f.Splitter != splitter {
+		th.t.Errorf("unexpected repository format: %v %v, want %v %v", f.BlockFormat, f.Splitter, blockFormat, splitter)
+	}
+}
+
+// verifyPreviousGenerationRetired verifies that the committed upgrade removed blocks of the initial storage generation
+// and that it can't be opened using its format by clients which are not aware of storage generations.
+func (th *upgradeTestHarness) verifyPreviousGenerationRetired(previous *config.RepositoryObjectFormat) {
+	th.t.Helper()
+	ctx := context.Background()
+
+	for _, prefix := range block.PackBlockPrefixes {
+		blocks, err := storage.ListAllBlocks(ctx, th.env.Storage, prefix)
+		if err != nil {
+			th.t.Fatalf("unable to list blocks: %v", err)
+		}
+
+		if len(blocks) != 0 {
+			th.t.Errorf("blocks of previous generation with prefix %q were not removed: %v", prefix, len(blocks))
+		}
+	}
+
+	// only the marker of retired generation is left, which looks like an index block.
+	blocks, err := storage.ListAllBlocks(ctx, th.env.Storage, block.IndexBlockPrefix)
+	if err != nil {
+		th.t.Fatalf("unable to list blocks: %v", err)
+	}
+
+	if len(blocks) != 1 {
+		th.t.Errorf("unexpected index blocks of previous generation: %v", blocks)
+	}
+
+	if _, err := block.NewManager(ctx, th.env.Storage, previous.FormattingOptions, block.CachingOptions{}); err == nil {
+		th.t.Errorf("unexpected success opening previous generation")
+	}
+}
+
+// verifySnapshots verifies that all snapshots have been migrated with their original contents and hash caches
+// referencing the migrated files.
+func (th *upgradeTestHarness) verifySnapshots() {
+	th.t.Helper()
+	ctx := context.Background()
+
+	mans, err := snapshot.ListSnapshots(ctx, th.rep, testSource)
+	if err != nil {
+		th.t.Fatalf("unable to list snapshots: %v", err)
+	}
+
+	if len(mans) != len(th.contents) {
+		th.t.Fatalf("unexpected number of snapshots: %v, want %v", len(mans), len(th.contents))
+	}
+
+	remaining := map[string]map[string][]byte{}
+	for _, want := range th.contents {
+		remaining[string(want[descriptionFile])] = want
+	}
+
+	for _, man := range mans {
+		files := th.readFiles(repofs.DirectoryEntry(th.rep, man.RootObjectID(), nil), "")
+
+		want := remaining[string(files[descriptionFile])]
+		if want == nil {
+			th.t.Errorf("unexpected snapshot %v", man.ID)
+			continue
+		}
+		delete(remaining, string(files[descriptionFile]))
+
+		if len(files) != len(want) {
+			th.t.Errorf("unexpected number of files in snapshot %v: %v, want %v", man.ID, len(files), len(want))
+		}
+
+		for name, content := range want {
+			if !bytes.Equal(files[name], content) {
+				th.t.Errorf("invalid contents of %v in snapshot %v", name, man.ID)
+			}
+		}
+
+		th.verifyHashCache(man)
+	}
+}
+
+// descriptionFile is included in each snapshot to identify it after the upgrade, which changes manifest IDs.
+const descriptionFile = "description"
+
+func (th *upgradeTestHarness) readFiles(d fs.Directory, prefix string) map[string][]byte {
+	ctx := context.Background()
+	result := map[string][]byte{}
+
+	entries, err := d.Readdir(ctx)
+	if err != nil {
+		th.t.Fatalf("unable to read directory %v: %v", prefix, err)
+	}
+
+	for _, e := range entries {
+		name := prefix + e.Metadata().Name
+
+		if sd, ok := e.(fs.Directory); ok {
+			for n, content := range th.readFiles(sd, name+"/") {
+				result[n] = content
+			}
+			continue
+		}
+
+		r, err := e.(fs.File).Open(ctx)
+		if err != nil {
+			th.t.Fatalf("unable to open %v: %v", name, err)
+		}
+
+		content, err := ioutil.ReadAll(r)
+		r.Close() //nolint:errcheck
+		if err != nil {
+			th.t.Fatalf("unable to read %v: %v", name, err)
+		}
+
+		result[name] = content
+	}
+
+	return result
+}
+
+type hashCacheEntries []hashcache.Entry
+
+func (hc *hashCacheEntries) WriteEntry(e hashcache.Entry) error {
+	*hc = append(*hc, e)
+	return nil
+}
+
+func (hc *hashCacheEntries) Finalize() error {
+	return nil
+}
+
+func (th *upgradeTestHarness) verifyHashCache(man *snapshot.Manifest) {
+	th.t.Helper()
+	ctx := context.Background()
+
+	if man.HashCacheID == "" {
+		th.t.Errorf("snapshot %v has no hash cache", man.ID)
+		return
+	}
+
+	r, err := th.rep.Objects.Open(ctx, man.HashCacheID)
+	if err != nil {
+		th.t.Fatalf("unable to open hash cache of %v: %v", man.ID, err)
+	}
+	defer r.Close() //nolint:errcheck
+
+	var entries hashCacheEntries
+	if err := hashcache.Open(r).CopyTo(&entries); err != nil {
+		th.t.Fatalf("unable to read hash cache of %v: %v", man.ID, err)
+	}
+
+	if len(entries) == 0 {
+		th.t.Errorf("hash cache of snapshot %v is empty", man.ID)
+	}
+
+	for _, e := range entries {
+		if _, _, err := th.rep.Objects.VerifyObject(ctx, e.ObjectID); err != nil {
+			th.t.Errorf("hash cache of snapshot %v references invalid object %v of %v: %v", man.ID, e.ObjectID, e.Name, err)
+		}
+	}
+}
+
+// createSnapshots creates snapshots sharing some of their files, including ones stored as indirect objects,
+// and returns their manifests.
+func (th *upgradeTestHarness) createSnapshots(n int) []*snapshot.Manifest {
+	var result []*snapshot.Manifest
+
+	for i := 0; i < n; i++ {
+		th.snapshotCount++
+
+		// previous snapshots are not passed to the uploader, because mock files have the same modification time
+		// and it would reuse hash cache entries of changed files of the same size.
+		man := th.snapshot(map[string][]byte{
+			descriptionFile: {byte('a' + th.snapshotCount)},
+			"small":         repotesting.TestData(1, 100),
+			"big":           repotesting.TestData(2, 20000),
+			"sub/changed":   repotesting.TestData(byte(10+th.snapshotCount), 10000),
+		})
+
+		result = append(result, man)
+	}
+
+	return result
+}
+
+func (th *upgradeTestHarness) putManifest(labels map[string]string, payload interface{}) {
+	if _, err := th.rep.Manifests.Put(context.Background(), labels, payload); err != nil {
+		th.t.Fatalf("unable to write manifest: %v", err)
+	}
+
+	if err := th.rep.Flush(context.Background()); err != nil {
+		th.t.Fatalf("unable to flush: %v", err)
+	}
+}
+
+func (th *upgradeTestHarness) verifyManifest(labels map[string]string, want map[string]string) {
+	th.t.Helper()
+	ctx := context.Background()
+
+	entries, err := th.rep.Manifests.Find(ctx, labels)
+	if err != nil {
+		th.t.Fatalf("unable to find manifests: %v", err)
+	}
+
+	if len(entries) != 1 {
+		th.t.Fatalf("unexpected number of manifests %v: %v", labels, len(entries))
+	}
+
+	got := map[string]string{}
+	if err := th.rep.Manifests.Get(ctx, entries[0].ID, &got); err != nil {
+		th.t.Fatalf("unable to load manifest: %v", err)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		th.t.Errorf("unexpected manifest payload: %v, want %v", got, want)
+	}
+}
+
+func TestUpgradeBlockFormat(t *testing.T) {
+	th := newUpgradeTestHarness(t)
+	defer th.close()
+
+	th.createSnapshots(3)
+	th.putManifest(map[string]string{"type": "test"}, map[string]string{"key": "value"})
+
+	previous, err := th.rep.Format()
+	if err != nil {
+		t.Fatalf("unable to get repository format: %v", err)
+	}
+
+	st := th.run(Options{UpgradeOptions: repo.UpgradeOptions{BlockFormat: "ENCRYPTED_HMAC_SHA256_AES256_GCM"}})
+	if st.Resumed || st.SnapshotCount != 3 || st.ManifestCount != 5 || st.DeletedManifestCount != 0 {
+		t.Errorf("unexpected upgrade stats: %+v", st)
+	}
+
+	if st.BlockCount == 0 || st.Bytes == 0 {
+		t.Errorf("no blocks were migrated: %+v", st)
+	}
+
+	th.verifyFormat("ENCRYPTED_HMAC_SHA256_AES256_GCM", "FIXED")
+	th.verifySnapshots()
+	th.verifyManifest(map[string]string{"type": "test"}, map[string]string{"key": "value"})
+	th.verifyPreviousGenerationRetired(previous)
+
+	if _, err := Run(context.Background(), th.rep, Options{UpgradeOptions: repo.UpgradeOptions{BlockFormat: "ENCRYPTED_HMAC_SHA256_AES256_GCM"}}); err == nil {
+		t.Errorf("unexpected success upgrading to the current format")
+	}
+}
+
+func TestUpgradeSplitter(t *testing.T) {
+	th := newUpgradeTestHarness(t)
+	defer th.close()
+
+	th.createSnapshots(2)
+
+	st := th.run(Options{UpgradeOptions: repo.UpgradeOptions{Splitter: "DYNAMIC"}})
+	if st.SnapshotCount != 2 || st.ManifestCount != 3 {
+		t.Errorf("unexpected upgrade stats: %+v", st)
+	}
+
+	// contents of files are split again, so they are copied instead of mapping blocks.
+	if st.BlockCount != 0 || st.Bytes == 0 {
+		t.Errorf("unexpected upgrade stats: %+v", st)
+	}
+
+	th.verifyFormat(block.DefaultFormat, "DYNAMIC")
+	th.verifySnapshots()
+}
+
+func TestUpgradeResume(t *testing.T) {
+	th := newUpgradeTestHarness(t)
+	defer th.close()
+
+	ctx := context.Background()
+	mans := th.createSnapshots(3)
+	opt := Options{UpgradeOptions: repo.UpgradeOptions{BlockFormat: "ENCRYPTED_HMAC_SHA256_AES256_GCM", Splitter: "DYNAMIC"}}
+
+	// interrupt the upgrade after a checkpoint including the first snapshot and another one
+	// which has been persisted after the checkpoint.
+	u, err := th.rep.BeginUpgrade(ctx, opt.UpgradeOptions)
+	if err != nil {
+		t.Fatalf("unable to begin upgrade: %v", err)
+	}
+
+	m, err := newMigrator(ctx, th.rep, u)
+	if err != nil {
+		t.Fatalf("unable to create migrator: %v", err)
+	}
+
+	if err := m.migrateManifest(ctx, mans[0].ID, map[string]string{"type": snapshotManifestType}); err != nil {
+		t.Fatalf("unable to migrate snapshot: %v", err)
+	}
+
+	if err := m.writeCheckpoint(ctx); err != nil {
+		t.Fatalf("unable to write checkpoint: %v", err)
+	}
+
+	if err := m.migrateManifest(ctx, mans[1].ID, map[string]string{"type": snapshotManifestType}); err != nil {
+		t.Fatalf("unable to migrate snapshot: %v", err)
+	}
+
+	if err := u.Flush(ctx); err != nil {
+		t.Fatalf("unable to flush upgrade: %v", err)
+	}
+
+	// the repository keeps using the current format until the upgrade is committed.
+	th.reopen()
+	th.verifyFormat(block.DefaultFormat, "FIXED")
+	th.verifySnapshots()
+
+	// the checkpointed snapshot is deleted and another one is created before resuming.
+	th.deleteSnapshot(mans[0].ID)
+	th.createSnapshots(1)
+
+	if _, err := Run(ctx, th.rep, Options{UpgradeOptions: repo.UpgradeOptions{Splitter: "DYNAMIC"}}); err == nil {
+		t.Errorf("unexpected success of different upgrade while another one is in progress")
+	}
+
+	st := th.run(opt)
+	if !st.Resumed {
+		t.Errorf("upgrade was not resumed")
+	}
+
+	// only the snapshot in the checkpoint is not migrated again.
+	if st.SnapshotCount != 3 || st.ManifestCount != 4 || st.DeletedManifestCount != 1 {
+		t.Errorf("unexpected upgrade stats: %+v", st)
+	}
+
+	th.verifyFormat("ENCRYPTED_HMAC_SHA256_AES256_GCM", "DYNAMIC")
+	th.verifySnapshots()
+}
+
+func TestUpgradeRetiresPreviousGeneration(t *testing.T) {
+	th := newUpgradeTestHarness(t)
+	defer th.close()
+
+	ctx := context.Background()
+	th.createSnapshots(1)
+
+	// another client which keeps the repository open during the upgrade.
+	stale := th.env.Open()
+	defer stale.Close(ctx) //nolint:errcheck
+
+	// another client with the format block in its cache.
+	cachedConfigFile := filepath.Join(th.env.Dir, "cached.config")
+	if err := repo.Connect(ctx, cachedConfigFile, th.env.Storage, repotesting.Password, repo.ConnectOptions{
+		CachingOptions: block.CachingOptions{CacheDirectory: filepath.Join(th.env.Dir, "cache")},
+	}); err != nil {
+		t.Fatalf("unable to connect to repository: %v", err)
+	}
+
+	cached, err := repo.Open(ctx, cachedConfigFile, repotesting.Password, &repo.Options{})
+	if err != nil {
+		t.Fatalf("unable to open repository: %v", err)
+	}
+	cached.Close(ctx) //nolint:errcheck
+
+	th.run(Options{UpgradeOptions: repo.UpgradeOptions{Splitter: "DYNAMIC"}})
+
+	if err := stale.Refresh(ctx); err != repo.ErrRepositoryUpgraded {
+		t.Errorf("unexpected error refreshing repository opened before the upgrade: %v", err)
+	}
+
+	if _, err := stale.BeginUpgrade(ctx, repo.UpgradeOptions{BlockFormat: "ENCRYPTED_HMAC_SHA256_AES256_GCM"}); err != repo.ErrRepositoryUpgraded {
+		t.Errorf("unexpected error upgrading repository opened before the upgrade: %v", err)
+	}
+
+	cached, err = repo.Open(ctx, cachedConfigFile, repotesting.Password, &repo.Options{})
+	if err != nil {
+		t.Fatalf("unable to open repository with cached format: %v", err)
+	}
+	defer cached.Close(ctx) //nolint:errcheck
+
+	if f, err := cached.Format(); err != nil || f.Splitter != "DYNAMIC" {
+		t.Errorf("unexpected format of repository with cached format: %v %v", f, err)
+	}
+}
+
+func TestUpgradeHoldsMaintenanceLease(t *testing.T) {
+	th := newUpgradeTestHarness(t)
+	defer th.close()
+
+	ctx := context.Background()
+	th.createSnapshots(1)
+
+	opt := Options{UpgradeOptions: repo.UpgradeOptions{Splitter: "DYNAMIC"}, Owner: "upgrade"}
+
+	if err := maintenance.WithLease(ctx, th.rep, "other", func(ctx context.Context) error {
+		_, err := Run(ctx, th.rep, opt)
+		if _, ok := err.(*maintenance.LeaseHeldError); !ok {
+			t.Errorf("unexpected error upgrading during maintenance: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("unable to run with maintenance lease: %v", err)
+	}
+
+	th.run(opt)
+	th.verifyFormat(block.DefaultFormat, "DYNAMIC")
+
+	// the lease held by the upgrade is not migrated to the new generation.
+	if _, err := maintenance.Run(ctx, th.rep, maintenance.ModeQuick, "other"); err != nil {
+		t.Errorf("unable to run maintenance after the upgrade: %v", err)
+	}
+}